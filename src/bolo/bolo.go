@@ -31,6 +31,7 @@ import (
 )
 
 const PacketHeaderSize = 8
+const packetGameInfoSize = PacketHeaderSize + 63
 const boloSignature = "Bolo"
 
 const hexPacketSignature = "426f6c6f"
@@ -40,12 +41,14 @@ const PacketTypeOffset = 0x07
 const PacketType0 = 0x00
 const PacketType1 = 0x01
 const PacketTypeGameState = 0x02
+const PacketType3 = 0x03
 const PacketTypeGameStateAck = 0x04
 const PacketType5 = 0x05
 const PacketType6 = 0x06
 const PacketType7 = 0x07
 const PacketType8 = 0x08
 const PacketType9 = 0x09
+const PacketTypeGameInfoRequest = 0x0d
 const PacketTypeGameInfo = 0x0e
 
 const PacketType0PeerAddrOffset = 8
@@ -118,7 +121,7 @@ func GetPacketType(msg []byte) int {
 }
 
 func ValidatePacket(packet proxy.UdpPacket) (bool, string) {
-	if packet.Len < PacketHeaderSize {
+	if packet.Len < PacketHeaderSize || len(packet.Buffer) < PacketHeaderSize {
 		return false, fmt.Sprintf("datagram too short (smaller than bolo header) (%d)", packet.Len)
 	}
 
@@ -154,21 +157,95 @@ func MarshalPacketTypeD() []byte {
 	return buffer
 }
 
-func RewritePacketGameInfo(buffer []byte, ip net.IP) {
+// MarshalPacketGameInfo builds the game info (0x0e) packet a Bolo host sends
+// to a tracker. The host address and start timestamp come from the game id.
+func MarshalPacketGameInfo(gameInfo GameInfo) []byte {
+	buffer := make([]byte, packetGameInfoSize)
+	copy(buffer, boloSignature)
+	copy(buffer[4:7], []byte{0x65, 0x99, 0x08})
+	buffer[PacketTypeOffset] = PacketTypeGameInfo
+
+	var pos int = PacketHeaderSize
+
+	mapName := gameInfo.MapName
+	if len(mapName) > mapNameFieldSize-1 {
+		mapName = mapName[:mapNameFieldSize-1]
+	}
+	buffer[pos] = byte(len(mapName))
+	copy(buffer[pos+1:], mapName)
+	pos = pos + mapNameFieldSize
+
+	copy(buffer[pos:pos+8], gameInfo.GameId[:])
+	pos = pos + 8
+
+	buffer[pos] = byte(gameInfo.GameType)
+	pos = pos + 1
+
+	if !gameInfo.AllowHiddenMines {
+		buffer[pos] = MinesVisibleBitmask
+	}
+	pos = pos + 1
+
+	if gameInfo.AllowComputer {
+		buffer[pos] = 1
+	}
+	pos = pos + 1
+
+	if gameInfo.ComputerAdvantage {
+		buffer[pos] = 1
+	}
+	pos = pos + 1
+
+	binary.LittleEndian.PutUint32(buffer[pos:pos+4], gameInfo.StartDelay)
+	pos = pos + 4
+
+	binary.LittleEndian.PutUint32(buffer[pos:pos+4], gameInfo.TimeLimit)
+	pos = pos + 4
+
+	binary.LittleEndian.PutUint16(buffer[pos:pos+2], gameInfo.PlayerCount)
+	pos = pos + 2
+
+	binary.LittleEndian.PutUint16(buffer[pos:pos+2], gameInfo.NeutralPillboxCount)
+	pos = pos + 2
+
+	binary.LittleEndian.PutUint16(buffer[pos:pos+2], gameInfo.NeutralBaseCount)
+	pos = pos + 2
+
+	if gameInfo.HasPassword {
+		buffer[pos] = 1
+	}
+
+	return buffer
+}
+
+func RewritePacketGameInfo(buffer []byte, ip net.IP) error {
+	if len(buffer) < packetGameInfoSize {
+		return fmt.Errorf("game info packet too short (%d)", len(buffer))
+	}
+
 	var pos int = PacketHeaderSize
 	pos = pos + 36 // skip map name
 	buffer[pos+0] = ip[0]
 	buffer[pos+1] = ip[1]
 	buffer[pos+2] = ip[2]
 	buffer[pos+3] = ip[3]
+	return nil
 }
 
-func ParsePacketGameInfo(msg []byte) GameInfo {
+func ParsePacketGameInfo(msg []byte) (GameInfo, error) {
 	var gameInfo GameInfo
 	var pos int = PacketHeaderSize
 
-	gameInfo.MapName = string(msg[pos+1 : pos+1+int(msg[pos])])
-	pos = pos + 36
+	if len(msg) < packetGameInfoSize {
+		return gameInfo, fmt.Errorf("game info packet too short (%d)", len(msg))
+	}
+
+	mapName, err := parsePascalString(msg[pos:pos+mapNameFieldSize], mapNameFieldSize-1)
+	if err != nil {
+		return gameInfo, fmt.Errorf("map name: %s", err)
+	}
+	gameInfo.MapName = mapName
+	pos = pos + mapNameFieldSize
 
 	copy(gameInfo.GameId[:], msg[pos:pos+8])
 
@@ -208,25 +285,7 @@ func ParsePacketGameInfo(msg []byte) GameInfo {
 	gameInfo.HasPassword = msg[pos] > 0
 	pos = pos + 1
 
-	return gameInfo
-}
-
-func PrintGameInfo(gameInfo GameInfo) {
-	fmt.Println()
-	fmt.Println("Game Id:", hex.EncodeToString(gameInfo.GameId[:]))
-	fmt.Println("Map Name:", gameInfo.MapName)
-	fmt.Println("Start Timestamp:", ParseBoloTimestamp(gameInfo.StartTimestamp))
-	fmt.Println("Game Type:", gameInfo.GameType)
-	fmt.Println("Allow Hidden Mines:", gameInfo.AllowHiddenMines)
-	fmt.Println("Allow Computer:", gameInfo.AllowComputer)
-	fmt.Println("Computer Advantage:", gameInfo.ComputerAdvantage)
-	fmt.Println("Start Delay:", gameInfo.StartDelay)
-	fmt.Println("Time Limit:", gameInfo.TimeLimit)
-	fmt.Println("Player Count:", gameInfo.PlayerCount)
-	fmt.Println("Neutral Pillbox Count:", gameInfo.NeutralPillboxCount)
-	fmt.Println("Neutral Base Count:", gameInfo.NeutralBaseCount)
-	fmt.Println("Password:", gameInfo.HasPassword)
-	fmt.Println()
+	return gameInfo, nil
 }
 
 func ParseBoloTimestamp(timestamp uint32) time.Time {
@@ -240,15 +299,16 @@ func rewriteOpcodePlayerInfo(
 	proxyIP net.IP,
 	srcPlayer util.PlayerAddr,
 	playerLeaveGameChannel chan util.PlayerAddr,
-) {
+) error {
 	// skip address length, first address
 	pos = pos + 7
 
-	playerPort := binary.BigEndian.Uint16(buffer[pos+4 : pos+6])
-	fmt.Printf("Player disconnecting: %d (NAT %d.%d.%d.%d:%d)\n", proxyPort, buffer[pos+0], buffer[pos+1], buffer[pos+2], buffer[pos+3], playerPort)
+	if pos+6 > len(buffer) {
+		return fmt.Errorf("disconnect opcode sender address at offset %d extends past end of block", pos)
+	}
+
 	//if bytes.Equal(srcRoute.PlayerIPAddr.IP, buffer[pos:pos+4]) && int(playerPort) == srcRoute.PlayerIPAddr.Port {
 	if !bytes.Equal(buffer[pos:pos+4], proxyIP) {
-		fmt.Println("Sending LeaveGame event")
 		playerLeaveGameChannel <- srcPlayer
 	}
 
@@ -259,14 +319,13 @@ func rewriteOpcodePlayerInfo(
 		buffer[pos+3] = proxyIP[3]
 		binary.BigEndian.PutUint16(buffer[pos+4:pos+6], uint16(proxyPort))
 	}
+
+	return nil
 }
 
 func rewriteOpcodeGameInfo(pos int, buffer []byte, proxyPort int, proxyIP net.IP) {
-	//mapName := buffer[pos+1 : pos+1+int(buffer[pos])]
 	pos = pos + 36
 
-	//fmt.Println("OpcodeMapData Map Name:", string(mapName))
-
 	// game id is more unique if we leave the original ip address
 	/*
 		buffer[pos+0] = proxyIP[0]
@@ -276,16 +335,36 @@ func rewriteOpcodeGameInfo(pos int, buffer []byte, proxyPort int, proxyIP net.IP
 	*/
 }
 
-// parseOpcode returns the opcode and the length (including the opcode byte(s))
-func parseOpcode(pos int, buffer []byte) (int, int) {
-	opcode := int(buffer[pos])
+// parseOpcode returns the opcode and the length (including the opcode byte(s)).
+// The opcode must fit entirely within buffer, so callers pass the buffer
+// truncated at the block checksum.
+func parseOpcode(pos int, buffer []byte) (int, int, error) {
+	posStart := pos
+
+	// returns the byte at offset from pos, if it is inside buffer
+	lookahead := func(offset int) (int, error) {
+		if pos+offset >= len(buffer) {
+			return 0, fmt.Errorf("opcode at offset %d extends past end of block", posStart)
+		}
+		return int(buffer[pos+offset]), nil
+	}
+
+	opcode, err := lookahead(0)
+	if err != nil {
+		return 0, 0, err
+	}
 	pos = pos + 1
 	offset := 0
 
+	prefixLength := 0
 	if opcode == 0xff {
-		opcode = int(buffer[pos])
+		opcode, err = lookahead(0)
+		if err != nil {
+			return 0, 0, err
+		}
 		pos = pos + 1
 		offset = 0x20
+		prefixLength = 1
 	}
 
 	if opcode < 0xf0 {
@@ -299,11 +378,20 @@ func parseOpcode(pos int, buffer []byte) (int, int) {
 
 	switch opcode {
 	case OpcodeDisconnect:
-		addressLength := int(buffer[pos])
+		addressLength, err := lookahead(0)
+		if err != nil {
+			return opcode, 0, err
+		}
 		opcodeLength = (addressLength * 3) + 2
 	case OpcodeGameInfo:
-		subcode := int(buffer[pos])
-		count := int(buffer[pos+1])
+		subcode, err := lookahead(0)
+		if err != nil {
+			return opcode, 0, err
+		}
+		count, err := lookahead(1)
+		if err != nil {
+			return opcode, 0, err
+		}
 
 		switch subcode {
 		case OpcodeGameInfoSubcodeGame:
@@ -318,19 +406,35 @@ func parseOpcode(pos int, buffer []byte) (int, int) {
 			opcodeLength = 42
 		}
 	case OpcodeMapData:
-		mapDataLength := int(buffer[pos+2])
+		mapDataLength, err := lookahead(2)
+		if err != nil {
+			return opcode, 0, err
+		}
 		opcodeLength = mapDataLength + 3
 	case OpcodePlayerName:
-		playerNameLength := int(buffer[pos])
+		playerNameLength, err := lookahead(0)
+		if err != nil {
+			return opcode, 0, err
+		}
 		opcodeLength = playerNameLength + 2
 	case OpcodeSendMessage:
-		messageLength := int(buffer[pos+2])
+		messageLength, err := lookahead(2)
+		if err != nil {
+			return opcode, 0, err
+		}
 		opcodeLength = messageLength + 4
 	default:
 		opcodeLength = opcodeLengthLookup[opcode]
 	}
 
-	return opcode, opcodeLength
+	// lengths are counted from the second byte of two byte opcodes
+	opcodeLength = opcodeLength + prefixLength
+
+	if posStart+opcodeLength > len(buffer) {
+		return opcode, opcodeLength, fmt.Errorf("opcode 0x%02x at offset %d extends past end of block (length %d)", opcode, posStart, opcodeLength)
+	}
+
+	return opcode, opcodeLength, nil
 }
 
 func rewriteGameStateBlock(
@@ -342,7 +446,7 @@ func rewriteGameStateBlock(
 	srcPlayer util.PlayerAddr,
 	playerInfoEventChannel chan util.PlayerInfoEvent,
 	playerLeaveGameChannel chan util.PlayerAddr,
-) int {
+) (int, error) {
 	// block length includes length byte, does not include checksum
 	blockLength := int(buffer[posStart] & 0x7f)
 	posBlockStart := posStart + 1
@@ -355,10 +459,13 @@ func rewriteGameStateBlock(
 			// don't know what this is, can't continue parsing
 			posNextBlock = len(buffer) // skip to end
 		}
-		return posNextBlock
+		return posNextBlock, nil
+	}
+
+	if posNextBlock > len(buffer) {
+		return posNextBlock, fmt.Errorf("block at offset %d extends past end of packet (%d > %d)", posStart, posNextBlock, len(buffer))
 	}
 
-	//blockSequence := buffer[posBlockStart]
 	pos := posBlockStart + 1 // skip sequence
 	senderFlags := buffer[pos] & 0xf0
 	sender := buffer[pos] & 0x0f
@@ -374,13 +481,15 @@ func rewriteGameStateBlock(
 		pos = pos + 3
 	}
 
-	for pos < posChecksum {
-		opcode, opcodeLength := parseOpcode(pos, buffer)
+	if pos > posChecksum {
+		return posNextBlock, fmt.Errorf("block at offset %d header extends past checksum", posStart)
+	}
 
-		/*
-			fmt.Printf("PacketLength: %d PacketSequence: 0x%02x BlockSequence: 0x%02x BlockLength: %d RawOpcode: 0x%02x Opcode: 0x%02x OpcodeLength: %d\n",
-				len(buffer), packetSequence, blockSequence, blockLength, buffer[pos], opcode, opcodeLength)
-		*/
+	for pos < posChecksum {
+		opcode, opcodeLength, err := parseOpcode(pos, buffer[:posChecksum])
+		if err != nil {
+			return posNextBlock, err
+		}
 
 		switch opcode {
 		case OpcodeGameInfo:
@@ -392,14 +501,18 @@ func rewriteGameStateBlock(
 				rewriteCrc = true
 			}
 		case OpcodePlayerName:
-			if (packetSequence == 0x02) && (buffer[posStart]&0x80 == 0) {
-				playerInfoEventChannel <- util.PlayerInfoEvent{srcPlayer, true, false, int(sender), ""}
-			}
+			// parseOpcode has already checked the name fits in the opcode
 			nameLength := int(buffer[pos+1])
 			playerName := string(buffer[pos+2 : pos+2+nameLength])
-			playerInfoEventChannel <- util.PlayerInfoEvent{srcPlayer, false, true, int(sender), playerName}
+			if (packetSequence == 0x02) && (buffer[posStart]&0x80 == 0) {
+				playerInfoEventChannel <- util.PlayerInfoEvent{PlayerAddr: srcPlayer, SetId: true, PlayerId: int(sender)}
+			}
+			playerInfoEventChannel <- util.PlayerInfoEvent{PlayerAddr: srcPlayer, SetName: true, PlayerId: int(sender), Name: playerName}
 		case OpcodeDisconnect:
-			rewriteOpcodePlayerInfo(pos+2, buffer, proxyPort, proxyIP, srcPlayer, playerLeaveGameChannel)
+			err = rewriteOpcodePlayerInfo(pos+2, buffer[:posChecksum], proxyPort, proxyIP, srcPlayer, playerLeaveGameChannel)
+			if err != nil {
+				return posNextBlock, err
+			}
 			rewriteCrc = true
 		}
 
@@ -411,7 +524,7 @@ func rewriteGameStateBlock(
 		binary.BigEndian.PutUint16(buffer[posChecksum:posNextBlock], uint16(crc64))
 	}
 
-	return posNextBlock
+	return posNextBlock, nil
 }
 
 func rewritePacketGameState(
@@ -421,13 +534,17 @@ func rewritePacketGameState(
 	srcPlayer util.PlayerAddr,
 	playerInfoEventChannel chan util.PlayerInfoEvent,
 	playerLeaveGameChannel chan util.PlayerAddr,
-) {
+) error {
 	pos := PacketHeaderSize
+	if pos >= len(buffer) {
+		return fmt.Errorf("game state packet too short (%d)", len(buffer))
+	}
 	packetSequence := int(buffer[pos])
 	pos = pos + 1 // skip state sequence
 
+	var err error
 	for pos < len(buffer) {
-		pos = rewriteGameStateBlock(
+		pos, err = rewriteGameStateBlock(
 			packetSequence,
 			pos,
 			buffer,
@@ -437,10 +554,19 @@ func rewritePacketGameState(
 			playerInfoEventChannel,
 			playerLeaveGameChannel,
 		)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func rewritePacketFixedPosition(buffer []byte, proxyIP net.IP, proxyPort int, offset int) {
+func rewritePacketFixedPosition(buffer []byte, proxyIP net.IP, proxyPort int, offset int) error {
+	if offset+6 > len(buffer) {
+		return fmt.Errorf("packet type 0x%02x too short for peer address (%d)", buffer[PacketTypeOffset], len(buffer))
+	}
+
 	packetIP := buffer[offset : offset+4]
 	if !bytes.Equal(packetIP, proxyIP) {
 		port := make([]byte, 2)
@@ -452,6 +578,8 @@ func rewritePacketFixedPosition(buffer []byte, proxyIP net.IP, proxyPort int, of
 		buffer[offset+4] = port[0]
 		buffer[offset+5] = port[1]
 	}
+
+	return nil
 }
 
 func RewritePacket(
@@ -461,30 +589,29 @@ func RewritePacket(
 	srcPlayer util.PlayerAddr,
 	playerInfoEventChannel chan util.PlayerInfoEvent,
 	playerLeaveGameChannel chan util.PlayerAddr,
-) {
+) error {
 	// only the player who starts the game will send packets with the wrong ip address, and it will
 	// be their own. so we can search for any ip that isn't ours, replace it with ours, and replace
 	// the port with the player's assigned port
 
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
-			fmt.Println(hex.Dump(buffer))
-		}
-	}()
+	if len(buffer) < PacketHeaderSize {
+		return fmt.Errorf("datagram too short (smaller than bolo header) (%d)", len(buffer))
+	}
 
 	switch buffer[PacketTypeOffset] {
 	case PacketType0:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType0PeerAddrOffset)
+		return rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType0PeerAddrOffset)
 	case PacketType1:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType1PeerAddrOffset)
+		return rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType1PeerAddrOffset)
 	case PacketTypeGameState:
-		rewritePacketGameState(buffer, proxyIP, proxyPort, srcPlayer, playerInfoEventChannel, playerLeaveGameChannel)
+		return rewritePacketGameState(buffer, proxyIP, proxyPort, srcPlayer, playerInfoEventChannel, playerLeaveGameChannel)
 	case PacketType6:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType6PeerAddrOffset)
+		return rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType6PeerAddrOffset)
 	case PacketType7:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType7PeerAddrOffset)
+		return rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType7PeerAddrOffset)
 	case PacketType9:
-		rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType9PeerAddrOffset)
+		return rewritePacketFixedPosition(buffer, proxyIP, proxyPort, PacketType9PeerAddrOffset)
 	}
+
+	return nil
 }
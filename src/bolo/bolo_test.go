@@ -0,0 +1,598 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/util"
+	"github.com/snksoft/crc"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+var testProxyIP = net.IPv4(203, 0, 113, 1).To4()
+
+const testProxyPort = 40001
+
+// readHexFile reads a packet written as hex bytes, ignoring whitespace and
+// lines starting with '#'
+func readHexFile(tb testing.TB, path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+
+	var sb strings.Builder
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sb.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	buffer, err := hex.DecodeString(sb.String())
+	if err != nil {
+		tb.Fatalf("%s: %s", path, err)
+	}
+	return buffer
+}
+
+func writeHexFile(tb testing.TB, path string, comment string, buffer []byte) {
+	var sb strings.Builder
+	sb.WriteString("# " + comment + "\n")
+	for pos := 0; pos < len(buffer); pos = pos + 16 {
+		end := pos + 16
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		var line []string
+		for _, b := range buffer[pos:end] {
+			line = append(line, hex.EncodeToString([]byte{b}))
+		}
+		sb.WriteString(strings.Join(line, " ") + "\n")
+	}
+
+	err := os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// corpusPackets returns the packets in testdata/packets keyed by file name
+// (without extension), and the sorted names
+func corpusPackets(tb testing.TB) (map[string][]byte, []string) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "packets", "*.hex"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if len(paths) == 0 {
+		tb.Fatal("no packets in testdata/packets")
+	}
+
+	packets := make(map[string][]byte)
+	var names []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+		packets[name] = readHexFile(tb, path)
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return packets, names
+}
+
+func udpPacket(buffer []byte) proxy.UdpPacket {
+	return proxy.UdpPacket{Len: len(buffer), Buffer: buffer}
+}
+
+// rewrite runs RewritePacket on a copy of buffer, discarding player events
+func rewrite(buffer []byte) ([]byte, error) {
+	rewritten := make([]byte, len(buffer))
+	copy(rewritten, buffer)
+
+	playerInfoEventChannel := make(chan util.PlayerInfoEvent)
+	playerLeaveGameChannel := make(chan util.PlayerAddr)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-playerInfoEventChannel:
+			case <-playerLeaveGameChannel:
+			}
+		}
+	}()
+
+	err := RewritePacket(rewritten, testProxyIP, testProxyPort, util.PlayerAddr{}, playerInfoEventChannel, playerLeaveGameChannel)
+	return rewritten, err
+}
+
+func TestValidatePacketCorpus(t *testing.T) {
+	packets, names := corpusPackets(t)
+	for _, name := range names {
+		valid, reason := ValidatePacket(udpPacket(packets[name]))
+		if !valid {
+			t.Errorf("%s: %s", name, reason)
+		}
+	}
+}
+
+func TestValidatePacketRejects(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":     {},
+		"short":     []byte("Bolo"),
+		"signature": []byte("Bola\x65\x99\x08\x02"),
+		"version":   []byte("Bolo\x65\x99\x07\x02"),
+	}
+	for name, buffer := range tests {
+		valid, _ := ValidatePacket(udpPacket(buffer))
+		if valid {
+			t.Errorf("%s: expected packet to be rejected", name)
+		}
+	}
+}
+
+func TestParsePacketGameInfo(t *testing.T) {
+	packets, _ := corpusPackets(t)
+	gameInfo, err := ParsePacketGameInfo(packets["type0e"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gameInfo.MapName != "Everard Island" {
+		t.Errorf("MapName = %q", gameInfo.MapName)
+	}
+	expectedGameId := GameId{0xc0, 0xa8, 0x01, 0x0a, 0xdc, 0x89, 0x85, 0x00}
+	if gameInfo.GameId != expectedGameId {
+		t.Errorf("GameId = %x", gameInfo.GameId)
+	}
+	if gameInfo.GameType != 2 {
+		t.Errorf("GameType = %d", gameInfo.GameType)
+	}
+	if gameInfo.AllowHiddenMines {
+		t.Error("AllowHiddenMines = true, mines visible bit is set")
+	}
+	if !gameInfo.AllowComputer || gameInfo.ComputerAdvantage {
+		t.Errorf("AllowComputer = %t ComputerAdvantage = %t", gameInfo.AllowComputer, gameInfo.ComputerAdvantage)
+	}
+	if gameInfo.StartDelay != 500 || gameInfo.TimeLimit != 90000 {
+		t.Errorf("StartDelay = %d TimeLimit = %d", gameInfo.StartDelay, gameInfo.TimeLimit)
+	}
+	if gameInfo.PlayerCount != 3 || gameInfo.NeutralPillboxCount != 4 || gameInfo.NeutralBaseCount != 5 {
+		t.Errorf("PlayerCount = %d NeutralPillboxCount = %d NeutralBaseCount = %d",
+			gameInfo.PlayerCount, gameInfo.NeutralPillboxCount, gameInfo.NeutralBaseCount)
+	}
+	if !gameInfo.HasPassword {
+		t.Error("HasPassword = false")
+	}
+}
+
+func TestMarshalPacketGameInfo(t *testing.T) {
+	packets, _ := corpusPackets(t)
+	gameInfo, err := ParsePacketGameInfo(packets["type0e"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := MarshalPacketGameInfo(gameInfo)
+	if !bytes.Equal(buffer, packets["type0e"]) {
+		t.Errorf("marshalled game info differs from corpus\ngot:\n%swant:\n%s", hex.Dump(buffer), hex.Dump(packets["type0e"]))
+	}
+}
+
+func TestParsePacketGameInfoTruncated(t *testing.T) {
+	packets, _ := corpusPackets(t)
+	buffer := packets["type0e"]
+	for n := 0; n < len(buffer); n++ {
+		_, err := ParsePacketGameInfo(buffer[:n])
+		if err == nil {
+			t.Errorf("no error for packet truncated to %d bytes", n)
+		}
+	}
+
+	long := make([]byte, len(buffer))
+	copy(long, buffer)
+	long[PacketHeaderSize] = 36
+	_, err := ParsePacketGameInfo(long)
+	if err == nil {
+		t.Error("no error for map name longer than its field")
+	}
+}
+
+func TestDecodeGameState(t *testing.T) {
+	packets, _ := corpusPackets(t)
+
+	packet, err := DecodeGameState(packets["type02_game_info"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Sequence != 0x05 || len(packet.Blocks) != 2 {
+		t.Fatalf("Sequence = 0x%02x, %d blocks", packet.Sequence, len(packet.Blocks))
+	}
+	for _, block := range packet.Blocks {
+		if !block.CrcValid {
+			t.Errorf("block at offset %d has invalid crc", block.Offset)
+		}
+	}
+	gameInfo, ok := packet.Blocks[0].Opcodes[0].(GameInfoOp)
+	if !ok {
+		t.Fatalf("opcode is %T, not GameInfoOp", packet.Blocks[0].Opcodes[0])
+	}
+	if gameInfo.MapName != "Everard Island" || !gameInfo.HostIpAddr.Equal(net.IPv4(192, 168, 1, 10)) {
+		t.Errorf("MapName = %q HostIpAddr = %s", gameInfo.MapName, gameInfo.HostIpAddr)
+	}
+	pillboxes, ok := packet.Blocks[1].Opcodes[0].(GameInfoListOp)
+	if !ok || len(pillboxes.Records) != 2 {
+		t.Errorf("pillbox opcode = %#v", packet.Blocks[1].Opcodes[0])
+	}
+
+	packet, err = DecodeGameState(packets["type02_disconnect"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	disconnect, ok := packet.Blocks[0].Opcodes[0].(DisconnectOp)
+	if !ok {
+		t.Fatalf("opcode is %T, not DisconnectOp", packet.Blocks[0].Opcodes[0])
+	}
+	if disconnect.Sender.String() != "192.168.1.10:50000" || disconnect.Upstream.String() != "10.0.0.23:50000" {
+		t.Errorf("Sender = %s Upstream = %s", disconnect.Sender.String(), disconnect.Upstream.String())
+	}
+
+	packet, err = DecodeGameState(packets["type02_player_name"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Blocks) != 2 || len(packet.Blocks[1].Opcodes) != 2 {
+		t.Fatalf("decoded %#v", packet)
+	}
+	name, ok := packet.Blocks[0].Opcodes[0].(PlayerNameOp)
+	if !ok || name.Name != "Stuart@Unknown Machine Name" {
+		t.Errorf("player name opcode = %#v", packet.Blocks[0].Opcodes[0])
+	}
+
+	packet, err = DecodeGameState(packets["type02_map_data_empty"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapData, ok := packet.Blocks[0].Opcodes[0].(MapDataOp)
+	if !ok || len(mapData.Data) != 0 || len(mapData.Bytes) != 3 {
+		t.Errorf("map data opcode = %#v", packet.Blocks[0].Opcodes[0])
+	}
+
+	packet, err = DecodeGameState(packets["type02_send_message"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Blocks[0].ExtendedHeader) != 5 {
+		t.Errorf("ExtendedHeader = %x", packet.Blocks[0].ExtendedHeader)
+	}
+	message, ok := packet.Blocks[0].Opcodes[0].(SendMessageOp)
+	if !ok || message.Message != "hello there" || message.Recipients != 0x0002 {
+		t.Errorf("send message opcode = %#v", packet.Blocks[0].Opcodes[0])
+	}
+}
+
+func TestDecodeChatMessages(t *testing.T) {
+	packets, _ := corpusPackets(t)
+
+	messages, err := DecodeChatMessages(packets["type02_send_message"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("decoded %d messages", len(messages))
+	}
+	message := messages[0]
+	if message.Sender != 1 || message.Sequence != 0x09 || message.Checksum != 0x3f49 || message.Message != "hello there" {
+		t.Errorf("message is %+v", message)
+	}
+	if ids := message.RecipientIds(); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("recipients are %v", ids)
+	}
+
+	for _, name := range []string{"type02_player_name", "type02_map_data", "type02_disconnect"} {
+		messages, err = DecodeChatMessages(packets[name])
+		if err != nil || len(messages) != 0 {
+			t.Errorf("%s decoded %d messages, %v", name, len(messages), err)
+		}
+	}
+}
+
+func TestMarshalSendMessageBlock(t *testing.T) {
+	packets, _ := corpusPackets(t)
+	original := packets["type02_player_name"]
+
+	block, err := MarshalSendMessageBlock(0x09, 15, 0x0002, "hello there")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer, err := AppendGameStateBlocks(original, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := DecodeGameState(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet.Blocks) != 3 {
+		t.Fatalf("packet has %d blocks", len(packet.Blocks))
+	}
+	added := packet.Blocks[2]
+	if !added.CrcValid || !added.LengthFlag || added.Sequence != 0x09 || added.Sender != 15 {
+		t.Errorf("added block is %+v", added)
+	}
+	messages, err := DecodeChatMessages(buffer)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("decoded %d messages, %v", len(messages), err)
+	}
+	if messages[0].Message != "hello there" || messages[0].Recipients != 0x0002 || messages[0].Sender != 15 {
+		t.Errorf("message is %+v", messages[0])
+	}
+
+	removed, count, err := RemoveGameStateBlocks(buffer, func(block GameStateBlock) bool {
+		return block.Sender == 15
+	})
+	if err != nil || count != 1 || !bytes.Equal(removed, original) {
+		t.Errorf("removed %d blocks, %v, leaving\n%s", count, err, hex.Dump(removed))
+	}
+	unchanged, count, _ := RemoveGameStateBlocks(buffer, func(block GameStateBlock) bool { return false })
+	if count != 0 || !bytes.Equal(unchanged, buffer) {
+		t.Errorf("removing no blocks changed the packet")
+	}
+
+	_, err = MarshalSendMessageBlock(0x09, 15, 0x0002, strings.Repeat("x", MaxMessageLength+1))
+	if err == nil {
+		t.Error("message longer than a block was marshalled")
+	}
+	block, err = MarshalSendMessageBlock(0x09, 15, 0x0002, strings.Repeat("x", MaxMessageLength))
+	if err != nil || block[0]&blockLengthBitmask != blockLengthBitmask {
+		t.Errorf("longest message block starts %02x, %v", block[0], err)
+	}
+}
+
+func TestDecodeGameStateInvalidCrc(t *testing.T) {
+	packets, _ := corpusPackets(t)
+	buffer := make([]byte, len(packets["type02_disconnect"]))
+	copy(buffer, packets["type02_disconnect"])
+	buffer[len(buffer)-1] ^= 0xff
+
+	packet, err := DecodeGameState(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Blocks[0].CrcValid {
+		t.Error("corrupted checksum decoded as valid")
+	}
+}
+
+func TestXmodemCrc(t *testing.T) {
+	// check value from the CRC catalogue for CRC-16/XMODEM
+	checksum := crc.CalculateCRC(crc.XMODEM, []byte("123456789"))
+	if checksum != 0x31c3 {
+		t.Errorf("XMODEM crc = 0x%04x, expected 0x31c3", checksum)
+	}
+}
+
+func TestRewritePacketGolden(t *testing.T) {
+	packets, names := corpusPackets(t)
+	for _, name := range names {
+		rewritten, err := rewrite(packets[name])
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		path := filepath.Join("testdata", "golden", name+".hex")
+		if *update {
+			writeHexFile(t, path, name+" rewritten for 203.0.113.1:40001", rewritten)
+			continue
+		}
+
+		expected := readHexFile(t, path)
+		if !bytes.Equal(rewritten, expected) {
+			t.Errorf("%s: rewritten packet differs from golden file\ngot:\n%swant:\n%s", name, hex.Dump(rewritten), hex.Dump(expected))
+		}
+	}
+}
+
+// TestRewritePacketChanges checks that the golden files rewrite the packets
+// that carry a player's address, and only those, so that a golden file equal
+// to its packet means the packet is meant to be relayed as it is
+func TestRewritePacketChanges(t *testing.T) {
+	rewritten := map[string]bool{
+		"type00":                     true,
+		"type01":                     true,
+		"type02_disconnect":          true,
+		"type02_disconnect_extended": true,
+		"type06":                     true,
+		"type07":                     true,
+		"type09":                     true,
+	}
+
+	packets, names := corpusPackets(t)
+	for _, name := range names {
+		expected := readHexFile(t, filepath.Join("testdata", "golden", name+".hex"))
+		changed := !bytes.Equal(packets[name], expected)
+		if changed != rewritten[name] {
+			t.Errorf("%s: rewrite changed packet = %t, expected %t", name, changed, rewritten[name])
+		}
+	}
+}
+
+func TestRewritePacketChecksum(t *testing.T) {
+	packets, names := corpusPackets(t)
+	for _, name := range names {
+		if GetPacketType(packets[name]) != PacketTypeGameState {
+			continue
+		}
+
+		rewritten, err := rewrite(packets[name])
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		packet, err := DecodeGameState(rewritten)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for _, block := range packet.Blocks {
+			if !block.CrcValid {
+				t.Errorf("%s: block at offset %d has invalid crc after rewrite", name, block.Offset)
+			}
+		}
+	}
+
+	rewritten, _ := rewrite(packets["type02_disconnect"])
+	packet, _ := DecodeGameState(rewritten)
+	disconnect := packet.Blocks[0].Opcodes[0].(DisconnectOp)
+	if disconnect.Sender.String() != "203.0.113.1:40001" {
+		t.Errorf("disconnect sender rewritten to %s", disconnect.Sender.String())
+	}
+	if bytes.Equal(rewritten[len(rewritten)-2:], packets["type02_disconnect"][len(rewritten)-2:]) {
+		t.Error("checksum was not recalculated")
+	}
+}
+
+func TestRewritePacketTruncated(t *testing.T) {
+	packets, names := corpusPackets(t)
+	for _, name := range names {
+		buffer := packets[name]
+		for n := 0; n < len(buffer); n++ {
+			// must not panic, errors are expected
+			rewrite(buffer[:n])
+		}
+	}
+}
+
+func TestParseOpcodeBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+	}{
+		{"empty", []byte{}},
+		{"prefix only", []byte{0xff}},
+		{"disconnect without length", []byte{0xff, 0xf0}},
+		{"disconnect past end", []byte{0xff, 0xf0, 0x06, 0x00}},
+		{"player name past end", []byte{0xf8, 0x05, 'a'}},
+		{"send message without length", []byte{0xfa, 0x00, 0x00}},
+		{"game info without count", []byte{0xf1, 0x02}},
+		{"fixed length past end", []byte{0x30}},
+	}
+	for _, test := range tests {
+		_, _, err := parseOpcode(0, test.buffer)
+		if err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	opcode, length, err := parseOpcode(0, []byte{0xff, 0xf0, 0x06, 1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6})
+	if err != nil || opcode != OpcodeDisconnect || length != 21 {
+		t.Errorf("disconnect: opcode 0x%02x length %d err %v", opcode, length, err)
+	}
+}
+
+// TestParseOpcodeTwoByte walks a block from a two byte opcode to the opcode
+// after it. The length of a two byte opcode is counted from its second byte,
+// so the 0xff prefix is one byte more.
+func TestParseOpcodeTwoByte(t *testing.T) {
+	disconnect := []byte{0xff, 0xf0, 0x06, 1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6}
+	playerName := []byte{0xf8, 0x03, 'B', 'o', 'b'}
+	buffer := append(append([]byte{}, disconnect...), playerName...)
+
+	var opcodes, offsets []int
+	for pos := 0; pos < len(buffer); {
+		opcode, length, err := parseOpcode(pos, buffer)
+		if err != nil {
+			t.Fatalf("offset %d: %s", pos, err)
+		}
+		opcodes = append(opcodes, opcode)
+		offsets = append(offsets, pos)
+		pos = pos + length
+	}
+
+	if fmt.Sprint(opcodes) != fmt.Sprint([]int{OpcodeDisconnect, OpcodePlayerName}) || fmt.Sprint(offsets) != fmt.Sprint([]int{0, len(disconnect)}) {
+		t.Errorf("walked opcodes %x at offsets %v", opcodes, offsets)
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	packets, names := corpusPackets(t)
+
+	for _, name := range names {
+		packet, err := DecodePacket(packets[name])
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if packet.VersionString() != "65.99.8" {
+			t.Errorf("%s: version %s", name, packet.VersionString())
+		}
+	}
+
+	packet, _ := DecodePacket(packets["type00"])
+	if packet.Addr == nil || packet.Addr.String() != "192.168.1.10:50000" || packet.Trailer != nil {
+		t.Errorf("type 0x00 decoded as %+v", packet)
+	}
+	packet, _ = DecodePacket(packets["type06"])
+	if packet.Addr == nil || packet.Addr.String() != "192.168.1.10:50000" || !bytes.Equal(packet.Unknown, []byte{0xff, 0xff, 0x01, 0x23}) {
+		t.Errorf("type 0x06 decoded as %+v", packet)
+	}
+	packet, _ = DecodePacket(packets["type03"])
+	if packet.Sequence != 0x12 || len(packet.Trailer) != 2 {
+		t.Errorf("type 0x03 decoded as %+v", packet)
+	}
+	packet, _ = DecodePacket(packets["type08"])
+	if packet.Password == nil || *packet.Password != "swordfish" || PacketTypeName(packet.Type) != "Password" {
+		t.Errorf("type 0x08 decoded as %+v", packet)
+	}
+	packet, _ = DecodePacket(packets["type0e"])
+	if packet.GameInfo == nil || packet.GameInfo.MapName != "Everard Island" || packet.GameInfo.PlayerCount != 3 {
+		t.Errorf("type 0x0e decoded as %+v", packet)
+	}
+	packet, _ = DecodePacket(packets["type02_send_message"])
+	if packet.GameState == nil || len(packet.GameState.Blocks) != 1 {
+		t.Errorf("type 0x02 decoded as %+v", packet)
+	}
+
+	_, err := DecodePacket([]byte("Bolo"))
+	if err == nil {
+		t.Error("short packet decoded")
+	}
+	_, err = DecodePacket([]byte("Blob\x65\x99\x08\x02"))
+	if err == nil {
+		t.Error("packet with the wrong signature decoded")
+	}
+}
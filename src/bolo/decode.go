@@ -0,0 +1,540 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/snksoft/crc"
+)
+
+const blockLengthFlagBitmask = 0x80
+const blockLengthBitmask = 0x7f
+const blockFlagsExtendedBitmask = 0x80
+const senderFlagsExtendedBitmask = 0xe0
+const blockChecksumSize = 2
+const mapNameFieldSize = 36
+
+// opcodeSendMessageByte is how OpcodeSendMessage is written in a block
+const opcodeSendMessageByte = 0xe0 | OpcodeSendMessage
+
+// GameStatePacket is a decoded game state (0x02) packet
+type GameStatePacket struct {
+	Sequence int
+	Blocks   []GameStateBlock
+	// bytes after the last block that could not be decoded as a block
+	Trailer []byte
+}
+
+// GameStateBlock is a single checksummed block of a game state packet
+type GameStateBlock struct {
+	Offset      int
+	Length      int // includes the length byte, does not include the checksum
+	LengthFlag  bool
+	Sequence    int
+	SenderFlags int
+	Sender      int
+	Flags       int
+	// optional header bytes present when the block or sender flags call for them
+	ExtendedHeader []byte
+	Checksum       uint16
+	CrcValid       bool
+	Opcodes        []Opcode
+}
+
+// Opcode is implemented by every decoded game state opcode
+type Opcode interface {
+	Raw() RawOpcode
+}
+
+// RawOpcode is the undecoded form of an opcode. Code is the normalized opcode
+// (e.g. OpcodeSendMessage), Bytes includes the opcode byte(s).
+type RawOpcode struct {
+	Code   int
+	Offset int
+	Bytes  []byte
+}
+
+func (op RawOpcode) Raw() RawOpcode {
+	return op
+}
+
+// GameInfoOp is an OpcodeGameInfo with the OpcodeGameInfoSubcodeGame subcode
+type GameInfoOp struct {
+	RawOpcode
+	MapName           string
+	HostIpAddr        net.IP
+	StartTimestamp    uint32
+	GameType          int
+	AllowHiddenMines  bool
+	AllowComputer     bool
+	ComputerAdvantage bool
+	StartDelay        uint32
+	TimeLimit         uint32
+}
+
+// GameInfoListOp is an OpcodeGameInfo carrying pillbox, base or start records
+type GameInfoListOp struct {
+	RawOpcode
+	Subcode int
+	Records [][]byte
+}
+
+type MapDataOp struct {
+	RawOpcode
+	Data []byte
+}
+
+type PlayerNameOp struct {
+	RawOpcode
+	Name string
+}
+
+// SendMessageOp is a chat message. Recipients has bit n set for each player
+// id n the message is sent to.
+type SendMessageOp struct {
+	RawOpcode
+	Recipients uint16
+	Message    string
+}
+
+// RecipientIds lists the player ids the message is sent to, lowest first
+func (op SendMessageOp) RecipientIds() []int {
+	var ids []int
+	for id := 0; id < 16; id++ {
+		if op.Recipients&(1<<id) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// DisconnectOp lists the upstream, sender and downstream addresses of the
+// player who is leaving the ring
+type DisconnectOp struct {
+	RawOpcode
+	Upstream   net.UDPAddr
+	Sender     net.UDPAddr
+	Downstream net.UDPAddr
+}
+
+type UnknownOp struct {
+	RawOpcode
+}
+
+func DecodeGameState(buffer []byte) (GameStatePacket, error) {
+	var packet GameStatePacket
+
+	if len(buffer) < PacketHeaderSize+1 {
+		return packet, fmt.Errorf("game state packet too short (%d)", len(buffer))
+	}
+
+	if GetPacketType(buffer) != PacketTypeGameState {
+		return packet, fmt.Errorf("not a game state packet (packet type 0x%02x)", GetPacketType(buffer))
+	}
+
+	pos := PacketHeaderSize
+	packet.Sequence = int(buffer[pos])
+	pos = pos + 1
+
+	for pos < len(buffer) {
+		blockLength := int(buffer[pos] & blockLengthBitmask)
+		if blockLength < 4 {
+			// don't know what this is, can't continue parsing
+			packet.Trailer = buffer[pos:]
+			break
+		}
+
+		block, err := decodeGameStateBlock(pos, buffer)
+		if err != nil {
+			return packet, err
+		}
+		packet.Blocks = append(packet.Blocks, block)
+		pos = pos + block.Length + blockChecksumSize
+	}
+
+	return packet, nil
+}
+
+func decodeGameStateBlock(posStart int, buffer []byte) (GameStateBlock, error) {
+	var block GameStateBlock
+
+	block.Offset = posStart
+	block.LengthFlag = buffer[posStart]&blockLengthFlagBitmask != 0
+	block.Length = int(buffer[posStart] & blockLengthBitmask)
+	posChecksum := posStart + block.Length
+	posNextBlock := posChecksum + blockChecksumSize
+
+	if posNextBlock > len(buffer) {
+		return block, fmt.Errorf("block at offset %d extends past end of packet (%d > %d)", posStart, posNextBlock, len(buffer))
+	}
+
+	pos := posStart + 1
+	block.Sequence = int(buffer[pos])
+	pos = pos + 1
+	block.SenderFlags = int(buffer[pos] & 0xf0)
+	block.Sender = int(buffer[pos] & 0x0f)
+	pos = pos + 1
+	block.Flags = int(buffer[pos])
+	pos = pos + 1
+
+	posHeaderEnd := pos
+	if block.Flags&blockFlagsExtendedBitmask > 0 {
+		posHeaderEnd = posHeaderEnd + 5
+	}
+	if block.SenderFlags&senderFlagsExtendedBitmask > 0 {
+		posHeaderEnd = posHeaderEnd + 3
+	}
+	if posHeaderEnd > posChecksum {
+		return block, fmt.Errorf("block at offset %d header extends past checksum", posStart)
+	}
+	block.ExtendedHeader = buffer[pos:posHeaderEnd]
+	pos = posHeaderEnd
+
+	block.Checksum = binary.BigEndian.Uint16(buffer[posChecksum:posNextBlock])
+	block.CrcValid = uint16(crc.CalculateCRC(crc.XMODEM, buffer[posStart:posChecksum])) == block.Checksum
+
+	for pos < posChecksum {
+		opcode, opcodeLength, err := parseOpcode(pos, buffer[:posChecksum])
+		if err != nil {
+			return block, err
+		}
+
+		raw := RawOpcode{Code: opcode, Offset: pos, Bytes: buffer[pos : pos+opcodeLength]}
+		op, err := decodeOpcode(raw)
+		if err != nil {
+			return block, err
+		}
+		block.Opcodes = append(block.Opcodes, op)
+
+		pos = pos + opcodeLength
+	}
+
+	return block, nil
+}
+
+func decodeOpcode(raw RawOpcode) (Opcode, error) {
+	b := raw.Bytes
+
+	switch raw.Code {
+	case OpcodeGameInfo:
+		subcode := int(b[1])
+		switch subcode {
+		case OpcodeGameInfoSubcodeGame:
+			return decodeGameInfoOp(raw)
+		case OpcodeGameInfoSubcodePillbox:
+			return GameInfoListOp{raw, subcode, splitRecords(b[3:], 5)}, nil
+		case OpcodeGameInfoSubcodeBase:
+			return GameInfoListOp{raw, subcode, splitRecords(b[3:], 6)}, nil
+		case OpcodeGameInfoSubcodeStart:
+			return GameInfoListOp{raw, subcode, splitRecords(b[3:], 3)}, nil
+		}
+	case OpcodeMapData:
+		// the length byte counts itself, so a length of 0 ends the opcode
+		// before it, as parseOpcode reads it, and there is no data
+		if len(b) < 4 {
+			return MapDataOp{raw, []byte{}}, nil
+		}
+		return MapDataOp{raw, b[4:]}, nil
+	case OpcodePlayerName:
+		name, err := parsePascalString(b[1:], len(b)-2)
+		if err != nil {
+			return nil, fmt.Errorf("player name at offset %d: %s", raw.Offset, err)
+		}
+		return PlayerNameOp{raw, name}, nil
+	case OpcodeSendMessage:
+		message, err := parsePascalString(b[3:], len(b)-4)
+		if err != nil {
+			return nil, fmt.Errorf("message at offset %d: %s", raw.Offset, err)
+		}
+		return SendMessageOp{raw, binary.BigEndian.Uint16(b[1:3]), message}, nil
+	case OpcodeDisconnect:
+		return decodeDisconnectOp(raw), nil
+	}
+
+	return UnknownOp{raw}, nil
+}
+
+// ChatMessage is a SendMessageOp with the block it was sent in, which
+// identifies it as the block is passed around the ring of players
+type ChatMessage struct {
+	Sender   int // player id
+	Sequence int
+	Checksum uint16
+	SendMessageOp
+}
+
+// DecodeChatMessages returns the chat messages of a game state packet
+func DecodeChatMessages(buffer []byte) ([]ChatMessage, error) {
+	if len(buffer) <= PacketHeaderSize || bytes.IndexByte(buffer[PacketHeaderSize:], opcodeSendMessageByte) < 0 {
+		// no packet can carry a message without its opcode byte
+		return nil, nil
+	}
+
+	packet, err := DecodeGameState(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []ChatMessage
+	for _, block := range packet.Blocks {
+		for _, op := range block.Opcodes {
+			if message, ok := op.(SendMessageOp); ok {
+				messages = append(messages, ChatMessage{
+					Sender:        block.Sender,
+					Sequence:      block.Sequence,
+					Checksum:      block.Checksum,
+					SendMessageOp: message,
+				})
+			}
+		}
+	}
+	return messages, nil
+}
+
+func decodeGameInfoOp(raw RawOpcode) (Opcode, error) {
+	b := raw.Bytes
+	op := GameInfoOp{RawOpcode: raw}
+	pos := 2
+
+	mapName, err := parsePascalString(b[pos:pos+mapNameFieldSize], mapNameFieldSize-1)
+	if err != nil {
+		return nil, fmt.Errorf("map name at offset %d: %s", raw.Offset+pos, err)
+	}
+	op.MapName = mapName
+	pos = pos + mapNameFieldSize
+
+	op.HostIpAddr = net.IPv4(b[pos], b[pos+1], b[pos+2], b[pos+3])
+	pos = pos + 4
+
+	op.StartTimestamp = binary.BigEndian.Uint32(b[pos : pos+4])
+	pos = pos + 4
+
+	op.GameType = int(b[pos])
+	pos = pos + 1
+
+	op.AllowHiddenMines = !((b[pos] & MinesVisibleBitmask) == MinesVisibleBitmask)
+	pos = pos + 1
+
+	op.AllowComputer = b[pos] > 0
+	pos = pos + 1
+
+	op.ComputerAdvantage = b[pos] > 0
+	pos = pos + 1
+
+	op.StartDelay = binary.LittleEndian.Uint32(b[pos : pos+4])
+	pos = pos + 4
+
+	op.TimeLimit = binary.LittleEndian.Uint32(b[pos : pos+4])
+
+	return op, nil
+}
+
+func decodeDisconnectOp(raw RawOpcode) Opcode {
+	b := raw.Bytes
+	op := DisconnectOp{RawOpcode: raw}
+
+	// 0xff 0xf0, address length, then three addresses
+	addressLength := int(b[2])
+	if addressLength != 6 || len(b) < 3+(addressLength*3) {
+		return op
+	}
+
+	addrs := []*net.UDPAddr{&op.Upstream, &op.Sender, &op.Downstream}
+	pos := 3
+	for _, addr := range addrs {
+		addr.IP = net.IPv4(b[pos], b[pos+1], b[pos+2], b[pos+3])
+		addr.Port = int(binary.BigEndian.Uint16(b[pos+4 : pos+6]))
+		pos = pos + addressLength
+	}
+
+	return op
+}
+
+func splitRecords(buffer []byte, recordLength int) [][]byte {
+	var records [][]byte
+	for pos := 0; pos+recordLength <= len(buffer); pos = pos + recordLength {
+		records = append(records, buffer[pos:pos+recordLength])
+	}
+	return records
+}
+
+// parsePascalString returns the contents of the length-prefixed string at the
+// start of buffer
+func parsePascalString(buffer []byte, maxLength int) (string, error) {
+	if len(buffer) < 1 {
+		return "", fmt.Errorf("missing string length")
+	}
+
+	length := int(buffer[0])
+	if length > maxLength || 1+length > len(buffer) {
+		return "", fmt.Errorf("invalid string length (%d)", length)
+	}
+
+	return string(buffer[1 : 1+length]), nil
+}
+
+// Packet is a decoded bolo datagram of any packet type, laid out the way the
+// wireshark dissector shows it. Fields that don't apply to the packet's type
+// are left zero.
+type Packet struct {
+	Type    int
+	Version [3]byte
+	// Addr is the sender of 0x00 and 0x01 packets, and the peer of 0x06, 0x07
+	// and 0x09 packets
+	Addr *net.UDPAddr
+	// Sequence is set for 0x03 and 0x04 packets, game states have their own
+	Sequence  int
+	GameState *GameStatePacket
+	Password  *string
+	GameInfo  *GameInfo // the host address is the first 4 bytes of its GameId
+	// Unknown is the undecoded bytes in front of the address of 0x06 and 0x07
+	// packets
+	Unknown []byte
+	// Trailer is the bytes after the decoded fields, or all of the body of a
+	// packet type with nothing known about it
+	Trailer []byte
+}
+
+var packetTypeNames = map[int]string{
+	PacketTypeGameState:       "Game State",
+	PacketTypeGameStateAck:    "Game State Acknowledge",
+	PacketType8:               "Password",
+	PacketTypeGameInfoRequest: "Game Info Request",
+	PacketTypeGameInfo:        "Game Info",
+}
+
+// PacketTypeName is the dissector's name for a packet type, "Unknown" for the
+// types it only numbers
+func PacketTypeName(packetType int) string {
+	name, ok := packetTypeNames[packetType]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+var opcodeNames = map[int]string{
+	OpcodeGameInfo:    "Game Info",
+	OpcodeMapData:     "Map Data",
+	OpcodePlayerName:  "Player Name",
+	OpcodeSendMessage: "Send Message",
+	OpcodeDisconnect:  "Disconnect",
+}
+
+// OpcodeName is the dissector's name for a normalized game state opcode,
+// "Unknown" for the opcodes whose meaning isn't known
+func OpcodeName(opcode int) string {
+	name, ok := opcodeNames[opcode]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// VersionString formats a packet's version like the dissector, e.g. 65.99.8
+func (packet Packet) VersionString() string {
+	return fmt.Sprintf("%x.%x.%x", packet.Version[0], packet.Version[1], packet.Version[2])
+}
+
+// DecodePacket decodes a bolo datagram of any packet type. Bytes of a packet
+// too short for its fields are left in Trailer rather than failing, the way
+// the dissector shows them as unknown.
+func DecodePacket(buffer []byte) (Packet, error) {
+	var packet Packet
+
+	if len(buffer) < PacketHeaderSize {
+		return packet, fmt.Errorf("datagram too short (smaller than bolo header) (%d)", len(buffer))
+	}
+	if !verifyBoloSignature(buffer) {
+		return packet, fmt.Errorf("invalid signature (%q)", buffer[0:4])
+	}
+
+	packet.Type = GetPacketType(buffer)
+	copy(packet.Version[:], buffer[4:7])
+	body := buffer[PacketHeaderSize:]
+
+	switch packet.Type {
+	case PacketType0, PacketType1:
+		if len(body) == 6 {
+			packet.Addr = decodeAddr(body)
+		} else {
+			packet.Trailer = body
+		}
+	case PacketTypeGameState:
+		gameState, err := DecodeGameState(buffer)
+		if err != nil {
+			return packet, err
+		}
+		packet.GameState = &gameState
+	case PacketType3, PacketTypeGameStateAck:
+		if len(body) >= 1 {
+			packet.Sequence = int(body[0])
+			packet.Trailer = body[1:]
+		}
+	case PacketType6, PacketType7:
+		if len(body) >= 10 {
+			packet.Unknown = body[:4]
+			packet.Addr = decodeAddr(body[4:])
+			packet.Trailer = body[10:]
+		} else {
+			packet.Trailer = body
+		}
+	case PacketType8:
+		password, err := parsePascalString(body, mapNameFieldSize-1)
+		if len(body) >= mapNameFieldSize && err == nil {
+			packet.Password = &password
+			packet.Trailer = body[mapNameFieldSize:]
+		} else {
+			packet.Trailer = body
+		}
+	case PacketType9:
+		if len(body) >= 6 {
+			packet.Addr = decodeAddr(body)
+			packet.Trailer = body[6:]
+		} else {
+			packet.Trailer = body
+		}
+	case PacketTypeGameInfo:
+		gameInfo, err := ParsePacketGameInfo(buffer)
+		if err == nil {
+			packet.GameInfo = &gameInfo
+			packet.Trailer = buffer[packetGameInfoSize:]
+		} else {
+			packet.Trailer = body
+		}
+	default:
+		packet.Trailer = body
+	}
+
+	if len(packet.Trailer) == 0 {
+		packet.Trailer = nil
+	}
+	return packet, nil
+}
+
+// decodeAddr decodes the ip address and port at the start of buffer
+func decodeAddr(buffer []byte) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IPv4(buffer[0], buffer[1], buffer[2], buffer[3]),
+		Port: int(binary.BigEndian.Uint16(buffer[4:6])),
+	}
+}
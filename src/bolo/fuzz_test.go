@@ -0,0 +1,126 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func addCorpus(f *testing.F) {
+	packets, names := corpusPackets(f)
+	for _, name := range names {
+		f.Add(packets[name])
+	}
+}
+
+func FuzzValidatePacket(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		valid, _ := ValidatePacket(udpPacket(buffer))
+		if valid && !bytes.HasPrefix(buffer, []byte("Bolo\x65\x99\x08")) {
+			t.Errorf("accepted packet without bolo header: %x", buffer)
+		}
+	})
+}
+
+func FuzzParsePacketGameInfo(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		gameInfo, err := ParsePacketGameInfo(buffer)
+		if err == nil && len(gameInfo.MapName) > 35 {
+			t.Errorf("map name longer than its field: %q", gameInfo.MapName)
+		}
+	})
+}
+
+func FuzzParseOpcode(f *testing.F) {
+	packets, names := corpusPackets(f)
+	for _, name := range names {
+		if len(packets[name]) > PacketHeaderSize {
+			f.Add(packets[name][PacketHeaderSize:])
+		}
+	}
+	f.Add([]byte{0xff, 0xf0, 0x06})
+	f.Add([]byte{0xfa, 0x00, 0x00, 0x05, 'h', 'e'})
+
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		for pos := 0; pos < len(buffer); pos++ {
+			opcode, length, err := parseOpcode(pos, buffer)
+			if err != nil {
+				continue
+			}
+			if length < 1 || pos+length > len(buffer) {
+				t.Errorf("opcode 0x%02x at %d has length %d in %d byte buffer", opcode, pos, length, len(buffer))
+			}
+		}
+	})
+}
+
+func FuzzRewritePacket(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		rewritten, err := rewrite(buffer)
+		if err != nil {
+			return
+		}
+		if len(rewritten) != len(buffer) {
+			t.Fatalf("rewrite changed packet length from %d to %d", len(buffer), len(rewritten))
+		}
+
+		// once rewritten, a packet only contains the proxy address
+		again, err := rewrite(rewritten)
+		if err != nil {
+			t.Fatalf("rewritten packet failed to rewrite: %s", err)
+		}
+		if !bytes.Equal(again, rewritten) {
+			t.Errorf("rewrite is not idempotent:\n%x\n%x", rewritten, again)
+		}
+	})
+}
+
+func FuzzDecodeGameState(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		packet, err := DecodeGameState(buffer)
+		if err != nil {
+			return
+		}
+		for _, block := range packet.Blocks {
+			for _, op := range block.Opcodes {
+				raw := op.Raw()
+				if raw.Offset+len(raw.Bytes) > block.Offset+block.Length {
+					t.Errorf("opcode at %d extends past block at %d", raw.Offset, block.Offset)
+				}
+			}
+		}
+	})
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, buffer []byte) {
+		packet, err := DecodePacket(buffer)
+		if err != nil {
+			return
+		}
+		if packet.Password != nil && len(*packet.Password) > 35 {
+			t.Errorf("password longer than its field: %q", *packet.Password)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolo
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/snksoft/crc"
+)
+
+// blockHeaderSize is the length, sequence, sender and flags bytes of a block
+// without the extended header
+const blockHeaderSize = 4
+
+// sendMessageHeaderSize is the opcode, recipients and message length bytes
+const sendMessageHeaderSize = 4
+
+// MaxMessageLength is the longest chat message that fits in one block
+const MaxMessageLength = blockLengthBitmask - blockHeaderSize - sendMessageHeaderSize
+
+// MarshalSendMessageBlock builds a checksummed game state block carrying one
+// OpcodeSendMessage from player id sender to the player ids set in
+// recipients. The length flag is set the way Bolo sets it on the chat blocks
+// it sends.
+func MarshalSendMessageBlock(sequence int, sender int, recipients uint16, message string) ([]byte, error) {
+	if len(message) > MaxMessageLength {
+		return nil, fmt.Errorf("message is %d bytes, longer than %d", len(message), MaxMessageLength)
+	}
+	if sender < 0 || sender > 15 {
+		return nil, fmt.Errorf("sender %d is not a player id", sender)
+	}
+
+	blockLength := blockHeaderSize + sendMessageHeaderSize + len(message)
+	block := make([]byte, 0, blockLength+blockChecksumSize)
+	block = append(block, blockLengthFlagBitmask|byte(blockLength), byte(sequence), byte(sender), 0)
+	block = append(block, opcodeSendMessageByte)
+	block = binary.BigEndian.AppendUint16(block, recipients)
+	block = append(block, byte(len(message)))
+	block = append(block, message...)
+
+	checksum := crc.CalculateCRC(crc.XMODEM, block)
+	return binary.BigEndian.AppendUint16(block, uint16(checksum)), nil
+}
+
+// AppendGameStateBlocks returns a game state packet with blocks added after
+// the blocks of buffer, ahead of any trailer Bolo can't parse
+func AppendGameStateBlocks(buffer []byte, blocks ...[]byte) ([]byte, error) {
+	packet, err := DecodeGameState(buffer)
+	if err != nil {
+		return buffer, err
+	}
+
+	pos := len(buffer) - len(packet.Trailer)
+	size := len(buffer)
+	for _, block := range blocks {
+		size = size + len(block)
+	}
+	result := make([]byte, 0, size)
+	result = append(result, buffer[:pos]...)
+	for _, block := range blocks {
+		result = append(result, block...)
+	}
+	return append(result, packet.Trailer...), nil
+}
+
+// RemoveGameStateBlocks returns a game state packet without the blocks of
+// buffer that remove reports true for, and how many were removed. buffer is
+// returned unchanged when no block is removed.
+func RemoveGameStateBlocks(buffer []byte, remove func(block GameStateBlock) bool) ([]byte, int, error) {
+	packet, err := DecodeGameState(buffer)
+	if err != nil {
+		return buffer, 0, err
+	}
+
+	var result []byte
+	removed := 0
+	pos := 0
+	for _, block := range packet.Blocks {
+		if !remove(block) {
+			continue
+		}
+		if result == nil {
+			result = make([]byte, 0, len(buffer))
+		}
+		result = append(result, buffer[pos:block.Offset]...)
+		pos = block.Offset + block.Length + blockChecksumSize
+		removed++
+	}
+	if removed == 0 {
+		return buffer, 0, nil
+	}
+
+	result = append(result, buffer[pos:]...)
+	return result, removed, nil
+}
@@ -0,0 +1,223 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bolotest scripts fake Bolo 0.99.8 peers for relay tests
+package bolotest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/transport"
+	"git.astrospark.com/bolorama/util"
+)
+
+const receiveQueueSize = 64
+
+// Packet is a datagram received by a Client
+type Packet struct {
+	SrcAddr net.UDPAddr
+	Buffer  []byte
+}
+
+// Client behaves like a Bolo 0.99.8 player on the network. It answers game
+// info requests (0x0d) and nat probes (0x06) by itself, every other packet is
+// queued for Receive.
+type Client struct {
+	TrackerAddr *net.UDPAddr
+	connection  transport.PacketConn
+	received    chan Packet
+	wg          sync.WaitGroup
+	mutex       sync.Mutex
+	gameInfo    *bolo.GameInfo
+	pingCount   int
+	probeCount  int
+}
+
+// NewClient listens on a random loopback port
+func NewClient(trackerAddr *net.UDPAddr) (*Client, error) {
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(trackerAddr, connection), nil
+}
+
+// NewClientOn listens on a random port of transport, such as a host on an
+// in-memory transport.Network
+func NewClientOn(transport transport.Transport, trackerAddr *net.UDPAddr) (*Client, error) {
+	connection, err := transport.ListenUDP(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return newClient(trackerAddr, connection), nil
+}
+
+func newClient(trackerAddr *net.UDPAddr, connection transport.PacketConn) *Client {
+	client := &Client{
+		TrackerAddr: trackerAddr,
+		connection:  connection,
+		received:    make(chan Packet, receiveQueueSize),
+	}
+
+	client.wg.Add(1)
+	go client.listen()
+
+	return client
+}
+
+func (client *Client) Addr() *net.UDPAddr {
+	return client.connection.LocalAddr().(*net.UDPAddr)
+}
+
+func (client *Client) Close() {
+	client.connection.Close()
+	client.wg.Wait()
+}
+
+// SetGameInfo sets the game this client answers game info requests with
+func (client *Client) SetGameInfo(gameInfo bolo.GameInfo) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.gameInfo = &gameInfo
+}
+
+// Host starts a game and announces it to the tracker
+func (client *Client) Host(gameInfo bolo.GameInfo) error {
+	client.SetGameInfo(gameInfo)
+	return client.Send(client.TrackerAddr, bolo.MarshalPacketGameInfo(gameInfo))
+}
+
+// Join asks the player at addr to let this client into their game
+func (client *Client) Join(addr *net.UDPAddr) error {
+	return client.Send(addr, MarshalPacket(bolo.PacketType5, []byte{0x00, 0x00, 0x00, 0x01}))
+}
+
+func (client *Client) Send(addr *net.UDPAddr, buffer []byte) error {
+	_, err := client.connection.WriteToUDP(buffer, addr)
+	return err
+}
+
+// Receive returns the next queued packet
+func (client *Client) Receive(timeout time.Duration) (Packet, error) {
+	select {
+	case packet := <-client.received:
+		return packet, nil
+	case <-time.After(timeout):
+		return Packet{}, fmt.Errorf("no packet received by %s within %s", client.Addr().String(), timeout)
+	}
+}
+
+// ReceiveType returns the next queued packet of packetType, discarding others
+func (client *Client) ReceiveType(packetType int, timeout time.Duration) (Packet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		packet, err := client.Receive(time.Until(deadline))
+		if err != nil {
+			return packet, fmt.Errorf("no packet of type 0x%02x received by %s within %s", packetType, client.Addr().String(), timeout)
+		}
+		if bolo.GetPacketType(packet.Buffer) == packetType {
+			return packet, nil
+		}
+	}
+}
+
+// PingCount is the number of game info requests answered
+func (client *Client) PingCount() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.pingCount
+}
+
+// ProbeCount is the number of nat probes answered
+func (client *Client) ProbeCount() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.probeCount
+}
+
+func (client *Client) listen() {
+	defer client.wg.Done()
+	buffer := make([]byte, util.MaxUdpPacketSize)
+
+	for {
+		n, addr, err := client.connection.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buffer)
+
+		if n < bolo.PacketHeaderSize {
+			continue
+		}
+
+		switch bolo.GetPacketType(data) {
+		case bolo.PacketTypeGameInfoRequest:
+			client.answerPing(addr)
+		case bolo.PacketType6:
+			client.answerProbe(data)
+		default:
+			select {
+			case client.received <- Packet{SrcAddr: *addr, Buffer: data}:
+			default:
+				// nobody is reading, drop it like the network would
+			}
+		}
+	}
+}
+
+func (client *Client) answerPing(addr *net.UDPAddr) {
+	client.mutex.Lock()
+	gameInfo := client.gameInfo
+	if gameInfo != nil {
+		client.pingCount = client.pingCount + 1
+	}
+	client.mutex.Unlock()
+
+	if gameInfo != nil {
+		client.Send(addr, bolo.MarshalPacketGameInfo(*gameInfo))
+	}
+}
+
+// answerProbe sends a 0x07 to the peer named in the 0x06, which is how Bolo
+// opens its nat to a new peer
+func (client *Client) answerProbe(probe []byte) {
+	if len(probe) < bolo.PacketType6PeerPortOffset+2 {
+		return
+	}
+
+	ip := probe[bolo.PacketType6PeerAddrOffset : bolo.PacketType6PeerAddrOffset+4]
+	port := binary.BigEndian.Uint16(probe[bolo.PacketType6PeerPortOffset : bolo.PacketType6PeerPortOffset+2])
+
+	reply := make([]byte, len(probe))
+	copy(reply, probe)
+	reply[bolo.PacketTypeOffset] = bolo.PacketType7
+
+	client.mutex.Lock()
+	client.probeCount = client.probeCount + 1
+	client.mutex.Unlock()
+
+	client.Send(&net.UDPAddr{IP: net.IPv4(ip[0], ip[1], ip[2], ip[3]), Port: int(port)}, reply)
+}
@@ -0,0 +1,98 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolotest
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"github.com/snksoft/crc"
+)
+
+// NewGameInfo returns the settings of an open game hosted at hostIpAddr. The
+// game id is built the way Bolo builds it, from the host address and the
+// start time.
+func NewGameInfo(mapName string, hostIpAddr net.IP) bolo.GameInfo {
+	// seconds since 1904, see bolo.ParseBoloTimestamp
+	startTimestamp := uint32(time.Now().Unix()) + (((1970-1904)*365 + 17) * 24 * 60 * 60)
+
+	gameInfo := bolo.GameInfo{
+		MapName:        mapName,
+		StartTimestamp: startTimestamp,
+		GameType:       1,
+		AllowComputer:  true,
+		PlayerCount:    1,
+	}
+	copy(gameInfo.GameId[0:4], hostIpAddr.To4())
+	binary.BigEndian.PutUint32(gameInfo.GameId[4:8], startTimestamp)
+
+	return gameInfo
+}
+
+// MarshalPacket prepends the bolo header to payload
+func MarshalPacket(packetType int, payload []byte) []byte {
+	buffer := []byte{'B', 'o', 'l', 'o', 0x65, 0x99, 0x08, byte(packetType)}
+	return append(buffer, payload...)
+}
+
+// GameStatePacket builds a game state (0x02) packet from blocks made by GameStateBlock
+func GameStatePacket(sequence int, blocks ...[]byte) []byte {
+	payload := []byte{byte(sequence)}
+	for _, block := range blocks {
+		payload = append(payload, block...)
+	}
+	return MarshalPacket(bolo.PacketTypeGameState, payload)
+}
+
+// GameStateBlock builds a checksummed block holding opcodes
+func GameStateBlock(sequence int, sender int, opcodes ...[]byte) []byte {
+	block := []byte{0, byte(sequence), byte(sender & 0x0f), 0}
+	for _, opcode := range opcodes {
+		block = append(block, opcode...)
+	}
+	block[0] = byte(len(block))
+
+	checksum := crc.CalculateCRC(crc.XMODEM, block)
+	return append(block, byte(checksum>>8), byte(checksum))
+}
+
+func PlayerNameOpcode(name string) []byte {
+	return append([]byte{0xf8, byte(len(name))}, name...)
+}
+
+// SendMessageOpcode is a chat message to the players with the player ids set
+// in recipients
+func SendMessageOpcode(recipients uint16, message string) []byte {
+	opcode := []byte{0xfa, byte(recipients >> 8), byte(recipients), byte(len(message))}
+	return append(opcode, message...)
+}
+
+// DisconnectOpcode is sent by a player leaving the game, naming themselves and
+// their neighbours
+func DisconnectOpcode(upstream *net.UDPAddr, sender *net.UDPAddr, downstream *net.UDPAddr) []byte {
+	opcode := []byte{0xff, 0xf0, 0x06}
+	for _, addr := range []*net.UDPAddr{upstream, sender, downstream} {
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+		opcode = append(opcode, addr.IP.To4()...)
+		opcode = append(opcode, port[:]...)
+	}
+	return opcode
+}
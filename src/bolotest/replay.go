@@ -0,0 +1,169 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bolotest
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/recording"
+	"git.astrospark.com/bolorama/transport"
+)
+
+const defaultReplayTimeout = 5 * time.Second
+
+// Replayer re-sends the game state of a recorded game through a relay, each
+// packet from a Client standing in for the player who sent it
+type Replayer struct {
+	// Clients listen on Transport, such as a host on an in-memory
+	// transport.Network, and find the relay's tracker at TrackerAddr
+	Transport   transport.Transport
+	TrackerAddr *net.UDPAddr
+	// RelayAddr returns the address other players reach the player at addr
+	// through, waiting for the relay to know the player. A test gets it from
+	// the server the clients are relayed by.
+	RelayAddr func(addr *net.UDPAddr) (*net.UDPAddr, error)
+	// Speed scales the gaps between packets: 1 keeps the recorded pace, 2
+	// plays twice as fast, and 0 sends each packet as soon as the one before
+	// it has been relayed
+	Speed float64
+	// Timeout is how long to wait for each packet to be relayed, 0 means 5
+	// seconds
+	Timeout time.Duration
+}
+
+// Relayed is a recorded packet and the packet the relay delivered for it
+type Relayed struct {
+	Record recording.Record
+	Buffer []byte
+}
+
+// Replay hosts the recorded game, joins each recorded player to it, and then
+// sends the recorded game state packets in order, waiting for each to be
+// relayed before the next is sent. Only the packets as they were sent are
+// replayed, the relayed ones are left for the caller to compare with what is
+// returned.
+func (replayer Replayer) Replay(header recording.Header, records []recording.Record) ([]Relayed, error) {
+	timeout := replayer.Timeout
+	if timeout == 0 {
+		timeout = defaultReplayTimeout
+	}
+
+	var sent []recording.Record
+	var proxyPorts []int
+	seen := make(map[int]bool)
+	for _, record := range records {
+		if record.Direction != capture.Inbound {
+			continue
+		}
+		sent = append(sent, record)
+		for _, proxyPort := range []int{record.ProxyPort, record.PeerProxyPort} {
+			if !seen[proxyPort] {
+				seen[proxyPort] = true
+				proxyPorts = append(proxyPorts, proxyPort)
+			}
+		}
+	}
+	if len(sent) == 0 {
+		return nil, nil
+	}
+
+	// a client for each recorded player, the first of them hosting
+	clients := make(map[int]*Client)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for _, proxyPort := range proxyPorts {
+		client, err := NewClientOn(replayer.Transport, replayer.TrackerAddr)
+		if err != nil {
+			return nil, err
+		}
+		clients[proxyPort] = client
+	}
+
+	host := clients[proxyPorts[0]]
+	gameInfo := NewGameInfo("Replay", host.Addr().IP)
+	gameInfo.GameId = header.GameId
+	err := host.Host(gameInfo)
+	if err != nil {
+		return nil, err
+	}
+	relayAddrs := make(map[int]*net.UDPAddr)
+	relayAddrs[proxyPorts[0]], err = replayer.RelayAddr(host.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proxyPort := range proxyPorts[1:] {
+		client := clients[proxyPort]
+		client.SetGameInfo(gameInfo)
+		err = client.Join(relayAddrs[proxyPorts[0]])
+		if err != nil {
+			return nil, err
+		}
+		_, err = host.ReceiveType(bolo.PacketType5, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("player %d did not join: %w", proxyPort, err)
+		}
+		relayAddrs[proxyPort], err = replayer.RelayAddr(client.Addr())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// open the nats between the players who joined, the way the host's was
+	// opened by each join, so that no game state waits for a probe
+	for i, proxyPort := range proxyPorts[1:] {
+		for _, peerProxyPort := range proxyPorts[i+2:] {
+			err = clients[proxyPort].Send(relayAddrs[peerProxyPort], MarshalPacket(bolo.PacketType5, []byte{0x00, 0x00, 0x00, 0x01}))
+			if err != nil {
+				return nil, err
+			}
+			_, err = clients[peerProxyPort].ReceiveType(bolo.PacketType5, timeout)
+			if err != nil {
+				return nil, fmt.Errorf("nat between players %d and %d did not open: %w", proxyPort, peerProxyPort, err)
+			}
+		}
+	}
+
+	relayed := make([]Relayed, 0, len(sent))
+	started := time.Now()
+	for i, record := range sent {
+		if replayer.Speed > 0 {
+			offset := time.Duration(float64(record.Time.Sub(sent[0].Time)) / replayer.Speed)
+			time.Sleep(time.Until(started.Add(offset)))
+		}
+
+		buffer := append([]byte(nil), record.Buffer...)
+		err = clients[record.ProxyPort].Send(relayAddrs[record.PeerProxyPort], buffer)
+		if err != nil {
+			return relayed, err
+		}
+		received, err := clients[record.PeerProxyPort].ReceiveType(bolo.PacketTypeGameState, timeout)
+		if err != nil {
+			return relayed, fmt.Errorf("packet %d from player %d to %d was not relayed: %w", i, record.ProxyPort, record.PeerProxyPort, err)
+		}
+		relayed = append(relayed, Relayed{Record: record, Buffer: received.Buffer})
+	}
+	return relayed, nil
+}
@@ -0,0 +1,264 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package capture records relayed packets to pcapng files, so a game that
+// misbehaves can be looked at in wireshark without asking its players to
+// capture it themselves
+package capture
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// queueSize is how many packets can wait to be written before more are
+// dropped
+const queueSize = 1024
+
+type Direction int
+
+const (
+	Inbound  Direction = iota // from a player to the relay
+	Outbound                  // from the relay to a player
+)
+
+// Packet is one datagram the relay received or sent
+type Packet struct {
+	Time      time.Time
+	Direction Direction
+	SrcAddr   net.UDPAddr
+	DstAddr   net.UDPAddr
+	GameId    bolo.GameId
+	// ProxyPort is the player the packet is from or to, and PeerProxyPort
+	// the other player when it is relayed between two players
+	ProxyPort     int
+	PeerProxyPort int
+	Buffer        []byte
+}
+
+// Filter picks the packets a capture records. Zero fields match any packet.
+type Filter struct {
+	GameId    bolo.GameId
+	ProxyPort int // either player of a packet
+}
+
+func (filter Filter) Match(packet *Packet) bool {
+	if filter.GameId != (bolo.GameId{}) && filter.GameId != packet.GameId {
+		return false
+	}
+	if filter.ProxyPort != 0 && filter.ProxyPort != packet.ProxyPort && filter.ProxyPort != packet.PeerProxyPort {
+		return false
+	}
+	return true
+}
+
+// Status describes the capture being recorded, or the last one
+type Status struct {
+	Running  bool
+	Filename string
+	Filter   Filter
+	Started  time.Time
+	Packets  uint64 // written to the file
+	Dropped  uint64 // not written because the file fell behind
+}
+
+// Capture records at most one capture at a time into files in a directory
+type Capture struct {
+	directory string
+	logger    *slog.Logger
+	running   int32 // checked without the mutex on every packet
+	mutex     sync.RWMutex
+	channel   chan Packet
+	done      chan struct{}
+	status    Status
+	packets   uint64
+	dropped   uint64
+}
+
+// New creates captures in directory. An empty directory disables capturing.
+func New(directory string, logger *slog.Logger) *Capture {
+	return &Capture{directory: directory, logger: logger}
+}
+
+// Enabled reports whether captures can be started
+func (capture *Capture) Enabled() bool {
+	return capture.directory != ""
+}
+
+// Running reports whether a capture is being recorded, so that callers can
+// skip building packets when none is
+func (capture *Capture) Running() bool {
+	return atomic.LoadInt32(&capture.running) != 0
+}
+
+// Start records packets matching filter to a new file until Stop
+func (capture *Capture) Start(filter Filter) (Status, error) {
+	if !capture.Enabled() {
+		return Status{}, errors.New("capture directory is not set")
+	}
+
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if capture.status.Running {
+		return capture.statusLocked(), fmt.Errorf("already capturing to %s", capture.status.Filename)
+	}
+
+	err := os.MkdirAll(capture.directory, 0755)
+	if err != nil {
+		return Status{}, err
+	}
+
+	started := time.Now()
+	filename := filepath.Join(capture.directory, captureName(started, filter))
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Status{}, err
+	}
+	buffered := bufio.NewWriter(file)
+	writer, err := NewWriter(buffered)
+	if err != nil {
+		file.Close()
+		return Status{}, err
+	}
+
+	capture.status = Status{Running: true, Filename: filename, Filter: filter, Started: started}
+	atomic.StoreUint64(&capture.packets, 0)
+	atomic.StoreUint64(&capture.dropped, 0)
+	capture.channel = make(chan Packet, queueSize)
+	capture.done = make(chan struct{})
+	go capture.write(file, buffered, writer, capture.channel, capture.done)
+	atomic.StoreInt32(&capture.running, 1)
+
+	capture.logger.Info("capture started", "filename", filename)
+	return capture.statusLocked(), nil
+}
+
+// Stop finishes the capture being recorded and closes its file
+func (capture *Capture) Stop() (Status, error) {
+	capture.mutex.Lock()
+	defer capture.mutex.Unlock()
+
+	if !capture.status.Running {
+		return capture.statusLocked(), errors.New("not capturing")
+	}
+
+	atomic.StoreInt32(&capture.running, 0)
+	close(capture.channel)
+	<-capture.done
+	capture.status.Running = false
+
+	status := capture.statusLocked()
+	capture.logger.Info("capture stopped", "filename", status.Filename, "packets", status.Packets, "dropped", status.Dropped)
+	return status, nil
+}
+
+func (capture *Capture) Status() Status {
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+	return capture.statusLocked()
+}
+
+func (capture *Capture) statusLocked() Status {
+	status := capture.status
+	status.Packets = atomic.LoadUint64(&capture.packets)
+	status.Dropped = atomic.LoadUint64(&capture.dropped)
+	return status
+}
+
+// Record queues packet to be written if it matches the capture's filter. It
+// never blocks; packets are dropped when the file falls behind. The buffer is
+// copied, so the caller may go on to rewrite it.
+func (capture *Capture) Record(packet Packet) {
+	if !capture.Running() {
+		return
+	}
+
+	capture.mutex.RLock()
+	defer capture.mutex.RUnlock()
+
+	if !capture.status.Running || !capture.status.Filter.Match(&packet) {
+		return
+	}
+	if packet.Time.IsZero() {
+		packet.Time = time.Now()
+	}
+	packet.Buffer = append([]byte(nil), packet.Buffer...)
+
+	select {
+	case capture.channel <- packet:
+	default:
+		atomic.AddUint64(&capture.dropped, 1)
+	}
+}
+
+func (capture *Capture) write(file *os.File, buffered *bufio.Writer, writer *Writer, channel chan Packet, done chan struct{}) {
+	defer close(done)
+
+	failed := false
+	for packet := range channel {
+		if failed {
+			atomic.AddUint64(&capture.dropped, 1)
+			continue
+		}
+		err := writer.WritePacket(packet)
+		if err == nil && len(channel) == 0 {
+			// keep the file readable while the capture runs
+			err = buffered.Flush()
+		}
+		if err != nil {
+			capture.logger.Error("capture write failed", "filename", file.Name(), "error", err)
+			failed = true
+			atomic.AddUint64(&capture.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&capture.packets, 1)
+	}
+
+	err := buffered.Flush()
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil && !failed {
+		capture.logger.Error("capture write failed", "filename", file.Name(), "error", err)
+	}
+}
+
+// captureName names a capture file after when it started and its filter
+func captureName(started time.Time, filter Filter) string {
+	name := "bolorama-" + started.Format("20060102-150405.000")
+	if filter.GameId != (bolo.GameId{}) {
+		name += "-game-" + hex.EncodeToString(filter.GameId[:])
+	}
+	if filter.ProxyPort != 0 {
+		name += fmt.Sprintf("-port-%d", filter.ProxyPort)
+	}
+	return name + ".pcapng"
+}
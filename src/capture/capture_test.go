@@ -0,0 +1,272 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/logging"
+)
+
+var testGameId = bolo.GameId{0xc0, 0xa8, 0x01, 0x0a, 0xdc, 0x89, 0x85, 0x00}
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks splits a pcapng file into its blocks, checking their lengths
+func readBlocks(t *testing.T, file []byte) []block {
+	var blocks []block
+	for len(file) > 0 {
+		if len(file) < 12 {
+			t.Fatalf("%d bytes left over", len(file))
+		}
+		length := binary.LittleEndian.Uint32(file[4:])
+		if length%4 != 0 || int(length) > len(file) || binary.LittleEndian.Uint32(file[length-4:]) != length {
+			t.Fatalf("block length %d is not valid", length)
+		}
+		blocks = append(blocks, block{binary.LittleEndian.Uint32(file), file[8 : length-4]})
+		file = file[length:]
+	}
+	return blocks
+}
+
+func testPacket(direction Direction, buffer []byte) Packet {
+	return Packet{
+		Time:          time.Unix(1634480000, 123456000),
+		Direction:     direction,
+		SrcAddr:       net.UDPAddr{IP: net.IPv4(203, 0, 113, 10), Port: 50000},
+		DstAddr:       net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40001},
+		GameId:        testGameId,
+		ProxyPort:     40002,
+		PeerProxyPort: 40001,
+		Buffer:        buffer,
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var file bytes.Buffer
+	writer, err := NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("Bolo\x99\x08\x06payload")
+	err = writer.WritePacket(testPacket(Outbound, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readBlocks(t, file.Bytes())
+	if len(blocks) != 3 || blocks[0].blockType != blockSectionHeader || blocks[1].blockType != blockInterface || blocks[2].blockType != blockEnhancedPacket {
+		t.Fatalf("got blocks %+v", blocks)
+	}
+	if binary.LittleEndian.Uint16(blocks[1].body) != linkTypeRaw {
+		t.Error("interface is not raw ip")
+	}
+
+	body := blocks[2].body
+	micros := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	if micros != 1634480000123456 {
+		t.Errorf("timestamp is %d", micros)
+	}
+	length := int(binary.LittleEndian.Uint32(body[12:]))
+	if length != 28+len(payload) {
+		t.Fatalf("captured length is %d", length)
+	}
+	datagram := body[20 : 20+length]
+	if ipChecksum(datagram[:20]) != 0 {
+		t.Error("ip header checksum is wrong")
+	}
+	if !net.IP(datagram[12:16]).Equal(net.IPv4(203, 0, 113, 10)) || !net.IP(datagram[16:20]).Equal(net.IPv4(198, 51, 100, 1)) {
+		t.Errorf("ip addresses are %v", datagram[12:20])
+	}
+	udp := datagram[20:]
+	if binary.BigEndian.Uint16(udp) != 50000 || binary.BigEndian.Uint16(udp[2:]) != 40001 || int(binary.BigEndian.Uint16(udp[4:])) != 8+len(payload) {
+		t.Errorf("udp header is %x", udp[:8])
+	}
+	if !bytes.Equal(udp[8:], payload) {
+		t.Errorf("payload is %q", udp[8:])
+	}
+
+	options := body[20+(length+3)&^3:]
+	if binary.LittleEndian.Uint16(options) != optionEnhancedFlags || binary.LittleEndian.Uint32(options[4:]) != enhancedFlagsOutbound {
+		t.Errorf("flags option is %x", options)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	capture := New(t.TempDir(), logging.Discard().Capture)
+	capture.Record(testPacket(Inbound, []byte("before")))
+
+	status, err := capture.Start(Filter{GameId: testGameId, ProxyPort: 40001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Running || !capture.Running() {
+		t.Fatal("capture is not running")
+	}
+	_, err = capture.Start(Filter{})
+	if err == nil {
+		t.Error("second capture started")
+	}
+
+	buffer := []byte("match")
+	capture.Record(testPacket(Inbound, buffer))
+	buffer[0] = 'M' // the buffer is copied, so the relay can rewrite it
+	otherGame := testPacket(Inbound, []byte("other game"))
+	otherGame.GameId[7] = 1
+	capture.Record(otherGame)
+	otherPort := testPacket(Inbound, []byte("other port"))
+	otherPort.PeerProxyPort = 40003
+	capture.Record(otherPort)
+
+	status, err = capture.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Running || status.Packets != 1 || status.Dropped != 0 {
+		t.Errorf("got status %+v", status)
+	}
+	capture.Record(testPacket(Inbound, []byte("after")))
+	_, err = capture.Stop()
+	if err == nil {
+		t.Error("stopped twice")
+	}
+
+	file, err := os.ReadFile(status.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := readBlocks(t, file)
+	if len(blocks) != 3 || !bytes.HasSuffix(blocks[2].body[:20+28+5], []byte("match")) {
+		t.Errorf("capture has %d blocks", len(blocks))
+	}
+}
+
+func TestCaptureDisabled(t *testing.T) {
+	capture := New("", logging.Discard().Capture)
+	if capture.Enabled() {
+		t.Error("capture without a directory is enabled")
+	}
+	_, err := capture.Start(Filter{})
+	if err == nil {
+		t.Error("capture without a directory started")
+	}
+}
+
+func TestReaderPcapng(t *testing.T) {
+	var file bytes.Buffer
+	writer, err := NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := []Packet{testPacket(Inbound, []byte("Bolo\x65\x99\x08\x0d")), testPacket(Outbound, []byte("odd"))}
+	for _, packet := range written {
+		err = writer.WritePacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !IsCapture(file.Bytes()) {
+		t.Error("pcapng file is not recognized")
+	}
+	reader, err := NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range written {
+		packet, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !packet.Time.Equal(want.Time) || packet.Direction != want.Direction ||
+			packet.SrcAddr.String() != want.SrcAddr.String() || packet.DstAddr.String() != want.DstAddr.String() ||
+			!bytes.Equal(packet.Buffer, want.Buffer) {
+			t.Errorf("read %+v, wrote %+v", packet, want)
+		}
+	}
+	_, err = reader.Next()
+	if err != io.EOF {
+		t.Errorf("got %v at end of file", err)
+	}
+}
+
+func TestReaderPcap(t *testing.T) {
+	// a big endian pcap of ethernet frames: a udp datagram, then an arp packet
+	// to skip
+	var file bytes.Buffer
+	order := binary.BigEndian
+	header := make([]byte, 24)
+	order.PutUint32(header, pcapMagic)
+	order.PutUint16(header[4:], 2)
+	order.PutUint16(header[6:], 4)
+	order.PutUint32(header[16:], 65535)
+	order.PutUint32(header[20:], linkTypeEthernet)
+	file.Write(header)
+
+	record := func(frame []byte) {
+		recordHeader := make([]byte, 16)
+		order.PutUint32(recordHeader, 1634480000)
+		order.PutUint32(recordHeader[4:], 500000)
+		order.PutUint32(recordHeader[8:], uint32(len(frame)))
+		order.PutUint32(recordHeader[12:], uint32(len(frame)))
+		file.Write(recordHeader)
+		file.Write(frame)
+	}
+
+	payload := []byte("Bolo\x65\x99\x08\x0d")
+	writer := &Writer{}
+	datagram := writer.marshalDatagram(testPacket(Inbound, payload))
+	ethernet := append(make([]byte, 12), 0x08, 0x00)
+	record(append(ethernet, datagram...))
+	record(append(append(make([]byte, 12), 0x08, 0x06), make([]byte, 28)...))
+
+	if !IsCapture(file.Bytes()) {
+		t.Error("pcap file is not recognized")
+	}
+	reader, err := NewReader(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !packet.Time.Equal(time.Unix(1634480000, 500000000)) || packet.SrcAddr.String() != "203.0.113.10:50000" || !bytes.Equal(packet.Buffer, payload) {
+		t.Errorf("read %+v", packet)
+	}
+	_, err = reader.Next()
+	if err != io.EOF {
+		t.Errorf("got %v instead of skipping the arp packet", err)
+	}
+
+	_, err = NewReader(strings.NewReader("# not a capture\n"))
+	if err == nil {
+		t.Error("text read as a capture")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// pcapng block types, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	blockSectionHeader     = 0x0a0d0d0a
+	blockInterface         = 0x00000001
+	blockEnhancedPacket    = 0x00000006
+	byteOrderMagic         = 0x1a2b3c4d
+	linkTypeRaw            = 101 // packets start with an ip header
+	optionEnd              = 0
+	optionEnhancedFlags    = 2
+	ipv4HeaderLength       = 20
+	udpHeaderLength        = 8
+	ipProtocolUdp          = 17
+	ipTimeToLive           = 64
+	enhancedFlagsInbound   = 1
+	enhancedFlagsOutbound  = 2
+	enhancedPacketOverhead = 32 + 12 // fixed fields, then the flags option and end of options
+)
+
+// Writer writes packets to a pcapng file as ipv4 udp datagrams, so that
+// wireshark and the bolo.lua dissector can read them
+type Writer struct {
+	w        io.Writer
+	ipHeader uint16 // identification field of the next ip header
+}
+
+// NewWriter writes the section header and the one interface packets are
+// captured on
+func NewWriter(w io.Writer) (*Writer, error) {
+	header := make([]byte, 28)
+	binary.LittleEndian.PutUint32(header[0:], blockSectionHeader)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(header)))
+	binary.LittleEndian.PutUint32(header[8:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(header[12:], 1) // major version
+	binary.LittleEndian.PutUint16(header[14:], 0) // minor version
+	binary.LittleEndian.PutUint64(header[16:], 0xffffffffffffffff)
+	binary.LittleEndian.PutUint32(header[24:], uint32(len(header)))
+
+	// timestamps are in the default resolution of microseconds
+	iface := make([]byte, 20)
+	binary.LittleEndian.PutUint32(iface[0:], blockInterface)
+	binary.LittleEndian.PutUint32(iface[4:], uint32(len(iface)))
+	binary.LittleEndian.PutUint16(iface[8:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(iface[12:], 0) // no snap length
+	binary.LittleEndian.PutUint32(iface[16:], uint32(len(iface)))
+
+	_, err := w.Write(append(header, iface...))
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes packet as an enhanced packet block
+func (writer *Writer) WritePacket(packet Packet) error {
+	datagram := writer.marshalDatagram(packet)
+	padded := (len(datagram) + 3) &^ 3
+	block := make([]byte, enhancedPacketOverhead+padded)
+
+	micros := uint64(packet.Time.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(block[0:], blockEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[8:], 0) // interface
+	binary.LittleEndian.PutUint32(block[12:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(micros))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(datagram)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(datagram)))
+	copy(block[28:], datagram)
+
+	pos := 28 + padded
+	flags := uint32(enhancedFlagsInbound)
+	if packet.Direction == Outbound {
+		flags = enhancedFlagsOutbound
+	}
+	binary.LittleEndian.PutUint16(block[pos:], optionEnhancedFlags)
+	binary.LittleEndian.PutUint16(block[pos+2:], 4)
+	binary.LittleEndian.PutUint32(block[pos+4:], flags)
+	binary.LittleEndian.PutUint16(block[pos+8:], optionEnd)
+	binary.LittleEndian.PutUint16(block[pos+10:], 0)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(block)))
+
+	_, err := writer.w.Write(block)
+	return err
+}
+
+// marshalDatagram puts ipv4 and udp headers in front of the packet's buffer.
+// The udp checksum is left zero, which ipv4 allows.
+func (writer *Writer) marshalDatagram(packet Packet) []byte {
+	length := ipv4HeaderLength + udpHeaderLength + len(packet.Buffer)
+	datagram := make([]byte, length)
+
+	writer.ipHeader++
+	datagram[0] = 0x45 // version 4, 5 words of header
+	binary.BigEndian.PutUint16(datagram[2:], uint16(length))
+	binary.BigEndian.PutUint16(datagram[4:], writer.ipHeader)
+	datagram[8] = ipTimeToLive
+	datagram[9] = ipProtocolUdp
+	copy(datagram[12:16], ipv4(packet.SrcAddr.IP))
+	copy(datagram[16:20], ipv4(packet.DstAddr.IP))
+	binary.BigEndian.PutUint16(datagram[10:], ipChecksum(datagram[:ipv4HeaderLength]))
+
+	udp := datagram[ipv4HeaderLength:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(packet.SrcAddr.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(packet.DstAddr.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHeaderLength+len(packet.Buffer)))
+	copy(udp[udpHeaderLength:], packet.Buffer)
+
+	return datagram
+}
+
+// ipv4 returns ip as 4 bytes, or 0.0.0.0 if it isn't an ipv4 address
+func ipv4(ip net.IP) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return net.IPv4zero.To4()
+	}
+	return ip4
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,388 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// pcap file magic numbers, for microsecond and nanosecond timestamps
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNanos = 0xa1b23c4d
+)
+
+// link types the reader can find ipv4 in
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLoop     = 108
+	linkTypeLinuxSll = 113
+	linkTypeIpv4     = 228
+	linkTypeSll2     = 276
+)
+
+const (
+	blockSimplePacket      = 0x00000003
+	optionInterfaceTsresol = 9
+	etherTypeIpv4          = 0x0800
+	etherTypeVlan          = 0x8100
+	maxBlockLength         = 16 * 1024 * 1024
+)
+
+// IsCapture reports whether the start of a file is a pcap or pcapng file
+func IsCapture(start []byte) bool {
+	if len(start) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		magic := order.Uint32(start)
+		if magic == pcapMagic || magic == pcapMagicNanos {
+			return true
+		}
+	}
+	return binary.LittleEndian.Uint32(start) == blockSectionHeader
+}
+
+// Reader reads the ipv4 udp datagrams of a pcap or pcapng file. Other
+// packets are skipped.
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	frame int
+	// the one link of a pcap file, or the interfaces of a pcapng section
+	interfaces []readerInterface
+}
+
+type readerInterface struct {
+	linkType int
+	// timestamps are counted in units of 1/unitsPerSecond seconds
+	unitsPerSecond uint64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+
+	start, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a pcap or pcapng file: %w", err)
+	}
+	if binary.LittleEndian.Uint32(start) == blockSectionHeader {
+		reader.ng = true
+		return reader, nil
+	}
+
+	header := make([]byte, 24)
+	_, err = io.ReadFull(reader.r, header)
+	if err != nil {
+		return nil, fmt.Errorf("pcap header: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		link := readerInterface{linkType: int(order.Uint32(header[20:]) & 0x0fffffff)}
+		switch order.Uint32(header) {
+		case pcapMagic:
+			link.unitsPerSecond = 1000000
+		case pcapMagicNanos:
+			link.unitsPerSecond = 1000000000
+		default:
+			continue
+		}
+		reader.order = order
+		reader.interfaces = []readerInterface{link}
+		return reader, nil
+	}
+	return nil, errors.New("not a pcap or pcapng file")
+}
+
+// Next returns the next udp datagram, or io.EOF at the end of the file.
+// Packets read from pcapng have the direction they were captured in, those
+// from pcap are Inbound.
+func (reader *Reader) Next() (Packet, error) {
+	for {
+		var packet Packet
+		var frame []byte
+		var linkType int
+		var err error
+		if reader.ng {
+			frame, linkType, err = reader.nextBlock(&packet)
+		} else {
+			frame, linkType, err = reader.nextRecord(&packet)
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		if frame == nil {
+			continue
+		}
+		reader.frame++
+		if decodeFrame(frame, linkType, &packet) {
+			return packet, nil
+		}
+	}
+}
+
+// Frame is the number of the packet Next last returned, counting from 1 and
+// including the packets it skipped, the way wireshark numbers frames
+func (reader *Reader) Frame() int {
+	return reader.frame
+}
+
+func (reader *Reader) nextRecord(packet *Packet) ([]byte, int, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader.r, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("truncated pcap record header")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	length := reader.order.Uint32(header[8:])
+	if length > maxBlockLength {
+		return nil, 0, fmt.Errorf("pcap record length %d is too long", length)
+	}
+	frame := make([]byte, length)
+	_, err = io.ReadFull(reader.r, frame)
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated pcap record: %w", err)
+	}
+
+	link := reader.interfaces[0]
+	seconds := uint64(reader.order.Uint32(header[0:]))
+	units := uint64(reader.order.Uint32(header[4:]))
+	packet.Time = time.Unix(int64(seconds), int64(units*1000000000/link.unitsPerSecond))
+	packet.Direction = Inbound
+	return frame, link.linkType, nil
+}
+
+// nextBlock reads one pcapng block, returning the frame of a packet block or
+// nil for other blocks
+func (reader *Reader) nextBlock(packet *Packet) ([]byte, int, error) {
+	header := make([]byte, 12)
+	_, err := io.ReadFull(reader.r, header[:8])
+	if err == io.ErrUnexpectedEOF {
+		return nil, 0, fmt.Errorf("truncated pcapng block header")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blockType := binary.LittleEndian.Uint32(header)
+	if blockType == blockSectionHeader {
+		// the byte order magic decides the order of the length before it
+		_, err = io.ReadFull(reader.r, header[8:12])
+		if err != nil {
+			return nil, 0, fmt.Errorf("truncated pcapng section header: %w", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(header[8:]) == byteOrderMagic:
+			reader.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(header[8:]) == byteOrderMagic:
+			reader.order = binary.BigEndian
+		default:
+			return nil, 0, errors.New("pcapng section header has no byte order magic")
+		}
+		reader.interfaces = nil
+	} else if reader.order == nil {
+		return nil, 0, errors.New("pcapng file doesn't start with a section header")
+	}
+
+	blockType = reader.order.Uint32(header)
+	length := reader.order.Uint32(header[4:])
+	read := uint32(8)
+	if blockType == blockSectionHeader {
+		read = 12
+	}
+	if length < read+4 || length%4 != 0 || length > maxBlockLength {
+		return nil, 0, fmt.Errorf("pcapng block length %d is not valid", length)
+	}
+	body := make([]byte, length-read)
+	_, err = io.ReadFull(reader.r, body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated pcapng block: %w", err)
+	}
+	body = body[:len(body)-4]
+
+	switch blockType {
+	case blockInterface:
+		if len(body) < 8 {
+			return nil, 0, errors.New("pcapng interface block is too short")
+		}
+		iface := readerInterface{linkType: int(reader.order.Uint16(body)), unitsPerSecond: 1000000}
+		reader.forEachOption(body[8:], func(code uint16, value []byte) {
+			if code == optionInterfaceTsresol && len(value) == 1 {
+				iface.unitsPerSecond = tsresol(value[0])
+			}
+		})
+		reader.interfaces = append(reader.interfaces, iface)
+	case blockEnhancedPacket:
+		if len(body) < 20 {
+			return nil, 0, errors.New("pcapng packet block is too short")
+		}
+		iface, err := reader.iface(reader.order.Uint32(body))
+		if err != nil {
+			return nil, 0, err
+		}
+		captured := reader.order.Uint32(body[12:])
+		if uint64(captured) > uint64(len(body)-20) {
+			return nil, 0, errors.New("pcapng packet block is shorter than its packet")
+		}
+		units := uint64(reader.order.Uint32(body[4:]))<<32 | uint64(reader.order.Uint32(body[8:]))
+		packet.Time = unitsTime(units, iface.unitsPerSecond)
+		packet.Direction = Inbound
+		padded := (captured + 3) &^ 3
+		if uint64(padded) <= uint64(len(body)-20) {
+			reader.forEachOption(body[20+padded:], func(code uint16, value []byte) {
+				if code == optionEnhancedFlags && len(value) == 4 && reader.order.Uint32(value)&3 == enhancedFlagsOutbound {
+					packet.Direction = Outbound
+				}
+			})
+		}
+		return body[20 : 20+captured], iface.linkType, nil
+	case blockSimplePacket:
+		if len(body) < 4 {
+			return nil, 0, errors.New("pcapng simple packet block is too short")
+		}
+		iface, err := reader.iface(0)
+		if err != nil {
+			return nil, 0, err
+		}
+		original := reader.order.Uint32(body)
+		frame := body[4:]
+		if uint64(original) < uint64(len(frame)) {
+			frame = frame[:original]
+		}
+		packet.Direction = Inbound
+		return frame, iface.linkType, nil
+	}
+	return nil, 0, nil
+}
+
+func (reader *Reader) iface(id uint32) (readerInterface, error) {
+	if uint64(id) >= uint64(len(reader.interfaces)) {
+		return readerInterface{}, fmt.Errorf("pcapng packet is on unknown interface %d", id)
+	}
+	return reader.interfaces[id], nil
+}
+
+func (reader *Reader) forEachOption(options []byte, f func(code uint16, value []byte)) {
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options)
+		length := int(reader.order.Uint16(options[2:]))
+		if code == optionEnd || 4+length > len(options) {
+			return
+		}
+		f(code, options[4:4+length])
+		options = options[4+(length+3)&^3:]
+	}
+}
+
+// tsresol is the number of timestamp units per second of an if_tsresol option
+func tsresol(value byte) uint64 {
+	exponent := float64(value & 0x7f)
+	if value&0x80 != 0 {
+		return uint64(math.Pow(2, exponent))
+	}
+	return uint64(math.Pow(10, exponent))
+}
+
+func unitsTime(units uint64, unitsPerSecond uint64) time.Time {
+	if unitsPerSecond == 0 {
+		return time.Time{}
+	}
+	seconds := units / unitsPerSecond
+	fraction := units % unitsPerSecond
+	nanos := uint64(float64(fraction) * 1e9 / float64(unitsPerSecond))
+	return time.Unix(int64(seconds), int64(nanos))
+}
+
+// decodeFrame finds the udp datagram in a captured frame
+func decodeFrame(frame []byte, linkType int, packet *Packet) bool {
+	switch linkType {
+	case linkTypeNull, linkTypeLoop:
+		// the address family, in either byte order
+		if len(frame) < 4 || (binary.LittleEndian.Uint32(frame) != 2 && binary.BigEndian.Uint32(frame) != 2) {
+			return false
+		}
+		frame = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		if etherType == etherTypeVlan && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+		if etherType != etherTypeIpv4 {
+			return false
+		}
+	case linkTypeLinuxSll:
+		if len(frame) < 16 || binary.BigEndian.Uint16(frame[14:]) != etherTypeIpv4 {
+			return false
+		}
+		frame = frame[16:]
+	case linkTypeSll2:
+		if len(frame) < 20 || binary.BigEndian.Uint16(frame) != etherTypeIpv4 {
+			return false
+		}
+		frame = frame[20:]
+	case linkTypeRaw, linkTypeIpv4:
+	default:
+		return false
+	}
+	return decodeIpv4(frame, packet)
+}
+
+func decodeIpv4(datagram []byte, packet *Packet) bool {
+	if len(datagram) < ipv4HeaderLength || datagram[0]>>4 != 4 || datagram[9] != ipProtocolUdp {
+		return false
+	}
+	headerLength := int(datagram[0]&0x0f) * 4
+	length := int(binary.BigEndian.Uint16(datagram[2:]))
+	if headerLength < ipv4HeaderLength || length < headerLength || length > len(datagram) {
+		return false
+	}
+	// fragments other than a whole datagram can't be decoded on their own
+	if binary.BigEndian.Uint16(datagram[6:])&0x3fff != 0 {
+		return false
+	}
+
+	udp := datagram[headerLength:length]
+	if len(udp) < udpHeaderLength {
+		return false
+	}
+	udpLength := int(binary.BigEndian.Uint16(udp[4:]))
+	if udpLength < udpHeaderLength || udpLength > len(udp) {
+		return false
+	}
+
+	packet.SrcAddr = net.UDPAddr{IP: net.IP(append([]byte(nil), datagram[12:16]...)), Port: int(binary.BigEndian.Uint16(udp[0:]))}
+	packet.DstAddr = net.UDPAddr{IP: net.IP(append([]byte(nil), datagram[16:20]...)), Port: int(binary.BigEndian.Uint16(udp[2:]))}
+	packet.Buffer = udp[udpHeaderLength:udpLength]
+	return true
+}
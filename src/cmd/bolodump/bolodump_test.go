@@ -0,0 +1,149 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/capture"
+)
+
+// testPacket reads a packet from the bolo package's corpus
+func testPacket(t *testing.T, name string) []byte {
+	file, err := os.ReadFile(filepath.Join("..", "..", "bolo", "testdata", "packets", name+".hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := readHexPackets(bytes.NewReader(file))
+	if err != nil || len(packets) != 1 {
+		t.Fatalf("%s: read %d packets, %v", name, len(packets), err)
+	}
+	return packets[0]
+}
+
+func TestReadHexPackets(t *testing.T) {
+	message := testPacket(t, "type02_send_message")
+	probe := testPacket(t, "type06")
+
+	var text strings.Builder
+	text.WriteString("# two packets as hex.Dump prints them\n")
+	text.WriteString(hex.Dump(message))
+	text.WriteString(hex.Dump(probe))
+	text.WriteString("# a logged malformed packet, in both log formats\n")
+	var logs bytes.Buffer
+	slog.New(slog.NewTextHandler(&logs, nil)).Warn("malformed packet", "dump", hex.Dump(message))
+	record, _ := json.Marshal(map[string]string{"msg": "malformed packet", "dump": hex.Dump(probe)})
+	text.WriteString(logs.String())
+	text.Write(append(record, '\n'))
+	text.WriteString("\n426f6c6f6599080d\n")
+
+	packets, err := readHexPackets(strings.NewReader(text.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{message, probe, message, probe, []byte("Bolo\x65\x99\x08\x0d")}
+	if len(packets) != len(want) {
+		t.Fatalf("read %d packets, expected %d", len(packets), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(packets[i], want[i]) {
+			t.Errorf("packet %d is %x, expected %x", i, packets[i], want[i])
+		}
+	}
+
+	_, err = readHexPackets(strings.NewReader("42 6f 6c zz\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Errorf("bad hex got %v", err)
+	}
+}
+
+func TestDumpHex(t *testing.T) {
+	var output bytes.Buffer
+	err := dump(&output, strings.NewReader(hex.Dump(testPacket(t, "type02_send_message"))), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"Packet 1: 35 bytes",
+		"Bolo Protocol, Version: 65.99.8, Packet Type: Game State (0x02)",
+		"Bolo Game State, Sequence: 0x11",
+		"    Block: 24 bytes, Sequence: 0x09, Sender: 0x01",
+		"        Unknown: 01 02 03 04 05",
+		"        Opcode: 0xfa (Send Message), Message: hello there",
+		"            Message: hello there",
+		"        Checksum: 0x3f49 [valid]",
+	}
+	for _, line := range want {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("output is missing %q:\n%s", line, output.String())
+		}
+	}
+}
+
+func TestDumpCapture(t *testing.T) {
+	var file bytes.Buffer
+	writer, err := capture.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := capture.Packet{
+		Time:    time.Date(2021, 10, 17, 12, 0, 0, 0, time.UTC),
+		SrcAddr: net.UDPAddr{IP: net.IPv4(203, 0, 113, 10), Port: 50000},
+		DstAddr: net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 50000},
+	}
+	packet.Buffer = testPacket(t, "type0e")
+	writer.WritePacket(packet)
+	packet.Buffer = []byte("not bolo")
+	writer.WritePacket(packet)
+
+	var output bytes.Buffer
+	err = dump(&output, bytes.NewReader(file.Bytes()), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Frame 1: 2021-10-17 12:00:00.000000 203.0.113.10:50000 -> 198.51.100.1:50000, 71 bytes",
+		"Bolo Game Info, Map: Everard Island, Host: 192.168.1.10",
+		"    Game Type: Tournament (0x02)",
+		"    Start Delay: 11 Seconds",
+	}
+	for _, line := range want {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("output is missing %q:\n%s", line, output.String())
+		}
+	}
+	if strings.Contains(output.String(), "Frame 2") {
+		t.Error("datagram that isn't bolo was listed")
+	}
+
+	output.Reset()
+	dump(&output, bytes.NewReader(file.Bytes()), options{all: true})
+	if !strings.Contains(output.String(), "Frame 2") {
+		t.Error("datagram that isn't bolo wasn't listed with -a")
+	}
+}
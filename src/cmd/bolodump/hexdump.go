@@ -0,0 +1,144 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dumpOffset matches the offset column of a hex.Dump line
+var dumpOffset = regexp.MustCompile(`^([0-9a-f]{8})  `)
+
+// hexReader collects packets from hex text. Packets are separated by blank
+// lines, comment lines starting with '#', and hex.Dump lines starting again
+// at offset 0.
+type hexReader struct {
+	packets [][]byte
+	packet  []byte
+}
+
+// readHexPackets reads packets written as hex bytes: files like those in
+// bolo/testdata/packets, the output of hex.Dump, or relay log lines carrying
+// the dump of a malformed packet
+func readHexPackets(r io.Reader) ([][]byte, error) {
+	reader := &hexReader{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		err := reader.line(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	reader.flush()
+	return reader.packets, nil
+}
+
+func (reader *hexReader) flush() {
+	if len(reader.packet) > 0 {
+		reader.packets = append(reader.packets, reader.packet)
+	}
+	reader.packet = nil
+}
+
+func (reader *hexReader) line(line string) error {
+	line = strings.TrimSpace(line)
+
+	dump, ok, err := logDump(line)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// a logged dump is one whole packet
+		reader.flush()
+		for _, dumpLine := range strings.Split(dump, "\n") {
+			err = reader.line(dumpLine)
+			if err != nil {
+				return err
+			}
+		}
+		reader.flush()
+		return nil
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		reader.flush()
+		return nil
+	}
+
+	if match := dumpOffset.FindStringSubmatch(line); match != nil {
+		if match[1] == "00000000" {
+			reader.flush()
+		}
+		line = line[len(match[0]):]
+		if end := strings.Index(line, "  |"); end >= 0 {
+			line = line[:end]
+		}
+	}
+
+	buffer, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+	if err != nil {
+		return fmt.Errorf("not hex bytes: %s", err)
+	}
+	reader.packet = append(reader.packet, buffer...)
+	return nil
+}
+
+// logDump returns the dump field of a relay log line, in either log format
+func logDump(line string) (string, bool, error) {
+	if strings.HasPrefix(line, "{") {
+		var record struct {
+			Dump *string `json:"dump"`
+		}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil || record.Dump == nil {
+			return "", false, nil
+		}
+		return *record.Dump, true, nil
+	}
+
+	start := strings.Index(line, " dump=")
+	if start < 0 {
+		return "", false, nil
+	}
+	value := line[start+len(" dump="):]
+	if !strings.HasPrefix(value, `"`) {
+		return "", false, nil
+	}
+	quoted, err := strconv.QuotedPrefix(value)
+	if err != nil {
+		return "", false, fmt.Errorf("dump field: %s", err)
+	}
+	dump, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", false, fmt.Errorf("dump field: %s", err)
+	}
+	return dump, true, nil
+}
@@ -0,0 +1,151 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Command bolodump prints the Bolo packets in pcap and pcapng files, or in
+// hex dumps, field by field the way the wireshark dissector does
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"git.astrospark.com/bolorama/capture"
+)
+
+// options are the command line flags
+type options struct {
+	hexDump bool
+	all     bool
+}
+
+func main() {
+	var opts options
+	flag.BoolVar(&opts.hexDump, "x", false, "print each packet's bytes after its fields")
+	flag.BoolVar(&opts.all, "a", false, "also list udp datagrams that aren't bolo packets")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: bolodump [-x] [-a] [file ...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "Reads pcap, pcapng or hex dump files, or standard input.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+
+	failed := false
+	for _, name := range names {
+		if len(names) > 1 {
+			fmt.Fprintf(output, "==> %s <==\n\n", name)
+		}
+		err := dumpFile(output, name, opts)
+		if err != nil {
+			output.Flush()
+			fmt.Fprintf(os.Stderr, "bolodump: %s: %s\n", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		output.Flush()
+		os.Exit(1)
+	}
+}
+
+func dumpFile(w io.Writer, name string, opts options) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	return dump(w, r, opts)
+}
+
+// dump prints the packets of a capture file, or of hex text if r doesn't
+// start like a capture
+func dump(w io.Writer, r io.Reader, opts options) error {
+	buffered := bufio.NewReader(r)
+	start, _ := buffered.Peek(4)
+	if capture.IsCapture(start) {
+		return dumpCapture(w, buffered, opts)
+	}
+
+	packets, err := readHexPackets(buffered)
+	if err != nil {
+		return err
+	}
+	for i, buffer := range packets {
+		fmt.Fprintf(w, "Packet %d: %d bytes\n", i+1, len(buffer))
+		dumpPacket(w, buffer, opts)
+	}
+	return nil
+}
+
+func dumpCapture(w io.Writer, r io.Reader, opts options) error {
+	reader, err := capture.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		bolo := len(packet.Buffer) >= 4 && string(packet.Buffer[0:4]) == "Bolo"
+		if !bolo && !opts.all {
+			continue
+		}
+		fmt.Fprintf(w, "Frame %d: %s %s -> %s, %d bytes\n",
+			reader.Frame(),
+			packet.Time.UTC().Format("2006-01-02 15:04:05.000000"),
+			&packet.SrcAddr,
+			&packet.DstAddr,
+			len(packet.Buffer),
+		)
+		if bolo {
+			dumpPacket(w, packet.Buffer, opts)
+		} else {
+			fmt.Fprintln(w, "Not a Bolo packet")
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func dumpPacket(w io.Writer, buffer []byte, opts options) {
+	printPacket(&printer{w: w}, buffer)
+	if opts.hexDump {
+		fmt.Fprint(w, strings.TrimSuffix(hex.Dump(buffer), "\n")+"\n")
+	}
+	fmt.Fprintln(w)
+}
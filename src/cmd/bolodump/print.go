@@ -0,0 +1,310 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+// printer writes a packet as an indented tree, with the same fields and names
+// as wireshark/bolo.lua
+type printer struct {
+	w     io.Writer
+	depth int
+}
+
+func (p *printer) line(format string, args ...interface{}) {
+	fmt.Fprintf(p.w, "%s%s\n", strings.Repeat("    ", p.depth), fmt.Sprintf(format, args...))
+}
+
+// tree writes a line with the lines written by children indented under it
+func (p *printer) tree(children func(), format string, args ...interface{}) {
+	p.line(format, args...)
+	p.depth++
+	children()
+	p.depth--
+}
+
+func (p *printer) unknown(buffer []byte) {
+	if len(buffer) > 0 {
+		p.line("Unknown: %s", spacedHex(buffer))
+	}
+}
+
+func spacedHex(buffer []byte) string {
+	var sb strings.Builder
+	for i, b := range buffer {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x", b)
+	}
+	return sb.String()
+}
+
+// pascalString shows an empty string the way the dissector does
+func pascalString(s string) string {
+	if s == "" {
+		return "[empty]"
+	}
+	return s
+}
+
+func trueFalse(b bool) string {
+	if b {
+		return "True"
+	}
+	return "False"
+}
+
+func startTime(timestamp uint32) string {
+	return bolo.ParseBoloTimestamp(timestamp).UTC().Format(time.ANSIC) + " UTC"
+}
+
+// startDelay and timeLimit convert ticks of 1/50 second like the dissector
+func startDelay(ticks uint32) uint32 {
+	if ticks == 0 {
+		return 0
+	}
+	return ticks/50 + 1
+}
+
+func timeLimit(ticks uint32) uint32 {
+	if ticks == 0 {
+		return 0
+	}
+	return ticks/50/60 + 1
+}
+
+// playerIds lists player ids like (1, 3)
+func playerIds(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return "(" + strings.Join(s, ", ") + ")"
+}
+
+func plural(n uint32, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+func printPacket(p *printer, buffer []byte) {
+	packet, err := bolo.DecodePacket(buffer)
+	if err != nil {
+		p.line("Malformed Bolo Packet: %s", err)
+		return
+	}
+
+	typeName := bolo.PacketTypeName(packet.Type)
+	p.tree(func() {
+		p.line("Signature: %s", buffer[0:4])
+		p.line("Version: %s", packet.VersionString())
+		p.line("Packet Type: 0x%02x (%s)", packet.Type, typeName)
+	}, "Bolo Protocol, Version: %s, Packet Type: %s (0x%02x)", packet.VersionString(), typeName, packet.Type)
+
+	switch packet.Type {
+	case bolo.PacketType0, bolo.PacketType1:
+		printAddrPacket(p, packet, "Sender")
+	case bolo.PacketTypeGameState:
+		printGameState(p, *packet.GameState)
+	case bolo.PacketType3:
+		printSequencePacket(p, packet, "Bolo Packet Type 0x03")
+	case bolo.PacketTypeGameStateAck:
+		printSequencePacket(p, packet, "Bolo Game State Acknowledge")
+	case bolo.PacketType6, bolo.PacketType7, bolo.PacketType9:
+		printAddrPacket(p, packet, "Peer")
+	case bolo.PacketType8:
+		title := "Bolo Password"
+		if packet.Password != nil {
+			title = title + ", Password: " + pascalString(*packet.Password)
+		}
+		p.tree(func() {
+			if packet.Password != nil {
+				p.line("Password: %s", pascalString(*packet.Password))
+			}
+			p.unknown(packet.Trailer)
+		}, "%s", title)
+	case bolo.PacketTypeGameInfoRequest:
+		p.tree(func() { p.unknown(packet.Trailer) }, "Bolo Game Info Request")
+	case bolo.PacketTypeGameInfo:
+		printGameInfo(p, packet)
+	default:
+		p.tree(func() { p.unknown(packet.Trailer) }, "Bolo Packet Type 0x%02x", packet.Type)
+	}
+}
+
+func printAddrPacket(p *printer, packet bolo.Packet, role string) {
+	title := fmt.Sprintf("Bolo Packet Type 0x%02x", packet.Type)
+	if packet.Addr != nil {
+		title = fmt.Sprintf("%s, %s: %s", title, role, packet.Addr)
+	}
+	p.tree(func() {
+		p.unknown(packet.Unknown)
+		if packet.Addr != nil {
+			p.line("%s Address: %s", role, packet.Addr)
+		}
+		p.unknown(packet.Trailer)
+	}, "%s", title)
+}
+
+func printSequencePacket(p *printer, packet bolo.Packet, title string) {
+	p.tree(func() {
+		p.line("Sequence: 0x%02x", packet.Sequence)
+		p.unknown(packet.Trailer)
+	}, "%s, Sequence: 0x%02x", title, packet.Sequence)
+}
+
+func printGameInfo(p *printer, packet bolo.Packet) {
+	gameInfo := packet.GameInfo
+	if gameInfo == nil {
+		p.tree(func() { p.unknown(packet.Trailer) }, "Bolo Game Info")
+		return
+	}
+
+	host := net.IP(gameInfo.GameId[0:4])
+	p.tree(func() {
+		p.line("Map Name: %s", pascalString(gameInfo.MapName))
+		p.line("Host Address: %s", host)
+		p.line("Start Time: %s", startTime(gameInfo.StartTimestamp))
+		p.line("Game Type: %s (0x%02x)", tracker.GameTypeName(gameInfo.GameType), gameInfo.GameType)
+		p.line("Mines Visible: %s", trueFalse(!gameInfo.AllowHiddenMines))
+		p.line("Allow Computer: %s", trueFalse(gameInfo.AllowComputer))
+		p.line("Computer Advantage: %s", trueFalse(gameInfo.ComputerAdvantage))
+		p.line("Start Delay: %s", plural(startDelay(gameInfo.StartDelay), "Second"))
+		p.line("Time Limit: %s", plural(timeLimit(gameInfo.TimeLimit), "Minute"))
+		p.line("Number of Players: %d", gameInfo.PlayerCount)
+		p.line("Free Pills: %d", gameInfo.NeutralPillboxCount)
+		p.line("Free Bases: %d", gameInfo.NeutralBaseCount)
+		p.line("Has Password: %s", trueFalse(gameInfo.HasPassword))
+		p.unknown(packet.Trailer)
+	}, "Bolo Game Info, Map: %s, Host: %s", pascalString(gameInfo.MapName), host)
+}
+
+func printGameState(p *printer, packet bolo.GameStatePacket) {
+	p.tree(func() {
+		p.line("Sequence: 0x%02x", packet.Sequence)
+		for _, block := range packet.Blocks {
+			printBlock(p, block)
+		}
+		p.unknown(packet.Trailer)
+	}, "Bolo Game State, Sequence: 0x%02x", packet.Sequence)
+}
+
+func printBlock(p *printer, block bolo.GameStateBlock) {
+	lengthFlag := 0
+	if block.LengthFlag {
+		lengthFlag = 1
+	}
+	checksum := "valid"
+	if !block.CrcValid {
+		checksum = "invalid"
+	}
+
+	p.tree(func() {
+		p.line("Length Flag: %d", lengthFlag)
+		p.line("Sequence: 0x%02x", block.Sequence)
+		p.line("Sender Flags: 0x%02x", block.SenderFlags)
+		p.line("Sender: 0x%02x", block.Sender)
+		p.line("Block Flags: 0x%02x", block.Flags)
+		p.unknown(block.ExtendedHeader)
+		for _, op := range block.Opcodes {
+			printOpcode(p, op)
+		}
+		p.line("Checksum: 0x%04x [%s]", block.Checksum, checksum)
+	}, "Block: %d bytes, Sequence: 0x%02x, Sender: 0x%02x", block.Length, block.Sequence, block.Sender)
+}
+
+// opcodeByte is the opcode as it is written in the block, 0xfff0 for the two
+// byte opcodes
+func opcodeByte(raw bolo.RawOpcode) string {
+	if raw.Bytes[0] == 0xff && len(raw.Bytes) > 1 {
+		return fmt.Sprintf("0xff%02x", raw.Bytes[1])
+	}
+	return fmt.Sprintf("0x%02x", raw.Bytes[0])
+}
+
+func printOpcode(p *printer, op bolo.Opcode) {
+	raw := op.Raw()
+	title := fmt.Sprintf("Opcode: %s (%s)", opcodeByte(raw), bolo.OpcodeName(raw.Code))
+
+	switch op := op.(type) {
+	case bolo.GameInfoOp:
+		p.tree(func() {
+			p.line("Subcode: 0x%02x", bolo.OpcodeGameInfoSubcodeGame)
+			p.line("Map Name: %s", pascalString(op.MapName))
+			p.line("Host Address: %s", op.HostIpAddr)
+			p.line("Start Time: %s", startTime(op.StartTimestamp))
+			p.line("Game Type: %s (0x%02x)", tracker.GameTypeName(op.GameType), op.GameType)
+			p.line("Mines Visible: %s", trueFalse(!op.AllowHiddenMines))
+			p.line("Allow Computer: %s", trueFalse(op.AllowComputer))
+			p.line("Computer Advantage: %s", trueFalse(op.ComputerAdvantage))
+			p.line("Start Delay: %s", plural(startDelay(op.StartDelay), "Second"))
+			p.line("Time Limit: %s", plural(timeLimit(op.TimeLimit), "Minute"))
+			p.unknown(op.Bytes[58:])
+		}, "%s, Map: %s, Host: %s", title, pascalString(op.MapName), op.HostIpAddr)
+	case bolo.GameInfoListOp:
+		kind := map[int]string{
+			bolo.OpcodeGameInfoSubcodePillbox: "Pillbox",
+			bolo.OpcodeGameInfoSubcodeBase:    "Base",
+			bolo.OpcodeGameInfoSubcodeStart:   "Start",
+		}[op.Subcode]
+		p.tree(func() {
+			p.line("Subcode: 0x%02x", op.Subcode)
+			p.line("Map %s Count: %d", kind, len(op.Records))
+			for _, record := range op.Records {
+				p.line("Map %s Data: %s", kind, spacedHex(record))
+			}
+		}, "%s, Map %s Count: %d", title, kind, len(op.Records))
+	case bolo.MapDataOp:
+		p.tree(func() {
+			p.unknown(op.Bytes[1:4])
+			p.line("Map Data: %s", spacedHex(op.Data))
+		}, "%s", title)
+	case bolo.PlayerNameOp:
+		p.tree(func() {
+			p.line("Player Name: %s", pascalString(op.Name))
+		}, "%s, Player Name: %s", title, pascalString(op.Name))
+	case bolo.SendMessageOp:
+		p.tree(func() {
+			p.line("Recipients: 0x%04x %s", op.Recipients, playerIds(op.RecipientIds()))
+			p.line("Message: %s", pascalString(op.Message))
+		}, "%s, Message: %s", title, pascalString(op.Message))
+	case bolo.DisconnectOp:
+		p.tree(func() {
+			p.line("Address Length: %d Bytes", op.Bytes[2])
+			p.line("Upstream Address: %s", &op.Upstream)
+			p.line("Sender Address: %s", &op.Sender)
+			p.line("Downstream Address: %s", &op.Downstream)
+		}, "%s, Upstream: %s, Sender: %s, Downstream: %s", title, &op.Upstream, &op.Sender, &op.Downstream)
+	default:
+		p.tree(func() {
+			p.unknown(raw.Bytes[1:])
+		}, "%s, Length: %d", title, len(raw.Bytes))
+	}
+}
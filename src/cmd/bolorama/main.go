@@ -18,9 +18,11 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
@@ -28,35 +30,46 @@ import (
 	"syscall"
 	"time"
 
-	"git.astrospark.com/bolorama/bolo"
 	"git.astrospark.com/bolorama/config"
 	"git.astrospark.com/bolorama/data"
-	"git.astrospark.com/bolorama/proxy"
-	"git.astrospark.com/bolorama/state"
-	"git.astrospark.com/bolorama/stats"
-	"git.astrospark.com/bolorama/tracker"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/server"
+	"git.astrospark.com/bolorama/upgrade"
 	"git.astrospark.com/bolorama/util"
+	"git.astrospark.com/bolorama/webhook"
 )
 
-func initSignalHandler(shutdownChannel chan struct{}) {
-	signalChannel := make(chan os.Signal)
+// upgradeTimeout is how long the upgraded process has to start relaying
+// before it is killed and this one carries on
+const upgradeTimeout = 30 * time.Second
+
+// takeBackRetry is how long to wait before trying again to take back over
+// from a failed upgrade
+const takeBackRetry = time.Second
+
+// initSignalHandler closes shutdownChannel on the first signal, and
+// hurryChannel on the second, to skip warning the players
+func initSignalHandler(shutdownChannel chan struct{}, hurryChannel chan struct{}) {
+	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
 		<-signalChannel
 		close(shutdownChannel)
+		<-signalChannel
+		close(hurryChannel)
 	}()
 }
 
-func listenNetShutdown(shutdownChannel chan struct{}) {
+func listenNetShutdown(logger *slog.Logger, shutdownChannel chan struct{}) {
 	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", 49999))
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("can't listen for shutdown", "error", err)
 		return
 	}
 
 	connection, err := net.ListenUDP("udp4", listenAddr)
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("can't listen for shutdown", "error", err)
 		return
 	}
 
@@ -65,235 +78,198 @@ func listenNetShutdown(shutdownChannel chan struct{}) {
 	_, _, err = connection.ReadFromUDP(buffer)
 	if err != nil {
 		if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-			fmt.Println(err)
+			logger.Warn("receive failed", "port", 49999, "error", err)
 		}
-		fmt.Println("Stopped listening on UDP port", 49999)
+		logger.Info("stopped listening on udp", "port", 49999)
 	}
 
 	connection.Close()
 	close(shutdownChannel)
 }
 
-func main() {
-	proxyHostname := config.GetValueString("hostname")
-	trackerPort := config.GetValueInt("tracker_port")
-
-	context := state.InitContext(trackerPort)
-	playerInfoEventChannel := make(chan util.PlayerInfoEvent)
-	playerLeaveGameChannel := make(chan util.PlayerAddr)
-	startPlayerPingChannel := make(chan state.Player)
-	beginShutdownChannel := make(chan struct{})
-	mainShutdownChannel := make(chan struct{})
-
-	fmt.Println("Hostname:", proxyHostname)
-	fmt.Println("IP Address:", context.ProxyIpAddr)
-
-	defer func() {
-		fmt.Println("Shutdown completed")
-	}()
-
-	initSignalHandler(beginShutdownChannel)
-	//go listenNetShutdown(beginShutdownChannel)
-
-	var db *sql.DB = nil
+// fatal logs err and exits
+func fatal(logger *slog.Logger, message string, err error) {
+	logger.Error(message, "error", err)
+	os.Exit(1)
+}
 
-	if config.GetValueBool("enable_statistics") {
-		db = data.Init()
+func getWebhookConfig(logger *slog.Logger) webhook.Config {
+	template := ""
+	templateFilename := config.GetValueString("webhook_template_file")
+	if templateFilename != "" {
+		b, err := os.ReadFile(templateFilename)
+		if err != nil {
+			fatal(logger, "failed to read webhook template", err)
+		}
+		template = string(b)
 	}
 
-	context.WaitGroup.Add(1)
-	go stats.Logger(context, db)
+	return webhook.Config{
+		URL:         config.GetValueString("webhook_url"),
+		Template:    template,
+		PlayerCount: config.GetValueInt("webhook_player_count"),
+		Attempts:    config.GetValueInt("webhook_attempts"),
+		RetryDelay:  time.Duration(config.GetValueInt("webhook_retry_seconds")) * time.Second,
+	}
+}
 
-	context.WaitGroup.Add(1)
-	go tracker.Tracker(context, startPlayerPingChannel)
+// upgradeRelay hands relay over to a new process of the executable this one
+// was started from, so that replacing the file and signalling upgrades it. It
+// returns nil once the new process is relaying, or the server relaying in
+// this process if it isn't.
+func upgradeRelay(logger *slog.Logger, relay *server.Server, serverConfig server.Config) *server.Server {
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("can't upgrade", "error", err)
+		return relay
+	}
 
-	go func() {
-		<-beginShutdownChannel
-		fmt.Println("Shutting down")
-		close(context.ShutdownChannel)
-		context.WaitGroup.Wait()
-		close(mainShutdownChannel)
-	}()
+	logger.Info("upgrading", "executable", executable)
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	pid, handoff, err := upgrade.Start(ctx, executable, os.Args[1:], relay)
+	if err == nil {
+		logger.Info("handed over to the upgraded process", "pid", pid)
+		return nil
+	}
+	if handoff == nil {
+		logger.Error("upgrade failed, carrying on", "error", err)
+		return relay
+	}
+	defer handoff.Close()
 
-loop:
+	// relay has stopped, so carry on from the sockets that were handed over,
+	// for as long as it takes, since exiting would drop every player
+	logger.Error("upgrade failed after taking over, taking back over", "error", err)
+	serverConfig.Handoff = handoff
 	for {
-		select {
-		case _, ok := <-mainShutdownChannel:
-			if !ok {
-				break loop
-			}
-		case playerInfo := <-playerInfoEventChannel:
-			if playerInfo.SetId {
-				state.PlayerSetId(context, playerInfo.PlayerAddr, playerInfo.PlayerId, true)
-			} else if playerInfo.SetName {
-				state.PlayerSetName(context, playerInfo.PlayerAddr, playerInfo.PlayerId, playerInfo.Name)
+		relay, err = server.New(serverConfig)
+		if err == nil {
+			err = relay.Start(context.Background())
+			if err == nil {
+				return relay
 			}
-		case playerPort := <-playerLeaveGameChannel:
-			state.PlayerDelete(context, playerPort, true)
-			state.PrintServerState(context, true)
-		case packet := <-context.RxChannel:
-			processPacket(context, packet, startPlayerPingChannel, playerInfoEventChannel, playerLeaveGameChannel)
 		}
-	}
-
-	if db != nil {
-		db.Close()
+		logger.Error("can't take back over, retrying", "error", err, "retry_seconds", takeBackRetry.Seconds())
+		time.Sleep(takeBackRetry)
 	}
 }
 
-func processPacket(
-	context *state.ServerContext,
-	packet proxy.UdpPacket,
-	startPlayerPingChannel chan state.Player,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
-	valid, _ := bolo.ValidatePacket(packet)
-	if !valid {
-		// skip non-bolo packets
-		return
-	}
-
-	packetType := bolo.GetPacketType(packet.Buffer)
-
-	context.Mutex.Lock()
+func main() {
+	var db *sql.DB = nil
 
-	// get destination player ip by proxy port
-	dstPlayer, err := state.PlayerGetByPort(context, packet.DstPort, false)
+	logs, err := logging.New(os.Stdout, logging.Format(config.GetValueString("log_format")))
 	if err != nil {
-		// normally won't happen, but there could be a pending packet incoming from a player that was subsequently deleted
-		fmt.Println(err)
-		context.Mutex.Unlock()
-		return
+		log.Fatalln(err)
 	}
-
-	srcPlayer, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
+	if config.GetValueBool("debug") {
+		logs.SetDebugList("all")
+	}
+	err = logs.SetDebugList(config.GetValueString("debug_subsystems"))
 	if err != nil {
-		srcPlayer = state.PlayerNew(context, packet.SrcAddr, dstPlayer.GameId, dstPlayer.ProxyPort, false)
-		startPlayerPingChannel <- srcPlayer
-		state.PrintServerState(context, false)
+		fatal(logs.Server, "bad debug_subsystems", err)
 	}
 
-	context.PlayerPongChannel <- util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
-
-	if packetType == bolo.PacketType5 {
-		if srcPlayer.GameId != dstPlayer.GameId {
-			state.PlayerJoinGame(context, srcPlayer.ProxyPort, dstPlayer.GameId, false)
-		}
+	if config.GetValueBool("enable_statistics") {
+		db = data.Init(logs.Data)
 	}
 
-	if context.Debug {
-		if packetType == bolo.PacketType5 || packetType == bolo.PacketType6 || packetType == bolo.PacketType7 {
-			srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
-			dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
-			timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
+	var webhooks []webhook.Config
+	if config.GetValueString("webhook_url") != "" {
+		webhooks = append(webhooks, getWebhookConfig(logs.Server))
+	}
 
-			natStatus := "?"
-			if time.Since(timestamp).Seconds() < 20 {
-				natStatus = "*"
-			}
+	serverConfig := server.Config{
+		Hostname:                     config.GetValueString("hostname"),
+		TrackerPort:                  config.GetValueInt("tracker_port"),
+		TrackerDebugPort:             config.GetValueInt("tracker_debug_port"),
+		GameInfoPingSeconds:          config.GetValueInt("game_info_ping_seconds"),
+		PlayerTimeoutSeconds:         config.GetValueInt("player_timeout_seconds"),
+		ProxyPortFirst:               config.GetValueInt("proxy_port_first"),
+		ProxyPortLast:                config.GetValueInt("proxy_port_last"),
+		MultiplexPorts:               config.GetValueInt("multiplex_ports"),
+		HttpPort:                     config.GetValueInt("http_port"),
+		AdminToken:                   config.GetValueString("admin_token"),
+		ProxyPortCooldownSeconds:     config.GetValueInt("proxy_port_cooldown_seconds"),
+		RateLimitNewPlayersPerMinute: config.GetValueInt("rate_limit_new_players_per_minute"),
+		RateLimitNewGamesPerMinute:   config.GetValueInt("rate_limit_new_games_per_minute"),
+		RateLimitPacketsPerSecond:    config.GetValueInt("rate_limit_packets_per_second"),
+		CaptureDirectory:             config.GetValueString("capture_directory"),
+		RecordingDirectory:           config.GetValueString("recording_directory"),
+		Log:                          logs,
+		Webhooks:                     webhooks,
+		DB:                           db,
+		LogChat:                      config.GetValueBool("log_chat"),
+		Motd:                         config.GetValueString("motd"),
+		TxQueueSize:                  config.GetValueInt("tx_queue_size"),
+		RxQueueSize:                  config.GetValueInt("rx_queue_size"),
+		WatchdogSeconds:              config.GetValueInt("watchdog_seconds"),
+		SnapshotFile:                 config.GetValueString("snapshot_file"),
+		SnapshotSeconds:              config.GetValueInt("snapshot_seconds"),
+	}
 
-			fmt.Printf("%s PacketType=%d %d (%s:%d) -> %d (%s:%d)\n", natStatus, packetType,
-				srcPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort,
-				dstPlayer.ProxyPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort,
-			)
-			fmt.Printf("    Timestamp=%s\n", timestamp)
-		}
+	beginShutdownChannel := make(chan struct{})
+	hurryChannel := make(chan struct{})
+	initSignalHandler(beginShutdownChannel, hurryChannel)
+	upgradeChannel := make(chan os.Signal, 1)
+	signal.Notify(upgradeChannel, syscall.SIGHUP, syscall.SIGUSR2)
+	//go listenNetShutdown(logs.Server, beginShutdownChannel)
+
+	// the process being upgraded relays until this takes over, so it is done
+	// just before starting
+	handoff, ready, err := upgrade.Inherit()
+	if err != nil {
+		fatal(logs.Server, "can't take over from the upgraded process", err)
+	}
+	serverConfig.Handoff = handoff
+	relay, err := server.New(serverConfig)
+	if err != nil {
+		fatal(logs.Server, "bad config", err)
+	}
+	err = relay.Start(context.Background())
+	if err != nil {
+		fatal(logs.Server, "can't start", err)
+	}
+	if handoff != nil {
+		handoff.Close()
+		serverConfig.Handoff = nil
 	}
 
-	if packetType == bolo.PacketType7 {
-		if bytes.Equal(packet.Buffer[10:12], []byte{0x01, 0x23}) {
-			if bytes.Equal(packet.Buffer[18:22], []byte{0x45, 0x67, 0x89, 0xab}) {
-				savedPacket, ok := srcPlayer.PeerPackets[dstPlayer.ProxyPort]
-				if !ok {
-					fmt.Printf("received nat probe reply (%d -> %d, %s:%d -> %s:%d)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort)
-					fmt.Println("  error: no saved packet")
-					context.Mutex.Unlock()
-					return
-				}
-				if context.Debug {
-					fmt.Printf("received nat probe reply (%d -> %d, %s:%d -> %s:%d)\n", srcPlayer.ProxyPort, dstPlayer.ProxyPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort)
-					fmt.Printf("  packet length = %d\n", len(savedPacket.Buffer))
-					fmt.Printf("  forwarding PacketType=%d (%d -> %d, %s:%d -> %s:%d)\n", bolo.GetPacketType(savedPacket.Buffer), dstPlayer.ProxyPort, srcPlayer.ProxyPort, dstPlayer.IpAddr.String(), dstPlayer.IpPort, srcPlayer.IpAddr.String(), srcPlayer.IpPort)
+	logs.Server.Info("started", "hostname", config.GetValueString("hostname"), "ip_addr", relay.ProxyIpAddr().String())
+	ready()
+
+	for running := true; running; {
+		select {
+		case <-beginShutdownChannel:
+			running = false
+		case <-upgradeChannel:
+			relay = upgradeRelay(logs.Server, relay, serverConfig)
+			if relay == nil {
+				if db != nil {
+					db.Close()
 				}
-				delete(srcPlayer.PeerPackets, dstPlayer.ProxyPort)
-				srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
-				context.Mutex.Unlock()
-				go forwardPacket(savedPacket, context.ProxyIpAddr, dstPlayer, srcPlayer, playerInfoEventChannel, playerLeaveGameChannel)
+				logs.Server.Info("upgrade completed")
 				return
 			}
 		}
 	}
 
-	if srcPlayer.NatPort != context.ProxyPort {
-		natProbe(context, srcPlayer, context.ProxyPort, false)
-	}
-
-	// if the player is talking to themselves (happens when they are the last player in the game), no nat traversal is needed
-	if srcPlayer.ProxyPort != dstPlayer.ProxyPort {
-		srcTimestamp := srcPlayer.Peers[dstPlayer.ProxyPort]
-		dstTimestamp := dstPlayer.Peers[srcPlayer.ProxyPort]
-		timestamp := util.MaxTime(srcTimestamp, dstTimestamp)
-		if time.Since(timestamp).Seconds() > 20 {
-			dstPlayer.PeerPackets[srcPlayer.ProxyPort] = packet
-			natProbe(context, dstPlayer, srcPlayer.ProxyPort, false)
-			context.Mutex.Unlock()
-			return
-		}
-
-		srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
-	}
-
-	context.Mutex.Unlock()
-
-	go forwardPacket(packet, context.ProxyIpAddr, srcPlayer, dstPlayer, playerInfoEventChannel, playerLeaveGameChannel)
-}
-
-func natProbe(context *state.ServerContext, dstPlayer state.Player, targetProxyPort int, lock bool) {
-	trackerPort := config.GetValueInt("tracker_port")
-	buffer := bolo.MarshalPacketType6(context.ProxyIpAddr, targetProxyPort)
-	dstAddr := &net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
-
-	if context.Debug {
-		fmt.Printf("sending nat probe to %s:%d (target port: %d)\n", dstPlayer.IpAddr.String(), dstPlayer.IpPort, targetProxyPort)
+	warningSeconds := config.GetValueInt("shutdown_warning_seconds")
+	if warningSeconds > 0 {
+		logs.Server.Info("shutting down after warning players", "seconds", warningSeconds)
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-hurryChannel
+			cancel()
+		}()
+		relay.WarnShutdown(ctx, time.Duration(warningSeconds)*time.Second)
+		cancel()
 	}
+	relay.Shutdown(context.Background())
 
-	if dstPlayer.NatPort == trackerPort {
-		if context.Debug {
-			fmt.Printf("  (nat probe source port: %d)\n", trackerPort)
-		}
-		context.UdpConnection.WriteToUDP(buffer, dstAddr)
-	} else {
-		natPlayer, err := state.PlayerGetByPort(context, dstPlayer.NatPort, lock)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		if context.Debug {
-			fmt.Printf("  (nat probe source port: %d)\n", natPlayer.ProxyPort)
-		}
-		natPlayer.TxChannel <- proxy.UdpPacket{DstAddr: *dstAddr, Buffer: buffer}
+	if db != nil {
+		db.Close()
 	}
-}
 
-func forwardPacket(
-	packet proxy.UdpPacket,
-	proxyIP net.IP,
-	srcPlayer state.Player,
-	dstPlayer state.Player,
-	playerInfoEventChannel chan util.PlayerInfoEvent,
-	playerLeaveGameChannel chan util.PlayerAddr,
-) {
-	srcPlayerAddr := util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
-	bolo.RewritePacket(
-		packet.Buffer,
-		proxyIP,
-		srcPlayer.ProxyPort,
-		srcPlayerAddr,
-		playerInfoEventChannel,
-		playerLeaveGameChannel,
-	)
-
-	packet.DstAddr = net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
-	srcPlayer.TxChannel <- packet
+	logs.Server.Info("shutdown completed")
 }
@@ -32,24 +32,76 @@ const configFilename = "config.txt"
 var configMap map[string]string = nil
 
 var valid []string = []string{
+	"admin_token",
+	"capture_directory",
 	"database_filename",
 	"debug",
+	"debug_subsystems",
 	"enable_statistics",
 	"hostname",
 	"game_info_ping_seconds",
+	"http_port",
+	"log_chat",
+	"log_format",
+	"motd",
+	"multiplex_ports",
 	"player_timeout_seconds",
+	"proxy_port_cooldown_seconds",
+	"proxy_port_first",
+	"proxy_port_last",
+	"rate_limit_new_games_per_minute",
+	"rate_limit_new_players_per_minute",
+	"rate_limit_packets_per_second",
+	"recording_directory",
+	"rx_queue_size",
+	"shutdown_warning_seconds",
+	"snapshot_file",
+	"snapshot_seconds",
 	"tracker_debug_port",
 	"tracker_port",
+	"tx_queue_size",
+	"watchdog_seconds",
+	"webhook_attempts",
+	"webhook_player_count",
+	"webhook_retry_seconds",
+	"webhook_template_file",
+	"webhook_url",
 }
 
 var defaults = map[string]string{
-	"database_filename":      "db.sqlite",
-	"debug":                  "false",
-	"enable_statistics":      "false",
-	"game_info_ping_seconds": "20",
-	"player_timeout_seconds": "60",
-	"tracker_debug_port":     "50001",
-	"tracker_port":           "50000",
+	"admin_token":                       "",
+	"capture_directory":                 "",
+	"database_filename":                 "db.sqlite",
+	"debug":                             "false",
+	"debug_subsystems":                  "",
+	"enable_statistics":                 "false",
+	"game_info_ping_seconds":            "20",
+	"http_port":                         "0",
+	"log_chat":                          "false",
+	"log_format":                        "text",
+	"motd":                              "",
+	"multiplex_ports":                   "0",
+	"player_timeout_seconds":            "60",
+	"proxy_port_cooldown_seconds":       "60",
+	"proxy_port_first":                  "40001",
+	"proxy_port_last":                   "41000",
+	"rate_limit_new_games_per_minute":   "10",
+	"rate_limit_new_players_per_minute": "30",
+	"rate_limit_packets_per_second":     "2000",
+	"recording_directory":               "",
+	"rx_queue_size":                     "1024",
+	"shutdown_warning_seconds":          "0",
+	"snapshot_file":                     "",
+	"snapshot_seconds":                  "60",
+	"tracker_debug_port":                "50001",
+	"tracker_port":                      "50000",
+	"tx_queue_size":                     "64",
+	"watchdog_seconds":                  "10",
+	"webhook_attempts":                  "5",
+	"webhook_player_count":              "0",
+	"webhook_retry_seconds":             "5",
+	"webhook_template_file":             "",
+	"webhook_url":                       "",
 }
 
 var mapBoolValue = map[string]bool{
@@ -86,15 +138,29 @@ func GetValueBool(name string) bool {
 	return valueBool
 }
 
-func load() {
-	if configMap != nil {
-		return
+// SetValue overrides a setting. If no settings have been read yet, the config
+// file is skipped and the remaining settings keep their defaults. Tests use
+// this to run without a config file.
+func SetValue(name string, value string) {
+	if configMap == nil {
+		loadDefaults()
 	}
+	configMap[name] = value
+}
 
+func loadDefaults() {
 	configMap = make(map[string]string)
 	for key, value := range defaults {
 		configMap[key] = value
 	}
+}
+
+func load() {
+	if configMap != nil {
+		return
+	}
+
+	loadDefaults()
 
 	file, err := os.Open(configFilename)
 	if err != nil {
@@ -19,7 +19,9 @@ package data
 
 import (
 	"database/sql"
-	"log"
+	"errors"
+	"log/slog"
+	"os"
 	"runtime/debug"
 	"strings"
 
@@ -27,7 +29,33 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const kDataSchemaVersion = 1
+const kDataSchemaVersion = 2
+
+// logError logs a statement that failed after the database was opened, and
+// returns the error for the caller to count
+func logError(logger *slog.Logger, message string, err error) error {
+	if err == nil {
+		logger.Error(message, "stack", string(debug.Stack()))
+		return errors.New(message)
+	}
+	logger.Error(message, "error", err, "stack", string(debug.Stack()))
+	return err
+}
+
+// fatal logs an error the statistics can't be kept without and exits
+func fatal(logger *slog.Logger, message string, err error) {
+	logger.Error(message, "error", err, "stack", string(debug.Stack()))
+	os.Exit(1)
+}
+
+type DataChatMessage struct {
+	GameId     string
+	SenderName string
+	// Recipients has bit n set for each player id n the message was sent to
+	Recipients int
+	Message    string
+	SentAt     string
+}
 
 type DataGame struct {
 	GameId               string
@@ -38,29 +66,66 @@ type DataGame struct {
 	ElapsedPlayerMinutes int
 }
 
-func Init() *sql.DB {
+func Init(logger *slog.Logger) *sql.DB {
 	db_filename := config.GetValueString("database_filename")
 	db, err := sql.Open("sqlite3", db_filename+"?Mode=rwc")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalf("failed to open/create database (%s): %s\n", db_filename, err)
+		fatal(logger, "failed to open/create database "+db_filename, err)
 	}
 
 	var count int
 	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'config' and type = 'table'").Scan(&count)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 
 	if count == 0 {
-		InitTables(db)
+		InitTables(logger, db)
+	} else {
+		MigrateTables(logger, db)
 	}
 
 	return db
 }
 
-func InitTables(db *sql.DB) {
+// MigrateTables brings the tables of a database created by an earlier version
+// up to date
+func MigrateTables(logger *slog.Logger, db *sql.DB) {
+	var version int
+	err := db.QueryRow("SELECT value FROM config WHERE name = 'schema_version'").Scan(&version)
+	if err != nil {
+		fatal(logger, "sqlite error", err)
+	}
+
+	if version < 2 {
+		createChatMessageTable(logger, db)
+	}
+
+	if version < kDataSchemaVersion {
+		_, err = db.Exec("UPDATE config SET value = $1 WHERE name = 'schema_version'", kDataSchemaVersion)
+		if err != nil {
+			fatal(logger, "sqlite error", err)
+		}
+	}
+}
+
+func createChatMessageTable(logger *slog.Logger, db *sql.DB) {
+	_, err := db.Exec(
+		"CREATE TABLE chat_message (" +
+			"id INTEGER PRIMARY KEY AUTOINCREMENT, " +
+			"game_id TEXT NOT NULL, " +
+			"sender_name TEXT NOT NULL, " +
+			"recipients INTEGER NOT NULL, " +
+			"message TEXT NOT NULL, " +
+			"sent_at TEXT NOT NULL" +
+			")",
+	)
+	if err != nil {
+		fatal(logger, "sqlite error", err)
+	}
+}
+
+func InitTables(logger *slog.Logger, db *sql.DB) {
 	_, err := db.Exec(
 		"CREATE TABLE game (" +
 			"id TEXT PRIMARY KEY, " +
@@ -72,8 +137,7 @@ func InitTables(db *sql.DB) {
 			")",
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 
 	_, err = db.Exec(
@@ -85,35 +149,33 @@ func InitTables(db *sql.DB) {
 			")",
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 
+	createChatMessageTable(logger, db)
+
 	_, err = db.Exec("CREATE TABLE config (name TEXT PRIMARY KEY, value TEXT)")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 
 	statement, err := db.Prepare("INSERT INTO config (name, value) VALUES ($1, $2)")
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 	defer statement.Close()
 
 	_, err = statement.Exec("schema_version", kDataSchemaVersion)
 	if err != nil {
-		debug.PrintStack()
-		log.Fatalln("sqlite error", err)
+		fatal(logger, "sqlite error", err)
 	}
 }
 
-func SelectGames(db *sql.DB, gameIds []string) []DataGame {
+func SelectGames(logger *slog.Logger, db *sql.DB, gameIds []string) ([]DataGame, error) {
 	var games []DataGame
 
 	if len(gameIds) == 0 {
-		return games
+		return games, nil
 	}
 
 	args := make([]interface{}, len(gameIds))
@@ -134,9 +196,7 @@ func SelectGames(db *sql.DB, gameIds []string) []DataGame {
 
 	rows, err := db.Query(sql, args...)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return games
+		return games, logError(logger, "sqlite error", err)
 	}
 	defer rows.Close()
 
@@ -151,23 +211,20 @@ func SelectGames(db *sql.DB, gameIds []string) []DataGame {
 			&game.ElapsedPlayerMinutes,
 		)
 		if err != nil {
-			debug.PrintStack()
-			log.Println("sqlite error", err)
-			return games
+			return games, logError(logger, "sqlite error", err)
 		}
 		games = append(games, game)
 	}
 
 	err = rows.Err()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
+		return games, logError(logger, "sqlite error", err)
 	}
 
-	return games
+	return games, nil
 }
 
-func InsertGame(db *sql.DB, game DataGame) {
+func InsertGame(logger *slog.Logger, db *sql.DB, game DataGame) error {
 	result, err := db.Exec(
 		"INSERT INTO game "+
 			"(id, map_name, started_at, max_player_count, elapsed_player_minutes) "+
@@ -179,23 +236,19 @@ func InsertGame(db *sql.DB, game DataGame) {
 		game.ElapsedPlayerMinutes,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql insert game failed")
+		return logError(logger, "sql insert game failed", nil)
 	}
+	return nil
 }
 
-func UpdateGame(db *sql.DB, game DataGame) {
+func UpdateGame(logger *slog.Logger, db *sql.DB, game DataGame) error {
 	result, err := db.Exec(
 		"UPDATE game "+
 			"SET "+
@@ -207,23 +260,19 @@ func UpdateGame(db *sql.DB, game DataGame) {
 		game.GameId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql update game failed")
+		return logError(logger, "sql update game failed", nil)
 	}
+	return nil
 }
 
-func EndGame(db *sql.DB, gameId string) {
+func EndGame(logger *slog.Logger, db *sql.DB, gameId string) error {
 	result, err := db.Exec(
 		"UPDATE game "+
 			"SET "+
@@ -232,23 +281,19 @@ func EndGame(db *sql.DB, gameId string) {
 		gameId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql update game failed")
+		return logError(logger, "sql update game failed", nil)
 	}
+	return nil
 }
 
-func InsertPlayerSession(db *sql.DB, playerId string) {
+func InsertPlayerSession(logger *slog.Logger, db *sql.DB, playerId string) error {
 	result, err := db.Exec(
 		"INSERT INTO player_session "+
 			"(player_id, joined_at) "+
@@ -256,23 +301,19 @@ func InsertPlayerSession(db *sql.DB, playerId string) {
 		playerId,
 	)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql insert player session failed")
+		return logError(logger, "sql insert player session failed", nil)
 	}
+	return nil
 }
 
-func EndPlayerSession(db *sql.DB, playerId string) {
+func EndPlayerSession(logger *slog.Logger, db *sql.DB, playerId string) error {
 	sql := "UPDATE player_session " +
 		"SET " +
 		"left_at = datetime('now') " +
@@ -281,18 +322,38 @@ func EndPlayerSession(db *sql.DB, playerId string) {
 
 	result, err := db.Exec(sql, playerId)
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return logError(logger, "sqlite error", err)
+	}
+	if rowCount != 1 {
+		return logError(logger, "sql end player session failed", nil)
+	}
+	return nil
+}
+
+func InsertChatMessage(logger *slog.Logger, db *sql.DB, message DataChatMessage) error {
+	result, err := db.Exec(
+		"INSERT INTO chat_message "+
+			"(game_id, sender_name, recipients, message, sent_at) "+
+			"VALUES ($1, $2, $3, $4, datetime($5, 'unixepoch'))",
+		message.GameId,
+		message.SenderName,
+		message.Recipients,
+		message.Message,
+		message.SentAt,
+	)
+	if err != nil {
+		return logError(logger, "sqlite error", err)
 	}
 	rowCount, err := result.RowsAffected()
 	if err != nil {
-		debug.PrintStack()
-		log.Println("sqlite error", err)
-		return
+		return logError(logger, "sqlite error", err)
 	}
 	if rowCount != 1 {
-		debug.PrintStack()
-		log.Println("sql end player session failed")
+		return logError(logger, "sql insert chat message failed", nil)
 	}
+	return nil
 }
@@ -0,0 +1,138 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package events publishes what happens to games and players to anyone
+// listening in the same process, such as the http event stream
+package events
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+type Type string
+
+const (
+	GameCreated           Type = "game_created"
+	GameEnded             Type = "game_ended"
+	PlayerJoined          Type = "player_joined"
+	PlayerRenamed         Type = "player_renamed"
+	PlayerLeft            Type = "player_left"
+	NatTraversalSucceeded Type = "nat_traversal_succeeded"
+	NatTraversalFailed    Type = "nat_traversal_failed"
+	ChatMessage           Type = "chat_message"
+)
+
+// Event is one change to the server's games or players. Fields that don't
+// apply to the event's type are left zero.
+type Event struct {
+	Type   Type
+	Time   time.Time
+	GameId bolo.GameId
+	// MapName is set for GameCreated
+	MapName string
+	// PlayerAddr and ProxyPort identify the player of player and nat events.
+	// In nat events it is the player behind the nat that was probed, and in
+	// chat events the sender, if the relay knows who has the sender's player
+	// id.
+	PlayerAddr net.UDPAddr
+	ProxyPort  int
+	Name       string
+	// OldName is set for PlayerRenamed
+	OldName string
+	// PeerProxyPort is the player whose packets were waiting for the probed
+	// player's nat to open, in nat events
+	PeerProxyPort int
+	// Message, and the players it was sent to, are set for ChatMessage
+	Message    string
+	Recipients []Recipient
+}
+
+// Recipient is a player a chat message was sent to. ProxyPort is 0 if the
+// relay doesn't know who has the player id.
+type Recipient struct {
+	PlayerId  int
+	ProxyPort int
+	Name      string
+}
+
+// Bus hands each published event to every subscriber. Publishing never
+// blocks, so it is safe while holding the server's mutex; a subscriber that
+// falls behind misses events instead.
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+	dropped     uint64
+}
+
+type Subscription struct {
+	C       <-chan Event
+	channel chan Event
+	bus     *Bus
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Publish sends event to the subscribers, stamping it with the current time
+// if it has none
+func (bus *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+
+	for subscription := range bus.subscribers {
+		select {
+		case subscription.channel <- event:
+		default:
+			atomic.AddUint64(&bus.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a subscription that queues up to size events
+func (bus *Bus) Subscribe(size int) *Subscription {
+	channel := make(chan Event, size)
+	subscription := &Subscription{C: channel, channel: channel, bus: bus}
+
+	bus.mutex.Lock()
+	bus.subscribers[subscription] = struct{}{}
+	bus.mutex.Unlock()
+
+	return subscription
+}
+
+// Dropped is the number of events subscribers were too slow to receive
+func (bus *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&bus.dropped)
+}
+
+// Close stops the subscription. Events already queued can still be received.
+func (subscription *Subscription) Close() {
+	bus := subscription.bus
+	bus.mutex.Lock()
+	delete(bus.subscribers, subscription)
+	bus.mutex.Unlock()
+}
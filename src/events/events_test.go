@@ -0,0 +1,73 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package events
+
+import (
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	bus := NewBus()
+	first := bus.Subscribe(1)
+	second := bus.Subscribe(1)
+
+	bus.Publish(Event{Type: GameCreated, MapName: "Everard Island"})
+
+	for _, subscription := range []*Subscription{first, second} {
+		event := <-subscription.C
+		if event.Type != GameCreated || event.MapName != "Everard Island" {
+			t.Errorf("received %+v", event)
+		}
+		if event.Time.IsZero() {
+			t.Error("event was not timestamped")
+		}
+	}
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	bus := NewBus()
+	subscription := bus.Subscribe(1)
+
+	bus.Publish(Event{Type: PlayerJoined, ProxyPort: 40001})
+	bus.Publish(Event{Type: PlayerLeft, ProxyPort: 40001})
+
+	if bus.Dropped() != 1 {
+		t.Errorf("dropped %d events, expected 1", bus.Dropped())
+	}
+	event := <-subscription.C
+	if event.Type != PlayerJoined {
+		t.Errorf("received %s, expected the first event", event.Type)
+	}
+}
+
+func TestClose(t *testing.T) {
+	bus := NewBus()
+	subscription := bus.Subscribe(1)
+	subscription.Close()
+
+	bus.Publish(Event{Type: GameEnded})
+
+	select {
+	case event := <-subscription.C:
+		t.Errorf("closed subscription received %s", event.Type)
+	default:
+	}
+	if bus.Dropped() != 0 {
+		t.Errorf("dropped %d events", bus.Dropped())
+	}
+}
@@ -1,6 +1,6 @@
 module git.astrospark.com/bolorama
 
-go 1.15
+go 1.21
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.6
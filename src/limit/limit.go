@@ -0,0 +1,135 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package limit rate limits events per key with token buckets
+package limit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// buckets that have refilled are forgotten this often
+const pruneInterval = time.Minute
+
+// Limiter holds a token bucket for each key. Each bucket starts full with
+// burst tokens and refills at rate tokens per second. A nil Limiter allows
+// everything.
+type Limiter struct {
+	rate      float64
+	burst     float64
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	denied    uint64
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// New returns a limiter, or nil if rate is not positive
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// PerMinute returns a limiter allowing count events per minute per key, all
+// of which may happen at once
+func PerMinute(count int) *Limiter {
+	return New(float64(count)/60, count)
+}
+
+// PerSecond returns a limiter allowing count events per second per key, all
+// of which may happen at once
+func PerSecond(count int) *Limiter {
+	return New(float64(count), count)
+}
+
+// Allow takes a token from key's bucket, if it has one
+func (limiter *Limiter) Allow(key string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	if now.Sub(limiter.lastPrune) >= pruneInterval {
+		limiter.prune(now)
+	}
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = b
+	}
+
+	b.tokens = limiter.refill(b, now)
+	b.updated = now
+
+	if b.tokens < 1 {
+		atomic.AddUint64(&limiter.denied, 1)
+		return false
+	}
+
+	b.tokens = b.tokens - 1
+	return true
+}
+
+// Denied is the number of events not allowed
+func (limiter *Limiter) Denied() uint64 {
+	if limiter == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&limiter.denied)
+}
+
+func (limiter *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*limiter.rate
+	if tokens > limiter.burst {
+		return limiter.burst
+	}
+	return tokens
+}
+
+// prune forgets full buckets, which are the same as new ones. It must be
+// called with the mutex held.
+func (limiter *Limiter) prune(now time.Time) {
+	for key, b := range limiter.buckets {
+		if limiter.refill(b, now) >= limiter.burst {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastPrune = now
+}
@@ -0,0 +1,79 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := PerMinute(2)
+	limiter.now = func() time.Time { return now }
+
+	if !limiter.Allow("a") || !limiter.Allow("a") {
+		t.Fatal("burst was not allowed")
+	}
+	if limiter.Allow("a") {
+		t.Fatal("allowed more than the burst")
+	}
+	if !limiter.Allow("b") {
+		t.Fatal("one key's bucket limited another key")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !limiter.Allow("a") {
+		t.Error("bucket did not refill")
+	}
+	if limiter.Allow("a") {
+		t.Error("bucket refilled too fast")
+	}
+
+	if limiter.Denied() != 2 {
+		t.Errorf("%d denied, expected 2", limiter.Denied())
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := PerSecond(10)
+	limiter.now = func() time.Time { return now }
+	limiter.lastPrune = now
+
+	limiter.Allow("a")
+	now = now.Add(pruneInterval)
+	limiter.Allow("b")
+
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("full bucket was not pruned")
+	}
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets, expected 1", len(limiter.buckets))
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	limiter := New(0, 10)
+	if limiter != nil {
+		t.Fatal("zero rate should disable the limiter")
+	}
+	if !limiter.Allow("a") || limiter.Denied() != 0 {
+		t.Error("nil limiter limited something")
+	}
+}
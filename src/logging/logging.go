@@ -0,0 +1,190 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package logging creates the leveled, structured loggers each part of the
+// server logs with. Each subsystem has its own logger whose debug messages
+// can be turned on and off while the server runs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+type Subsystem string
+
+const (
+	Server    Subsystem = "server"
+	Proxy     Subsystem = "proxy"
+	Tracker   Subsystem = "tracker"
+	Nat       Subsystem = "nat"
+	Stats     Subsystem = "stats"
+	Data      Subsystem = "data"
+	Web       Subsystem = "web"
+	Webhook   Subsystem = "webhook"
+	Capture   Subsystem = "capture"
+	Recording Subsystem = "recording"
+)
+
+var Subsystems = []Subsystem{Server, Proxy, Tracker, Nat, Stats, Data, Web, Webhook, Capture, Recording}
+
+// Keys of the fields messages about players, games and packets carry
+const (
+	ProxyPort  = "proxy_port"
+	PlayerAddr = "player_addr"
+	GameId     = "game_id"
+	PacketType = "packet_type"
+)
+
+type Format string
+
+const (
+	Text Format = "text" // logfmt
+	Json Format = "json"
+)
+
+type Loggers struct {
+	Server    *slog.Logger
+	Proxy     *slog.Logger
+	Tracker   *slog.Logger
+	Nat       *slog.Logger
+	Stats     *slog.Logger
+	Data      *slog.Logger
+	Web       *slog.Logger
+	Webhook   *slog.Logger
+	Capture   *slog.Logger
+	Recording *slog.Logger
+	levels    map[Subsystem]*slog.LevelVar
+}
+
+// New creates loggers writing to w in format, logging info and above
+func New(w io.Writer, format Format) (*Loggers, error) {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch format {
+	case Text, "":
+		handler = slog.NewTextHandler(w, options)
+	case Json:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("log format %q is not text or json", format)
+	}
+
+	loggers := &Loggers{levels: make(map[Subsystem]*slog.LevelVar)}
+	logger := func(subsystem Subsystem) *slog.Logger {
+		level := &slog.LevelVar{}
+		loggers.levels[subsystem] = level
+		return slog.New(&levelHandler{level: level, handler: handler}).With("subsystem", string(subsystem))
+	}
+	loggers.Server = logger(Server)
+	loggers.Proxy = logger(Proxy)
+	loggers.Tracker = logger(Tracker)
+	loggers.Nat = logger(Nat)
+	loggers.Stats = logger(Stats)
+	loggers.Data = logger(Data)
+	loggers.Web = logger(Web)
+	loggers.Webhook = logger(Webhook)
+	loggers.Capture = logger(Capture)
+	loggers.Recording = logger(Recording)
+	return loggers, nil
+}
+
+// Discard creates loggers that write nothing
+func Discard() *Loggers {
+	loggers, _ := New(io.Discard, Text)
+	return loggers
+}
+
+// SetDebug turns debug messages of subsystem on or off
+func (loggers *Loggers) SetDebug(subsystem Subsystem, debug bool) error {
+	level, ok := loggers.levels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem %q", subsystem)
+	}
+	if debug {
+		level.Set(slog.LevelDebug)
+	} else {
+		level.Set(slog.LevelInfo)
+	}
+	return nil
+}
+
+// SetDebugList turns on debug messages for a comma separated list of
+// subsystems, or all of them for "all"
+func (loggers *Loggers) SetDebugList(list string) error {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "all" {
+			for _, subsystem := range Subsystems {
+				loggers.SetDebug(subsystem, true)
+			}
+			continue
+		}
+		err := loggers.SetDebug(Subsystem(name), true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Debug returns the subsystems with debug messages turned on
+func (loggers *Loggers) Debug() []Subsystem {
+	var subsystems []Subsystem
+	for subsystem, level := range loggers.levels {
+		if level.Level() <= slog.LevelDebug {
+			subsystems = append(subsystems, subsystem)
+		}
+	}
+	sort.Slice(subsystems, func(i, j int) bool { return subsystems[i] < subsystems[j] })
+	return subsystems
+}
+
+// levelHandler filters the messages of one subsystem by its level
+type levelHandler struct {
+	level   *slog.LevelVar
+	handler slog.Handler
+}
+
+func (handler *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= handler.level.Level()
+}
+
+func (handler *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return handler.handler.Handle(ctx, record)
+}
+
+func (handler *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: handler.level, handler: handler.handler.WithAttrs(attrs)}
+}
+
+func (handler *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: handler.level, handler: handler.handler.WithGroup(name)}
+}
+
+// DebugEnabled reports whether logger logs debug messages, so that costly
+// ones can be skipped
+func DebugEnabled(logger *slog.Logger) bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
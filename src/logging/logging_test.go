@@ -0,0 +1,102 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buffer bytes.Buffer
+	loggers, err := New(&buffer, Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loggers.Nat.Debug("hidden")
+	loggers.Nat.Info("shown")
+	if strings.Contains(buffer.String(), "hidden") || !strings.Contains(buffer.String(), "shown") {
+		t.Fatalf("got %q", buffer.String())
+	}
+
+	err = loggers.SetDebugList("nat, proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Reset()
+	loggers.Nat.Debug("nat debug")
+	loggers.Tracker.Debug("tracker debug")
+	if !strings.Contains(buffer.String(), "nat debug") || strings.Contains(buffer.String(), "tracker debug") {
+		t.Errorf("got %q", buffer.String())
+	}
+	debug := loggers.Debug()
+	if len(debug) != 2 || debug[0] != Nat || debug[1] != Proxy {
+		t.Errorf("got debug %v", debug)
+	}
+
+	loggers.SetDebug(Nat, false)
+	if DebugEnabled(loggers.Nat) || !DebugEnabled(loggers.Proxy) {
+		t.Error("nat debug wasn't turned off on its own")
+	}
+
+	loggers.SetDebugList("all")
+	if len(loggers.Debug()) != len(Subsystems) {
+		t.Errorf("all turned on %v", loggers.Debug())
+	}
+
+	if loggers.SetDebugList("nat,nope") == nil {
+		t.Error("unknown subsystem was accepted")
+	}
+}
+
+func TestJson(t *testing.T) {
+	var buffer bytes.Buffer
+	loggers, err := New(&buffer, Json)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loggers.Proxy.With(ProxyPort, 40001, GameId, "c0a8010adc898500").Warn("dropping packet", PacketType, 2)
+
+	var record map[string]interface{}
+	err = json.Unmarshal(buffer.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"level":     "WARN",
+		"msg":       "dropping packet",
+		"subsystem": "proxy",
+		ProxyPort:   40001.0,
+		GameId:      "c0a8010adc898500",
+		PacketType:  2.0,
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%s is %v, want %v", key, record[key], value)
+		}
+	}
+
+	_, err = New(&buffer, "xml")
+	if err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
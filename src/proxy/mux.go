@@ -0,0 +1,105 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"git.astrospark.com/bolorama/limit"
+	"git.astrospark.com/bolorama/transport"
+	"git.astrospark.com/bolorama/watchdog"
+)
+
+// Mux serves every player from a fixed pool of sockets instead of one socket
+// per player. Packets from all of them arrive on the shared rx queue with
+// DstPort set to the socket's port, and the server works out which player
+// they are for.
+type Mux struct {
+	routes map[int]Route
+	ports  []int
+}
+
+// NewMux listens on count ports starting at firstPort. Either all of the
+// ports are opened or none are.
+func NewMux(
+	transport transport.Transport,
+	firstPort int,
+	count int,
+	packetLimiter *limit.Limiter,
+	logger *slog.Logger,
+	watchdog *watchdog.Watchdog,
+	wg *sync.WaitGroup,
+	rxQueue *Queue,
+	handler Handler,
+	txPolicy QueuePolicy,
+	shutdownChannel chan struct{},
+) (*Mux, error) {
+	mux := &Mux{routes: make(map[int]Route)}
+
+	for port := firstPort; port < firstPort+count; port++ {
+		connection, err := transport.ListenUDP(port)
+		if err != nil {
+			for _, route := range mux.routes {
+				route.Connection.Close()
+			}
+			return nil, err
+		}
+
+		// the disconnect channel is nil, so the socket stays open until shutdown
+		route := Route{
+			PlayerIPAddr:  net.UDPAddr{},
+			ProxyPort:     port,
+			Connection:    connection,
+			RxQueue:       rxQueue,
+			TxQueue:       NewQueue(txPolicy),
+			Handler:       handler,
+			PacketLimiter: packetLimiter,
+			Logger:        logger.With("relay_port", port),
+			Watchdog:      watchdog,
+		}
+		mux.routes[port] = route
+		mux.ports = append(mux.ports, port)
+	}
+
+	logger.Info("multiplexing players", "first_port", firstPort, "last_port", firstPort+count-1)
+
+	for _, port := range mux.ports {
+		wg.Add(2)
+		go udpListener(wg, shutdownChannel, mux.routes[port])
+		go udpTransmitter(wg, shutdownChannel, mux.routes[port])
+	}
+
+	return mux, nil
+}
+
+// Ports are the ports of the pool, in order
+func (mux *Mux) Ports() []int {
+	return mux.ports
+}
+
+// Socket returns the queue packets are sent from port with, and its connection
+func (mux *Mux) Socket(port int) (*Queue, transport.PacketConn, error) {
+	route, ok := mux.routes[port]
+	if !ok {
+		return nil, nil, fmt.Errorf("port %d is not multiplexed", port)
+	}
+	return route.TxQueue, route.Connection, nil
+}
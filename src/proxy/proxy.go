@@ -19,26 +19,42 @@ package proxy
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"git.astrospark.com/bolorama/limit"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/transport"
 	"git.astrospark.com/bolorama/util"
+	"git.astrospark.com/bolorama/watchdog"
 )
 
-const firstPlayerPort = 40001
+// firstVirtualPort numbers multiplexed players, whose proxy port is not a socket
+const firstVirtualPort = 1
 
 // Route associates a proxy port with a player's real IP address + port
 type Route struct {
 	PlayerIPAddr      net.UDPAddr
 	ProxyPort         int
-	Connection        *net.UDPConn
-	RxChannel         chan UdpPacket
-	TxChannel         chan UdpPacket
+	Connection        transport.PacketConn
+	RxQueue           *Queue
+	TxQueue           *Queue
 	DisconnectChannel chan struct{}
+	Handler           Handler
+	PacketLimiter     *limit.Limiter // packets per source ip
+	Logger            *slog.Logger
+	Watchdog          *watchdog.Watchdog
 }
 
+// Handler relays a packet in the goroutine of the port it arrived on, and
+// reports whether it did. Packets it leaves are pushed to the rx queue.
+type Handler func(packet UdpPacket) bool
+
 // UdpPacket represents a packet being sent from srcAddr to dstAddr
 type UdpPacket struct {
 	SrcAddr net.UDPAddr
@@ -48,7 +64,34 @@ type UdpPacket struct {
 	Buffer  []byte
 }
 
-var assignedPlayerPorts []int
+// Ports are the proxy ports assigned to the players of one server. They are
+// guarded by the server's context mutex.
+type Ports struct {
+	first    int
+	last     int
+	assigned []int
+	// a port isn't reused until cooldown after it is freed, so that packets
+	// still on their way to the last player aren't delivered to the next one
+	cooldown time.Duration
+	cooling  map[int]time.Time
+	now      func() time.Time
+}
+
+// NewPorts assigns ports from first to last inclusive
+func NewPorts(first int, last int, cooldown time.Duration) *Ports {
+	return &Ports{
+		first:    first,
+		last:     last,
+		cooldown: cooldown,
+		cooling:  make(map[int]time.Time),
+		now:      time.Now,
+	}
+}
+
+// NewVirtualPorts numbers players without opening sockets for them, see Mux
+func NewVirtualPorts() *Ports {
+	return NewPorts(firstVirtualPort, math.MaxInt32, 0)
+}
 
 // 0 <= index <= len(a)
 func insert(a []int, index int, value int) []int {
@@ -60,36 +103,52 @@ func insert(a []int, index int, value int) []int {
 	return a
 }
 
-func getNextAvailablePort(firstPort int, assignedPorts *[]int) int {
-	nextPort := firstPort
-	portCount := len(*assignedPorts)
-
-	if portCount == 0 {
-		*assignedPorts = append(*assignedPorts, nextPort)
-		return nextPort
+// Assign reserves the lowest port that is neither assigned nor cooling down
+func (ports *Ports) Assign() (int, error) {
+	now := ports.now()
+	for port, freed := range ports.cooling {
+		if now.Sub(freed) >= ports.cooldown {
+			delete(ports.cooling, port)
+		}
 	}
 
-	// use a first hole in port list, if one exists
-	for i, port := range *assignedPorts {
-		if port == nextPort {
-			nextPort = port + 1
-		} else {
-			*assignedPorts = insert(*assignedPorts, i, nextPort)
-			break
+	// assigned is sorted, so walk it alongside the range
+	i := 0
+	for port := ports.first; port <= ports.last; port++ {
+		for i < len(ports.assigned) && ports.assigned[i] < port {
+			i++
+		}
+		if i < len(ports.assigned) && ports.assigned[i] == port {
+			continue
+		}
+		if _, ok := ports.cooling[port]; ok {
+			continue
 		}
+		ports.assigned = insert(ports.assigned, i, port)
+		return port, nil
 	}
 
-	lastPort := (*assignedPorts)[len(*assignedPorts)-1]
-	if nextPort > lastPort {
-		*assignedPorts = append(*assignedPorts, nextPort)
-	}
+	return 0, fmt.Errorf("all proxy ports from %d to %d are in use", ports.first, ports.last)
+}
 
-	return nextPort
+// Reserve assigns port itself, such as the port a restored player had
+// before a restart
+func (ports *Ports) Reserve(port int) error {
+	if port < ports.first || port > ports.last {
+		return fmt.Errorf("proxy port %d is not between %d and %d", port, ports.first, ports.last)
+	}
+	i := sort.SearchInts(ports.assigned, port)
+	if i < len(ports.assigned) && ports.assigned[i] == port {
+		return fmt.Errorf("proxy port %d is in use", port)
+	}
+	delete(ports.cooling, port)
+	ports.assigned = insert(ports.assigned, i, port)
+	return nil
 }
 
-func DeletePort(port int) {
+func (ports *Ports) Delete(port int) {
 	idx := -1
-	for i, value := range assignedPlayerPorts {
+	for i, value := range ports.assigned {
 		if value == port {
 			idx = i
 			break
@@ -97,56 +156,75 @@ func DeletePort(port int) {
 	}
 
 	if idx >= 0 {
-		copy(assignedPlayerPorts[idx:], assignedPlayerPorts[idx+1:])
-		assignedPlayerPorts = assignedPlayerPorts[:len(assignedPlayerPorts)-1]
+		copy(ports.assigned[idx:], ports.assigned[idx+1:])
+		ports.assigned = ports.assigned[:len(ports.assigned)-1]
+		if ports.cooldown > 0 {
+			ports.cooling[port] = ports.now()
+		}
 	}
 }
 
+// Assigned is the number of ports in use
+func (ports *Ports) Assigned() int {
+	return len(ports.assigned)
+}
+
+// AddPlayer opens a socket relaying for the player at playerAddr, on
+// proxyPort or, when it is 0, the lowest free port
 func AddPlayer(
+	transport transport.Transport,
+	ports *Ports,
+	proxyPort int,
+	packetLimiter *limit.Limiter,
+	logger *slog.Logger,
+	watchdog *watchdog.Watchdog,
 	wg *sync.WaitGroup,
 	playerAddr net.UDPAddr,
-	rxChannel chan UdpPacket,
+	rxQueue *Queue,
+	handler Handler,
+	txPolicy QueuePolicy,
 	disconnectChannel chan struct{},
 	shutdownChannel chan struct{},
-) (int, chan UdpPacket, *net.UDPConn) {
-	if len(assignedPlayerPorts) > 1000 {
-		// TODO this allows someone to deny service
-		panic("maximum players exceeded (1000)")
-	}
-	nextPlayerPort := getNextAvailablePort(firstPlayerPort, &assignedPlayerPorts)
-	playerRoute := newPlayerRoute(playerAddr, nextPlayerPort, rxChannel, disconnectChannel)
-	createPlayerProxy(wg, playerRoute, shutdownChannel)
-	return playerRoute.ProxyPort, playerRoute.TxChannel, playerRoute.Connection
+) (int, *Queue, transport.PacketConn, error) {
+	nextPlayerPort := proxyPort
+	var err error
+	if proxyPort == 0 {
+		nextPlayerPort, err = ports.Assign()
+	} else {
+		err = ports.Reserve(proxyPort)
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	playerRoute := newPlayerRoute(playerAddr, nextPlayerPort, rxQueue, NewQueue(txPolicy), disconnectChannel)
+	playerRoute.PacketLimiter = packetLimiter
+	playerRoute.Handler = handler
+	playerRoute.Logger = logger.With(logging.ProxyPort, nextPlayerPort)
+	playerRoute.Watchdog = watchdog
+	playerRoute, err = createPlayerProxy(transport, wg, playerRoute, shutdownChannel)
+	if err != nil {
+		ports.Delete(nextPlayerPort)
+		return 0, nil, nil, err
+	}
+	return playerRoute.ProxyPort, playerRoute.TxQueue, playerRoute.Connection, nil
 }
 
-func newPlayerRoute(addr net.UDPAddr, port int, rxChannel chan UdpPacket, disconnectChannel chan struct{}) Route {
-	txChannel := make(chan UdpPacket)
-
+func newPlayerRoute(addr net.UDPAddr, port int, rxQueue *Queue, txQueue *Queue, disconnectChannel chan struct{}) Route {
 	return Route{
-		addr,
-		port,
-		nil,
-		rxChannel,
-		txChannel,
-		disconnectChannel,
+		PlayerIPAddr:      addr,
+		ProxyPort:         port,
+		RxQueue:           rxQueue,
+		TxQueue:           txQueue,
+		DisconnectChannel: disconnectChannel,
 	}
 }
 
-func createPlayerProxy(wg *sync.WaitGroup, playerRoute Route, shutdownChannel chan struct{}) {
-	fmt.Println()
-	log.Printf("Creating proxy: %d => %s:%d\n", playerRoute.ProxyPort,
-		playerRoute.PlayerIPAddr.IP.String(), playerRoute.PlayerIPAddr.Port)
-
-	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", playerRoute.ProxyPort))
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
+func createPlayerProxy(transport transport.Transport, wg *sync.WaitGroup, playerRoute Route, shutdownChannel chan struct{}) (Route, error) {
+	playerRoute.Logger.Info("creating proxy", logging.PlayerAddr, playerRoute.PlayerIPAddr.String())
 
-	connection, err := net.ListenUDP("udp4", listenAddr)
+	connection, err := transport.ListenUDP(playerRoute.ProxyPort)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return playerRoute, err
 	}
 
 	playerRoute.Connection = connection
@@ -154,66 +232,84 @@ func createPlayerProxy(wg *sync.WaitGroup, playerRoute Route, shutdownChannel ch
 	wg.Add(2)
 	go udpListener(wg, shutdownChannel, playerRoute)
 	go udpTransmitter(wg, shutdownChannel, playerRoute)
+
+	return playerRoute, nil
 }
 
 func udpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, playerRoute Route) {
 	defer wg.Done()
 	buffer := make([]byte, util.MaxUdpPacketSize)
+	watch := playerRoute.Watchdog.Watch(fmt.Sprint("listener on port ", playerRoute.ProxyPort))
+	defer watch.Stop()
 
-	go func() {
-		for {
-			select {
-			case _, ok := <-playerRoute.DisconnectChannel:
-				if !ok {
-					playerRoute.Connection.Close()
-					return
-				}
-			case _, ok := <-shutdownChannel:
-				if !ok {
-					playerRoute.Connection.Close()
-					return
-				}
-			}
-		}
-	}()
-
+	// the transmitter closes the socket, which stops this
 	for {
 		n, addr, err := playerRoute.Connection.ReadFromUDP(buffer)
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
+				playerRoute.Logger.Warn("receive failed", "error", err)
 			}
-			fmt.Println("Stopped listening on UDP port", playerRoute.ProxyPort)
+			playerRoute.Logger.Debug("stopped listening")
 			break
 		}
 
+		if !playerRoute.PacketLimiter.Allow(addr.IP.String()) {
+			continue
+		}
+
+		watch.Busy()
 		data := make([]byte, n)
 		copy(data, buffer)
-		playerRoute.RxChannel <- UdpPacket{*addr, net.UDPAddr{}, playerRoute.ProxyPort, n, data}
+		packet := UdpPacket{*addr, net.UDPAddr{}, playerRoute.ProxyPort, n, data}
+		if playerRoute.Handler == nil || !playerRoute.Handler(packet) {
+			playerRoute.RxQueue.Push(packet, playerRoute.DisconnectChannel, shutdownChannel)
+		}
+		watch.Idle()
 	}
 }
 
 func udpTransmitter(wg *sync.WaitGroup, shutdownChannel chan struct{}, playerRoute Route) {
 	defer wg.Done()
 	defer func() {
-		fmt.Println("Stopped transmitting on UDP port", playerRoute.ProxyPort)
+		playerRoute.Logger.Debug("stopped transmitting")
 	}()
+	defer playerRoute.Connection.Close()
+	watch := playerRoute.Watchdog.Watch(fmt.Sprint("transmitter on port ", playerRoute.ProxyPort))
+	defer watch.Stop()
+
+	transmit := func(data UdpPacket) {
+		watch.Busy()
+		_, err := playerRoute.Connection.WriteToUDP(data.Buffer, &data.DstAddr)
+		if err != nil {
+			playerRoute.Logger.Warn("send failed", logging.PlayerAddr, data.DstAddr.String(), "error", err)
+		}
+		watch.Idle()
+	}
 
 	for {
 		select {
 		case _, ok := <-playerRoute.DisconnectChannel:
 			if !ok {
-				return
+				// what was queued before the player left, such as the
+				// packet telling their peers so, is still sent
+				for {
+					data, ok := playerRoute.TxQueue.Pop()
+					if !ok {
+						return
+					}
+					transmit(data)
+				}
 			}
 		case _, ok := <-shutdownChannel:
 			if !ok {
 				return
 			}
-		case data := <-playerRoute.TxChannel:
-			_, err := playerRoute.Connection.WriteToUDP(data.Buffer, &data.DstAddr)
-			if err != nil {
-				fmt.Println(err)
+		case <-playerRoute.TxQueue.Ready():
+			data, ok := playerRoute.TxQueue.Pop()
+			if !ok {
+				continue
 			}
+			transmit(data)
 		}
 	}
 }
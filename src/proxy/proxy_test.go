@@ -0,0 +1,87 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func assign(t *testing.T, ports *Ports, expected int) {
+	t.Helper()
+	port, err := ports.Assign()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != expected {
+		t.Fatalf("assigned port %d, expected %d", port, expected)
+	}
+}
+
+func TestPortsAssignLowest(t *testing.T) {
+	ports := NewPorts(40001, 40003, 0)
+	assign(t, ports, 40001)
+	assign(t, ports, 40002)
+	assign(t, ports, 40003)
+
+	_, err := ports.Assign()
+	if err == nil {
+		t.Fatal("assigned a port outside the range")
+	}
+
+	ports.Delete(40002)
+	assign(t, ports, 40002)
+	if ports.Assigned() != 3 {
+		t.Errorf("%d ports assigned, expected 3", ports.Assigned())
+	}
+}
+
+func TestPortsCooldown(t *testing.T) {
+	now := time.Unix(0, 0)
+	ports := NewPorts(40001, 40002, time.Minute)
+	ports.now = func() time.Time { return now }
+
+	assign(t, ports, 40001)
+	assign(t, ports, 40002)
+	ports.Delete(40001)
+
+	_, err := ports.Assign()
+	if err == nil {
+		t.Fatal("reused a port during its cooldown")
+	}
+
+	now = now.Add(time.Minute)
+	assign(t, ports, 40001)
+}
+
+func TestPortsReserve(t *testing.T) {
+	ports := NewPorts(40001, 40003, 0)
+	err := ports.Reserve(40002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports.Reserve(40002) == nil {
+		t.Error("reserved a port twice")
+	}
+	if ports.Reserve(40004) == nil {
+		t.Error("reserved a port outside the range")
+	}
+
+	assign(t, ports, 40001)
+	assign(t, ports, 40003)
+}
@@ -0,0 +1,152 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy is how big a queue is and what it may drop when it is full
+type QueuePolicy struct {
+	Capacity int
+	// Droppable reports whether a packet may be dropped, nil drops nothing
+	Droppable func(packet UdpPacket) bool
+	// Dropped counts the packets dropped with sync/atomic, nil counts nothing
+	Dropped *uint64
+}
+
+// Queue is a bounded queue of packets. When it is full, the oldest packet
+// that may be dropped, such as stale game state, makes room for the next
+// one. A packet that may not be dropped, such as a join or a nat probe,
+// waits for room instead, so that the senders only stall once the queue is
+// full of packets nothing can be done without.
+type Queue struct {
+	policy  QueuePolicy
+	mutex   sync.Mutex
+	packets []UdpPacket
+	// ready and space are signalled when a packet is pushed and popped
+	ready chan struct{}
+	space chan struct{}
+}
+
+func NewQueue(policy QueuePolicy) *Queue {
+	if policy.Capacity < 1 {
+		policy.Capacity = 1
+	}
+	return &Queue{
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues packet and reports whether it was queued rather than dropped.
+// A packet that can't be dropped waits for room until disconnectChannel or
+// shutdownChannel is closed; either may be nil.
+func (queue *Queue) Push(packet UdpPacket, disconnectChannel chan struct{}, shutdownChannel chan struct{}) bool {
+	droppable := queue.policy.Droppable != nil && queue.policy.Droppable(packet)
+	for {
+		queue.mutex.Lock()
+		if len(queue.packets) >= queue.policy.Capacity && !queue.dropOldest() {
+			if droppable {
+				// nothing queued is older game state than this
+				queue.mutex.Unlock()
+				queue.countDrop()
+				return false
+			}
+			queue.mutex.Unlock()
+			select {
+			case <-queue.space:
+				continue
+			case <-disconnectChannel:
+				return false
+			case <-shutdownChannel:
+				return false
+			}
+		}
+		queue.packets = append(queue.packets, packet)
+		queue.mutex.Unlock()
+		signal(queue.ready)
+		return true
+	}
+}
+
+// dropOldest drops the oldest packet that may be dropped, and reports
+// whether there was one. The mutex is held.
+func (queue *Queue) dropOldest() bool {
+	if queue.policy.Droppable == nil {
+		return false
+	}
+	for i, packet := range queue.packets {
+		if queue.policy.Droppable(packet) {
+			copy(queue.packets[i:], queue.packets[i+1:])
+			queue.packets[len(queue.packets)-1] = UdpPacket{}
+			queue.packets = queue.packets[:len(queue.packets)-1]
+			queue.countDrop()
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *Queue) countDrop() {
+	if queue.policy.Dropped != nil {
+		atomic.AddUint64(queue.policy.Dropped, 1)
+	}
+}
+
+// Ready is signalled when there are packets to pop
+func (queue *Queue) Ready() <-chan struct{} {
+	return queue.ready
+}
+
+// Pop removes the oldest packet, and reports false if there was none
+func (queue *Queue) Pop() (UdpPacket, bool) {
+	queue.mutex.Lock()
+	if len(queue.packets) == 0 {
+		queue.mutex.Unlock()
+		return UdpPacket{}, false
+	}
+	packet := queue.packets[0]
+	queue.packets[0] = UdpPacket{}
+	queue.packets = queue.packets[1:]
+	remaining := len(queue.packets)
+	queue.mutex.Unlock()
+
+	if remaining > 0 {
+		// whoever pops next needn't drain the queue in one go
+		signal(queue.ready)
+	}
+	signal(queue.space)
+	return packet, true
+}
+
+// Len is the number of packets queued
+func (queue *Queue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.packets)
+}
+
+func signal(channel chan struct{}) {
+	select {
+	case channel <- struct{}{}:
+	default:
+	}
+}
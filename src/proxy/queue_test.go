@@ -0,0 +1,123 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// queued packets are numbered by their first byte, the second is 1 for a
+// packet that may be dropped
+func queuePacket(number byte, droppable bool) UdpPacket {
+	buffer := []byte{number, 0}
+	if droppable {
+		buffer[1] = 1
+	}
+	return UdpPacket{Buffer: buffer}
+}
+
+func newTestQueue(capacity int) (*Queue, *uint64) {
+	var dropped uint64
+	return NewQueue(QueuePolicy{
+		Capacity:  capacity,
+		Droppable: func(packet UdpPacket) bool { return packet.Buffer[1] == 1 },
+		Dropped:   &dropped,
+	}), &dropped
+}
+
+func popNumbers(queue *Queue) []byte {
+	var numbers []byte
+	for {
+		packet, ok := queue.Pop()
+		if !ok {
+			return numbers
+		}
+		numbers = append(numbers, packet.Buffer[0])
+	}
+}
+
+func TestQueueDropsOldestDroppable(t *testing.T) {
+	queue, dropped := newTestQueue(3)
+	queue.Push(queuePacket(1, true), nil, nil)
+	queue.Push(queuePacket(2, false), nil, nil)
+	queue.Push(queuePacket(3, true), nil, nil)
+
+	// a full queue drops the oldest game state for game state, and for a
+	// packet that can't be dropped
+	if !queue.Push(queuePacket(4, true), nil, nil) {
+		t.Error("newer game state was dropped")
+	}
+	if !queue.Push(queuePacket(5, false), nil, nil) {
+		t.Error("control packet was dropped")
+	}
+	if numbers := popNumbers(queue); string(numbers) != string([]byte{2, 4, 5}) {
+		t.Errorf("popped %v", numbers)
+	}
+	if *dropped != 2 {
+		t.Errorf("counted %d dropped packets, expected 2", *dropped)
+	}
+
+	// with only control packets queued, game state is dropped itself
+	queue.Push(queuePacket(6, false), nil, nil)
+	queue.Push(queuePacket(7, false), nil, nil)
+	queue.Push(queuePacket(8, false), nil, nil)
+	if queue.Push(queuePacket(9, true), nil, nil) {
+		t.Error("game state was queued past the capacity")
+	}
+	if *dropped != 3 || queue.Len() != 3 {
+		t.Errorf("%d packets queued, %d dropped", queue.Len(), *dropped)
+	}
+}
+
+func TestQueueControlWaitsForRoom(t *testing.T) {
+	queue, dropped := newTestQueue(1)
+	queue.Push(queuePacket(1, false), nil, nil)
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- queue.Push(queuePacket(2, false), nil, nil)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("control packet was pushed onto a queue full of control packets")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-queue.Ready()
+	if packet, _ := queue.Pop(); packet.Buffer[0] != 1 {
+		t.Errorf("popped packet %d first", packet.Buffer[0])
+	}
+	if !<-pushed {
+		t.Error("waiting control packet was dropped")
+	}
+	if packet, _ := queue.Pop(); packet.Buffer[0] != 2 || *dropped != 0 {
+		t.Errorf("popped packet %d, %d dropped", packet.Buffer[0], *dropped)
+	}
+
+	// a player who leaves stops the wait
+	queue.Push(queuePacket(3, false), nil, nil)
+	disconnectChannel := make(chan struct{})
+	go func() {
+		pushed <- queue.Push(queuePacket(4, false), disconnectChannel, nil)
+	}()
+	close(disconnectChannel)
+	if <-pushed {
+		t.Error("packet to a player who left was queued")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/util"
+)
+
+// A recording file is a header followed by records:
+//
+//	header: "BOLOREC" version(1) game_id(8) started(8, unix microseconds)
+//	record: time(uvarint, microseconds since started) direction(1)
+//	        proxy_port(2) peer_proxy_port(2) length(uvarint) packet(length)
+//
+// Numbers are big endian. A file can be appended to after it is reopened,
+// since record times are relative to the header.
+const magic = "BOLOREC"
+const version = 1
+const headerSize = len(magic) + 1 + 8 + 8
+
+// Extension is the file name extension of recordings
+const Extension = ".bolorec"
+
+// Header identifies the game a recording is of
+type Header struct {
+	GameId  bolo.GameId
+	Started time.Time
+}
+
+// Record is one game state packet relayed between two players
+type Record struct {
+	Time time.Time
+	// Direction is Inbound for the packet as the sender sent it, and
+	// Outbound for the packet as it was relayed after rewriting
+	Direction capture.Direction
+	// ProxyPort is the player who sent the packet, PeerProxyPort the player
+	// it was relayed to
+	ProxyPort     int
+	PeerProxyPort int
+	Buffer        []byte
+}
+
+// Filename is the name of the recording of gameId in a recording directory
+func Filename(gameId bolo.GameId) string {
+	return hex.EncodeToString(gameId[:]) + Extension
+}
+
+// Writer writes records to a recording file
+type Writer struct {
+	w      io.Writer
+	header Header
+}
+
+// NewWriter writes header to w, which starts a new recording
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	buffer := make([]byte, 0, headerSize)
+	buffer = append(buffer, magic...)
+	buffer = append(buffer, version)
+	buffer = append(buffer, header.GameId[:]...)
+	buffer = binary.BigEndian.AppendUint64(buffer, uint64(header.Started.UnixMicro()))
+	_, err := w.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return AppendWriter(w, header), nil
+}
+
+// AppendWriter writes records to the end of a recording that starts with
+// header
+func AppendWriter(w io.Writer, header Header) *Writer {
+	return &Writer{w: w, header: header}
+}
+
+func (writer *Writer) WriteRecord(record Record) error {
+	if record.ProxyPort < 0 || record.ProxyPort > 65535 || record.PeerProxyPort < 0 || record.PeerProxyPort > 65535 {
+		return fmt.Errorf("proxy ports %d and %d are out of range", record.ProxyPort, record.PeerProxyPort)
+	}
+
+	offset := record.Time.Sub(writer.header.Started).Microseconds()
+	if offset < 0 {
+		// the clock went backwards
+		offset = 0
+	}
+
+	buffer := make([]byte, 0, 2*binary.MaxVarintLen64+5+len(record.Buffer))
+	buffer = binary.AppendUvarint(buffer, uint64(offset))
+	buffer = append(buffer, byte(record.Direction))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(record.ProxyPort))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(record.PeerProxyPort))
+	buffer = binary.AppendUvarint(buffer, uint64(len(record.Buffer)))
+	buffer = append(buffer, record.Buffer...)
+	_, err := writer.w.Write(buffer)
+	return err
+}
+
+// Reader reads the records of a recording file
+type Reader struct {
+	Header Header
+	r      *bufio.Reader
+	// offset is the end of the last whole record read
+	offset int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+
+	buffer := make([]byte, headerSize)
+	_, err := io.ReadFull(reader.r, buffer)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("not a recording, too short")
+		}
+		return nil, err
+	}
+	if string(buffer[0:len(magic)]) != magic {
+		return nil, errors.New("not a recording")
+	}
+	if buffer[len(magic)] != version {
+		return nil, fmt.Errorf("recording version %d is not supported", buffer[len(magic)])
+	}
+	copy(reader.Header.GameId[:], buffer[len(magic)+1:])
+	reader.Header.Started = time.UnixMicro(int64(binary.BigEndian.Uint64(buffer[len(magic)+9:])))
+	reader.offset = int64(headerSize)
+
+	return reader, nil
+}
+
+// Next returns the next record, or io.EOF after the last one.
+// io.ErrUnexpectedEOF means the file ends part way through a record, as it
+// does when the server stopped while writing it.
+func (reader *Reader) Next() (Record, error) {
+	var record Record
+	size := int64(0)
+
+	offset, n, err := readUvarint(reader.r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && n == 0 {
+			return record, io.EOF
+		}
+		return record, err
+	}
+	size += int64(n)
+	record.Time = reader.Header.Started.Add(time.Duration(offset) * time.Microsecond)
+
+	fields := make([]byte, 5)
+	_, err = io.ReadFull(reader.r, fields)
+	if err != nil {
+		return record, io.ErrUnexpectedEOF
+	}
+	size += int64(len(fields))
+	record.Direction = capture.Direction(fields[0])
+	record.ProxyPort = int(binary.BigEndian.Uint16(fields[1:3]))
+	record.PeerProxyPort = int(binary.BigEndian.Uint16(fields[3:5]))
+
+	length, n, err := readUvarint(reader.r)
+	if err != nil {
+		return record, err
+	}
+	size += int64(n)
+	if length > util.MaxUdpPacketSize {
+		return record, fmt.Errorf("record at offset %d is %d bytes, too long for a packet", reader.offset, length)
+	}
+
+	record.Buffer = make([]byte, length)
+	_, err = io.ReadFull(reader.r, record.Buffer)
+	if err != nil {
+		return record, io.ErrUnexpectedEOF
+	}
+	size += int64(length)
+
+	reader.offset += size
+	return record, nil
+}
+
+// Offset is the size of the header and the records read so far
+func (reader *Reader) Offset() int64 {
+	return reader.offset
+}
+
+// readUvarint is binary.ReadUvarint, also returning how many bytes were read
+// and turning any end of file into io.ErrUnexpectedEOF
+func readUvarint(r io.ByteReader) (uint64, int, error) {
+	var value uint64
+	for n := 0; n < binary.MaxVarintLen64; n++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, n, err
+		}
+		value |= uint64(b&0x7f) << (7 * n)
+		if b < 0x80 {
+			return value, n + 1, nil
+		}
+	}
+	return 0, binary.MaxVarintLen64, errors.New("varint is too long")
+}
+
+// ReadFile reads a whole recording. If the file ends part way through a
+// record, the whole records before it are returned with the error.
+func ReadFile(filename string) (Header, []Record, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer file.Close()
+
+	reader, err := NewReader(file)
+	if err != nil {
+		return Header{}, nil, err
+	}
+
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return reader.Header, records, nil
+		}
+		if err != nil {
+			return reader.Header, records, err
+		}
+		records = append(records, record)
+	}
+}
@@ -0,0 +1,293 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package recording records the game state packets of every game to a file
+// per game, so that real matches can be replayed through a test relay with
+// bolotest.Replayer
+package recording
+
+import (
+	"bufio"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logging"
+)
+
+// queueSize is how many packets can wait to be written before more are
+// dropped
+const queueSize = 1024
+const eventQueueSize = 256
+
+// Packet is a game state packet of a game, see Record
+type Packet struct {
+	Time          time.Time
+	Direction     capture.Direction
+	GameId        bolo.GameId
+	ProxyPort     int
+	PeerProxyPort int
+	Buffer        []byte
+}
+
+// Recorder writes the packets of each game to its own file in a directory,
+// from when the game's first packet is relayed until the game ends
+type Recorder struct {
+	directory string
+	logger    *slog.Logger
+	channel   chan Packet
+	packets   uint64
+	dropped   uint64
+}
+
+// gameFile is the open recording of one game
+type gameFile struct {
+	file     *os.File
+	buffered *bufio.Writer
+	writer   *Writer
+	failed   bool
+	packets  uint64
+}
+
+// New records games into directory. An empty directory disables recording.
+func New(directory string, logger *slog.Logger) *Recorder {
+	return &Recorder{
+		directory: directory,
+		logger:    logger,
+		channel:   make(chan Packet, queueSize),
+	}
+}
+
+// Enabled reports whether games are recorded, so that callers can skip
+// building packets when they aren't
+func (recorder *Recorder) Enabled() bool {
+	return recorder.directory != ""
+}
+
+// Filename is where the recording of gameId is written
+func (recorder *Recorder) Filename(gameId bolo.GameId) string {
+	return filepath.Join(recorder.directory, Filename(gameId))
+}
+
+// Packets is the number of packets written
+func (recorder *Recorder) Packets() uint64 {
+	return atomic.LoadUint64(&recorder.packets)
+}
+
+// Dropped is the number of packets not written because the files fell behind
+// or could not be written
+func (recorder *Recorder) Dropped() uint64 {
+	return atomic.LoadUint64(&recorder.dropped)
+}
+
+// Record queues packet to be written. It never blocks; packets are dropped
+// when the files fall behind. The buffer is copied, so the caller may go on to
+// rewrite it.
+func (recorder *Recorder) Record(packet Packet) {
+	if !recorder.Enabled() {
+		return
+	}
+
+	if packet.Time.IsZero() {
+		packet.Time = time.Now()
+	}
+	packet.Buffer = append([]byte(nil), packet.Buffer...)
+
+	select {
+	case recorder.channel <- packet:
+	default:
+		atomic.AddUint64(&recorder.dropped, 1)
+	}
+}
+
+// Subscribe starts listening for games ending, so that none are missed before
+// Run
+func (recorder *Recorder) Subscribe(bus *events.Bus) *events.Subscription {
+	return bus.Subscribe(eventQueueSize)
+}
+
+// Run writes queued packets until shutdown is closed, closing the recording
+// of each game that ends
+func (recorder *Recorder) Run(wg *sync.WaitGroup, shutdown chan struct{}, subscription *events.Subscription) {
+	defer wg.Done()
+	defer subscription.Close()
+
+	games := make(map[bolo.GameId]*gameFile)
+	for {
+		select {
+		case <-shutdown:
+			// write what was relayed before the shutdown
+			for {
+				select {
+				case packet := <-recorder.channel:
+					recorder.write(games, packet)
+				default:
+					for gameId := range games {
+						recorder.close(games, gameId)
+					}
+					return
+				}
+			}
+		case packet := <-recorder.channel:
+			recorder.write(games, packet)
+			if len(recorder.channel) == 0 {
+				// keep the files readable while games run
+				for gameId, game := range games {
+					recorder.flush(gameId, game)
+				}
+			}
+		case event := <-subscription.C:
+			if event.Type == events.GameEnded {
+				if _, ok := games[event.GameId]; ok {
+					recorder.close(games, event.GameId)
+				}
+			}
+		}
+	}
+}
+
+func (recorder *Recorder) write(games map[bolo.GameId]*gameFile, packet Packet) {
+	game, ok := games[packet.GameId]
+	if !ok {
+		game = recorder.open(packet.GameId, packet.Time)
+		games[packet.GameId] = game
+	}
+	if game.failed {
+		atomic.AddUint64(&recorder.dropped, 1)
+		return
+	}
+
+	err := game.writer.WriteRecord(Record{
+		Time:          packet.Time,
+		Direction:     packet.Direction,
+		ProxyPort:     packet.ProxyPort,
+		PeerProxyPort: packet.PeerProxyPort,
+		Buffer:        packet.Buffer,
+	})
+	if err != nil {
+		recorder.fail(packet.GameId, game, err)
+		atomic.AddUint64(&recorder.dropped, 1)
+		return
+	}
+	game.packets++
+	atomic.AddUint64(&recorder.packets, 1)
+}
+
+// open starts the recording of a game, or continues it if the game was
+// recorded before, such as before a restart
+func (recorder *Recorder) open(gameId bolo.GameId, started time.Time) *gameFile {
+	game := &gameFile{}
+	filename := recorder.Filename(gameId)
+	logger := recorder.logger.With(logging.GameId, hex.EncodeToString(gameId[:]), "filename", filename)
+
+	err := os.MkdirAll(recorder.directory, 0755)
+	if err != nil {
+		logger.Error("can't record game", "error", err)
+		game.failed = true
+		return game
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logger.Error("can't record game", "error", err)
+		game.failed = true
+		return game
+	}
+	game.file = file
+	game.buffered = bufio.NewWriter(file)
+
+	reader, err := NewReader(file)
+	if err != nil {
+		// a new file, or one too broken to add to
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, 0)
+		}
+		if err == nil {
+			game.writer, err = NewWriter(game.buffered, Header{GameId: gameId, Started: started})
+		}
+		if err != nil {
+			recorder.fail(gameId, game, err)
+			return game
+		}
+		logger.Info("recording game")
+		return game
+	}
+
+	// drop a record cut off by the last run stopping while writing it
+	for {
+		_, err = reader.Next()
+		if err != nil {
+			break
+		}
+	}
+	err = file.Truncate(reader.Offset())
+	if err == nil {
+		_, err = file.Seek(reader.Offset(), 0)
+	}
+	if err != nil {
+		recorder.fail(gameId, game, err)
+		return game
+	}
+	game.writer = AppendWriter(game.buffered, reader.Header)
+	logger.Info("continuing recording of game")
+	return game
+}
+
+func (recorder *Recorder) flush(gameId bolo.GameId, game *gameFile) {
+	if game.failed {
+		return
+	}
+	err := game.buffered.Flush()
+	if err != nil {
+		recorder.fail(gameId, game, err)
+	}
+}
+
+// fail stops recording a game after its file could not be written
+func (recorder *Recorder) fail(gameId bolo.GameId, game *gameFile, err error) {
+	recorder.logger.Error("recording write failed", logging.GameId, hex.EncodeToString(gameId[:]), "filename", recorder.Filename(gameId), "error", err)
+	game.failed = true
+	game.file.Close()
+}
+
+func (recorder *Recorder) close(games map[bolo.GameId]*gameFile, gameId bolo.GameId) {
+	game := games[gameId]
+	delete(games, gameId)
+	if game.failed {
+		return
+	}
+
+	err := game.buffered.Flush()
+	if err == nil {
+		err = game.file.Close()
+	} else {
+		game.file.Close()
+	}
+	if err != nil {
+		recorder.logger.Error("recording write failed", logging.GameId, hex.EncodeToString(gameId[:]), "filename", recorder.Filename(gameId), "error", err)
+		return
+	}
+	recorder.logger.Info("recording closed", logging.GameId, hex.EncodeToString(gameId[:]), "filename", recorder.Filename(gameId), "packets", game.packets)
+}
@@ -0,0 +1,204 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package recording
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logging"
+)
+
+var gameId = bolo.GameId{192, 168, 1, 10, 0xdc, 0x89, 0x85, 0x00}
+
+func TestFile(t *testing.T) {
+	started := time.UnixMicro(1634472000123456)
+	records := []Record{
+		{Time: started, Direction: capture.Inbound, ProxyPort: 40001, PeerProxyPort: 40002, Buffer: []byte("Bolo\x65\x99\x08\x02\x10")},
+		{Time: started.Add(1500 * time.Microsecond), Direction: capture.Outbound, ProxyPort: 40001, PeerProxyPort: 40002, Buffer: []byte("Bolo\x65\x99\x08\x02\x10")},
+		{Time: started.Add(time.Hour), Direction: capture.Inbound, ProxyPort: 40002, PeerProxyPort: 40002, Buffer: bytes.Repeat([]byte{0xff}, 300)},
+	}
+
+	var file bytes.Buffer
+	writer, err := NewWriter(&file, Header{GameId: gameId, Started: started})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		err = writer.WriteRecord(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if file.Len() > headerSize+3*(5+1+4+2)+2*9+300 {
+		t.Errorf("recording is %d bytes", file.Len())
+	}
+
+	reader, err := NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Header.GameId != gameId || !reader.Header.Started.Equal(started) {
+		t.Errorf("header is %+v", reader.Header)
+	}
+	for i, want := range records {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !record.Time.Equal(want.Time) {
+			t.Errorf("record %d time is %s, expected %s", i, record.Time, want.Time)
+		}
+		record.Time = want.Time
+		if !reflect.DeepEqual(record, want) {
+			t.Errorf("record %d is %+v, expected %+v", i, record, want)
+		}
+	}
+	_, err = reader.Next()
+	if err != io.EOF {
+		t.Errorf("read past the last record got %v", err)
+	}
+	if reader.Offset() != int64(file.Len()) {
+		t.Errorf("offset is %d, expected %d", reader.Offset(), file.Len())
+	}
+
+	// a record cut off part way
+	reader, _ = NewReader(bytes.NewReader(file.Bytes()[:file.Len()-10]))
+	reader.Next()
+	reader.Next()
+	_, err = reader.Next()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated record got %v", err)
+	}
+
+	_, err = NewReader(bytes.NewReader([]byte("Bolo\x65\x99\x08\x02")))
+	if err == nil {
+		t.Error("a packet was read as a recording")
+	}
+}
+
+// runRecorder runs a recorder until the test ends
+func runRecorder(t *testing.T, directory string) (*Recorder, *events.Bus, func()) {
+	recorder := New(directory, logging.Discard().Recording)
+	bus := events.NewBus()
+	wg := &sync.WaitGroup{}
+	shutdown := make(chan struct{})
+	wg.Add(1)
+	go recorder.Run(wg, shutdown, recorder.Subscribe(bus))
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(shutdown)
+			wg.Wait()
+		})
+	}
+	t.Cleanup(stop)
+	return recorder, bus, stop
+}
+
+func waitForPackets(t *testing.T, recorder *Recorder, packets uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for recorder.Packets() < packets && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if recorder.Packets() < packets {
+		t.Fatalf("recorded %d packets, expected %d", recorder.Packets(), packets)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "recordings")
+	recorder, bus, stop := runRecorder(t, directory)
+	otherGameId := gameId
+	otherGameId[7] = 0x01
+
+	buffer := []byte("Bolo\x65\x99\x08\x02\x10")
+	recorder.Record(Packet{Direction: capture.Inbound, GameId: gameId, ProxyPort: 40001, PeerProxyPort: 40002, Buffer: buffer})
+	buffer[8] = 0x11 // the recorder has its own copy
+	recorder.Record(Packet{Direction: capture.Outbound, GameId: gameId, ProxyPort: 40001, PeerProxyPort: 40002, Buffer: buffer})
+	recorder.Record(Packet{Direction: capture.Inbound, GameId: otherGameId, ProxyPort: 40003, PeerProxyPort: 40003, Buffer: buffer})
+	waitForPackets(t, recorder, 3)
+
+	// the file is readable while the game runs, and closed when it ends
+	header, records, err := ReadFile(recorder.Filename(gameId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.GameId != gameId || len(records) != 2 {
+		t.Fatalf("recording of %x has %d records", header.GameId, len(records))
+	}
+	if records[0].Buffer[8] != 0x10 || records[1].Direction != capture.Outbound || records[1].Time.Before(records[0].Time) {
+		t.Errorf("records are %+v", records)
+	}
+	bus.Publish(events.Event{Type: events.GameEnded, GameId: gameId})
+
+	// a packet after the game ended, and one after a restart with a record
+	// cut off, add to the same file
+	recorder.Record(Packet{Direction: capture.Inbound, GameId: gameId, ProxyPort: 40002, PeerProxyPort: 40001, Buffer: buffer})
+	waitForPackets(t, recorder, 4)
+	stop()
+
+	file, err := os.OpenFile(recorder.Filename(gameId), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0x01, 0x00, 0x9c})
+	file.Close()
+
+	recorder, _, stop = runRecorder(t, directory)
+	recorder.Record(Packet{Direction: capture.Inbound, GameId: gameId, ProxyPort: 40001, PeerProxyPort: 40002, Buffer: buffer})
+	waitForPackets(t, recorder, 1)
+	stop()
+
+	header, records, err = ReadFile(recorder.Filename(gameId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("recording has %d records, expected 4", len(records))
+	}
+	if records[2].ProxyPort != 40002 || records[3].ProxyPort != 40001 || records[3].Time.Before(header.Started) {
+		t.Errorf("records are %+v", records)
+	}
+
+	_, records, err = ReadFile(recorder.Filename(otherGameId))
+	if err != nil || len(records) != 1 {
+		t.Errorf("other game has %d records, %v", len(records), err)
+	}
+}
+
+func TestRecorderDisabled(t *testing.T) {
+	recorder := New("", logging.Discard().Recording)
+	if recorder.Enabled() {
+		t.Error("recorder without a directory is enabled")
+	}
+	recorder.Record(Packet{GameId: gameId, Buffer: []byte("Bolo")})
+	if len(recorder.channel) != 0 {
+		t.Error("disabled recorder queued a packet")
+	}
+}
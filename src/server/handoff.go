@@ -0,0 +1,176 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/transport"
+)
+
+// Handoff is what a stopped server hands to the server taking over from it,
+// such as the same server in an upgraded program: its sockets, still open,
+// and its state
+type Handoff struct {
+	Sockets  []transport.Socket
+	Snapshot state.Snapshot
+	// TrackerPort and TrackerDebugPort are the ports the tracker listened
+	// on, which the next server listens on when its Config leaves them 0
+	TrackerPort      int
+	TrackerDebugPort int
+}
+
+// Close closes the handoff's copies of the sockets. A server started with the
+// handoff listens on its own copies, so the caller closes the handoff once
+// Start returns. After Start fails, the handoff can start another server
+// first.
+func (handoff *Handoff) Close() {
+	for _, socket := range handoff.Sockets {
+		socket.File.Close()
+	}
+}
+
+// inherit returns a transport that listens on the handed over sockets
+// before opening new ones from fallback
+func (handoff *Handoff) inherit(fallback transport.Transport) *transport.Inherited {
+	return transport.NewInherited(fallback, handoff.Sockets)
+}
+
+// Handoff stops the server like Shutdown, but keeps its sockets open so that
+// a server started with them in Config.Handoff carries on relaying for the
+// same players from the same ports. Packets that arrive in between wait in
+// the sockets. It is BeginHandoff and FinishHandoff at once.
+func (server *Server) Handoff(ctx context.Context) (*Handoff, error) {
+	handoff, err := server.BeginHandoff()
+	if err != nil {
+		return nil, err
+	}
+	err = server.FinishHandoff(ctx, handoff)
+	if err != nil {
+		handoff.Close()
+		return nil, err
+	}
+	return handoff, nil
+}
+
+// BeginHandoff duplicates the server's sockets while it carries on relaying,
+// so that whatever takes over, such as an upgraded process, can get ready
+// with them first. FinishHandoff stops the server and adds its state. An
+// error leaves the server running.
+func (server *Server) BeginHandoff() (*Handoff, error) {
+	context := server.getContext()
+	if context == nil {
+		return nil, errors.New("server is not started")
+	}
+
+	sockets, err := server.dupSockets(context)
+	if err != nil {
+		return nil, err
+	}
+	return &Handoff{
+		Sockets:          sockets,
+		TrackerPort:      context.ProxyPort,
+		TrackerDebugPort: context.TrackerDebugPort,
+	}, nil
+}
+
+// FinishHandoff stops the server like Shutdown and adds its state to handoff,
+// from BeginHandoff. If ctx is done before the server has stopped, the state
+// is left out.
+func (server *Server) FinishHandoff(ctx context.Context, handoff *Handoff) error {
+	context := server.getContext()
+	if context == nil {
+		return errors.New("server is not started")
+	}
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		return err
+	}
+	// the snapshot is taken once nothing is relayed any more, so that the
+	// next server starts from where this one stopped
+	handoff.Snapshot = state.TakeSnapshot(context, true)
+	return nil
+}
+
+// dupSockets duplicates every socket the server listens on. A player who
+// joins after this is given a new socket by the next server, at the same
+// port once this server has stopped.
+func (server *Server) dupSockets(context *state.ServerContext) ([]transport.Socket, error) {
+	context.Mutex.RLock()
+	defer context.Mutex.RUnlock()
+
+	type listening struct {
+		network string
+		port    int
+		socket  any
+	}
+	tcpPort := func(listener net.Listener) int {
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+
+	all := []listening{
+		{"udp", context.ProxyPort, context.UdpConnection},
+		{"tcp", tcpPort(server.listeners.tracker), server.listeners.tracker},
+		{"tcp", tcpPort(server.listeners.trackerDebug), server.listeners.trackerDebug},
+	}
+	if server.listeners.http != nil {
+		all = append(all, listening{"tcp", tcpPort(server.listeners.http), server.listeners.http})
+	}
+	if context.Mux != nil {
+		for _, port := range context.Mux.Ports() {
+			_, connection, err := context.Mux.Socket(port)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, listening{"udp", port, connection})
+		}
+	} else {
+		for _, player := range context.Players.All() {
+			all = append(all, listening{"udp", player.ProxyPort, player.Connection})
+		}
+	}
+
+	sockets := make([]transport.Socket, 0, len(all))
+	for _, socket := range all {
+		file, err := transport.Dup(socket.socket)
+		if err != nil {
+			(&Handoff{Sockets: sockets}).Close()
+			return nil, err
+		}
+		sockets = append(sockets, transport.Socket{Network: socket.network, Port: socket.port, File: file})
+	}
+	return sockets, nil
+}
+
+// restoreHandoff relays the games and players of the server that handed
+// over, and returns the players for the tracker to ping
+func restoreHandoff(context *state.ServerContext, handoff *Handoff) []state.Player {
+	logger := context.Log.Server
+	players, err := state.RestoreSnapshot(context, handoff.Snapshot, true)
+	if err != nil {
+		logger.Warn("can't restore handed over state", "error", err)
+		return nil
+	}
+	logger.Info("took over from the last server", "games", len(handoff.Snapshot.Games),
+		"players", len(players), "sockets", len(handoff.Sockets))
+	return players
+}
@@ -0,0 +1,459 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/recording"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/util"
+)
+
+// natProbeTimeout is how long a player's nat has to answer probes before nat
+// traversal to a peer is reported as failed. It is a variable so tests can
+// shorten it.
+var natProbeTimeout = 10 * time.Second
+
+// field keys for the other player in nat messages
+const peerProxyPort = "peer_proxy_port"
+const peerAddr = "peer_addr"
+
+func processPacket(
+	context *state.ServerContext,
+	packet proxy.UdpPacket,
+	startPlayerPingChannel chan state.Player,
+	playerInfoEventChannel chan util.PlayerInfoEvent,
+	playerLeaveGameChannel chan util.PlayerAddr,
+	chatChannel chan relayedChat,
+) {
+	valid, _ := bolo.ValidatePacket(packet)
+	if !valid {
+		// skip non-bolo packets
+		state.CountInvalidPacket(context)
+		return
+	}
+
+	packetType := bolo.GetPacketType(packet.Buffer)
+
+	context.Mutex.Lock()
+
+	// get destination player ip by the port the packet arrived on
+	dstPlayer, err := state.PlayerGetByRelayPort(context, packet.SrcAddr, packet.DstPort, false)
+	if err != nil {
+		// normally won't happen, but there could be a pending packet incoming from a player that was subsequently deleted
+		context.Log.Proxy.Debug("dropping packet", logging.PlayerAddr, packet.SrcAddr.String(), "error", err)
+		context.Mutex.Unlock()
+		return
+	}
+
+	// the tracker takes the mutex, so what it is sent, and the nat probes
+	// that may wait for room in a tx queue, are sent once every return
+	// below has unlocked it
+	var sends []func()
+	defer func() {
+		for _, send := range sends {
+			send()
+		}
+	}()
+
+	srcPlayer, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
+	if err != nil {
+		srcPlayer, err = state.PlayerNew(context, packet.SrcAddr, dstPlayer.GameId, packet.DstPort, false)
+		if err != nil {
+			state.RejectPlayer(context, packet.SrcAddr, err)
+			context.Mutex.Unlock()
+			return
+		}
+		newPlayer := *srcPlayer
+		sends = append(sends, func() {
+			select {
+			case startPlayerPingChannel <- newPlayer:
+			case <-context.ShutdownChannel:
+			}
+		})
+		state.LogServerState(context, false)
+	}
+
+	pong := util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
+	sends = append(sends, func() {
+		select {
+		case context.PlayerPongChannel <- pong:
+		case <-context.ShutdownChannel:
+		}
+	})
+	captureInbound(context, packet, srcPlayer, dstPlayer)
+
+	if packetType == bolo.PacketType5 {
+		if srcPlayer.GameId != dstPlayer.GameId {
+			err = state.PlayerJoinGame(context, srcPlayer.ProxyPort, dstPlayer.GameId, false)
+			if err != nil {
+				state.PlayerLogger(context.Log.Proxy, srcPlayer).Warn("player can't join game", "error", err)
+				context.Mutex.Unlock()
+				return
+			}
+			srcPlayer, _ = state.PlayerGetByPort(context, srcPlayer.ProxyPort, false)
+		}
+	}
+
+	natLogger := context.Log.Nat
+	if logging.DebugEnabled(natLogger) {
+		if packetType == bolo.PacketType5 || packetType == bolo.PacketType6 || packetType == bolo.PacketType7 {
+			timestamp := state.PeerLastSeen(context, srcPlayer, dstPlayer)
+
+			state.PlayerLogger(natLogger, srcPlayer).Debug("relaying nat packet",
+				logging.PacketType, packetType,
+				peerProxyPort, dstPlayer.ProxyPort,
+				peerAddr, fmt.Sprintf("%s:%d", dstPlayer.IpAddr.String(), dstPlayer.IpPort),
+				"traversed", time.Since(timestamp) < state.NatOpenPeriod,
+				"last_traversed", timestamp,
+			)
+		}
+	}
+
+	if packetType == bolo.PacketType7 && len(packet.Buffer) >= 22 {
+		if bytes.Equal(packet.Buffer[10:12], []byte{0x01, 0x23}) {
+			if bytes.Equal(packet.Buffer[18:22], []byte{0x45, 0x67, 0x89, 0xab}) {
+				state.CountNatProbeReply(context)
+				savedPacket, ok := srcPlayer.PeerPackets[dstPlayer.ProxyPort]
+				if !ok {
+					state.PlayerLogger(natLogger, srcPlayer).Debug("nat probe reply with no saved packet",
+						peerProxyPort, dstPlayer.ProxyPort)
+					context.Mutex.Unlock()
+					return
+				}
+				state.PlayerLogger(natLogger, srcPlayer).Debug("nat probe reply, replaying saved packet",
+					peerProxyPort, dstPlayer.ProxyPort,
+					logging.PacketType, bolo.GetPacketType(savedPacket.Buffer),
+					"length", len(savedPacket.Buffer),
+				)
+				delete(srcPlayer.PeerPackets, dstPlayer.ProxyPort)
+				delete(srcPlayer.PeerProbes, dstPlayer.ProxyPort)
+				state.CountPeerPacketReplayed(context)
+				srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
+				event := state.PlayerEvent(events.NatTraversalSucceeded, srcPlayer)
+				event.PeerProxyPort = dstPlayer.ProxyPort
+				context.Events.Publish(event)
+				// the players are copied, since forwardPacket runs without
+				// the mutex
+				src, dst := *srcPlayer, *dstPlayer
+				context.Mutex.Unlock()
+				go forwardPacket(context, savedPacket, dst, src, playerInfoEventChannel, playerLeaveGameChannel, chatChannel)
+				return
+			}
+		}
+	}
+
+	if srcPlayer.NatPort != context.ProxyPort {
+		sends = append(sends, natProbe(context, srcPlayer, context.ProxyPort, false))
+	}
+
+	// if the player is talking to themselves (happens when they are the last player in the game), no nat traversal is needed
+	if srcPlayer.ProxyPort != dstPlayer.ProxyPort {
+		timestamp := state.PeerLastSeen(context, srcPlayer, dstPlayer)
+		if time.Since(timestamp) > state.NatOpenPeriod {
+			probeTimestamp, ok := dstPlayer.PeerProbes[srcPlayer.ProxyPort]
+			if !ok {
+				dstPlayer.PeerProbes[srcPlayer.ProxyPort] = time.Now()
+			} else if time.Since(probeTimestamp) > natProbeTimeout {
+				// report it once per timeout while the peer keeps trying
+				dstPlayer.PeerProbes[srcPlayer.ProxyPort] = time.Now()
+				event := state.PlayerEvent(events.NatTraversalFailed, dstPlayer)
+				event.PeerProxyPort = srcPlayer.ProxyPort
+				context.Events.Publish(event)
+				state.PlayerLogger(natLogger, dstPlayer).Info("nat traversal failed",
+					peerProxyPort, srcPlayer.ProxyPort, "timeout", natProbeTimeout)
+			}
+			// the packet held until now is never replayed
+			if _, ok := dstPlayer.PeerPackets[srcPlayer.ProxyPort]; ok {
+				state.CountPeerPacketExpired(context)
+			}
+			dstPlayer.PeerPackets[srcPlayer.ProxyPort] = packet
+			sends = append(sends, natProbe(context, dstPlayer, srcPlayer.RelayPort, false))
+			context.Mutex.Unlock()
+			return
+		}
+
+		srcPlayer.Peers[dstPlayer.ProxyPort] = time.Now()
+		delete(dstPlayer.PeerProbes, srcPlayer.ProxyPort)
+	}
+
+	// the packets that follow on this route skip all of the above
+	if packetType != bolo.PacketType5 {
+		state.CacheRoute(context, packet.DstPort, srcPlayer, dstPlayer)
+	}
+
+	// the players are copied, since forwardPacket runs without the mutex
+	src, dst := *srcPlayer, *dstPlayer
+	context.Mutex.Unlock()
+
+	go forwardPacket(context, packet, src, dst, playerInfoEventChannel, playerLeaveGameChannel, chatChannel)
+}
+
+// relayCached relays a packet over a cached route in the goroutine of the
+// port it arrived on, without the context mutex, and reports whether it did.
+// Packets of routes that aren't cached or have gone stale, and the join and
+// nat packets that change routes, are left for processPacket.
+func relayCached(
+	context *state.ServerContext,
+	packet proxy.UdpPacket,
+	playerInfoEventChannel chan util.PlayerInfoEvent,
+	playerLeaveGameChannel chan util.PlayerAddr,
+	chatChannel chan relayedChat,
+) bool {
+	valid, _ := bolo.ValidatePacket(packet)
+	if !valid {
+		return false
+	}
+	packetType := bolo.GetPacketType(packet.Buffer)
+	if packetType == bolo.PacketType5 || packetType == bolo.PacketType6 || packetType == bolo.PacketType7 {
+		return false
+	}
+
+	route := state.CachedRoute(context, packet.DstPort, packet.SrcAddr)
+	if route == nil {
+		return false
+	}
+
+	state.CountCachedRoutePacket(context)
+	if route.Pong() {
+		select {
+		case context.PlayerPongChannel <- util.PlayerAddr{IpAddr: route.Src.IpAddr.String(), IpPort: route.Src.IpPort, ProxyPort: route.Src.ProxyPort}:
+		case <-context.ShutdownChannel:
+		}
+	}
+	captureInbound(context, packet, &route.Src, &route.Dst)
+	forwardPacket(context, packet, route.Src, route.Dst, playerInfoEventChannel, playerLeaveGameChannel, chatChannel)
+	return true
+}
+
+func captureInbound(context *state.ServerContext, packet proxy.UdpPacket, srcPlayer *state.Player, dstPlayer *state.Player) {
+	if context.Capture.Running() {
+		context.Capture.Record(capture.Packet{
+			Direction:     capture.Inbound,
+			SrcAddr:       packet.SrcAddr,
+			DstAddr:       net.UDPAddr{IP: context.ProxyIpAddr, Port: packet.DstPort},
+			GameId:        dstPlayer.GameId,
+			ProxyPort:     srcPlayer.ProxyPort,
+			PeerProxyPort: dstPlayer.ProxyPort,
+			Buffer:        packet.Buffer,
+		})
+	}
+}
+
+// natProbe logs and captures a nat probe to dstPlayer, and returns the func
+// that sends it, to be called without the mutex
+func natProbe(context *state.ServerContext, dstPlayer *state.Player, targetProxyPort int, lock bool) func() {
+	trackerPort := context.ProxyPort
+	buffer := bolo.MarshalPacketType6(context.ProxyIpAddr, targetProxyPort)
+	dstAddr := &net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
+
+	state.CountNatProbe(context)
+	natLogger := context.Log.Nat
+	if logging.DebugEnabled(natLogger) {
+		state.PlayerLogger(natLogger, dstPlayer).Debug("sending nat probe",
+			"target_port", targetProxyPort, "source_port", dstPlayer.NatPort)
+	}
+
+	if context.Capture.Running() {
+		context.Capture.Record(capture.Packet{
+			Direction: capture.Outbound,
+			SrcAddr:   net.UDPAddr{IP: context.ProxyIpAddr, Port: dstPlayer.NatPort},
+			DstAddr:   *dstAddr,
+			GameId:    dstPlayer.GameId,
+			ProxyPort: dstPlayer.ProxyPort,
+			Buffer:    buffer,
+		})
+	}
+
+	if dstPlayer.NatPort == trackerPort {
+		return func() {
+			context.UdpConnection.WriteToUDP(buffer, dstAddr)
+		}
+	}
+	txQueue, disconnectChannel, err := state.RelayTxQueue(context, dstPlayer.NatPort, lock)
+	if err != nil {
+		state.PlayerLogger(natLogger, dstPlayer).Warn("can't send nat probe", "error", err)
+		return func() {}
+	}
+	return func() {
+		txQueue.Push(proxy.UdpPacket{DstAddr: *dstAddr, Buffer: buffer}, disconnectChannel, context.ShutdownChannel)
+	}
+}
+
+func forwardPacket(
+	context *state.ServerContext,
+	packet proxy.UdpPacket,
+	srcPlayer state.Player,
+	dstPlayer state.Player,
+	playerInfoEventChannel chan util.PlayerInfoEvent,
+	playerLeaveGameChannel chan util.PlayerAddr,
+	chatChannel chan relayedChat,
+) {
+	gameState := bolo.GetPacketType(packet.Buffer) == bolo.PacketTypeGameState
+
+	// record game state as it was sent, and again as it is relayed
+	record := context.Recorder.Enabled() && gameState
+	if record {
+		context.Recorder.Record(recording.Packet{
+			Direction:     capture.Inbound,
+			GameId:        srcPlayer.GameId,
+			ProxyPort:     srcPlayer.ProxyPort,
+			PeerProxyPort: dstPlayer.ProxyPort,
+			Buffer:        packet.Buffer,
+		})
+	}
+
+	if gameState {
+		packet.Buffer = relayChat(context, srcPlayer, packet.Buffer, chatChannel)
+	}
+
+	// a player leaving is reported once the packet telling their peers so is
+	// queued, as deleting them stops their socket's transmitter. Disconnect
+	// opcodes start with 0xff, so there is room for all of them.
+	leaving := make(chan util.PlayerAddr, bytes.Count(packet.Buffer, []byte{0xff}))
+	defer func() {
+		close(leaving)
+		for player := range leaving {
+			playerLeaveGameChannel <- player
+		}
+	}()
+
+	srcPlayerAddr := util.PlayerAddr{IpAddr: srcPlayer.IpAddr.String(), IpPort: srcPlayer.IpPort, ProxyPort: srcPlayer.ProxyPort}
+	err := bolo.RewritePacket(
+		packet.Buffer,
+		context.ProxyIpAddr,
+		srcPlayer.RelayPort,
+		srcPlayerAddr,
+		playerInfoEventChannel,
+		leaving,
+	)
+	if err != nil {
+		// don't forward a packet we only partially rewrote
+		logger := state.PlayerLogger(context.Log.Proxy, &srcPlayer)
+		logger.Warn("dropping malformed packet", logging.PacketType, bolo.GetPacketType(packet.Buffer), "error", err)
+		if logging.DebugEnabled(logger) {
+			logger.Debug("malformed packet", "dump", hex.Dump(packet.Buffer))
+		}
+		state.CountMalformedPacket(context)
+		return
+	}
+
+	if gameState {
+		blocks := state.ServerChatBlocks(context, dstPlayer)
+		if len(blocks) > 0 {
+			buffer, err := bolo.AppendGameStateBlocks(packet.Buffer, blocks...)
+			if err == nil {
+				packet.Buffer = buffer
+				state.PlayerLogger(context.Log.Proxy, &dstPlayer).Debug("sent server messages", "messages", len(blocks))
+			}
+		}
+	}
+
+	packet.DstAddr = net.UDPAddr{IP: dstPlayer.IpAddr, Port: dstPlayer.IpPort}
+	if context.Capture.Running() {
+		context.Capture.Record(capture.Packet{
+			Direction:     capture.Outbound,
+			SrcAddr:       net.UDPAddr{IP: context.ProxyIpAddr, Port: srcPlayer.RelayPort},
+			DstAddr:       packet.DstAddr,
+			GameId:        srcPlayer.GameId,
+			ProxyPort:     dstPlayer.ProxyPort,
+			PeerProxyPort: srcPlayer.ProxyPort,
+			Buffer:        packet.Buffer,
+		})
+	}
+	if record {
+		context.Recorder.Record(recording.Packet{
+			Direction:     capture.Outbound,
+			GameId:        srcPlayer.GameId,
+			ProxyPort:     srcPlayer.ProxyPort,
+			PeerProxyPort: dstPlayer.ProxyPort,
+			Buffer:        packet.Buffer,
+		})
+	}
+	// game state is dropped rather than waited for when the socket is
+	// behind. The player may have left since the route was looked up, and
+	// their socket's transmitter with them.
+	if srcPlayer.TxQueue.Push(packet, srcPlayer.DisconnectChannel, context.ShutdownChannel) {
+		state.CountRelayedPacket(context, packet.Buffer)
+	}
+}
+
+// relayedChat is the chat messages of a game state packet, handed to the
+// serve loop to name their players
+type relayedChat struct {
+	gameId   bolo.GameId
+	messages []bolo.ChatMessage
+}
+
+// relayChat hands the chat messages of a game state packet to chatChannel,
+// the first time one of the players passing it around the ring sends it, and
+// returns the packet without the messages the server sent them. It runs
+// without the context mutex.
+func relayChat(context *state.ServerContext, srcPlayer state.Player, buffer []byte, chatChannel chan relayedChat) []byte {
+	messages, err := bolo.DecodeChatMessages(buffer)
+	if err != nil || len(messages) == 0 {
+		// a malformed packet is reported when rewriting it fails
+		return buffer
+	}
+
+	buffer, messages = state.RemoveServerChat(context, srcPlayer.GameId, buffer, messages)
+	messages = state.UnseenChatMessages(context, srcPlayer.GameId, messages)
+	if len(messages) > 0 {
+		select {
+		case chatChannel <- relayedChat{gameId: srcPlayer.GameId, messages: messages}:
+		case <-context.ShutdownChannel:
+		}
+	}
+	return buffer
+}
+
+// reportChat publishes and logs relayed chat messages
+func reportChat(context *state.ServerContext, chat relayedChat) {
+	chatEvents := state.ChatMessages(context, chat.gameId, chat.messages, true)
+	for _, event := range chatEvents {
+		recipients := make([]string, len(event.Recipients))
+		for i, recipient := range event.Recipients {
+			recipients[i] = recipient.Name
+			if recipient.Name == "" {
+				recipients[i] = fmt.Sprint("player ", recipient.PlayerId)
+			}
+		}
+		context.Log.Proxy.Info("chat message",
+			logging.GameId, hex.EncodeToString(event.GameId[:]),
+			logging.ProxyPort, event.ProxyPort,
+			"sender", event.Name,
+			"recipients", strings.Join(recipients, ", "),
+			"message", event.Message,
+		)
+
+		if context.LogChat {
+			state.SendStats(context, context.LogChatChannel, event)
+		}
+	}
+}
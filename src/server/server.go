@@ -0,0 +1,713 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package server runs a Bolorama tracker and relay. Each Server has its own
+// sockets and state, so several can run in one process.
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/limit"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/recording"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/stats"
+	"git.astrospark.com/bolorama/tracker"
+	"git.astrospark.com/bolorama/transport"
+	"git.astrospark.com/bolorama/util"
+	"git.astrospark.com/bolorama/watchdog"
+	"git.astrospark.com/bolorama/web"
+	"git.astrospark.com/bolorama/webhook"
+)
+
+const defaultGameInfoPingSeconds = 20
+const defaultPlayerTimeoutSeconds = 60
+const defaultSnapshotSeconds = 60
+const defaultProxyPortFirst = 40001
+const defaultProxyPortLast = 41000
+
+// Config holds the settings of one server. See the README for what each
+// setting does.
+type Config struct {
+	Hostname string
+	// TrackerPort 0 picks a free port, see Server.TrackerPort
+	TrackerPort          int
+	TrackerDebugPort     int
+	GameInfoPingSeconds  int // 0 means 20
+	PlayerTimeoutSeconds int // 0 means 60
+	// players are relayed through ports ProxyPortFirst to ProxyPortLast, 0
+	// means 40001 and 41000
+	ProxyPortFirst int
+	ProxyPortLast  int
+	// ProxyPortCooldownSeconds is how long a player's port is left unused
+	// after they leave
+	ProxyPortCooldownSeconds int
+	// MultiplexPorts > 0 relays every player through that many ports from
+	// ProxyPortFirst instead of opening a port for each player
+	MultiplexPorts int
+	// HttpPort > 0 serves the tracker over http on that port
+	HttpPort int
+	// AdminToken is the bearer token of the http requests that change the
+	// server, empty refuses them
+	AdminToken string
+	// limits per source ip, 0 means unlimited
+	RateLimitNewPlayersPerMinute int
+	RateLimitNewGamesPerMinute   int
+	RateLimitPacketsPerSecond    int
+	// Debug turns on debug messages for every subsystem
+	Debug bool
+	// Log nil logs in logfmt to stdout
+	Log *logging.Loggers
+	// CaptureDirectory is where packet captures are written, empty disables
+	// them
+	CaptureDirectory string
+	// RecordingDirectory is where the game state of every game is recorded,
+	// empty disables recording
+	RecordingDirectory string
+	// Webhooks are notified of new games, full games and ended games
+	Webhooks []webhook.Config
+	// Transport nil means real sockets
+	Transport transport.Transport
+	// DB nil disables statistics logging. The caller closes it after Shutdown.
+	DB *sql.DB
+	// LogChat saves chat messages to DB
+	LogChat bool
+	// Motd is a chat message sent to each player who joins a game, empty
+	// sends nothing
+	Motd string
+	// TxQueueSize is how many packets wait for each socket, 0 means 64, and
+	// RxQueueSize how many wait for the relay loop, 0 means 1024. Game
+	// state beyond them is dropped.
+	TxQueueSize int
+	RxQueueSize int
+	// WatchdogSeconds > 0 reports goroutines busy with one packet or
+	// record for that long
+	WatchdogSeconds int
+	// SnapshotFile is where the games and players are saved every
+	// SnapshotSeconds, 0 means 60, and on shutdown, and restored from on
+	// start. Empty disables snapshots.
+	SnapshotFile    string
+	SnapshotSeconds int
+	// Handoff non-nil takes over the sockets and state of a server stopped
+	// with Server.Handoff, instead of opening new sockets or restoring
+	// SnapshotFile. The caller closes it once Start returns, which closes
+	// the sockets nobody took over, such as those of players who left while
+	// it was handed over.
+	Handoff *Handoff
+}
+
+// Player is a snapshot of a player's relay state
+type Player struct {
+	Addr      net.UDPAddr
+	ProxyPort int
+	RelayPort int // the port other players see this player at
+	GameId    bolo.GameId
+	PlayerId  int
+	Name      string
+}
+
+type Server struct {
+	config               Config
+	mutex                sync.Mutex
+	context              *state.ServerContext
+	listeners            listeners
+	events               *events.Bus
+	capture              *capture.Capture
+	recorder             *recording.Recorder
+	hooks                []*webhook.Hook
+	beginShutdownChannel chan struct{}
+	shutdownOnce         sync.Once
+	doneChannel          chan struct{}
+}
+
+func New(config Config) (*Server, error) {
+	if config.Hostname == "" {
+		return nil, errors.New("hostname is not set")
+	}
+	if config.TrackerPort < 0 || config.TrackerPort > 65535 {
+		return nil, fmt.Errorf("tracker port %d is out of range", config.TrackerPort)
+	}
+	if config.TrackerDebugPort < 0 || config.TrackerDebugPort > 65535 {
+		return nil, fmt.Errorf("tracker debug port %d is out of range", config.TrackerDebugPort)
+	}
+	if config.GameInfoPingSeconds < 0 || config.PlayerTimeoutSeconds < 0 || config.ProxyPortCooldownSeconds < 0 || config.WatchdogSeconds < 0 || config.SnapshotSeconds < 0 {
+		return nil, errors.New("periods must not be negative")
+	}
+	if config.RateLimitNewPlayersPerMinute < 0 || config.RateLimitNewGamesPerMinute < 0 || config.RateLimitPacketsPerSecond < 0 {
+		return nil, errors.New("rate limits must not be negative")
+	}
+
+	if config.ProxyPortFirst == 0 {
+		config.ProxyPortFirst = defaultProxyPortFirst
+	}
+	if config.ProxyPortLast == 0 {
+		config.ProxyPortLast = defaultProxyPortLast
+	}
+	if config.ProxyPortFirst < 1 || config.ProxyPortLast > 65535 || config.ProxyPortFirst > config.ProxyPortLast {
+		return nil, fmt.Errorf("proxy port range %d-%d is not valid", config.ProxyPortFirst, config.ProxyPortLast)
+	}
+	if config.HttpPort < 0 || config.HttpPort > 65535 {
+		return nil, fmt.Errorf("http port %d is out of range", config.HttpPort)
+	}
+	for _, setting := range []struct {
+		name string
+		port int
+	}{
+		{"tracker", config.TrackerPort},
+		{"tracker debug", config.TrackerDebugPort},
+		{"http", config.HttpPort},
+	} {
+		if setting.port >= config.ProxyPortFirst && setting.port <= config.ProxyPortLast {
+			return nil, fmt.Errorf("%s port %d is in the proxy port range", setting.name, setting.port)
+		}
+	}
+	proxyPortCount := config.ProxyPortLast - config.ProxyPortFirst + 1
+	if config.MultiplexPorts < 0 || config.MultiplexPorts > proxyPortCount {
+		return nil, fmt.Errorf("multiplex ports must be between 0 and %d, the size of the proxy port range", proxyPortCount)
+	}
+
+	if len(config.Motd) > bolo.MaxMessageLength {
+		return nil, fmt.Errorf("motd is %d bytes, longer than %d", len(config.Motd), bolo.MaxMessageLength)
+	}
+
+	if config.TxQueueSize < 0 || config.RxQueueSize < 0 {
+		return nil, errors.New("queue sizes must not be negative")
+	}
+	if config.TxQueueSize == 0 {
+		config.TxQueueSize = state.DefaultTxQueueSize
+	}
+	if config.RxQueueSize == 0 {
+		config.RxQueueSize = state.DefaultRxQueueSize
+	}
+
+	if config.GameInfoPingSeconds == 0 {
+		config.GameInfoPingSeconds = defaultGameInfoPingSeconds
+	}
+	if config.PlayerTimeoutSeconds == 0 {
+		config.PlayerTimeoutSeconds = defaultPlayerTimeoutSeconds
+	}
+	if config.SnapshotSeconds == 0 {
+		config.SnapshotSeconds = defaultSnapshotSeconds
+	}
+	if config.Transport == nil {
+		config.Transport = transport.Net{}
+	}
+	if config.Log == nil {
+		config.Log, _ = logging.New(os.Stdout, logging.Text)
+	}
+	if config.Debug {
+		config.Log.SetDebugList("all")
+	}
+
+	var hooks []*webhook.Hook
+	for _, webhookConfig := range config.Webhooks {
+		hook, err := webhook.New(webhookConfig)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return &Server{
+		config:               config,
+		events:               events.NewBus(),
+		capture:              capture.New(config.CaptureDirectory, config.Log.Capture),
+		recorder:             recording.New(config.RecordingDirectory, config.Log.Recording),
+		hooks:                hooks,
+		beginShutdownChannel: make(chan struct{}),
+		doneChannel:          make(chan struct{}),
+	}, nil
+}
+
+// Start listens on the tracker ports and runs the server in the background
+// until Shutdown is called or ctx is done
+func (server *Server) Start(ctx context.Context) error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.context != nil {
+		return errors.New("server already started")
+	}
+
+	transport := server.config.Transport
+	trackerPort := server.config.TrackerPort
+	trackerDebugPort := server.config.TrackerDebugPort
+	if handoff := server.config.Handoff; handoff != nil {
+		transport = handoff.inherit(transport)
+		// ports picked by the server that handed over are kept, so that its
+		// sockets are taken over rather than new ones opened
+		if trackerPort == 0 {
+			trackerPort = handoff.TrackerPort
+		}
+		if trackerDebugPort == 0 {
+			trackerDebugPort = handoff.TrackerDebugPort
+		}
+	}
+
+	// close whatever was opened if a later socket fails
+	var sockets []io.Closer
+	closeSockets := func() {
+		for _, socket := range sockets {
+			socket.Close()
+		}
+	}
+
+	connection, err := transport.ListenUDP(trackerPort)
+	if err != nil {
+		return err
+	}
+	sockets = append(sockets, connection)
+	// the tracker answers tcp on the same port number as udp
+	trackerPort = connection.LocalAddr().(*net.UDPAddr).Port
+
+	listeners := listeners{}
+	listeners.tracker, err = transport.ListenTCP(trackerPort)
+	if err != nil {
+		closeSockets()
+		return err
+	}
+	sockets = append(sockets, listeners.tracker)
+
+	listeners.trackerDebug, err = transport.ListenTCP(trackerDebugPort)
+	if err != nil {
+		closeSockets()
+		return err
+	}
+	sockets = append(sockets, listeners.trackerDebug)
+
+	if server.config.HttpPort > 0 {
+		listeners.http, err = transport.ListenTCP(server.config.HttpPort)
+		if err != nil {
+			closeSockets()
+			return err
+		}
+		sockets = append(sockets, listeners.http)
+	}
+
+	context := state.InitContext(transport, connection)
+	context.Hostname = server.config.Hostname
+	context.TrackerDebugPort = listeners.trackerDebug.Addr().(*net.TCPAddr).Port
+	context.GameInfoPingPeriod = time.Duration(server.config.GameInfoPingSeconds) * time.Second
+	context.PlayerTimeout = time.Duration(server.config.PlayerTimeoutSeconds) * time.Second
+	context.Log = server.config.Log
+	context.Events = server.events
+	context.Capture = server.capture
+	context.AdminToken = server.config.AdminToken
+	context.Recorder = server.recorder
+	context.LogChat = server.config.LogChat && server.config.DB != nil
+	context.Motd = server.config.Motd
+	context.RxQueue = proxy.NewQueue(state.RxQueuePolicy(server.config.RxQueueSize, context.Counters))
+	context.TxPolicy = state.TxQueuePolicy(server.config.TxQueueSize, context.Counters)
+	context.Watchdog = watchdog.New(time.Duration(server.config.WatchdogSeconds)*time.Second, context.Log.Server)
+	context.ProxyPorts = proxy.NewPorts(
+		server.config.ProxyPortFirst,
+		server.config.ProxyPortLast,
+		time.Duration(server.config.ProxyPortCooldownSeconds)*time.Second,
+	)
+	context.Limits = state.Limits{
+		NewPlayers: limit.PerMinute(server.config.RateLimitNewPlayersPerMinute),
+		NewGames:   limit.PerMinute(server.config.RateLimitNewGamesPerMinute),
+		Packets:    limit.PerSecond(server.config.RateLimitPacketsPerSecond),
+	}
+
+	channels := relayChannels{
+		playerInfoEvent: make(chan util.PlayerInfoEvent),
+		playerLeaveGame: make(chan util.PlayerAddr),
+		chat:            make(chan relayedChat),
+	}
+	context.FastPath = func(packet proxy.UdpPacket) bool {
+		return relayCached(context, packet, channels.playerInfoEvent, channels.playerLeaveGame, channels.chat)
+	}
+
+	if server.config.MultiplexPorts > 0 {
+		mux, err := proxy.NewMux(transport, server.config.ProxyPortFirst, server.config.MultiplexPorts, context.Limits.Packets, context.Log.Proxy, context.Watchdog, context.WaitGroup, context.RxQueue, context.FastPath, context.TxPolicy, context.ShutdownChannel)
+		if err != nil {
+			closeSockets()
+			return err
+		}
+		context.Mux = mux
+		context.ProxyPorts = proxy.NewVirtualPorts()
+	}
+
+	var restored []state.Player
+	if server.config.Handoff != nil {
+		restored = restoreHandoff(context, server.config.Handoff)
+	} else if server.config.SnapshotFile != "" {
+		restored = restoreSnapshot(context, server.config.SnapshotFile)
+	}
+
+	server.context = context
+	server.listeners = listeners
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			server.beginShutdown()
+		case <-server.doneChannel:
+		}
+	}()
+
+	go func() {
+		server.serve(listeners, channels, restored)
+		close(server.doneChannel)
+	}()
+
+	return nil
+}
+
+// Shutdown stops the server and waits for it to finish, or for ctx to be done
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mutex.Lock()
+	started := server.context != nil
+	server.mutex.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	server.beginShutdown()
+
+	select {
+	case <-server.doneChannel:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the server has stopped
+func (server *Server) Done() <-chan struct{} {
+	return server.doneChannel
+}
+
+func (server *Server) beginShutdown() {
+	server.shutdownOnce.Do(func() {
+		close(server.beginShutdownChannel)
+	})
+}
+
+// TrackerPort is the port the tracker listens on, once started
+func (server *Server) TrackerPort() int {
+	context := server.getContext()
+	if context == nil {
+		return 0
+	}
+	return context.ProxyPort
+}
+
+// TrackerDebugPort is the port the tracker debug text is served on, once started
+func (server *Server) TrackerDebugPort() int {
+	context := server.getContext()
+	if context == nil {
+		return 0
+	}
+	return context.TrackerDebugPort
+}
+
+// ProxyIpAddr is the address players are told to reach the relay at, once
+// started
+func (server *Server) ProxyIpAddr() net.IP {
+	context := server.getContext()
+	if context == nil {
+		return nil
+	}
+	return context.ProxyIpAddr
+}
+
+// Games returns the games being tracked, newest first
+func (server *Server) Games() []bolo.GameInfo {
+	context := server.getContext()
+	if context == nil {
+		return nil
+	}
+
+	context.Mutex.RLock()
+	defer context.Mutex.RUnlock()
+
+	games := make([]bolo.GameInfo, 0, len(context.Games))
+	for _, game := range context.Games {
+		games = append(games, game)
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].ServerStartTimestamp.After(games[j].ServerStartTimestamp)
+	})
+	return games
+}
+
+// Game returns the game with gameId, if it is being tracked
+func (server *Server) Game(gameId bolo.GameId) (bolo.GameInfo, bool) {
+	context := server.getContext()
+	if context == nil {
+		return bolo.GameInfo{}, false
+	}
+
+	context.Mutex.RLock()
+	defer context.Mutex.RUnlock()
+
+	game, ok := context.Games[gameId]
+	return game, ok
+}
+
+// Players returns the players being relayed, ordered by proxy port
+func (server *Server) Players() []Player {
+	context := server.getContext()
+	if context == nil {
+		return nil
+	}
+
+	context.Mutex.RLock()
+	defer context.Mutex.RUnlock()
+
+	players := make([]Player, 0, context.Players.Len())
+	for _, player := range context.Players.All() {
+		players = append(players, Player{
+			Addr:      net.UDPAddr{IP: player.IpAddr, Port: player.IpPort},
+			ProxyPort: player.ProxyPort,
+			RelayPort: player.RelayPort,
+			GameId:    player.GameId,
+			PlayerId:  player.PlayerId,
+			Name:      player.Name,
+		})
+	}
+	return players
+}
+
+// Subscribe returns a subscription to the server's game and player events,
+// which can be made before the server is started. Close it when done.
+func (server *Server) Subscribe(size int) *events.Subscription {
+	return server.events.Subscribe(size)
+}
+
+// StartCapture records the relayed packets matching filter to a pcapng file
+// in Config.CaptureDirectory until StopCapture. Only one capture runs at a
+// time.
+func (server *Server) StartCapture(filter capture.Filter) (capture.Status, error) {
+	return server.capture.Start(filter)
+}
+
+// StopCapture finishes the capture being recorded
+func (server *Server) StopCapture() (capture.Status, error) {
+	return server.capture.Stop()
+}
+
+// CaptureStatus describes the capture being recorded, or the last one
+func (server *Server) CaptureStatus() capture.Status {
+	return server.capture.Status()
+}
+
+// Announce sends a chat message to every player, or to the players of gameId
+// when it isn't nil, returning how many players it will reach. Each player
+// gets it in the next game state packet relayed to them.
+func (server *Server) Announce(gameId *bolo.GameId, message string) (int, error) {
+	context := server.getContext()
+	if context == nil {
+		return 0, errors.New("server is not running")
+	}
+	return state.Announce(context, gameId, message, true)
+}
+
+// shutdownWarnings are how long before a shutdown the players are warned,
+// after the first warning
+var shutdownWarnings = []time.Duration{5 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second}
+
+// WarnShutdown tells the players the server is shutting down in delay, and
+// again as the time gets close, returning once delay has passed or ctx is done
+func (server *Server) WarnShutdown(ctx context.Context, delay time.Duration) error {
+	shutdownAt := time.Now().Add(delay)
+	warnings := []time.Duration{delay}
+	for _, warning := range shutdownWarnings {
+		if warning < delay {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	for _, warning := range warnings {
+		select {
+		case <-time.After(time.Until(shutdownAt.Add(-warning))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		count, err := server.Announce(nil, shutdownWarning(warning))
+		if err != nil {
+			return err
+		}
+		server.config.Log.Server.Info("warned players of shutdown", "players", count, "delay", warning)
+	}
+
+	select {
+	case <-time.After(time.Until(shutdownAt)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownWarning is the message warning of a shutdown in delay
+func shutdownWarning(delay time.Duration) string {
+	delay = delay.Round(time.Second)
+	if delay >= time.Minute && delay%time.Minute == 0 {
+		minutes := int(delay / time.Minute)
+		if minutes == 1 {
+			return "Server shutting down in 1 minute"
+		}
+		return fmt.Sprintf("Server shutting down in %d minutes", minutes)
+	}
+	seconds := int(delay / time.Second)
+	if seconds == 1 {
+		return "Server shutting down in 1 second"
+	}
+	return fmt.Sprintf("Server shutting down in %d seconds", seconds)
+}
+
+// SetDebug turns debug messages of a log subsystem on or off while the server
+// runs
+func (server *Server) SetDebug(subsystem logging.Subsystem, debug bool) error {
+	return server.config.Log.SetDebug(subsystem, debug)
+}
+
+func (server *Server) getContext() *state.ServerContext {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.context
+}
+
+// listeners are the tcp sockets a server serves on
+type listeners struct {
+	tracker      net.Listener
+	trackerDebug net.Listener
+	http         net.Listener // nil when http is disabled
+}
+
+// relayChannels take what relaying a packet learns about its sender to the
+// serve loop, from processPacket and from the ports' own goroutines
+type relayChannels struct {
+	playerInfoEvent chan util.PlayerInfoEvent
+	playerLeaveGame chan util.PlayerAddr
+	chat            chan relayedChat
+}
+
+// serve runs the tracker, statistics, http and relay until shutdown. The
+// tracker pings the players restored from a snapshot as if they had just
+// joined.
+func (server *Server) serve(listeners listeners, channels relayChannels, restored []state.Player) {
+	context := server.context
+	playerInfoEventChannel := channels.playerInfoEvent
+	playerLeaveGameChannel := channels.playerLeaveGame
+	startPlayerPingChannel := make(chan state.Player)
+	mainShutdownChannel := make(chan struct{})
+
+	// subscribe before the tracker runs so no game is missed
+	for _, hook := range server.hooks {
+		context.WaitGroup.Add(1)
+		go hook.Run(context, hook.Subscribe(context.Events))
+	}
+	if context.Recorder.Enabled() {
+		context.WaitGroup.Add(1)
+		go context.Recorder.Run(context.WaitGroup, context.ShutdownChannel, context.Recorder.Subscribe(context.Events))
+	}
+
+	context.WaitGroup.Add(1)
+	go stats.Logger(context, server.config.DB)
+
+	context.WaitGroup.Add(1)
+	go context.Watchdog.Run(context.WaitGroup, context.ShutdownChannel)
+
+	context.WaitGroup.Add(1)
+	go tracker.Tracker(context, startPlayerPingChannel, listeners.tracker, listeners.trackerDebug)
+
+	if listeners.http != nil {
+		context.WaitGroup.Add(1)
+		go web.Serve(context.WaitGroup, context, listeners.http)
+	}
+
+	snapshotFile := server.config.SnapshotFile
+	if snapshotFile != "" {
+		context.WaitGroup.Add(1)
+		go snapshotter(context, snapshotFile, time.Duration(server.config.SnapshotSeconds)*time.Second)
+	}
+
+	go func() {
+		for _, player := range restored {
+			select {
+			case startPlayerPingChannel <- player:
+			case <-context.ShutdownChannel:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		<-server.beginShutdownChannel
+		context.Log.Server.Info("shutting down")
+		close(context.ShutdownChannel)
+		context.WaitGroup.Wait()
+		if snapshotFile != "" {
+			saveSnapshot(context, snapshotFile)
+		}
+		if context.Capture.Running() {
+			context.Capture.Stop()
+		}
+		close(mainShutdownChannel)
+	}()
+
+	watch := context.Watchdog.Watch("relay")
+	for {
+		select {
+		case _, ok := <-mainShutdownChannel:
+			if !ok {
+				return
+			}
+		case playerInfo := <-playerInfoEventChannel:
+			watch.Busy()
+			if playerInfo.SetId {
+				state.PlayerSetId(context, playerInfo.PlayerAddr, playerInfo.PlayerId, true)
+			} else if playerInfo.SetName {
+				state.PlayerSetName(context, playerInfo.PlayerAddr, playerInfo.PlayerId, playerInfo.Name)
+			}
+		case playerPort := <-playerLeaveGameChannel:
+			watch.Busy()
+			context.Log.Proxy.Info("player left game", logging.ProxyPort, playerPort.ProxyPort,
+				logging.PlayerAddr, fmt.Sprintf("%s:%d", playerPort.IpAddr, playerPort.IpPort))
+			state.PlayerDelete(context, playerPort, true)
+			state.LogServerState(context, true)
+		case chat := <-channels.chat:
+			watch.Busy()
+			reportChat(context, chat)
+		case <-context.RxQueue.Ready():
+			watch.Busy()
+			packet, ok := context.RxQueue.Pop()
+			if ok {
+				processPacket(context, packet, startPlayerPingChannel, playerInfoEventChannel, playerLeaveGameChannel, channels.chat)
+			}
+		}
+		watch.Idle()
+	}
+}
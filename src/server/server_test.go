@@ -0,0 +1,1334 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/bolotest"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/recording"
+	"git.astrospark.com/bolorama/transport"
+)
+
+const testTimeout = 5 * time.Second
+
+// the proxy ports are below the ports the system picks, so that a tracker
+// port picked for a server can be reused by the one taking over from it
+const (
+	testProxyPortFirst = 30001
+	testProxyPortLast  = 30100
+)
+
+// startServer runs the relay on loopback
+func startServer(t *testing.T) *Server {
+	return startServerConfig(t, Config{Transport: transport.Loopback{}})
+}
+
+// startServerOn runs the relay on transport
+func startServerOn(t *testing.T, transport transport.Transport, trackerPort int, trackerDebugPort int) *Server {
+	return startServerConfig(t, Config{
+		TrackerPort:      trackerPort,
+		TrackerDebugPort: trackerDebugPort,
+		Transport:        transport,
+	})
+}
+
+// startServerConfig runs the relay with config, filling in the hostname, a
+// short game info ping period and, unless it is set, the proxy port range
+func startServerConfig(t *testing.T, config Config) *Server {
+	config.Hostname = "localhost"
+	config.GameInfoPingSeconds = 1
+	if config.ProxyPortFirst == 0 && config.ProxyPortLast == 0 {
+		config.ProxyPortFirst = testProxyPortFirst
+		config.ProxyPortLast = testProxyPortLast
+	}
+
+	server, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			t.Error("server did not shut down:", err)
+		}
+	})
+
+	return server
+}
+
+func trackerAddr(server *Server) *net.UDPAddr {
+	return &net.UDPAddr{IP: server.ProxyIpAddr(), Port: server.TrackerPort()}
+}
+
+func newClient(t *testing.T, server *Server) *bolotest.Client {
+	client, err := bolotest.NewClient(trackerAddr(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// waitForPlayer returns the player record for a client once the server has one
+func waitForPlayer(t *testing.T, server *Server, client *bolotest.Client) Player {
+	return waitForPlayerAddr(t, server, client.Addr())
+}
+
+// waitForPlayerAddr returns the player record for the address the server
+// sees a client at
+func waitForPlayerAddr(t *testing.T, server *Server, addr *net.UDPAddr) Player {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, player := range server.Players() {
+			if player.Addr.IP.Equal(addr.IP) && player.Addr.Port == addr.Port {
+				return player
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no player for %s", addr.String())
+	return Player{}
+}
+
+func proxyAddr(player Player) *net.UDPAddr {
+	return &net.UDPAddr{IP: transport.LoopbackIp, Port: player.ProxyPort}
+}
+
+func TestRelayJoinGame(t *testing.T) {
+	server := startServer(t)
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Everard Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+	if hostPlayer.GameId != gameInfo.GameId {
+		t.Errorf("host is in game %x, expected %x", hostPlayer.GameId, gameInfo.GameId)
+	}
+
+	// the joiner learns the host's proxy port from the tracker, and has never
+	// sent anything to the host, so the relay has to probe the host's nat
+	// before forwarding the join request
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, server, joiner)
+
+	join, err := host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.SrcAddr.Port != joinerPlayer.ProxyPort {
+		t.Errorf("join request came from port %d, expected joiner's proxy port %d", join.SrcAddr.Port, joinerPlayer.ProxyPort)
+	}
+	if host.ProbeCount() == 0 {
+		t.Error("host did not receive a nat probe")
+	}
+
+	context := server.getContext()
+	context.Mutex.RLock()
+	pending := 0
+	for _, player := range context.Players.All() {
+		pending = pending + len(player.PeerPackets)
+	}
+	context.Mutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("%d packets still waiting for nat probe replies", pending)
+	}
+
+	// the host has now heard from the joiner, so game state flows straight
+	// through. bolo names itself by its address behind the nat.
+	hostLanAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 50000}
+	disconnect := bolotest.DisconnectOpcode(&join.SrcAddr, hostLanAddr, &join.SrcAddr)
+	gameState := bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0, disconnect))
+	err = host.Send(&join.SrcAddr, gameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != hostPlayer.ProxyPort {
+		t.Errorf("game state came from port %d, expected host's proxy port %d", received.SrcAddr.Port, hostPlayer.ProxyPort)
+	}
+
+	packet, err := bolo.DecodeGameState(received.Buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := packet.Blocks[0]
+	if !block.CrcValid {
+		t.Error("relayed block has an invalid crc")
+	}
+	sender := block.Opcodes[0].(bolo.DisconnectOp).Sender
+	if !sender.IP.Equal(transport.LoopbackIp) || sender.Port != hostPlayer.ProxyPort {
+		t.Errorf("disconnect sender is %s, expected the host's proxy address", sender.String())
+	}
+	if bytes.Equal(received.Buffer, gameState) {
+		t.Error("game state was not rewritten")
+	}
+
+	counters := context.Counters
+	if atomic.LoadUint64(&counters.NatProbes) == 0 || atomic.LoadUint64(&counters.NatProbeReplies) == 0 {
+		t.Error("nat probes were not counted")
+	}
+	if atomic.LoadUint64(&counters.PeerPacketsReplayed) != 1 {
+		t.Errorf("counted %d replayed packets, expected the join request", atomic.LoadUint64(&counters.PeerPacketsReplayed))
+	}
+	if atomic.LoadUint64(&counters.RelayedPackets[bolo.PacketTypeGameState]) != 1 ||
+		atomic.LoadUint64(&counters.RelayedBytes[bolo.PacketTypeGameState]) != uint64(len(gameState)) {
+		t.Error("relayed game state was not counted")
+	}
+}
+
+func TestTrackerPing(t *testing.T) {
+	server := startServer(t)
+	host := newClient(t, server)
+
+	err := host.Host(bolotest.NewGameInfo("Pong", host.Addr().IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPlayer(t, server, host)
+
+	deadline := time.Now().Add(testTimeout)
+	for host.PingCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if host.PingCount() == 0 {
+		t.Fatal("host was never pinged for game info")
+	}
+
+	gameCount := len(server.Games())
+	if gameCount != 1 {
+		t.Errorf("%d games tracked, expected 1", gameCount)
+	}
+}
+
+func TestRelayNatTraversal(t *testing.T) {
+	t.Run("PortPerPlayer", func(t *testing.T) { testRelayNatTraversal(t, 0) })
+	t.Run("Multiplexed", func(t *testing.T) { testRelayNatTraversal(t, 2) })
+}
+
+func testRelayNatTraversal(t *testing.T, multiplexPorts int) {
+	serverIp := net.IPv4(198, 51, 100, 1).To4()
+	network := transport.NewNetwork(1)
+	server := startServerConfig(t, Config{
+		TrackerPort:      50000,
+		TrackerDebugPort: 50001,
+		MultiplexPorts:   multiplexPorts,
+		Transport:        network.Host(serverIp),
+	})
+
+	newNatClient := func(privateIp net.IP, publicIp net.IP) *bolotest.Client {
+		client, err := bolotest.NewClientOn(network.NatHost(privateIp, publicIp), trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+	host := newNatClient(net.IPv4(192, 168, 1, 10), net.IPv4(203, 0, 113, 10))
+	joiner := newNatClient(net.IPv4(192, 168, 2, 20), net.IPv4(203, 0, 113, 20))
+
+	gameInfo := bolotest.NewGameInfo("Nat Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayerAddr(t, server, network.PublicAddr(host.Addr()))
+	hostProxyAddr := &net.UDPAddr{IP: serverIp, Port: hostPlayer.RelayPort}
+
+	// the host's nat only lets in packets from the tracker port, so the join
+	// request reaches the host only if the relay probes it from there
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(hostProxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayerAddr(t, server, network.PublicAddr(joiner.Addr()))
+
+	join, err := host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if join.SrcAddr.Port != joinerPlayer.RelayPort {
+		t.Errorf("join request came from port %d, expected joiner's relay port %d", join.SrcAddr.Port, joinerPlayer.RelayPort)
+	}
+
+	gameState := bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0, bolotest.PlayerNameOpcode("Host")))
+	err = host.Send(&join.SrcAddr, gameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != hostPlayer.RelayPort {
+		t.Errorf("game state came from port %d, expected host's relay port %d", received.SrcAddr.Port, hostPlayer.RelayPort)
+	}
+}
+
+func TestCachedRoutes(t *testing.T) {
+	server := startServer(t)
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Cache Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	join, err := host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters := server.getContext().Counters
+	relay := func(sequence int) {
+		t.Helper()
+		gameState := bolotest.GameStatePacket(sequence, bolotest.GameStateBlock(0x01, 0))
+		err := host.Send(&join.SrcAddr, gameState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.SrcAddr.Port != hostPlayer.ProxyPort {
+			t.Errorf("game state came from port %d, expected host's proxy port %d", received.SrcAddr.Port, hostPlayer.ProxyPort)
+		}
+	}
+
+	// the first packet establishes the route, the rest follow it
+	relay(0x10)
+	if cached := atomic.LoadUint64(&counters.CachedRoutePackets); cached != 0 {
+		t.Errorf("%d packets relayed over a cached route before it was established", cached)
+	}
+	relay(0x11)
+	relay(0x12)
+	if cached := atomic.LoadUint64(&counters.CachedRoutePackets); cached != 2 {
+		t.Errorf("%d packets relayed over a cached route, expected 2", cached)
+	}
+
+	// another player joining the game makes the game's routes stale
+	third := newClient(t, server)
+	third.SetGameInfo(gameInfo)
+	err = third.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPlayer(t, server, third)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay(0x13)
+	if cached := atomic.LoadUint64(&counters.CachedRoutePackets); cached != 2 {
+		t.Errorf("%d packets relayed over a cached route after a player joined, expected 2", cached)
+	}
+	relay(0x14)
+	if cached := atomic.LoadUint64(&counters.CachedRoutePackets); cached != 3 {
+		t.Errorf("%d packets relayed over a cached route, expected 3", cached)
+	}
+	if relayed := atomic.LoadUint64(&counters.RelayedPackets[bolo.PacketTypeGameState]); relayed != 5 {
+		t.Errorf("%d game state packets relayed, expected 5", relayed)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	first := startServerConfig(t, Config{Transport: transport.Loopback{}, SnapshotFile: snapshotFile})
+	host := newClient(t, first)
+	joiner := newClient(t, first)
+
+	gameInfo := bolotest.NewGameInfo("Restart Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, first, host)
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, first, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	players := first.Players()
+	trackerPort := first.TrackerPort()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err = first.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new server relays for the same players from the same ports, so
+	// their games carry on without them doing anything
+	second := startServerConfig(t, Config{Transport: transport.Loopback{}, TrackerPort: trackerPort, SnapshotFile: snapshotFile})
+	restored := second.Players()
+	if len(restored) != len(players) {
+		t.Fatalf("restored %d players, expected %d", len(restored), len(players))
+	}
+	for i := range players {
+		if fmt.Sprint(restored[i]) != fmt.Sprint(players[i]) {
+			t.Errorf("restored %+v, expected %+v", restored[i], players[i])
+		}
+	}
+	if games := second.Games(); len(games) != 1 || games[0].GameId != gameInfo.GameId || games[0].PlayerCount != 2 {
+		t.Errorf("restored games %+v", games)
+	}
+
+	gameState := bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0))
+	err = host.Send(proxyAddr(joinerPlayer), gameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != hostPlayer.ProxyPort {
+		t.Errorf("game state came from port %d, expected host's proxy port %d", received.SrcAddr.Port, hostPlayer.ProxyPort)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	first := startServer(t)
+	host := newClient(t, first)
+	joiner := newClient(t, first)
+
+	gameInfo := bolotest.NewGameInfo("Handoff Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, first, host)
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, first, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	players := first.Players()
+	trackerPort := first.TrackerPort()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	handoff, err := first.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handoff.Close()
+
+	// sent while neither server is relaying, it waits in the joiner's socket
+	gameState := bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0))
+	err = host.Send(proxyAddr(joinerPlayer), gameState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := startServerConfig(t, Config{Transport: transport.Loopback{}, TrackerPort: trackerPort, Handoff: handoff})
+	restored := second.Players()
+	if len(restored) != len(players) {
+		t.Fatalf("took over %d players, expected %d", len(restored), len(players))
+	}
+	for i := range players {
+		if fmt.Sprint(restored[i]) != fmt.Sprint(players[i]) {
+			t.Errorf("took over %+v, expected %+v", restored[i], players[i])
+		}
+	}
+
+	received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != hostPlayer.ProxyPort {
+		t.Errorf("game state came from port %d, expected host's proxy port %d", received.SrcAddr.Port, hostPlayer.ProxyPort)
+	}
+}
+
+func TestHandoffMultiplexed(t *testing.T) {
+	config := Config{Transport: transport.Loopback{}, MultiplexPorts: 2}
+	first := startServerConfig(t, config)
+	host := newClient(t, first)
+	joiner := newClient(t, first)
+
+	gameInfo := bolotest.NewGameInfo("Handoff Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, first, host)
+	hostRelayAddr := &net.UDPAddr{IP: transport.LoopbackIp, Port: hostPlayer.RelayPort}
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(hostRelayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPlayer(t, first, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	config.TrackerPort = first.TrackerPort()
+	config.Handoff, err = first.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer config.Handoff.Close()
+	second := startServerConfig(t, config)
+
+	// the multiplexed ports are the ones handed over, so the joiner's game
+	// state still reaches the host from the joiner's relay port
+	joinerPlayer := waitForPlayer(t, second, joiner)
+	err = joiner.Send(hostRelayAddr, bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := host.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != joinerPlayer.RelayPort {
+		t.Errorf("game state came from port %d, expected joiner's relay port %d", received.SrcAddr.Port, joinerPlayer.RelayPort)
+	}
+}
+
+func TestServersShareProcess(t *testing.T) {
+	network := transport.NewNetwork(1)
+	servers := []*Server{
+		startServerOn(t, network.Host(net.IPv4(198, 51, 100, 1)), 50000, 50001),
+		startServerOn(t, network.Host(net.IPv4(198, 51, 100, 2)), 50000, 50001),
+	}
+
+	for i, server := range servers {
+		client, err := bolotest.NewClientOn(network.Host(net.IPv4(203, 0, 113, byte(10+i))), trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+
+		err = client.Host(bolotest.NewGameInfo("Island", client.Addr().IP))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForPlayer(t, server, client)
+	}
+
+	for i, server := range servers {
+		games := server.Games()
+		if len(games) != 1 {
+			t.Fatalf("server %d tracks %d games, expected 1", i, len(games))
+		}
+		if games[0].GameId[3] != byte(10+i) {
+			t.Errorf("server %d tracks game %x, which was hosted on the other server", i, games[0].GameId)
+		}
+		players := server.Players()
+		if len(players) != 1 {
+			t.Errorf("server %d relays %d players, expected 1", i, len(players))
+		}
+	}
+}
+
+func TestStartPortInUse(t *testing.T) {
+	network := transport.NewNetwork(1)
+	host := network.Host(net.IPv4(198, 51, 100, 1))
+	startServerOn(t, host, 50000, 50001)
+
+	server, err := New(Config{Hostname: "localhost", TrackerPort: 50000, TrackerDebugPort: 50002, Transport: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Start(context.Background())
+	if err == nil {
+		t.Error("second server started on a port in use")
+	}
+	if server.Shutdown(context.Background()) != nil {
+		t.Error("shutting down a server that never started failed")
+	}
+}
+
+func TestNewRejectsConfig(t *testing.T) {
+	for _, config := range []Config{
+		{},
+		{Hostname: "localhost", TrackerPort: 65536},
+		{Hostname: "localhost", TrackerDebugPort: -1},
+		{Hostname: "localhost", PlayerTimeoutSeconds: -1},
+		{Hostname: "localhost", ProxyPortFirst: 40010, ProxyPortLast: 40001},
+		{Hostname: "localhost", TrackerPort: 40005},
+		{Hostname: "localhost", TrackerDebugPort: 40005},
+		{Hostname: "localhost", HttpPort: 40005},
+		{Hostname: "localhost", ProxyPortFirst: 40001, ProxyPortLast: 40002, MultiplexPorts: 3},
+		{Hostname: "localhost", TxQueueSize: -1},
+		{Hostname: "localhost", WatchdogSeconds: -1},
+	} {
+		_, err := New(config)
+		if err == nil {
+			t.Errorf("New accepted %+v", config)
+		}
+	}
+}
+
+func TestMultiplexGames(t *testing.T) {
+	serverIp := net.IPv4(198, 51, 100, 1).To4()
+	network := transport.NewNetwork(1)
+	server := startServerConfig(t, Config{
+		TrackerPort:      50000,
+		TrackerDebugPort: 50001,
+		MultiplexPorts:   2,
+		Transport:        network.Host(serverIp),
+	})
+
+	newClient := func(i int) *bolotest.Client {
+		client, err := bolotest.NewClientOn(network.Host(net.IPv4(203, 0, 113, byte(i))), trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+
+	// two games on two ports, so each game's entry port is the other game's
+	// second player's port
+	type game struct {
+		host     *bolotest.Client
+		joiner   *bolotest.Client
+		gameInfo bolo.GameInfo
+	}
+	games := []game{{host: newClient(10), joiner: newClient(11)}, {host: newClient(20), joiner: newClient(21)}}
+	entryPorts := make(map[int]bool)
+	for i := range games {
+		games[i].gameInfo = bolotest.NewGameInfo(fmt.Sprint("Island ", i), games[i].host.Addr().IP)
+		err := games[i].host.Host(games[i].gameInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostPlayer := waitForPlayer(t, server, games[i].host)
+		entryPorts[hostPlayer.RelayPort] = true
+	}
+	if len(entryPorts) != 2 {
+		t.Fatal("games share an entry port")
+	}
+
+	for _, g := range games {
+		hostPlayer := waitForPlayer(t, server, g.host)
+		g.joiner.SetGameInfo(g.gameInfo)
+		err := g.joiner.Join(&net.UDPAddr{IP: serverIp, Port: hostPlayer.RelayPort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		joinerPlayer := waitForPlayer(t, server, g.joiner)
+		if joinerPlayer.GameId != g.gameInfo.GameId {
+			t.Errorf("joiner is in game %x, expected %x", joinerPlayer.GameId, g.gameInfo.GameId)
+		}
+		if joinerPlayer.RelayPort == hostPlayer.RelayPort {
+			t.Errorf("joiner shares relay port %d with the host", joinerPlayer.RelayPort)
+		}
+
+		join, err := g.host.ReceiveType(bolo.PacketType5, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the host answers on the joiner's port, which is the other game's
+		// entry port
+		err = g.host.Send(&join.SrcAddr, bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0, bolotest.PlayerNameOpcode(g.gameInfo.MapName))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := g.joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received.SrcAddr.Port != hostPlayer.RelayPort {
+			t.Errorf("game state came from port %d, expected host's relay port %d", received.SrcAddr.Port, hostPlayer.RelayPort)
+		}
+		packet, err := bolo.DecodeGameState(received.Buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := packet.Blocks[0].Opcodes[0].(bolo.PlayerNameOp).Name; name != g.gameInfo.MapName {
+			t.Errorf("joiner of %s received game state from %s", g.gameInfo.MapName, name)
+		}
+	}
+
+	// both ports are some game's entry port, so there is no room for a third
+	third := newClient(30)
+	err := third.Host(bolotest.NewGameInfo("Island 2", third.Addr().IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(server.Games()) != 2 {
+		t.Errorf("%d games tracked after the pool ran out of entry ports, expected 2", len(server.Games()))
+	}
+}
+
+func TestProxyPortsExhausted(t *testing.T) {
+	network := transport.NewNetwork(1)
+	server := startServerConfig(t, Config{
+		TrackerPort:      50000,
+		TrackerDebugPort: 50001,
+		ProxyPortFirst:   40001,
+		ProxyPortLast:    40001,
+		Transport:        network.Host(net.IPv4(198, 51, 100, 1)),
+	})
+
+	var clients []*bolotest.Client
+	for i := 0; i < 2; i++ {
+		client, err := bolotest.NewClientOn(network.Host(net.IPv4(203, 0, 113, byte(10+i))), trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		clients = append(clients, client)
+	}
+
+	err := clients[0].Host(bolotest.NewGameInfo("First", clients[0].Addr().IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPlayer(t, server, clients[0])
+
+	err = clients[1].Host(bolotest.NewGameInfo("Second", clients[1].Addr().IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters := server.getContext().Counters
+	deadline := time.Now().Add(testTimeout)
+	for atomic.LoadUint64(&counters.RejectedPlayers) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadUint64(&counters.RejectedPlayers) != 1 {
+		t.Fatalf("%d players rejected, expected 1", atomic.LoadUint64(&counters.RejectedPlayers))
+	}
+
+	// the first game carries on, and the second isn't listed
+	games := server.Games()
+	if len(games) != 1 || games[0].MapName != "First" {
+		t.Errorf("tracking %+v, expected only the first game", games)
+	}
+	if len(server.Players()) != 1 {
+		t.Errorf("%d players, expected 1", len(server.Players()))
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	network := transport.NewNetwork(1)
+	serverIp := net.IPv4(198, 51, 100, 1).To4()
+	server := startServerConfig(t, Config{
+		TrackerPort:                  50000,
+		TrackerDebugPort:             50001,
+		RateLimitNewPlayersPerMinute: 1,
+		RateLimitNewGamesPerMinute:   1,
+		RateLimitPacketsPerSecond:    100,
+		Transport:                    network.Host(serverIp),
+	})
+	limits := server.getContext().Limits
+
+	// every client is on the same address
+	clientHost := network.Host(net.IPv4(203, 0, 113, 10))
+	newClient := func() *bolotest.Client {
+		client, err := bolotest.NewClientOn(clientHost, trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.Now().Add(testTimeout)
+		for !condition() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !condition() {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+
+	host := newClient()
+	gameInfo := bolotest.NewGameInfo("Limited", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+
+	second := newClient()
+	// bolo names a game after the host's lan address, which differs
+	err = second.Host(bolotest.NewGameInfo("Second", net.IPv4(192, 168, 1, 11)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("new game to be limited", func() bool { return limits.NewGames.Denied() == 1 })
+
+	joiner := newClient()
+	err = joiner.Join(&net.UDPAddr{IP: serverIp, Port: hostPlayer.RelayPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor("new player to be limited", func() bool { return limits.NewPlayers.Denied() == 1 })
+
+	if len(server.Games()) != 1 || len(server.Players()) != 1 {
+		t.Errorf("%d games and %d players, expected only the first host", len(server.Games()), len(server.Players()))
+	}
+
+	for i := 0; i < 200; i++ {
+		host.Send(trackerAddr(server), []byte("spam"))
+	}
+	waitFor("packets to be limited", func() bool { return limits.Packets.Denied() > 0 })
+}
+
+func TestHttpApi(t *testing.T) {
+	network := transport.NewNetwork(1)
+	serverIp := net.IPv4(198, 51, 100, 1).To4()
+	server := startServerConfig(t, Config{
+		TrackerPort:      50000,
+		TrackerDebugPort: 50001,
+		HttpPort:         8080,
+		Transport:        network.Host(serverIp),
+	})
+
+	host, err := bolotest.NewClientOn(network.Host(net.IPv4(203, 0, 113, 10)), trackerAddr(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(host.Close)
+	err = host.Host(bolotest.NewGameInfo("Web Island", host.Addr().IP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+
+	browser := network.Host(net.IPv4(203, 0, 113, 20))
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+			tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+			if err != nil {
+				return nil, err
+			}
+			return browser.DialTCP(tcpAddr)
+		},
+	}}
+	response, err := client.Get("http://198.51.100.1:8080/api/games")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var games []struct {
+		MapName string `json:"map_name"`
+		Join    string `json:"join"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&games)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 || games[0].MapName != "Web Island" || games[0].Join != fmt.Sprint("localhost:", hostPlayer.RelayPort) {
+		t.Errorf("games are %+v", games)
+	}
+}
+
+// waitForEvent returns the next event of eventType, discarding others
+func waitForEvent(t *testing.T, subscription *events.Subscription, eventType events.Type) events.Event {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event := <-subscription.C:
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+			return events.Event{}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server := startServer(t)
+	subscription := server.Subscribe(64)
+	defer subscription.Close()
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Event Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := waitForEvent(t, subscription, events.GameCreated)
+	if created.GameId != gameInfo.GameId || created.MapName != "Event Island" {
+		t.Errorf("game created event is %+v", created)
+	}
+	hostJoined := waitForEvent(t, subscription, events.PlayerJoined)
+	hostPlayer := waitForPlayer(t, server, host)
+	if hostJoined.ProxyPort != hostPlayer.ProxyPort || hostJoined.GameId != gameInfo.GameId {
+		t.Errorf("host joined event is %+v", hostJoined)
+	}
+
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerJoined := waitForEvent(t, subscription, events.PlayerJoined)
+	joinerPlayer := waitForPlayer(t, server, joiner)
+	if joinerJoined.ProxyPort != joinerPlayer.ProxyPort {
+		t.Errorf("joiner joined event is %+v", joinerJoined)
+	}
+
+	traversed := waitForEvent(t, subscription, events.NatTraversalSucceeded)
+	if traversed.ProxyPort != hostPlayer.ProxyPort || traversed.PeerProxyPort != joinerPlayer.ProxyPort {
+		t.Errorf("nat traversal event is %+v", traversed)
+	}
+
+}
+
+func TestNatTraversalFailedEvent(t *testing.T) {
+	natProbeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { natProbeTimeout = 10 * time.Second })
+
+	server := startServer(t)
+	subscription := server.Subscribe(64)
+	defer subscription.Close()
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Silent Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+
+	// the host is gone, so nothing answers the probes while the joiner keeps
+	// asking to join
+	host.Close()
+	joiner.SetGameInfo(gameInfo)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				joiner.Join(proxyAddr(hostPlayer))
+			}
+		}
+	}()
+
+	failed := waitForEvent(t, subscription, events.NatTraversalFailed)
+	joinerPlayer := waitForPlayer(t, server, joiner)
+	if failed.ProxyPort != hostPlayer.ProxyPort || failed.PeerProxyPort != joinerPlayer.ProxyPort {
+		t.Errorf("nat traversal event is %+v", failed)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	server := startServerConfig(t, Config{Transport: transport.Loopback{}, CaptureDirectory: t.TempDir()})
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Capture Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+
+	_, err = server.StartCapture(capture.Filter{GameId: gameInfo.GameId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the join request in, the probe of the host's nat, and the join request
+	// out once the probe is answered
+	deadline := time.Now().Add(testTimeout)
+	for server.CaptureStatus().Packets < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, err := server.StopCapture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Packets < 3 || status.Dropped != 0 {
+		t.Errorf("captured %d packets and dropped %d", status.Packets, status.Dropped)
+	}
+	info, err := os.Stat(status.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() == 0 {
+		t.Error("capture file is empty")
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	network := transport.NewNetwork(1)
+	serverIp := net.IPv4(198, 51, 100, 1).To4()
+	directory := t.TempDir()
+	server := startServerConfig(t, Config{
+		TrackerPort:        50000,
+		TrackerDebugPort:   50001,
+		Transport:          network.Host(serverIp),
+		RecordingDirectory: directory,
+	})
+	newClientOn := func(i int) *bolotest.Client {
+		client, err := bolotest.NewClientOn(network.Host(net.IPv4(203, 0, 113, byte(i))), trackerAddr(server))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		return client
+	}
+	host := newClientOn(10)
+	joiner := newClientOn(11)
+
+	gameInfo := bolotest.NewGameInfo("Replay Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(&net.UDPAddr{IP: serverIp, Port: hostPlayer.ProxyPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, server, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a few exchanges of game state, the only packets that are recorded
+	hostAddr := &net.UDPAddr{IP: serverIp, Port: hostPlayer.ProxyPort}
+	joinerAddr := &net.UDPAddr{IP: serverIp, Port: joinerPlayer.ProxyPort}
+	for i := 0; i < 3; i++ {
+		err = host.Send(joinerAddr, bolotest.GameStatePacket(0x10+i, bolotest.GameStateBlock(i, 0, bolotest.PlayerNameOpcode("host"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = joiner.Send(hostAddr, bolotest.GameStatePacket(0x20+i, bolotest.GameStateBlock(i, 1, bolotest.PlayerNameOpcode("joiner"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = host.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var header recording.Header
+	var records []recording.Record
+	deadline := time.Now().Add(testTimeout)
+	for len(records) < 12 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		header, records, _ = recording.ReadFile(filepath.Join(directory, recording.Filename(gameInfo.GameId)))
+	}
+	if len(records) != 12 {
+		t.Fatalf("recorded %d packets, expected each of 6 as sent and as relayed", len(records))
+	}
+	if header.GameId != gameInfo.GameId {
+		t.Errorf("recording is of game %x", header.GameId)
+	}
+	first := records[0]
+	if first.Direction != capture.Inbound || first.ProxyPort != hostPlayer.ProxyPort || first.PeerProxyPort != joinerPlayer.ProxyPort {
+		t.Errorf("first record is %+v", first)
+	}
+
+	// replay it through a second relay
+	replayIp := net.IPv4(198, 51, 100, 2).To4()
+	replayServer := startServerOn(t, network.Host(replayIp), 50000, 50001)
+	replayer := bolotest.Replayer{
+		Transport:   network.Host(net.IPv4(203, 0, 113, 20)),
+		TrackerAddr: trackerAddr(replayServer),
+		RelayAddr: func(addr *net.UDPAddr) (*net.UDPAddr, error) {
+			player := waitForPlayerAddr(t, replayServer, addr)
+			return &net.UDPAddr{IP: replayIp, Port: player.RelayPort}, nil
+		},
+		Timeout: testTimeout,
+	}
+	relayed, err := replayer.Replay(header, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relayed) != 6 {
+		t.Fatalf("replayed %d packets, expected 6", len(relayed))
+	}
+
+	outbound := make([]recording.Record, 0, 6)
+	for _, record := range records {
+		if record.Direction == capture.Outbound {
+			outbound = append(outbound, record)
+		}
+	}
+	for i, packet := range relayed {
+		if !bytes.Equal(packet.Buffer, outbound[i].Buffer) {
+			t.Errorf("replayed packet %d was relayed as %x, recorded as %x", i, packet.Buffer, outbound[i].Buffer)
+		}
+	}
+	if _, ok := replayServer.Game(gameInfo.GameId); !ok {
+		t.Error("replayed game is not tracked under the recorded game id")
+	}
+}
+
+func TestChatMessage(t *testing.T) {
+	server := startServer(t)
+	subscription := server.Subscribe(64)
+	defer subscription.Close()
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Chat Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, server, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(from *bolotest.Client, to *bolotest.Client, toPlayer Player, packet []byte) {
+		err := from.Send(proxyAddr(toPlayer), packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = to.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bolo gives the players ids 0 and 1 along with their names
+	send(host, joiner, joinerPlayer, bolotest.GameStatePacket(0x02, bolotest.GameStateBlock(0x01, 0, bolotest.PlayerNameOpcode("Alice"))))
+	send(joiner, host, hostPlayer, bolotest.GameStatePacket(0x02, bolotest.GameStateBlock(0x01, 1, bolotest.PlayerNameOpcode("Bob"))))
+	waitForEvent(t, subscription, events.PlayerRenamed)
+	waitForEvent(t, subscription, events.PlayerRenamed)
+
+	// the message goes around the ring, back to its sender
+	chat := bolotest.GameStateBlock(0x02, 0, bolotest.SendMessageOpcode(0x0002, "gg"))
+	send(host, joiner, joinerPlayer, bolotest.GameStatePacket(0x03, chat))
+	send(joiner, host, hostPlayer, bolotest.GameStatePacket(0x03, chat))
+
+	message := waitForEvent(t, subscription, events.ChatMessage)
+	if message.GameId != gameInfo.GameId || message.Message != "gg" ||
+		message.ProxyPort != hostPlayer.ProxyPort || message.Name != "Alice" {
+		t.Errorf("chat message event is %+v", message)
+	}
+	want := []events.Recipient{{PlayerId: 1, ProxyPort: joinerPlayer.ProxyPort, Name: "Bob"}}
+	if fmt.Sprint(message.Recipients) != fmt.Sprint(want) {
+		t.Errorf("recipients are %+v, expected %+v", message.Recipients, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	for len(subscription.C) > 0 {
+		if event := <-subscription.C; event.Type == events.ChatMessage {
+			t.Errorf("message passed on around the ring was reported again: %+v", event)
+		}
+	}
+}
+
+func TestServerChat(t *testing.T) {
+	server := startServerConfig(t, Config{Transport: transport.Loopback{}, Motd: "Welcome to the test server"})
+	subscription := server.Subscribe(64)
+	defer subscription.Close()
+	host := newClient(t, server)
+	joiner := newClient(t, server)
+
+	gameInfo := bolotest.NewGameInfo("Chat Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPlayer := waitForPlayer(t, server, host)
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(proxyAddr(hostPlayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerPlayer := waitForPlayer(t, server, joiner)
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send relays a game state packet, returning the chat messages it was
+	// delivered with
+	var received bolotest.Packet
+	send := func(from *bolotest.Client, to *bolotest.Client, toPlayer Player, packet []byte) []bolo.ChatMessage {
+		err := from.Send(proxyAddr(toPlayer), packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err = to.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages, err := bolo.DecodeChatMessages(received.Buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return messages
+	}
+
+	// each player is greeted in the first packet relayed to them, the host
+	// once bolo has given them id 0
+	messages := send(host, joiner, joinerPlayer, bolotest.GameStatePacket(0x02, bolotest.GameStateBlock(0x01, 0, bolotest.PlayerNameOpcode("Alice"))))
+	if len(messages) != 1 || messages[0].Message != "Welcome to the test server" || messages[0].Recipients != 0xffff {
+		t.Errorf("joiner was greeted with %+v", messages)
+	}
+	messages = send(joiner, host, hostPlayer, bolotest.GameStatePacket(0x02, bolotest.GameStateBlock(0x01, 1, bolotest.PlayerNameOpcode("Bob"))))
+	if len(messages) != 1 || messages[0].Message != "Welcome to the test server" || messages[0].Recipients != 0x0001 {
+		t.Errorf("host was greeted with %+v", messages)
+	}
+	// the server speaks as the highest player id nobody has
+	if len(messages) == 1 && messages[0].Sender != 15 {
+		t.Errorf("server message sent from player %d", messages[0].Sender)
+	}
+	messages = send(host, joiner, joinerPlayer, bolotest.GameStatePacket(0x03))
+	if len(messages) != 0 {
+		t.Errorf("joiner was sent %+v again", messages)
+	}
+
+	count, err := server.Announce(&gameInfo.GameId, "Server restarting in 5 minutes")
+	if err != nil || count != 2 {
+		t.Fatalf("announced to %d players, %v", count, err)
+	}
+	_, err = server.Announce(nil, strings.Repeat("x", bolo.MaxMessageLength+1))
+	if err == nil {
+		t.Error("announced a message too long for a block")
+	}
+
+	// the joiner passes on the block they were sent, which the host gets
+	// their own copy of instead
+	messages = send(host, joiner, joinerPlayer, bolotest.GameStatePacket(0x04))
+	if len(messages) != 1 || messages[0].Message != "Server restarting in 5 minutes" || messages[0].Recipients != 0x0002 {
+		t.Fatalf("joiner was sent %+v", messages)
+	}
+	sent := received.Buffer[bolo.PacketHeaderSize+1:]
+	passedOn := bolotest.GameStatePacket(0x05, bolotest.GameStateBlock(0x02, 1, bolotest.SendMessageOpcode(0x0001, "ok")), sent)
+	messages = send(joiner, host, hostPlayer, passedOn)
+	if len(messages) != 2 || messages[0].Message != "ok" || messages[1].Message != "Server restarting in 5 minutes" || messages[1].Recipients != 0x0001 {
+		t.Errorf("host was sent %+v", messages)
+	}
+
+	// only the players' own messages are reported
+	message := waitForEvent(t, subscription, events.ChatMessage)
+	if message.Message != "ok" {
+		t.Errorf("chat message event is %+v", message)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for len(subscription.C) > 0 {
+		if event := <-subscription.C; event.Type == events.ChatMessage {
+			t.Errorf("server message was reported: %+v", event)
+		}
+	}
+}
+
+func TestShutdownWarning(t *testing.T) {
+	for delay, want := range map[time.Duration]string{
+		5 * time.Minute:  "Server shutting down in 5 minutes",
+		time.Minute:      "Server shutting down in 1 minute",
+		90 * time.Second: "Server shutting down in 90 seconds",
+		time.Second:      "Server shutting down in 1 second",
+	} {
+		if message := shutdownWarning(delay); message != want {
+			t.Errorf("warning for %s is %q", delay, message)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"git.astrospark.com/bolorama/state"
+)
+
+// restoreSnapshot relays the games and players saved by the last server
+// again, unless they will have given up on it by now, and returns the players
+// for the tracker to ping
+func restoreSnapshot(context *state.ServerContext, filename string) []state.Player {
+	logger := context.Log.Server
+	snapshot, err := state.ReadSnapshot(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		logger.Warn("can't read snapshot", "filename", filename, "error", err)
+		return nil
+	}
+
+	age := time.Since(snapshot.Time)
+	if age > context.PlayerTimeout {
+		logger.Info("snapshot is older than the player timeout, not restoring it",
+			"filename", filename, "age_seconds", age.Seconds())
+		return nil
+	}
+
+	players, err := state.RestoreSnapshot(context, snapshot, true)
+	if err != nil {
+		logger.Warn("can't restore snapshot", "filename", filename, "error", err)
+		return nil
+	}
+	logger.Info("restored snapshot", "filename", filename, "games", len(snapshot.Games),
+		"players", len(players), "age_seconds", age.Seconds())
+	return players
+}
+
+func saveSnapshot(context *state.ServerContext, filename string) {
+	err := state.WriteSnapshot(filename, state.TakeSnapshot(context, true))
+	if err != nil {
+		context.Log.Server.Warn("can't save snapshot", "filename", filename, "error", err)
+	}
+}
+
+// snapshotter saves a snapshot every period until shutdown, which saves the
+// last one once nothing is relayed any more
+func snapshotter(context *state.ServerContext, filename string, period time.Duration) {
+	defer context.WaitGroup.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-context.ShutdownChannel:
+			return
+		case <-ticker.C:
+			saveSnapshot(context, filename)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// Players is the registry of the players being relayed. Each player is held
+// by pointer, so a change made through one lookup is seen by every other, and
+// is indexed by address, proxy port, game and player id, so that finding the
+// players of a packet costs the same however many players there are.
+//
+// Players is guarded by the context mutex. A player found in it may only be
+// used while the mutex is held; copy it to keep it for longer.
+type Players struct {
+	byPort map[int]*Player
+	byAddr map[netip.AddrPort]*Player
+	byGame map[bolo.GameId]map[int]*Player
+	byId   map[playerIdKey]*Player
+}
+
+// playerIdKey is the player id Bolo gave a player in a game
+type playerIdKey struct {
+	gameId   bolo.GameId
+	playerId int
+}
+
+func NewPlayers() *Players {
+	return &Players{
+		byPort: make(map[int]*Player),
+		byAddr: make(map[netip.AddrPort]*Player),
+		byGame: make(map[bolo.GameId]map[int]*Player),
+		byId:   make(map[playerIdKey]*Player),
+	}
+}
+
+// addrKey is the index key of a player's address. IPv4 addresses are the same
+// key in their 4 and 16 byte forms, as they are for net.IP.Equal.
+func addrKey(ip net.IP, port int) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port))
+}
+
+// Len is the number of players
+func (players *Players) Len() int {
+	return len(players.byPort)
+}
+
+// Add registers player under its address, proxy port, game and player id
+func (players *Players) Add(player *Player) {
+	players.byPort[player.ProxyPort] = player
+	players.byAddr[addrKey(player.IpAddr, player.IpPort)] = player
+	players.addToGame(player)
+}
+
+// Remove forgets player
+func (players *Players) Remove(player *Player) {
+	if players.byPort[player.ProxyPort] != player {
+		return
+	}
+	delete(players.byPort, player.ProxyPort)
+	key := addrKey(player.IpAddr, player.IpPort)
+	if players.byAddr[key] == player {
+		delete(players.byAddr, key)
+	}
+	players.removeFromGame(player)
+}
+
+// SetGame moves player to gameId. Player ids are given out by each game, so
+// the player no longer has one.
+func (players *Players) SetGame(player *Player, gameId bolo.GameId) {
+	players.removeFromGame(player)
+	player.GameId = gameId
+	player.PlayerId = -1
+	players.addToGame(player)
+}
+
+// SetId records the player id Bolo gave player in their game
+func (players *Players) SetId(player *Player, playerId int) {
+	players.removeId(player)
+	player.PlayerId = playerId
+	if playerId >= 0 {
+		players.byId[playerIdKey{player.GameId, playerId}] = player
+	}
+}
+
+func (players *Players) addToGame(player *Player) {
+	game, ok := players.byGame[player.GameId]
+	if !ok {
+		game = make(map[int]*Player)
+		players.byGame[player.GameId] = game
+	}
+	game[player.ProxyPort] = player
+	if player.PlayerId >= 0 {
+		players.byId[playerIdKey{player.GameId, player.PlayerId}] = player
+	}
+}
+
+func (players *Players) removeFromGame(player *Player) {
+	players.removeId(player)
+	game := players.byGame[player.GameId]
+	delete(game, player.ProxyPort)
+	if len(game) == 0 {
+		delete(players.byGame, player.GameId)
+	}
+}
+
+// removeId drops player from the player id index. Another player of the game
+// may still claim the id, such as one who hasn't yet been told it was given
+// to someone else, and they are found by it instead.
+func (players *Players) removeId(player *Player) {
+	if player.PlayerId < 0 {
+		return
+	}
+	key := playerIdKey{player.GameId, player.PlayerId}
+	if players.byId[key] != player {
+		return
+	}
+	delete(players.byId, key)
+	for _, other := range players.byGame[player.GameId] {
+		if other != player && other.PlayerId == player.PlayerId {
+			players.byId[key] = other
+			return
+		}
+	}
+}
+
+// ByPort returns the player with proxy port port, or nil
+func (players *Players) ByPort(port int) *Player {
+	return players.byPort[port]
+}
+
+// ByAddr returns the player whose packets come from addr, or nil
+func (players *Players) ByAddr(addr net.UDPAddr) *Player {
+	return players.byAddr[addrKey(addr.IP, addr.Port)]
+}
+
+// ById returns the player of gameId with player id playerId, or nil
+func (players *Players) ById(gameId bolo.GameId, playerId int) *Player {
+	return players.byId[playerIdKey{gameId, playerId}]
+}
+
+// CountGame is the number of players in gameId
+func (players *Players) CountGame(gameId bolo.GameId) int {
+	return len(players.byGame[gameId])
+}
+
+// Game returns the players of gameId, ordered by proxy port
+func (players *Players) Game(gameId bolo.GameId) []*Player {
+	return sortPlayers(players.byGame[gameId])
+}
+
+// All returns every player, ordered by proxy port
+func (players *Players) All() []*Player {
+	return sortPlayers(players.byPort)
+}
+
+func sortPlayers(byPort map[int]*Player) []*Player {
+	result := make([]*Player, 0, len(byPort))
+	for _, player := range byPort {
+		result = append(result, player)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ProxyPort < result[j].ProxyPort
+	})
+	return result
+}
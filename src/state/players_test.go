@@ -0,0 +1,101 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"testing"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+var gameId = bolo.GameId{192, 168, 1, 10, 0xdc, 0x89, 0x85, 0x00}
+var otherGameId = bolo.GameId{192, 168, 1, 11, 0xdc, 0x89, 0x85, 0x00}
+
+func newPlayer(proxyPort int, ipPort int, gameId bolo.GameId) *Player {
+	return &Player{
+		IpAddr:    net.IPv4(203, 0, 113, 10),
+		IpPort:    ipPort,
+		ProxyPort: proxyPort,
+		GameId:    gameId,
+		PlayerId:  -1,
+	}
+}
+
+func TestPlayers(t *testing.T) {
+	players := NewPlayers()
+	alice := newPlayer(40002, 50000, gameId)
+	bob := newPlayer(40001, 50001, gameId)
+	zed := newPlayer(40003, 50002, otherGameId)
+	for _, player := range []*Player{alice, bob, zed} {
+		players.Add(player)
+	}
+
+	if players.Len() != 3 || players.CountGame(gameId) != 2 || players.CountGame(otherGameId) != 1 {
+		t.Errorf("%d players, %d and %d in the games", players.Len(), players.CountGame(gameId), players.CountGame(otherGameId))
+	}
+	if players.ByPort(40002) != alice || players.ByPort(40004) != nil {
+		t.Error("lookup by proxy port failed")
+	}
+	// net.IPv4 is 16 bytes, packets come from 4 byte addresses
+	if players.ByAddr(net.UDPAddr{IP: net.IPv4(203, 0, 113, 10).To4(), Port: 50001}) != bob {
+		t.Error("lookup by address failed")
+	}
+	if players.ByAddr(net.UDPAddr{IP: net.IPv4(203, 0, 113, 11), Port: 50001}) != nil {
+		t.Error("found a player at another address")
+	}
+	if game := players.Game(gameId); len(game) != 2 || game[0] != bob || game[1] != alice {
+		t.Errorf("game players are %v", game)
+	}
+
+	// changes through one lookup are seen through the others
+	players.ByPort(40002).Name = "Alice"
+	if players.ByAddr(net.UDPAddr{IP: alice.IpAddr, Port: 50000}).Name != "Alice" {
+		t.Error("player was copied")
+	}
+
+	players.SetId(alice, 0)
+	players.SetId(bob, 1)
+	players.SetId(zed, 0)
+	if players.ById(gameId, 0) != alice || players.ById(gameId, 1) != bob || players.ById(otherGameId, 0) != zed {
+		t.Error("lookup by player id failed")
+	}
+
+	// a player moving game has no player id until bolo gives them one
+	players.SetGame(bob, otherGameId)
+	if bob.PlayerId != -1 || players.ById(gameId, 1) != nil || players.CountGame(otherGameId) != 2 {
+		t.Errorf("player moved to %x with id %d", bob.GameId, bob.PlayerId)
+	}
+
+	// the id of a player who leaves goes to another player still claiming it
+	players.SetId(bob, 0)
+	players.Remove(zed)
+	if players.ById(otherGameId, 0) != bob {
+		t.Error("player id was not passed on")
+	}
+	players.Remove(zed)
+	if players.Len() != 2 || players.ByPort(40003) != nil || players.ByAddr(net.UDPAddr{IP: zed.IpAddr, Port: 50002}) != nil {
+		t.Error("removed player was found")
+	}
+
+	players.Remove(alice)
+	players.Remove(bob)
+	if players.Len() != 0 || len(players.byGame) != 0 || len(players.byId) != 0 || len(players.byAddr) != 0 {
+		t.Errorf("indexes are left with %+v", players)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+)
+
+// NatOpenPeriod is how long after packets last passed between two players
+// their nats are taken to still be open to each other
+const NatOpenPeriod = 20 * time.Second
+
+// routePongPeriod is how often a route tells the tracker its sender is still
+// there, rather than on every packet
+const routePongPeriod = time.Second
+
+// Route is an established path for packets from one player to another: both
+// are in the same game and their nats are open to each other. Routes are
+// cached by the port the packets arrive on and the sender's address, so that
+// each port's own goroutine can relay them without the context mutex.
+type Route struct {
+	// Src and Dst are copies of the players taken when the route was
+	// cached, and are not changed after
+	Src Player
+	Dst Player
+	// the route is stale once its game's generation moves on
+	game       *routeGeneration
+	generation uint64
+	// lastUsed and lastPong are unix nanoseconds
+	lastUsed atomic.Int64
+	lastPong atomic.Int64
+}
+
+// routeGeneration counts the membership changes of a game. Every change
+// makes the routes cached before it stale.
+type routeGeneration struct {
+	generation atomic.Uint64
+}
+
+type routeKey struct {
+	port int
+	addr netip.AddrPort
+}
+
+// Routes is the route cache. Lookups take no lock; routes are added by the
+// packets that take the slow path under the context mutex, and made stale by
+// membership changes, which hold it too.
+type Routes struct {
+	routes sync.Map // routeKey to *Route
+	// games is guarded by the context mutex
+	games map[bolo.GameId]*routeGeneration
+}
+
+func NewRoutes() *Routes {
+	return &Routes{games: make(map[bolo.GameId]*routeGeneration)}
+}
+
+// CachedRoute returns the route of a packet from srcAddr arriving on port,
+// or nil if there is none or it went stale, and marks it used
+func CachedRoute(context *ServerContext, port int, srcAddr net.UDPAddr) *Route {
+	value, ok := context.Routes.routes.Load(routeKey{port, addrKey(srcAddr.IP, srcAddr.Port)})
+	if !ok {
+		return nil
+	}
+	route := value.(*Route)
+	if route.game.generation.Load() != route.generation {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if time.Duration(now-route.lastUsed.Load()) > NatOpenPeriod {
+		// the slow path checks both directions and probes the nats if
+		// neither has been used
+		return nil
+	}
+	route.lastUsed.Store(now)
+	return route
+}
+
+// Pong reports whether it is time to tell the tracker the sender is still
+// there
+func (route *Route) Pong() bool {
+	now := time.Now().UnixNano()
+	last := route.lastPong.Load()
+	if time.Duration(now-last) < routePongPeriod {
+		return false
+	}
+	return route.lastPong.CompareAndSwap(last, now)
+}
+
+// CacheRoute remembers the route of packets from srcPlayer to dstPlayer
+// arriving on port. Routes are only cached once nothing is left for the slow
+// path to do for them, which is when the sender's nat is open to the
+// tracker.
+func CacheRoute(context *ServerContext, port int, srcPlayer *Player, dstPlayer *Player) {
+	if srcPlayer.NatPort != context.ProxyPort || srcPlayer.GameId != dstPlayer.GameId {
+		return
+	}
+
+	game := routeGenerationOf(context, srcPlayer.GameId)
+	route := &Route{
+		Src:        *srcPlayer,
+		Dst:        *dstPlayer,
+		game:       game,
+		generation: game.generation.Load(),
+	}
+	now := time.Now().UnixNano()
+	route.lastUsed.Store(now)
+	route.lastPong.Store(now)
+	context.Routes.routes.Store(routeKey{port, addrKey(srcPlayer.IpAddr, srcPlayer.IpPort)}, route)
+}
+
+// PeerLastSeen is when packets last passed between two players in either
+// direction, whether they were relayed by the slow path or over a cached
+// route
+func PeerLastSeen(context *ServerContext, srcPlayer *Player, dstPlayer *Player) time.Time {
+	lastSeen := srcPlayer.Peers[dstPlayer.ProxyPort]
+	if timestamp := dstPlayer.Peers[srcPlayer.ProxyPort]; timestamp.After(lastSeen) {
+		lastSeen = timestamp
+	}
+	for _, players := range [][2]*Player{{srcPlayer, dstPlayer}, {dstPlayer, srcPlayer}} {
+		value, ok := context.Routes.routes.Load(routeKey{players[1].RelayPort, addrKey(players[0].IpAddr, players[0].IpPort)})
+		if !ok {
+			continue
+		}
+		route := value.(*Route)
+		if route.Dst.ProxyPort != players[1].ProxyPort {
+			continue
+		}
+		if timestamp := time.Unix(0, route.lastUsed.Load()); timestamp.After(lastSeen) {
+			lastSeen = timestamp
+		}
+	}
+	return lastSeen
+}
+
+func routeGenerationOf(context *ServerContext, gameId bolo.GameId) *routeGeneration {
+	game, ok := context.Routes.games[gameId]
+	if !ok {
+		game = &routeGeneration{}
+		context.Routes.games[gameId] = game
+	}
+	return game
+}
+
+// routesChanged makes the cached routes of gameId stale, after a player
+// joins or leaves it or something a route copied from a player changes
+func routesChanged(context *ServerContext, gameId bolo.GameId) {
+	game, ok := context.Routes.games[gameId]
+	if ok {
+		game.generation.Add(1)
+	}
+}
+
+// routesDelete forgets the routes of a game that ended, and of the players
+// who left, so that the cache doesn't grow with every player ever relayed
+func routesDelete(context *ServerContext, gameId bolo.GameId) {
+	routesChanged(context, gameId)
+	delete(context.Routes.games, gameId)
+	context.Routes.routes.Range(func(key, value any) bool {
+		if value.(*Route).Src.GameId == gameId {
+			context.Routes.routes.Delete(key)
+		}
+		return true
+	})
+}
+
+// routesDeletePlayer forgets the routes to and from a player who left
+func routesDeletePlayer(context *ServerContext, player *Player) {
+	routesChanged(context, player.GameId)
+	context.Routes.routes.Range(func(key, value any) bool {
+		route := value.(*Route)
+		if route.Src.ProxyPort == player.ProxyPort || route.Dst.ProxyPort == player.ProxyPort {
+			context.Routes.routes.Delete(key)
+		}
+		return true
+	})
+}
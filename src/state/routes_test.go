@@ -0,0 +1,94 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoutes(t *testing.T) {
+	context := &ServerContext{ProxyPort: 50000, Routes: NewRoutes()}
+	alice := newPlayer(40001, 50001, gameId)
+	bob := newPlayer(40002, 50002, gameId)
+	for _, player := range []*Player{alice, bob} {
+		player.RelayPort = player.ProxyPort
+		player.NatPort = context.ProxyPort
+		player.Peers = make(map[int]time.Time)
+	}
+	aliceAddr := net.UDPAddr{IP: alice.IpAddr.To4(), Port: alice.IpPort}
+
+	// a sender whose nat is closed to the tracker still needs the slow path
+	alice.NatPort = 40003
+	CacheRoute(context, bob.RelayPort, alice, bob)
+	if CachedRoute(context, bob.RelayPort, aliceAddr) != nil {
+		t.Error("cached a route for a sender behind a closed nat")
+	}
+
+	alice.NatPort = context.ProxyPort
+	CacheRoute(context, bob.RelayPort, alice, bob)
+	route := CachedRoute(context, bob.RelayPort, aliceAddr)
+	if route == nil || route.Src.ProxyPort != alice.ProxyPort || route.Dst.ProxyPort != bob.ProxyPort {
+		t.Fatalf("cached route is %+v", route)
+	}
+	if CachedRoute(context, alice.RelayPort, aliceAddr) != nil {
+		t.Error("found the route on another port")
+	}
+
+	// bob has never sent anything, but alice's packets reached him
+	if lastSeen := PeerLastSeen(context, bob, alice); time.Since(lastSeen) > time.Second {
+		t.Errorf("players last seen each other at %v", lastSeen)
+	}
+
+	// the tracker hears from alice once a second, not on every packet
+	if route.Pong() {
+		t.Error("pong right after the route was cached")
+	}
+	route.lastPong.Store(time.Now().Add(-routePongPeriod).UnixNano())
+	if !route.Pong() || route.Pong() {
+		t.Error("pong was not once per period")
+	}
+
+	// a route unused for longer than nats stay open goes back to the slow path
+	route.lastUsed.Store(time.Now().Add(-NatOpenPeriod - time.Second).UnixNano())
+	if CachedRoute(context, bob.RelayPort, aliceAddr) != nil {
+		t.Error("found a route whose nats may have closed")
+	}
+
+	CacheRoute(context, bob.RelayPort, alice, bob)
+	routesChanged(context, gameId)
+	if CachedRoute(context, bob.RelayPort, aliceAddr) != nil {
+		t.Error("found a route cached before the game changed")
+	}
+
+	CacheRoute(context, bob.RelayPort, alice, bob)
+	routesDeletePlayer(context, bob)
+	if _, ok := context.Routes.routes.Load(routeKey{bob.RelayPort, addrKey(alice.IpAddr, alice.IpPort)}); ok {
+		t.Error("route to a player who left was kept")
+	}
+
+	CacheRoute(context, bob.RelayPort, alice, bob)
+	routesDelete(context, gameId)
+	if _, ok := context.Routes.games[gameId]; ok {
+		t.Error("generation of an ended game was kept")
+	}
+	if CachedRoute(context, bob.RelayPort, aliceAddr) != nil {
+		t.Error("found a route of an ended game")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/logging"
+)
+
+// snapshotVersion is written to snapshots and checked when they are read
+const snapshotVersion = 1
+
+// Snapshot is the state a server needs to carry on relaying its games after
+// a restart: the games, which player is at which proxy port, and enough about
+// each player that their nat needn't be probed again
+type Snapshot struct {
+	Version    int              `json:"version"`
+	Time       time.Time        `json:"time"`
+	Games      []bolo.GameInfo  `json:"games"`
+	EntryPorts []SnapshotEntry  `json:"entry_ports,omitempty"`
+	Players    []SnapshotPlayer `json:"players"`
+}
+
+// SnapshotEntry is the relay port new players join a multiplexed game at
+type SnapshotEntry struct {
+	GameId bolo.GameId `json:"game_id"`
+	Port   int         `json:"port"`
+}
+
+type SnapshotPlayer struct {
+	IpAddr    net.IP      `json:"ip_addr"`
+	IpPort    int         `json:"ip_port"`
+	ProxyPort int         `json:"proxy_port"`
+	RelayPort int         `json:"relay_port"`
+	GameId    bolo.GameId `json:"game_id"`
+	PlayerId  int         `json:"player_id"`
+	Name      string      `json:"name"`
+	NatPort   int         `json:"nat_port"`
+	// Peers is when packets last passed to each other player, by proxy port
+	Peers map[int]time.Time `json:"peers,omitempty"`
+}
+
+// TakeSnapshot copies the state worth keeping across a restart
+func TakeSnapshot(context *ServerContext, lock bool) Snapshot {
+	if lock {
+		context.Mutex.RLock()
+		defer context.Mutex.RUnlock()
+	}
+
+	snapshot := Snapshot{Version: snapshotVersion, Time: time.Now()}
+	for _, gameInfo := range context.Games {
+		snapshot.Games = append(snapshot.Games, gameInfo)
+	}
+	for gameId, port := range context.EntryPorts {
+		snapshot.EntryPorts = append(snapshot.EntryPorts, SnapshotEntry{GameId: gameId, Port: port})
+	}
+	for _, player := range context.Players.All() {
+		snapshotPlayer := SnapshotPlayer{
+			IpAddr:    player.IpAddr,
+			IpPort:    player.IpPort,
+			ProxyPort: player.ProxyPort,
+			RelayPort: player.RelayPort,
+			GameId:    player.GameId,
+			PlayerId:  player.PlayerId,
+			Name:      player.Name,
+			NatPort:   player.NatPort,
+			Peers:     make(map[int]time.Time),
+		}
+		for _, peer := range context.Players.Game(player.GameId) {
+			if lastSeen := PeerLastSeen(context, player, peer); !lastSeen.IsZero() {
+				snapshotPlayer.Peers[peer.ProxyPort] = lastSeen
+			}
+		}
+		snapshot.Players = append(snapshot.Players, snapshotPlayer)
+	}
+	return snapshot
+}
+
+// WriteSnapshot saves snapshot to filename. It is written beside it first
+// and renamed over it, so that a crash while writing leaves the last one.
+func WriteSnapshot(filename string, snapshot Snapshot) error {
+	buffer, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buffer)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// ReadSnapshot loads the snapshot saved to filename. A missing file is
+// reported with an error satisfying errors.Is(err, fs.ErrNotExist).
+func ReadSnapshot(filename string) (Snapshot, error) {
+	var snapshot Snapshot
+	buffer, err := os.ReadFile(filename)
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(buffer, &snapshot)
+	if err != nil {
+		return snapshot, err
+	}
+	if snapshot.Version != snapshotVersion {
+		return snapshot, fmt.Errorf("snapshot version %d is not %d", snapshot.Version, snapshotVersion)
+	}
+	return snapshot, nil
+}
+
+// RestoreSnapshot relays the games and players of snapshot again, each
+// player from the same proxy port as before so that their Bolo carries on
+// sending to it. Their return isn't published or logged to the statistics,
+// since to everyone else they never left. A player whose port can't be
+// opened again is left out, and a game left without players ends. The
+// restored players are returned for the tracker to ping.
+func RestoreSnapshot(context *ServerContext, snapshot Snapshot, lock bool) ([]Player, error) {
+	if lock {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+	}
+
+	if context.Players.Len() > 0 || len(context.Games) > 0 {
+		return nil, errors.New("server is already relaying games")
+	}
+
+	for _, gameInfo := range snapshot.Games {
+		context.Games[gameInfo.GameId] = gameInfo
+	}
+	for _, entry := range snapshot.EntryPorts {
+		context.EntryPorts[entry.GameId] = entry.Port
+	}
+
+	var restored []Player
+	for _, snapshotPlayer := range snapshot.Players {
+		playerAddr := net.UDPAddr{IP: snapshotPlayer.IpAddr, Port: snapshotPlayer.IpPort}
+		relayPort := 0
+		if context.Mux != nil {
+			relayPort = snapshotPlayer.RelayPort
+		}
+		player, err := playerOpen(context, playerAddr, snapshotPlayer.GameId, snapshotPlayer.ProxyPort, relayPort)
+		if err != nil {
+			context.Log.Server.Warn("can't restore player", logging.ProxyPort, snapshotPlayer.ProxyPort,
+				logging.PlayerAddr, playerAddr.String(), "error", err)
+			continue
+		}
+		player.PlayerId = snapshotPlayer.PlayerId
+		player.Name = snapshotPlayer.Name
+		player.NatPort = snapshotPlayer.NatPort
+		for peerPort, lastSeen := range snapshotPlayer.Peers {
+			player.Peers[peerPort] = lastSeen
+		}
+		context.Players.Add(player)
+		restored = append(restored, *player)
+	}
+
+	// a game whose players all failed to come back is over
+	for _, gameInfo := range snapshot.Games {
+		GameUpdatePlayerCount(context, gameInfo.GameId, false)
+	}
+
+	return restored, nil
+}
@@ -19,83 +19,228 @@ package state
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.astrospark.com/bolorama/bolo"
-	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/limit"
+	"git.astrospark.com/bolorama/logging"
 	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/recording"
+	"git.astrospark.com/bolorama/transport"
 	"git.astrospark.com/bolorama/util"
+	"git.astrospark.com/bolorama/watchdog"
 )
 
+// DefaultTxQueueSize and DefaultRxQueueSize are the packets each socket's
+// transmit queue and the serve loop's rx queue hold before dropping game
+// state
+const DefaultTxQueueSize = 64
+const DefaultRxQueueSize = 1024
+
+// statsQueueSize is the records the statistics logger may fall behind by
+const statsQueueSize = 256
+
 type ServerContext struct {
-	Players               []Player
-	Games                 map[bolo.GameId]bolo.GameInfo
-	ProxyIpAddr           net.IP
-	ProxyPort             int
-	UdpConnection         *net.UDPConn
-	RxChannel             chan proxy.UdpPacket
-	PlayerPongChannel     chan util.PlayerAddr
+	Players            *Players
+	Routes             *Routes
+	Games              map[bolo.GameId]bolo.GameInfo
+	Hostname           string
+	ProxyIpAddr        net.IP
+	ProxyPort          int
+	ProxyPorts         *proxy.Ports
+	Mux                *proxy.Mux // nil when each player has their own socket
+	EntryPorts         map[bolo.GameId]int
+	TrackerDebugPort   int
+	GameInfoPingPeriod time.Duration
+	PlayerTimeout      time.Duration
+	Transport          transport.Transport
+	UdpConnection      transport.PacketConn
+	// RxQueue takes the packets the fast path leaves to the serve loop
+	RxQueue *proxy.Queue
+	// TxPolicy is how big each socket's transmit queue is and what it drops
+	TxPolicy proxy.QueuePolicy
+	// FastPath relays the packets of cached routes in each proxy port's
+	// goroutine, ahead of the rx queue. It is set before any port opens.
+	FastPath          proxy.Handler
+	PlayerPongChannel chan util.PlayerAddr
+	// the statistics channels are buffered and sent on with SendStats, since
+	// their senders hold the mutex the statistics logger takes
 	LogGameEndChannel     chan bolo.GameId
 	LogPlayerJoinChannel  chan util.PlayerAddr
 	LogPlayerLeaveChannel chan util.PlayerAddr
-	ShutdownChannel       chan struct{}
-	WaitGroup             *sync.WaitGroup
-	Mutex                 *sync.RWMutex
-	Debug                 bool
+	// LogChatChannel takes chat message events to the statistics database
+	// when LogChat is set
+	LogChatChannel  chan events.Event
+	LogChat         bool
+	ShutdownChannel chan struct{}
+	WaitGroup       *sync.WaitGroup
+	Mutex           *sync.RWMutex
+	Counters        *Counters
+	Watchdog        *watchdog.Watchdog // nil watches nothing
+	Events          *events.Bus
+	Capture         *capture.Capture
+	Recorder        *recording.Recorder
+	Limits          Limits
+	Log             *logging.Loggers
+	// Motd is sent to each player who joins a game, empty sends nothing
+	Motd string
+	// AdminToken is the bearer token of the http requests that change the
+	// server, empty refuses them
+	AdminToken string
+	// chatMutex guards the chat state below instead of Mutex, since the chat
+	// of packets relayed over cached routes is handled without Mutex. It is
+	// taken after Mutex when both are held.
+	chatMutex  sync.Mutex
+	recentChat map[chatKey]time.Time
+	// serverChat is the sender of the server's messages in each game,
+	// serverChatBlocks the blocks they were sent in, and pendingChat the
+	// messages waiting for a game state packet to each player's proxy port.
+	// pendingChatCount is read without either mutex so that packets skip it
+	// when nothing waits.
+	serverChat       map[bolo.GameId]*serverChat
+	serverChatBlocks map[chatKey]time.Time
+	pendingChat      map[int][]pendingChat
+	pendingChatCount int64
+}
+
+// Limits are token buckets keyed by source ip. A nil limiter doesn't limit.
+type Limits struct {
+	NewPlayers *limit.Limiter
+	NewGames   *limit.Limiter
+	Packets    *limit.Limiter // on the tracker port and every proxy port
+}
+
+// Counters are updated with sync/atomic because packets are counted outside
+// of the context mutex
+type Counters struct {
+	InvalidPackets   uint64 // non-bolo datagrams rejected by bolo.ValidatePacket
+	MalformedPackets uint64 // bolo packets that failed to parse or rewrite
+	RejectedPlayers  uint64 // new players ignored, see RejectPlayer
+	NatProbes        uint64 // 0x06 packets sent to open a player's nat
+	NatProbeReplies  uint64 // 0x07 packets answering them
+	// PeerPackets replayed once a probe was answered, or dropped without
+	// being replayed: replaced by a newer packet, or discarded with the
+	// player they were held for or from
+	PeerPacketsReplayed uint64
+	PeerPacketsExpired  uint64
+	PlayerTimeouts      uint64
+	// DatabaseErrors are statements of the statistics database that failed
+	DatabaseErrors uint64
+	// packets dropped by full transmit queues and the rx queue, and
+	// statistics records dropped because the statistics logger fell behind
+	TxDropped    uint64
+	RxDropped    uint64
+	StatsDropped uint64
+	// CachedRoutePackets were relayed over a cached route, without the
+	// context mutex
+	CachedRoutePackets uint64
+	// RelayedPackets and RelayedBytes are indexed by packet type
+	RelayedPackets [256]uint64
+	RelayedBytes   [256]uint64
 }
 
 type Player struct {
-	IpAddr            net.IP
-	IpPort            int
-	ProxyPort         int
-	Connection        *net.UDPConn
-	TxChannel         chan proxy.UdpPacket
+	IpAddr net.IP
+	IpPort int
+	// ProxyPort identifies the player. When each player has their own socket it
+	// is that socket's port, when players are multiplexed it is only a number.
+	ProxyPort int
+	// RelayPort is the port other players see this player at
+	RelayPort         int
+	Connection        transport.PacketConn
+	TxQueue           *proxy.Queue
 	DisconnectChannel chan struct{}
 	GameId            bolo.GameId
 	PlayerId          int
 	Name              string
 	Peers             map[int]time.Time
 	PeerPackets       map[int]proxy.UdpPacket
-	NatPort           int
+	// PeerProbes is when the first probe was sent for each of PeerPackets
+	PeerProbes map[int]time.Time
+	NatPort    int
 }
 
-func InitContext(port int) *ServerContext {
-	debug := config.GetValueBool("debug")
+// InitContext creates the state of a server whose tracker listens on
+// connection. The remaining settings and the proxy ports are left for the
+// caller to fill in.
+func InitContext(transport transport.Transport, connection transport.PacketConn) *ServerContext {
+	counters := &Counters{}
 	return &ServerContext{
+		Players:               NewPlayers(),
+		Routes:                NewRoutes(),
 		Games:                 make(map[bolo.GameId]bolo.GameInfo),
-		ProxyIpAddr:           util.GetOutboundIp(),
-		ProxyPort:             port,
-		UdpConnection:         connectUdp(port),
+		ProxyIpAddr:           transport.OutboundIp(),
+		ProxyPort:             connection.LocalAddr().(*net.UDPAddr).Port,
+		EntryPorts:            make(map[bolo.GameId]int),
+		Transport:             transport,
+		UdpConnection:         connection,
 		PlayerPongChannel:     make(chan util.PlayerAddr),
-		RxChannel:             make(chan proxy.UdpPacket),
-		LogGameEndChannel:     make(chan bolo.GameId),
-		LogPlayerJoinChannel:  make(chan util.PlayerAddr),
-		LogPlayerLeaveChannel: make(chan util.PlayerAddr),
+		RxQueue:               proxy.NewQueue(RxQueuePolicy(DefaultRxQueueSize, counters)),
+		TxPolicy:              TxQueuePolicy(DefaultTxQueueSize, counters),
+		LogGameEndChannel:     make(chan bolo.GameId, statsQueueSize),
+		LogPlayerJoinChannel:  make(chan util.PlayerAddr, statsQueueSize),
+		LogPlayerLeaveChannel: make(chan util.PlayerAddr, statsQueueSize),
+		LogChatChannel:        make(chan events.Event, statsQueueSize),
 		ShutdownChannel:       make(chan struct{}),
 		WaitGroup:             &sync.WaitGroup{},
 		Mutex:                 &sync.RWMutex{},
-		Debug:                 debug,
+		Counters:              counters,
+		Events:                events.NewBus(),
+		Capture:               capture.New("", logging.Discard().Capture),
+		Recorder:              recording.New("", logging.Discard().Recording),
+		Log:                   logging.Discard(),
+		recentChat:            make(map[chatKey]time.Time),
+		serverChat:            make(map[bolo.GameId]*serverChat),
+		serverChatBlocks:      make(map[chatKey]time.Time),
+		pendingChat:           make(map[int][]pendingChat),
 	}
 }
 
-func connectUdp(port int) *net.UDPConn {
-	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", port))
-	if err != nil {
-		fmt.Println(err)
-		return nil
+// RxQueuePolicy drops the oldest game state, and anything that isn't a bolo
+// packet, once capacity packets are waiting for the serve loop
+func RxQueuePolicy(capacity int, counters *Counters) proxy.QueuePolicy {
+	return proxy.QueuePolicy{
+		Capacity: capacity,
+		Droppable: func(packet proxy.UdpPacket) bool {
+			valid, _ := bolo.ValidatePacket(packet)
+			return !valid || bolo.GetPacketType(packet.Buffer) == bolo.PacketTypeGameState
+		},
+		Dropped: &counters.RxDropped,
 	}
+}
 
-	connection, err := net.ListenUDP("udp4", listenAddr)
-	if err != nil {
-		fmt.Println(err)
-		return nil
+// TxQueuePolicy drops the oldest game state once capacity packets are
+// waiting for a socket. Game state is sent again and again, so a player
+// behind a slow link only misses some, while a dropped join, nat probe or
+// game info could lose them the game.
+func TxQueuePolicy(capacity int, counters *Counters) proxy.QueuePolicy {
+	return proxy.QueuePolicy{
+		Capacity: capacity,
+		Droppable: func(packet proxy.UdpPacket) bool {
+			return bolo.GetPacketType(packet.Buffer) == bolo.PacketTypeGameState
+		},
+		Dropped: &counters.TxDropped,
 	}
+}
 
-	return connection
+// SendStats hands a record to the statistics logger without waiting for it,
+// and drops it if the logger has fallen behind
+func SendStats[T any](context *ServerContext, channel chan T, record T) {
+	select {
+	case channel <- record:
+	default:
+		atomic.AddUint64(&context.Counters.StatsDropped, 1)
+		context.Log.Stats.Warn("statistics logger is behind, dropped a record")
+	}
 }
 
 func SprintServerState(context *ServerContext, newline string, lock bool) string {
@@ -106,30 +251,106 @@ func SprintServerState(context *ServerContext, newline string, lock bool) string
 
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("   Player                   Proxy Port    Game Id%s", newline))
-	for _, player := range context.Players {
+	for _, player := range context.Players.All() {
 		ipAddr := fmt.Sprintf("%s:%d", player.IpAddr.String(), player.IpPort)
-		sb.WriteString(fmt.Sprintf("   %-21s    %-10d    %s%s", ipAddr, player.ProxyPort, hex.EncodeToString(player.GameId[:]), newline))
+		sb.WriteString(fmt.Sprintf("   %-21s    %-10d    %s%s", ipAddr, player.RelayPort, hex.EncodeToString(player.GameId[:]), newline))
 	}
 	return sb.String()
 }
 
-func PrintServerState(context *ServerContext, lock bool) {
-	fmt.Print(SprintServerState(context, "\n", lock))
+func SprintCounters(context *ServerContext, newline string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("   Invalid packets: %d%s", atomic.LoadUint64(&context.Counters.InvalidPackets), newline))
+	sb.WriteString(fmt.Sprintf("   Malformed packets: %d%s", atomic.LoadUint64(&context.Counters.MalformedPackets), newline))
+	sb.WriteString(fmt.Sprintf("   Rejected players: %d%s", atomic.LoadUint64(&context.Counters.RejectedPlayers), newline))
+	sb.WriteString(fmt.Sprintf("   Dropped transmit packets: %d%s", atomic.LoadUint64(&context.Counters.TxDropped), newline))
+	sb.WriteString(fmt.Sprintf("   Dropped relay packets: %d%s", atomic.LoadUint64(&context.Counters.RxDropped), newline))
+	sb.WriteString(fmt.Sprintf("   Dropped statistics records: %d%s", atomic.LoadUint64(&context.Counters.StatsDropped), newline))
+	sb.WriteString(fmt.Sprintf("   Stuck goroutines: %d%s", context.Watchdog.Stuck(), newline))
+	sb.WriteString(fmt.Sprintf("   Rate limited packets: %d%s", context.Limits.Packets.Denied(), newline))
+	sb.WriteString(fmt.Sprintf("   Rate limited new players: %d%s", context.Limits.NewPlayers.Denied(), newline))
+	sb.WriteString(fmt.Sprintf("   Rate limited new games: %d%s", context.Limits.NewGames.Denied(), newline))
+	return sb.String()
 }
 
-func gameCountPlayers(context *ServerContext, targetGameId bolo.GameId, lock bool) int {
+func CountInvalidPacket(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.InvalidPackets, 1)
+}
+
+func CountMalformedPacket(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.MalformedPackets, 1)
+}
+
+func CountNatProbe(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.NatProbes, 1)
+}
+
+func CountNatProbeReply(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.NatProbeReplies, 1)
+}
+
+func CountPeerPacketReplayed(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.PeerPacketsReplayed, 1)
+}
+
+func CountPeerPacketExpired(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.PeerPacketsExpired, 1)
+}
+
+func CountPlayerTimeout(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.PlayerTimeouts, 1)
+}
+
+func CountCachedRoutePacket(context *ServerContext) {
+	atomic.AddUint64(&context.Counters.CachedRoutePackets, 1)
+}
+
+// CountRelayedPacket counts a bolo packet sent on to a player
+func CountRelayedPacket(context *ServerContext, buffer []byte) {
+	packetType := bolo.GetPacketType(buffer)
+	atomic.AddUint64(&context.Counters.RelayedPackets[packetType], 1)
+	atomic.AddUint64(&context.Counters.RelayedBytes[packetType], uint64(len(buffer)))
+}
+
+// RejectPlayer logs and counts a new player that PlayerNew failed to add,
+// because no proxy port was free or the player's ip is adding players too fast
+func RejectPlayer(context *ServerContext, playerAddr net.UDPAddr, err error) {
+	context.Log.Proxy.Warn("rejecting player", logging.PlayerAddr, playerAddr.String(), "error", err)
+	atomic.AddUint64(&context.Counters.RejectedPlayers, 1)
+}
+
+// LogServerState logs the players being relayed, as debug messages
+func LogServerState(context *ServerContext, lock bool) {
 	if lock {
 		context.Mutex.RLock()
 		defer context.Mutex.RUnlock()
 	}
 
-	count := 0
-	for _, player := range context.Players {
-		if player.GameId == targetGameId {
-			count = count + 1
-		}
+	logger := context.Log.Proxy
+	if !logging.DebugEnabled(logger) {
+		return
+	}
+	for _, player := range context.Players.All() {
+		PlayerLogger(logger, player).Debug("player", "relay_port", player.RelayPort, "nat_port", player.NatPort)
 	}
-	return count
+}
+
+// PlayerLogger adds the fields identifying player to the messages of logger
+func PlayerLogger(logger *slog.Logger, player *Player) *slog.Logger {
+	return logger.With(
+		logging.ProxyPort, player.ProxyPort,
+		logging.PlayerAddr, fmt.Sprintf("%s:%d", player.IpAddr.String(), player.IpPort),
+		logging.GameId, hex.EncodeToString(player.GameId[:]),
+	)
+}
+
+func gameCountPlayers(context *ServerContext, targetGameId bolo.GameId, lock bool) int {
+	if lock {
+		context.Mutex.RLock()
+		defer context.Mutex.RUnlock()
+	}
+
+	return context.Players.CountGame(targetGameId)
 }
 
 func GameUpdatePlayerCount(context *ServerContext, gameId bolo.GameId, lock bool) {
@@ -148,45 +369,235 @@ func GameUpdatePlayerCount(context *ServerContext, gameId bolo.GameId, lock bool
 	}
 }
 
+// GameAdd starts tracking a game nobody has announced before
+func GameAdd(context *ServerContext, gameInfo bolo.GameInfo, lock bool) {
+	if lock {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+	}
+
+	context.Games[gameInfo.GameId] = gameInfo
+	context.Events.Publish(events.Event{
+		Type:    events.GameCreated,
+		GameId:  gameInfo.GameId,
+		MapName: gameInfo.MapName,
+	})
+}
+
 func GameDelete(context *ServerContext, gameId bolo.GameId, lock bool) {
 	if lock {
 		context.Mutex.Lock()
 		defer context.Mutex.Unlock()
 	}
 
+	gameInfo, ok := context.Games[gameId]
 	delete(context.Games, gameId)
-	context.LogGameEndChannel <- gameId
+	delete(context.EntryPorts, gameId)
+	context.chatMutex.Lock()
+	delete(context.serverChat, gameId)
+	context.chatMutex.Unlock()
+	routesDelete(context, gameId)
+	SendStats(context, context.LogGameEndChannel, gameId)
+	if ok {
+		context.Events.Publish(events.Event{
+			Type:    events.GameEnded,
+			GameId:  gameId,
+			MapName: gameInfo.MapName,
+		})
+	}
+}
+
+// PlayerEvent is an event of eventType about player
+func PlayerEvent(eventType events.Type, player *Player) events.Event {
+	return events.Event{
+		Type:       eventType,
+		GameId:     player.GameId,
+		PlayerAddr: net.UDPAddr{IP: player.IpAddr, Port: player.IpPort},
+		ProxyPort:  player.ProxyPort,
+		Name:       player.Name,
+	}
 }
 
-func PlayerGetByAddr(context *ServerContext, addr net.UDPAddr, lock bool) (Player, error) {
+// GameEntryPort is the port the tracker lists for joining gameId
+func GameEntryPort(context *ServerContext, gameId bolo.GameId) int {
+	entryPort, ok := context.EntryPorts[gameId]
+	if ok {
+		return entryPort
+	}
+
+	lowestPort := 0
+	for _, player := range context.Players.Game(gameId) {
+		if lowestPort == 0 || player.RelayPort < lowestPort {
+			lowestPort = player.RelayPort
+		}
+	}
+	return lowestPort
+}
+
+// relayPortForGame picks the multiplexed port a player joining gameId is seen
+// at, ignoring the player with proxyPort. Players of one game each need their
+// own port, because packets from a player are matched to a peer in the same
+// game by port. The first player of a game claims a port nobody else is
+// listed at as the game's entry port, which routes players who have not
+// joined a game yet.
+func relayPortForGame(context *ServerContext, gameId bolo.GameId, proxyPort int) (int, error) {
+	inUse := make(map[int]bool)
+	inGame := make(map[int]bool)
+	for _, player := range context.Players.All() {
+		if player.ProxyPort == proxyPort {
+			continue
+		}
+		inUse[player.RelayPort] = true
+		if player.GameId == gameId {
+			inGame[player.RelayPort] = true
+		}
+	}
+
+	isEntryPort := make(map[int]bool)
+	for _, port := range context.EntryPorts {
+		isEntryPort[port] = true
+	}
+
+	entryPort, ok := context.EntryPorts[gameId]
+	if !ok {
+		entryPort = 0
+		for _, port := range context.Mux.Ports() {
+			if !isEntryPort[port] && (entryPort == 0 || !inUse[port]) {
+				entryPort = port
+				if !inUse[port] {
+					break
+				}
+			}
+		}
+		if entryPort == 0 {
+			return 0, fmt.Errorf("no free entry port for game %s", hex.EncodeToString(gameId[:]))
+		}
+		context.EntryPorts[gameId] = entryPort
+		return entryPort, nil
+	}
+
+	if !inGame[entryPort] {
+		return entryPort, nil
+	}
+
+	// a player at another game's entry port would take packets meant for
+	// that game from the players of this one, so avoid them if possible
+	relayPort := 0
+	for _, port := range context.Mux.Ports() {
+		if inGame[port] {
+			continue
+		}
+		if !isEntryPort[port] {
+			return port, nil
+		}
+		if relayPort == 0 {
+			relayPort = port
+		}
+	}
+	if relayPort == 0 {
+		return 0, fmt.Errorf("no free relay port in game %s", hex.EncodeToString(gameId[:]))
+	}
+	return relayPort, nil
+}
+
+// RelayTxQueue returns the queue that sends packets from relay port port,
+// and the channel closed once nothing sends from it any more. The channel is
+// nil for the mux's queues, which last as long as the server.
+func RelayTxQueue(context *ServerContext, port int, lock bool) (*proxy.Queue, chan struct{}, error) {
 	if lock {
 		context.Mutex.RLock()
 		defer context.Mutex.RUnlock()
 	}
 
-	for _, player := range context.Players {
-		if net.IP.Equal(addr.IP, player.IpAddr) && addr.Port == player.IpPort {
-			return player, nil
-		}
+	if context.Mux != nil {
+		txQueue, _, err := context.Mux.Socket(port)
+		return txQueue, nil, err
+	}
+
+	player, err := PlayerGetByPort(context, port, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return player.TxQueue, player.DisconnectChannel, nil
+}
+
+// PlayerGetByAddr returns the player whose packets come from addr. See
+// Players for how long the player may be used.
+func PlayerGetByAddr(context *ServerContext, addr net.UDPAddr, lock bool) (*Player, error) {
+	if lock {
+		context.Mutex.RLock()
+		defer context.Mutex.RUnlock()
 	}
 
-	return Player{}, fmt.Errorf("player with socket %s:%d not found",
+	player := context.Players.ByAddr(addr)
+	if player != nil {
+		return player, nil
+	}
+
+	return nil, fmt.Errorf("player with socket %s:%d not found",
 		addr.IP.String(), addr.Port)
 }
 
-func PlayerGetByPort(context *ServerContext, port int, lock bool) (Player, error) {
+// PlayerGetByPort returns the player with proxy port port. See Players for
+// how long the player may be used.
+func PlayerGetByPort(context *ServerContext, port int, lock bool) (*Player, error) {
+	if lock {
+		context.Mutex.RLock()
+		defer context.Mutex.RUnlock()
+	}
+
+	player := context.Players.ByPort(port)
+	if player != nil {
+		return player, nil
+	}
+
+	return nil, fmt.Errorf("player with proxy port %d not found", port)
+}
+
+// PlayerGetByRelayPort returns the player a packet from srcAddr to relay port
+// port is meant for. When each player has their own socket, that is the
+// player with the port. When players are multiplexed, it is the player at
+// port in the sender's game, or else a player of the game port is the entry
+// port of.
+func PlayerGetByRelayPort(context *ServerContext, srcAddr net.UDPAddr, port int, lock bool) (*Player, error) {
 	if lock {
 		context.Mutex.RLock()
 		defer context.Mutex.RUnlock()
 	}
 
-	for _, player := range context.Players {
-		if port == player.ProxyPort {
-			return player, nil
+	if context.Mux == nil {
+		return PlayerGetByPort(context, port, false)
+	}
+
+	srcPlayer := context.Players.ByAddr(srcAddr)
+	if srcPlayer != nil {
+		for _, player := range context.Players.Game(srcPlayer.GameId) {
+			if player.RelayPort == port {
+				return player, nil
+			}
+		}
+	}
+
+	for gameId, entryPort := range context.EntryPorts {
+		if entryPort != port {
+			continue
+		}
+
+		// the player who took the entry port may have left the game, any
+		// other player can let someone in
+		players := context.Players.Game(gameId)
+		for _, player := range players {
+			if player.RelayPort == port {
+				return player, nil
+			}
+		}
+		if len(players) > 0 {
+			return players[0], nil
 		}
 	}
 
-	return Player{}, fmt.Errorf("player with proxy port %d not found", port)
+	return nil, fmt.Errorf("player at relay port %d for %s:%d not found",
+		port, srcAddr.IP.String(), srcAddr.Port)
 }
 
 func PlayerNew(
@@ -195,70 +606,158 @@ func PlayerNew(
 	gameId bolo.GameId,
 	natPort int,
 	lock bool,
-) Player {
+) (*Player, error) {
 	if lock {
 		context.Mutex.Lock()
 		defer context.Mutex.Unlock()
 	}
 
+	if !context.Limits.NewPlayers.Allow(playerAddr.IP.String()) {
+		return nil, errors.New("too many new players from this address")
+	}
+
+	player, err := playerOpen(context, playerAddr, gameId, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	player.NatPort = natPort
+
+	context.Players.Add(player)
+	routesChanged(context, gameId)
+	SendStats(context, context.LogPlayerJoinChannel, util.PlayerAddr{IpAddr: playerAddr.IP.String(), IpPort: playerAddr.Port, ProxyPort: player.ProxyPort})
+	context.Events.Publish(PlayerEvent(events.PlayerJoined, player))
+	queueMotd(context, player)
+
+	return player, nil
+}
+
+// playerOpen creates a player relayed from proxyPort and relayPort, or from
+// free ports when they are 0, without adding them to the players
+func playerOpen(context *ServerContext, playerAddr net.UDPAddr, gameId bolo.GameId, proxyPort int, relayPort int) (*Player, error) {
 	disconnectChannel := make(chan struct{})
 
-	proxyPort, txChannel, connection := proxy.AddPlayer(
-		context.WaitGroup,
-		playerAddr,
-		context.RxChannel,
-		disconnectChannel,
-		context.ShutdownChannel,
-	)
+	var txQueue *proxy.Queue
+	var connection transport.PacketConn
+	var err error
+	if context.Mux == nil {
+		proxyPort, txQueue, connection, err = proxy.AddPlayer(
+			context.Transport,
+			context.ProxyPorts,
+			proxyPort,
+			context.Limits.Packets,
+			context.Log.Proxy,
+			context.Watchdog,
+			context.WaitGroup,
+			playerAddr,
+			context.RxQueue,
+			context.FastPath,
+			context.TxPolicy,
+			disconnectChannel,
+			context.ShutdownChannel,
+		)
+		if err != nil {
+			return nil, err
+		}
+		relayPort = proxyPort
+	} else {
+		if relayPort == 0 {
+			relayPort, err = relayPortForGame(context, gameId, -1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		txQueue, connection, err = context.Mux.Socket(relayPort)
+		if err != nil {
+			return nil, err
+		}
+		if proxyPort == 0 {
+			proxyPort, err = context.ProxyPorts.Assign()
+		} else {
+			err = context.ProxyPorts.Reserve(proxyPort)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	player := Player{
+		context.Log.Proxy.Info("relaying player", logging.ProxyPort, proxyPort,
+			logging.PlayerAddr, playerAddr.String(), "relay_port", relayPort)
+	}
+
+	return &Player{
 		IpAddr:            playerAddr.IP,
 		IpPort:            playerAddr.Port,
 		ProxyPort:         proxyPort,
+		RelayPort:         relayPort,
 		Connection:        connection,
-		TxChannel:         txChannel,
+		TxQueue:           txQueue,
 		DisconnectChannel: disconnectChannel,
 		GameId:            gameId,
 		PlayerId:          -1,
 		Name:              "<unknown>",
 		Peers:             make(map[int]time.Time),
 		PeerPackets:       make(map[int]proxy.UdpPacket),
-		NatPort:           natPort,
-	}
-
-	context.Players = append(context.Players, player)
-	context.LogPlayerJoinChannel <- util.PlayerAddr{IpAddr: playerAddr.IP.String(), IpPort: playerAddr.Port, ProxyPort: proxyPort}
-
-	return player
+		PeerProbes:        make(map[int]time.Time),
+	}, nil
 }
 
-func PlayerJoinGame(context *ServerContext, playerPort int, newGameId bolo.GameId, lock bool) {
+// PlayerJoinGame moves a player to another game. A multiplexed player may get
+// a new relay port, so callers holding a copy of the player need to get it
+// again.
+func PlayerJoinGame(context *ServerContext, playerPort int, newGameId bolo.GameId, lock bool) error {
 	if lock {
 		context.Mutex.Lock()
 		defer context.Mutex.Unlock()
 	}
 
-	var oldGameId bolo.GameId = bolo.GameId{}
-	var oldGameIdOk bool = false
-	for i, player := range context.Players {
-		if player.ProxyPort == playerPort {
-			oldGameId = player.GameId
-			oldGameIdOk = true
-			context.Players[i].GameId = newGameId
-			context.Players[i].PlayerId = -1
+	player := context.Players.ByPort(playerPort)
+	if player == nil {
+		GameUpdatePlayerCount(context, newGameId, false)
+		return nil
+	}
+
+	oldPlayer := *player
+	if context.Mux != nil && player.GameId != newGameId {
+		relayPort, err := relayPortForGame(context, newGameId, playerPort)
+		if err != nil {
+			return err
 		}
+		txQueue, connection, err := context.Mux.Socket(relayPort)
+		if err != nil {
+			return err
+		}
+		player.RelayPort = relayPort
+		player.TxQueue = txQueue
+		player.Connection = connection
+	}
+	if oldPlayer.GameId != newGameId {
+		playerDropPeerPackets(context, player)
+	}
+	context.Players.SetGame(player, newGameId)
+	if oldPlayer.GameId != newGameId {
+		routesChanged(context, oldPlayer.GameId)
+		routesChanged(context, newGameId)
+		context.Events.Publish(PlayerEvent(events.PlayerLeft, &oldPlayer))
+		context.Events.Publish(PlayerEvent(events.PlayerJoined, player))
+		queueMotd(context, player)
 	}
 
 	GameUpdatePlayerCount(context, newGameId, false)
 
-	if oldGameIdOk && oldGameId != newGameId {
-		GameUpdatePlayerCount(context, oldGameId, false)
+	if oldPlayer.GameId != newGameId {
+		GameUpdatePlayerCount(context, oldPlayer.GameId, false)
 	}
+
+	return nil
 }
 
-func playerRemoveElement(players []Player, idx int) []Player {
-	players[idx] = players[len(players)-1]
-	return players[:len(players)-1]
+// playerGetByPlayerAddr returns the player with the address and proxy port of
+// addr, or nil
+func playerGetByPlayerAddr(context *ServerContext, addr util.PlayerAddr) *Player {
+	player := context.Players.ByPort(addr.ProxyPort)
+	if player == nil || addr.IpAddr != player.IpAddr.String() || addr.IpPort != player.IpPort {
+		return nil
+	}
+	return player
 }
 
 func PlayerDelete(context *ServerContext, playerAddr util.PlayerAddr, lock bool) {
@@ -267,24 +766,23 @@ func PlayerDelete(context *ServerContext, playerAddr util.PlayerAddr, lock bool)
 		defer context.Mutex.Unlock()
 	}
 
-	player_idx := -1
-	for i, player := range context.Players {
-		if net.IP.Equal(player.IpAddr, net.ParseIP(playerAddr.IpAddr)) && player.IpPort == playerAddr.IpPort && player.ProxyPort == playerAddr.ProxyPort {
-			player_idx = i
-			break
-		}
-	}
-
-	if player_idx < 0 {
+	player := context.Players.ByPort(playerAddr.ProxyPort)
+	if player == nil || !net.IP.Equal(player.IpAddr, net.ParseIP(playerAddr.IpAddr)) || player.IpPort != playerAddr.IpPort {
 		return
 	}
 
-	gameId := context.Players[player_idx].GameId
+	gameId := player.GameId
 
-	close(context.Players[player_idx].DisconnectChannel)
-	proxy.DeletePort(context.Players[player_idx].ProxyPort)
-	context.Players = playerRemoveElement(context.Players, player_idx)
-	context.LogPlayerLeaveChannel <- playerAddr
+	close(player.DisconnectChannel)
+	playerDropPeerPackets(context, player)
+	context.ProxyPorts.Delete(player.ProxyPort)
+	context.Players.Remove(player)
+	routesDeletePlayer(context, player)
+	context.chatMutex.Lock()
+	playerDropChat(context, player.ProxyPort)
+	context.chatMutex.Unlock()
+	SendStats(context, context.LogPlayerLeaveChannel, playerAddr)
+	context.Events.Publish(PlayerEvent(events.PlayerLeft, player))
 	GameUpdatePlayerCount(context, gameId, false)
 }
 
@@ -294,64 +792,356 @@ func PlayerSetNatPort(context *ServerContext, addr util.PlayerAddr, natPort int,
 		defer context.Mutex.Unlock()
 	}
 
-	playerIdx := -1
-	for i, player := range context.Players {
-		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
-			playerIdx = i
-			break
+	player := playerGetByPlayerAddr(context, addr)
+	if player != nil && player.NatPort != natPort {
+		player.NatPort = natPort
+		routesChanged(context, player.GameId)
+	}
+}
+
+func PlayerSetId(context *ServerContext, addr util.PlayerAddr, playerId int, lock bool) {
+	if lock {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+	}
+
+	player := playerGetByPlayerAddr(context, addr)
+	if player != nil && player.PlayerId != playerId {
+		context.Players.SetId(player, playerId)
+		routesChanged(context, player.GameId)
+	}
+}
+
+func PlayerSetName(context *ServerContext, addr util.PlayerAddr, playerId int, playerName string) {
+	context.Mutex.Lock()
+	defer context.Mutex.Unlock()
+
+	sender := playerGetByPlayerAddr(context, addr)
+	if sender == nil {
+		return
+	}
+
+	player := context.Players.ById(sender.GameId, playerId)
+	if player == nil {
+		return
+	}
+
+	if strings.HasSuffix(playerName, "Unknown Machine Name") {
+		nameSlice := strings.Split(playerName, "@")
+		playerName = strings.Join(nameSlice[0:len(nameSlice)-1], "")
+	}
+	if player.Name != playerName {
+		event := PlayerEvent(events.PlayerRenamed, player)
+		event.OldName = player.Name
+		player.Name = playerName
+		routesChanged(context, player.GameId)
+		event.Name = playerName
+		context.Events.Publish(event)
+	}
+}
+
+// chatRepeatPeriod is how long a chat message is remembered, so that it is
+// reported once rather than by every player who passes its block on around
+// the ring
+const chatRepeatPeriod = 10 * time.Second
+
+// chatKey identifies a chat message by the block it was sent in
+type chatKey struct {
+	gameId   bolo.GameId
+	sender   int
+	sequence int
+	checksum uint16
+}
+
+// UnseenChatMessages returns the chat messages of a game state packet relayed
+// in gameId that weren't already seen in an earlier packet
+func UnseenChatMessages(context *ServerContext, gameId bolo.GameId, messages []bolo.ChatMessage) []bolo.ChatMessage {
+	context.chatMutex.Lock()
+	defer context.chatMutex.Unlock()
+
+	now := time.Now()
+	for key, seen := range context.recentChat {
+		if now.Sub(seen) > chatRepeatPeriod {
+			delete(context.recentChat, key)
 		}
 	}
 
-	if playerIdx >= 0 {
-		context.Players[playerIdx].NatPort = natPort
+	var unseen []bolo.ChatMessage
+	for _, message := range messages {
+		key := chatKey{gameId: gameId, sender: message.Sender, sequence: message.Sequence, checksum: message.Checksum}
+		if _, ok := context.recentChat[key]; ok {
+			continue
+		}
+		context.recentChat[key] = now
+		unseen = append(unseen, message)
 	}
+	return unseen
 }
 
-func PlayerSetId(context *ServerContext, addr util.PlayerAddr, playerId int, lock bool) {
+// ChatMessages publishes chat messages relayed in gameId, see
+// UnseenChatMessages, naming the sender and recipients by their player ids.
+// It returns their events.
+func ChatMessages(context *ServerContext, gameId bolo.GameId, messages []bolo.ChatMessage, lock bool) []events.Event {
+	if lock {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+	}
+
+	now := time.Now()
+	var chatEvents []events.Event
+	for _, message := range messages {
+		event := events.Event{
+			Type:    events.ChatMessage,
+			Time:    now,
+			GameId:  gameId,
+			Message: message.Message,
+		}
+		sender := context.Players.ById(gameId, message.Sender)
+		if sender != nil {
+			event.PlayerAddr = net.UDPAddr{IP: sender.IpAddr, Port: sender.IpPort}
+			event.ProxyPort = sender.ProxyPort
+			event.Name = sender.Name
+		}
+		for _, playerId := range message.RecipientIds() {
+			recipient := events.Recipient{PlayerId: playerId}
+			player := context.Players.ById(gameId, playerId)
+			if player != nil {
+				recipient.ProxyPort = player.ProxyPort
+				recipient.Name = player.Name
+			}
+			event.Recipients = append(event.Recipients, recipient)
+		}
+
+		context.Events.Publish(event)
+		chatEvents = append(chatEvents, event)
+	}
+	return chatEvents
+}
+
+// serverChatTimeout is how long a message from the server waits for a game
+// state packet to carry it to a player, and how long the block it was sent in
+// is removed from the packets of the players passing it on
+const serverChatTimeout = time.Minute
+
+// pendingChat is a message from the server waiting to be sent to a player
+type pendingChat struct {
+	queued  time.Time
+	message string
+}
+
+// serverChat is the player id the server's messages in a game are sent from,
+// one no player of the game has, and the sequence of its last block
+type serverChat struct {
+	sender   int
+	sequence int
+}
+
+// QueueChat sends message to the player at proxyPort in the next game state
+// packet relayed to them, see ServerChatBlocks
+func QueueChat(context *ServerContext, proxyPort int, message string, lock bool) error {
 	if lock {
 		context.Mutex.Lock()
 		defer context.Mutex.Unlock()
 	}
 
-	playerIdx := -1
-	for i, player := range context.Players {
-		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
-			playerIdx = i
-			break
+	if len(message) > bolo.MaxMessageLength {
+		return fmt.Errorf("message is %d bytes, longer than %d", len(message), bolo.MaxMessageLength)
+	}
+	player := context.Players.ByPort(proxyPort)
+	if player == nil {
+		return fmt.Errorf("player at proxy port %d not found", proxyPort)
+	}
+	if !queueChat(context, player, message) {
+		return errors.New("every player id in the game is taken")
+	}
+	return nil
+}
+
+// Announce sends message to every player of gameId, or of every game when
+// gameId is nil. It returns how many players it was queued for, which leaves
+// out those in games where every player id is taken.
+func Announce(context *ServerContext, gameId *bolo.GameId, message string, lock bool) (int, error) {
+	if lock {
+		context.Mutex.Lock()
+		defer context.Mutex.Unlock()
+	}
+
+	if len(message) > bolo.MaxMessageLength {
+		return 0, fmt.Errorf("message is %d bytes, longer than %d", len(message), bolo.MaxMessageLength)
+	}
+	players := context.Players.All()
+	if gameId != nil {
+		players = context.Players.Game(*gameId)
+	}
+	count := 0
+	for _, player := range players {
+		if queueChat(context, player, message) {
+			count++
 		}
 	}
+	return count, nil
+}
+
+// queueChat queues message for player, and picks the player id it is sent
+// from while the players of their game can be looked at. It reports whether
+// there was a free player id. The mutex is held.
+func queueChat(context *ServerContext, player *Player, message string) bool {
+	context.chatMutex.Lock()
+	defer context.chatMutex.Unlock()
 
-	if playerIdx >= 0 {
-		context.Players[playerIdx].PlayerId = playerId
+	if !serverChatSender(context, player.GameId) {
+		PlayerLogger(context.Log.Proxy, player).Warn("can't send server message, every player id is taken")
+		return false
 	}
+	context.pendingChat[player.ProxyPort] = append(context.pendingChat[player.ProxyPort], pendingChat{queued: time.Now(), message: message})
+	atomic.AddInt64(&context.pendingChatCount, 1)
+	return true
 }
 
-func PlayerSetName(context *ServerContext, addr util.PlayerAddr, playerId int, playerName string) {
-	context.Mutex.Lock()
-	defer context.Mutex.Unlock()
+// queueMotd greets a player who joined a game
+func queueMotd(context *ServerContext, player *Player) {
+	if context.Motd != "" {
+		queueChat(context, player, context.Motd)
+	}
+}
 
-	gameId := [8]byte{}
-	gameIdFound := false
-	for _, player := range context.Players {
-		if (addr.IpAddr == player.IpAddr.String()) && (addr.IpPort == player.IpPort) && (addr.ProxyPort == player.ProxyPort) {
-			gameId = player.GameId
-			gameIdFound = true
-			break
+// playerDropPeerPackets discards the packets held for player and the packets
+// its peers hold from it, whose probes will never be answered now
+func playerDropPeerPackets(context *ServerContext, player *Player) {
+	for peerPort := range player.PeerPackets {
+		CountPeerPacketExpired(context)
+		delete(player.PeerPackets, peerPort)
+		delete(player.PeerProbes, peerPort)
+	}
+	for _, peer := range context.Players.Game(player.GameId) {
+		if _, ok := peer.PeerPackets[player.ProxyPort]; ok {
+			CountPeerPacketExpired(context)
+			delete(peer.PeerPackets, player.ProxyPort)
+			delete(peer.PeerProbes, player.ProxyPort)
 		}
 	}
+}
 
-	if !gameIdFound {
-		return
+// playerDropChat drops the messages waiting for the player at proxyPort. The
+// chat mutex is held.
+func playerDropChat(context *ServerContext, proxyPort int) {
+	atomic.AddInt64(&context.pendingChatCount, -int64(len(context.pendingChat[proxyPort])))
+	delete(context.pendingChat, proxyPort)
+}
+
+// ServerChatBlocks returns the messages waiting for dstPlayer as game state
+// blocks to add to a packet relayed to them, sent from a player id nobody in
+// their game had when they were queued so that the sequences of the players'
+// own blocks are left alone. Messages that waited too long, or were queued
+// for a game the player has since left, are dropped. It takes only the chat
+// mutex, so that packets relayed over cached routes can call it.
+func ServerChatBlocks(context *ServerContext, dstPlayer Player) [][]byte {
+	if atomic.LoadInt64(&context.pendingChatCount) == 0 {
+		return nil
+	}
+
+	context.chatMutex.Lock()
+	defer context.chatMutex.Unlock()
+
+	pending, ok := context.pendingChat[dstPlayer.ProxyPort]
+	if !ok {
+		return nil
+	}
+	playerDropChat(context, dstPlayer.ProxyPort)
+
+	chat, ok := context.serverChat[dstPlayer.GameId]
+	if !ok {
+		return nil
+	}
+
+	recipients := uint16(0xffff)
+	if dstPlayer.PlayerId >= 0 {
+		recipients = 1 << dstPlayer.PlayerId
+	}
+
+	now := time.Now()
+	for key, sent := range context.serverChatBlocks {
+		if now.Sub(sent) > serverChatTimeout {
+			delete(context.serverChatBlocks, key)
+		}
+	}
+
+	var blocks [][]byte
+	for _, message := range pending {
+		if now.Sub(message.queued) > serverChatTimeout {
+			continue
+		}
+		chat.sequence = (chat.sequence + 1) & 0xff
+		block, err := bolo.MarshalSendMessageBlock(chat.sequence, chat.sender, recipients, message.message)
+		if err != nil {
+			// QueueChat checked the length
+			PlayerLogger(context.Log.Proxy, &dstPlayer).Warn("can't send server message", "error", err)
+			continue
+		}
+		checksum := uint16(block[len(block)-2])<<8 | uint16(block[len(block)-1])
+		key := chatKey{gameId: dstPlayer.GameId, sender: chat.sender, sequence: chat.sequence, checksum: checksum}
+		context.serverChatBlocks[key] = now
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// serverChatSender picks the player id the server sends from in gameId,
+// keeping the one it used before unless a player has since been given it, and
+// reports whether one was free. Both mutexes are held.
+func serverChatSender(context *ServerContext, gameId bolo.GameId) bool {
+	used := make(map[int]bool)
+	for _, player := range context.Players.Game(gameId) {
+		if player.PlayerId >= 0 {
+			used[player.PlayerId] = true
+		}
+	}
+
+	chat, ok := context.serverChat[gameId]
+	if ok && !used[chat.sender] {
+		return true
 	}
 
-	for i, player := range context.Players {
-		if (player.GameId == gameId) && (player.PlayerId == playerId) {
-			if strings.HasSuffix(playerName, "Unknown Machine Name") {
-				nameSlice := strings.Split(playerName, "@")
-				playerName = strings.Join(nameSlice[0:len(nameSlice)-1], "")
+	// bolo gives out the lowest free id, so the highest is the last a player
+	// gets
+	for sender := 15; sender >= 0; sender-- {
+		if !used[sender] {
+			if !ok {
+				chat = &serverChat{}
+				context.serverChat[gameId] = chat
 			}
-			context.Players[i].Name = playerName
-			break
+			chat.sender = sender
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveServerChat removes the blocks the server sent from a game state
+// packet a player passes on around the ring, since every player was sent
+// their own. It returns the packet and the messages of the players.
+func RemoveServerChat(context *ServerContext, gameId bolo.GameId, buffer []byte, messages []bolo.ChatMessage) ([]byte, []bolo.ChatMessage) {
+	context.chatMutex.Lock()
+	defer context.chatMutex.Unlock()
+
+	var playerMessages []bolo.ChatMessage
+	for _, message := range messages {
+		key := chatKey{gameId: gameId, sender: message.Sender, sequence: message.Sequence, checksum: message.Checksum}
+		if _, ok := context.serverChatBlocks[key]; !ok {
+			playerMessages = append(playerMessages, message)
 		}
 	}
+	if len(playerMessages) == len(messages) {
+		return buffer, messages
+	}
+
+	buffer, _, err := bolo.RemoveGameStateBlocks(buffer, func(block bolo.GameStateBlock) bool {
+		_, ok := context.serverChatBlocks[chatKey{gameId: gameId, sender: block.Sender, sequence: block.Sequence, checksum: block.Checksum}]
+		return ok
+	})
+	if err != nil {
+		// the messages were decoded from the same packet
+		context.Log.Proxy.Warn("can't remove server messages", "error", err)
+	}
+	return buffer, playerMessages
 }
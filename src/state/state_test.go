@@ -0,0 +1,73 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package state
+
+import (
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/util"
+)
+
+func TestSendStatsDoesNotWait(t *testing.T) {
+	context := &ServerContext{
+		LogPlayerJoinChannel: make(chan util.PlayerAddr, 1),
+		Counters:             &Counters{},
+		Log:                  logging.Discard(),
+	}
+
+	// nothing reads the channel, as when the statistics logger is waiting
+	// for the mutex the sender holds
+	SendStats(context, context.LogPlayerJoinChannel, util.PlayerAddr{ProxyPort: 40001})
+	SendStats(context, context.LogPlayerJoinChannel, util.PlayerAddr{ProxyPort: 40002})
+
+	if context.Counters.StatsDropped != 1 {
+		t.Errorf("counted %d dropped records, expected 1", context.Counters.StatsDropped)
+	}
+	if record := <-context.LogPlayerJoinChannel; record.ProxyPort != 40001 {
+		t.Errorf("kept the record for port %d", record.ProxyPort)
+	}
+}
+
+func TestDropPeerPacketsCounts(t *testing.T) {
+	context := &ServerContext{Players: NewPlayers(), Counters: &Counters{}}
+	alice := newPlayer(40001, 50001, gameId)
+	bob := newPlayer(40002, 50002, gameId)
+	carol := newPlayer(40003, 50003, gameId)
+	for _, player := range []*Player{alice, bob, carol} {
+		player.PeerPackets = make(map[int]proxy.UdpPacket)
+		player.PeerProbes = make(map[int]time.Time)
+		context.Players.Add(player)
+	}
+
+	// alice holds a packet from bob, and bob and carol each hold one from alice
+	alice.PeerPackets[bob.ProxyPort] = proxy.UdpPacket{}
+	bob.PeerPackets[alice.ProxyPort] = proxy.UdpPacket{}
+	bob.PeerPackets[carol.ProxyPort] = proxy.UdpPacket{}
+	carol.PeerPackets[alice.ProxyPort] = proxy.UdpPacket{}
+
+	playerDropPeerPackets(context, alice)
+	if context.Counters.PeerPacketsExpired != 3 {
+		t.Errorf("counted %d expired packets, expected 3", context.Counters.PeerPacketsExpired)
+	}
+	if len(alice.PeerPackets) != 0 || len(bob.PeerPackets) != 1 || len(carol.PeerPackets) != 0 {
+		t.Errorf("alice, bob and carol hold %d, %d and %d packets", len(alice.PeerPackets), len(bob.PeerPackets), len(carol.PeerPackets))
+	}
+}
@@ -22,13 +22,15 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
+	"log/slog"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"git.astrospark.com/bolorama/bolo"
 	"git.astrospark.com/bolorama/data"
+	"git.astrospark.com/bolorama/events"
 	"git.astrospark.com/bolorama/state"
 	"git.astrospark.com/bolorama/util"
 )
@@ -50,33 +52,51 @@ func LoggerNone(context *state.ServerContext) {
 	for {
 		select {
 		case <-context.ShutdownChannel:
-			fmt.Println("Stopped statistics")
+			context.Log.Stats.Info("stopped statistics")
 			return
 		case <-context.LogGameEndChannel:
 		case <-context.LogPlayerJoinChannel:
 		case <-context.LogPlayerLeaveChannel:
+		case <-context.LogChatChannel:
 		}
 	}
 }
 
 func LoggerSql(context *state.ServerContext, db *sql.DB) {
 	ticker := time.NewTicker(kLogIntervalSeconds * time.Second)
+	watch := context.Watchdog.Watch("statistics")
+	defer watch.Stop()
 
 	for {
 		select {
 		case <-context.ShutdownChannel:
-			fmt.Println("Stopped statistics")
+			context.Log.Stats.Info("stopped statistics")
 			ticker.Stop()
 			return
 		case <-ticker.C:
+			watch.Busy()
 			LogGames(context, db)
 		case gameId := <-context.LogGameEndChannel:
-			LogEndGame(db, gameId)
+			watch.Busy()
+			countError(context, LogEndGame(context.Log.Data, db, gameId))
 		case playerAddr := <-context.LogPlayerJoinChannel:
-			LogPlayerJoin(db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort)
+			watch.Busy()
+			countError(context, LogPlayerJoin(context.Log.Data, db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort))
 		case playerAddr := <-context.LogPlayerLeaveChannel:
-			LogPlayerLeave(db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort)
+			watch.Busy()
+			countError(context, LogPlayerLeave(context.Log.Data, db, net.ParseIP(playerAddr.IpAddr), playerAddr.IpPort))
+		case event := <-context.LogChatChannel:
+			watch.Busy()
+			countError(context, LogChat(context.Log.Data, db, event))
 		}
+		watch.Idle()
+	}
+}
+
+// countError counts a failed statistics database statement
+func countError(context *state.ServerContext, err error) {
+	if err != nil {
+		atomic.AddUint64(&context.Counters.DatabaseErrors, 1)
 	}
 }
 
@@ -97,7 +117,7 @@ func LogGames(context *state.ServerContext, db *sql.DB) {
 		}
 	}
 
-	for _, player := range context.Players {
+	for _, player := range context.Players.All() {
 		hash := sha256.Sum256(player.GameId[:])
 		strHash := hex.EncodeToString(hash[:])
 		game := games[strHash]
@@ -111,7 +131,9 @@ func LogGames(context *state.ServerContext, db *sql.DB) {
 	for gameId := range games {
 		gameIds = append(gameIds, gameId)
 	}
-	dbGames := data.SelectGames(db, gameIds)
+	logger := context.Log.Data
+	dbGames, err := data.SelectGames(logger, db, gameIds)
+	countError(context, err)
 
 	var insertGames []data.DataGame
 	var updateGames []data.DataGame
@@ -134,27 +156,44 @@ func LogGames(context *state.ServerContext, db *sql.DB) {
 	}
 
 	for _, game := range insertGames {
-		data.InsertGame(db, game)
+		countError(context, data.InsertGame(logger, db, game))
 	}
 
 	for _, game := range updateGames {
-		data.UpdateGame(db, game)
+		countError(context, data.UpdateGame(logger, db, game))
 	}
 }
 
-func LogEndGame(db *sql.DB, gameId bolo.GameId) {
+func LogEndGame(logger *slog.Logger, db *sql.DB, gameId bolo.GameId) error {
 	hash := sha256.Sum256(gameId[:])
-	data.EndGame(db, hex.EncodeToString(hash[:]))
+	return data.EndGame(logger, db, hex.EncodeToString(hash[:]))
 }
 
-func LogPlayerJoin(db *sql.DB, ipAddr net.IP, port int) {
+func LogPlayerJoin(logger *slog.Logger, db *sql.DB, ipAddr net.IP, port int) error {
 	hash := hashPlayerId(ipAddr, port)
-	data.InsertPlayerSession(db, hash)
+	return data.InsertPlayerSession(logger, db, hash)
 }
 
-func LogPlayerLeave(db *sql.DB, ipAddr net.IP, port int) {
+func LogPlayerLeave(logger *slog.Logger, db *sql.DB, ipAddr net.IP, port int) error {
 	hash := hashPlayerId(ipAddr, port)
-	data.EndPlayerSession(db, hash)
+	return data.EndPlayerSession(logger, db, hash)
+}
+
+// LogChat saves a chat message with the game it was sent in identified the
+// same way as in the game table
+func LogChat(logger *slog.Logger, db *sql.DB, event events.Event) error {
+	hash := sha256.Sum256(event.GameId[:])
+	recipients := 0
+	for _, recipient := range event.Recipients {
+		recipients = recipients | (1 << recipient.PlayerId)
+	}
+	return data.InsertChatMessage(logger, db, data.DataChatMessage{
+		GameId:     hex.EncodeToString(hash[:]),
+		SenderName: event.Name,
+		Recipients: recipients,
+		Message:    event.Message,
+		SentAt:     strconv.FormatInt(event.Time.Unix(), 10),
+	})
 }
 
 func hashPlayerId(ipAddr net.IP, port int) string {
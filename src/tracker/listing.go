@@ -0,0 +1,84 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracker
+
+import (
+	"sort"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/state"
+)
+
+// Listing is a game as the tracker lists it
+type Listing struct {
+	Game     bolo.GameInfo
+	Hostname string
+	Port     int // players join the game at Hostname:Port
+	Players  []string
+}
+
+// GetListings returns the games being tracked, newest first
+func GetListings(context *state.ServerContext, lock bool) []Listing {
+	if lock {
+		context.Mutex.RLock()
+		defer context.Mutex.RUnlock()
+	}
+
+	var games []bolo.GameInfo
+	for _, game := range context.Games {
+		games = append(games, game)
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].ServerStartTimestamp.After(games[j].ServerStartTimestamp)
+	})
+
+	listings := make([]Listing, 0, len(games))
+	for _, game := range games {
+		listings = append(listings, Listing{
+			Game:     game,
+			Hostname: context.Hostname,
+			Port:     state.GameEntryPort(context, game.GameId),
+			Players:  getGamePlayerNames(context, game.GameId),
+		})
+	}
+	return listings
+}
+
+// TrackedFor is how long the tracker has known about the game
+func (listing Listing) TrackedFor() time.Duration {
+	return time.Since(listing.Game.ServerStartTimestamp)
+}
+
+func GameTypeName(gameType int) string {
+	name, ok := gameTypeName[gameType]
+	if !ok {
+		return "Unknown"
+	}
+	return name
+}
+
+// YesNo is how the tracker shows a game option
+func YesNo(value bool) string {
+	return yesNo[value]
+}
+
+// MinesName describes whether a game allows hidden mines
+func MinesName(allowHiddenMines bool) string {
+	return minesHiddenVisible[allowHiddenMines]
+}
@@ -18,26 +18,15 @@
 package tracker
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
 )
 
-func tcpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, port int, tcpRequestChannel chan net.Conn) {
+func tcpListener(wg *sync.WaitGroup, logger *slog.Logger, shutdownChannel chan struct{}, connection net.Listener, port int, tcpRequestChannel chan net.Conn) {
 	defer wg.Done()
 
-	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", port))
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	connection, err := net.ListenTCP("tcp4", listenAddr)
-	if err != nil {
-		log.Fatalln(err)
-	}
-
 	go func() {
 		for {
 			_, ok := <-shutdownChannel
@@ -48,15 +37,15 @@ func tcpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, port int, tc
 		}
 	}()
 
-	fmt.Println("Listening on TCP port", port)
+	logger.Info("listening on tcp", "port", port)
 
 	for {
 		conn, err := connection.Accept()
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
+				logger.Warn("accept failed", "port", port, "error", err)
 			}
-			fmt.Println("Stopped listening on TCP port", port)
+			logger.Info("stopped listening on tcp", "port", port)
 			break
 		}
 
@@ -19,7 +19,6 @@ package tracker
 
 import (
 	"fmt"
-	"sort"
 	"strings"
 	"time"
 
@@ -56,13 +55,7 @@ func getTrackerText(context *state.ServerContext, hostname string) string {
 	sb.WriteString("= =================================================================== =\r")
 	sb.WriteString("\r")
 
-	var games []bolo.GameInfo
-	for _, game := range context.Games {
-		games = append(games, game)
-	}
-	sort.Slice(games, func(i, j int) bool {
-		return games[i].ServerStartTimestamp.After(games[j].ServerStartTimestamp)
-	})
+	games := GetListings(context, false)
 
 	if len(games) == 0 {
 		sb.WriteString("   There are no games in progress.\r\r")
@@ -70,10 +63,7 @@ func getTrackerText(context *state.ServerContext, hostname string) string {
 	}
 
 	for _, game := range games {
-		ports := getGamePlayerPorts(context, game.GameId)
-		players := getGamePlayerNames(context, game.GameId)
-		sort.Ints(ports)
-		sb.WriteString(getGameInfoText(hostname, ports[0], game, players))
+		sb.WriteString(getGameInfoText(game.Hostname, game.Port, game.Game, game.Players))
 		sb.WriteString("\r")
 	}
 
@@ -87,7 +77,7 @@ func getTrackerText(context *state.ServerContext, hostname string) string {
 }
 
 func getTrackerDebugText(context *state.ServerContext, hostname string) string {
-	return state.SprintServerState(context, "\r", false)
+	return state.SprintServerState(context, "\r", false) + "\r" + state.SprintCounters(context, "\r")
 }
 
 func getGameInfoText(hostname string, hostport int, gameInfo bolo.GameInfo, players []string) string {
@@ -129,22 +119,10 @@ func getGameInfoText(hostname string, hostport int, gameInfo bolo.GameInfo, play
 	return sb.String()
 }
 
-func getGamePlayerPorts(context *state.ServerContext, targetGameId bolo.GameId) []int {
-	var ports []int
-	for _, player := range context.Players {
-		if player.GameId == targetGameId {
-			ports = append(ports, player.ProxyPort)
-		}
-	}
-	return ports
-}
-
 func getGamePlayerNames(context *state.ServerContext, targetGameId bolo.GameId) []string {
 	var playerNames []string
-	for _, player := range context.Players {
-		if player.GameId == targetGameId {
-			playerNames = append(playerNames, player.Name)
-		}
+	for _, player := range context.Players.Game(targetGameId) {
+		playerNames = append(playerNames, player.Name)
 	}
 	return playerNames
 }
@@ -18,43 +18,49 @@
 package tracker
 
 import (
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"git.astrospark.com/bolorama/bolo"
-	"git.astrospark.com/bolorama/config"
+	"git.astrospark.com/bolorama/logging"
 	"git.astrospark.com/bolorama/proxy"
 	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/transport"
 	"git.astrospark.com/bolorama/util"
 )
 
+// Tracker serves the game list on trackerListener and the debug text on
+// trackerDebugListener, and keeps track of games announced on the tracker port
 func Tracker(
 	context *state.ServerContext,
 	startPlayerPingChannel chan state.Player,
+	trackerListener net.Listener,
+	trackerDebugListener net.Listener,
 ) {
 	defer context.WaitGroup.Done()
 	defer func() {
-		fmt.Println("Stopped tracker")
+		context.Log.Tracker.Info("stopped tracker")
 	}()
 	udpPacketChannel := make(chan proxy.UdpPacket)
 	tcpTrackerRequestChannel := make(chan net.Conn)
 	tcpTrackerDebugRequestChannel := make(chan net.Conn)
 	playerPingTimeoutChannel := make(chan util.PlayerAddr)
 	trackerShutdownChannel := make(chan struct{})
-	hostname := config.GetValueString("hostname")
-	port := config.GetValueInt("tracker_port")
-	trackerDebugPort := config.GetValueInt("tracker_debug_port")
-	proxyIp := util.GetOutboundIp()
+	hostname := context.Hostname
+	port := context.ProxyPort
+	trackerDebugPort := context.TrackerDebugPort
+	proxyIp := context.ProxyIpAddr
 	wg := sync.WaitGroup{}
 
 	wg.Add(4)
-	go udpListener(&wg, context.ShutdownChannel, context.UdpConnection, port, udpPacketChannel)
-	go tcpListener(&wg, context.ShutdownChannel, port, tcpTrackerRequestChannel)
-	go tcpListener(&wg, context.ShutdownChannel, trackerDebugPort, tcpTrackerDebugRequestChannel)
-	go pingTimeout(&wg, context.ShutdownChannel, context.PlayerPongChannel, playerPingTimeoutChannel)
+	go udpListener(&wg, context.Log.Tracker, context.ShutdownChannel, context.UdpConnection, port, context.Limits.Packets, udpPacketChannel)
+	go tcpListener(&wg, context.Log.Tracker, context.ShutdownChannel, trackerListener, port, tcpTrackerRequestChannel)
+	go tcpListener(&wg, context.Log.Tracker, context.ShutdownChannel, trackerDebugListener, trackerDebugPort, tcpTrackerDebugRequestChannel)
+	go pingTimeout(&wg, context.ShutdownChannel, context.PlayerTimeout, context.PlayerPongChannel, playerPingTimeoutChannel)
 
 	go func() {
 		wg.Wait()
@@ -74,20 +80,22 @@ func Tracker(
 			}
 			handleGameInfoPacket(context, proxyIp, port, packet, context.PlayerPongChannel)
 		case conn := <-tcpTrackerRequestChannel:
-			fmt.Println("tracker request")
+			context.Log.Tracker.Debug("tracker request", "remote_addr", conn.RemoteAddr().String())
 			conn.Write([]byte(getTrackerText(context, hostname)))
 			conn.Close()
 		case conn := <-tcpTrackerDebugRequestChannel:
-			fmt.Println("tracker debug request")
+			context.Log.Tracker.Debug("tracker debug request", "remote_addr", conn.RemoteAddr().String())
 			conn.Write([]byte(getTrackerDebugText(context, hostname)))
 			conn.Close()
 		case player := <-startPlayerPingChannel:
 			context.PlayerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
-			go pingGameInfo(context.UdpConnection, player, context.ShutdownChannel)
+			go pingGameInfo(context.Log.Tracker, context.UdpConnection, context.GameInfoPingPeriod, player, context.ShutdownChannel)
 		case playerAddr := <-playerPingTimeoutChannel:
-			log.Printf("Player timed out %s:%d\n", playerAddr.IpAddr, playerAddr.IpPort)
+			context.Log.Tracker.Info("player timed out", logging.ProxyPort, playerAddr.ProxyPort,
+				logging.PlayerAddr, fmt.Sprintf("%s:%d", playerAddr.IpAddr, playerAddr.IpPort))
+			state.CountPlayerTimeout(context)
 			state.PlayerDelete(context, playerAddr, true)
-			state.PrintServerState(context, true)
+			state.LogServerState(context, true)
 		}
 	}
 }
@@ -102,12 +110,14 @@ func handleGameInfoPacket(
 	valid, _ := bolo.ValidatePacket(packet)
 	if !valid {
 		// skip non-bolo packets
+		state.CountInvalidPacket(context)
 		return
 	}
 
 	packetType := bolo.GetPacketType(packet.Buffer)
 
 	if packetType == bolo.PacketType7 {
+		state.CountNatProbeReply(context)
 		context.Mutex.Lock()
 		player, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
 		if err == nil {
@@ -126,7 +136,12 @@ func handleGameInfoPacket(
 
 	// game id is more unique if we leave the original ip address
 	//bolo.RewritePacketGameInfo(packet.Buffer, proxyIp)
-	newGameInfo := bolo.ParsePacketGameInfo(packet.Buffer)
+	newGameInfo, err := bolo.ParsePacketGameInfo(packet.Buffer)
+	if err != nil {
+		context.Log.Tracker.Warn("dropping malformed game info packet", logging.PlayerAddr, packet.SrcAddr.String(), "error", err)
+		state.CountMalformedPacket(context)
+		return
+	}
 
 	context.Mutex.Lock()
 	defer func() { context.Mutex.Unlock() }()
@@ -136,47 +151,72 @@ func handleGameInfoPacket(
 	if ok {
 		newGameInfo.ServerStartTimestamp = gameInfo.ServerStartTimestamp
 	} else {
+		if !context.Limits.NewGames.Allow(packet.SrcAddr.IP.String()) {
+			context.Log.Tracker.Warn("dropping game info packet, too many new games", logging.PlayerAddr, packet.SrcAddr.String())
+			return
+		}
 		newGameInfo.ServerStartTimestamp = time.Now()
 		newGame = true
-		bolo.PrintGameInfo(newGameInfo)
+		context.Log.Tracker.Info("new game",
+			logging.GameId, hex.EncodeToString(newGameInfo.GameId[:]),
+			logging.PlayerAddr, packet.SrcAddr.String(),
+			"map_name", newGameInfo.MapName,
+			"game_type", GameTypeName(newGameInfo.GameType),
+			"player_count", newGameInfo.PlayerCount,
+			"password", newGameInfo.HasPassword,
+		)
+	}
+	if newGame {
+		state.GameAdd(context, newGameInfo, false)
+	} else {
+		context.Games[newGameInfo.GameId] = newGameInfo
 	}
-	context.Games[newGameInfo.GameId] = newGameInfo
 
 	player, err := state.PlayerGetByAddr(context, packet.SrcAddr, false)
 	if err == nil {
 		if player.GameId != newGameInfo.GameId {
-			state.PlayerJoinGame(context, player.ProxyPort, newGameInfo.GameId, false)
+			err = state.PlayerJoinGame(context, player.ProxyPort, newGameInfo.GameId, false)
+			if err != nil {
+				state.PlayerLogger(context.Log.Tracker, player).Warn("player can't join game", "error", err)
+			}
 		}
 		if player.NatPort != trackerPort {
 			state.PlayerSetNatPort(context, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, trackerPort, false)
 		}
 	} else {
-		player = state.PlayerNew(context, packet.SrcAddr, newGameInfo.GameId, trackerPort, false)
+		player, err = state.PlayerNew(context, packet.SrcAddr, newGameInfo.GameId, trackerPort, false)
+		if err != nil {
+			state.RejectPlayer(context, packet.SrcAddr, err)
+			// don't list a game nobody can join
+			state.GameUpdatePlayerCount(context, newGameInfo.GameId, false)
+			return
+		}
 		playerPongChannel <- util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}
-		go pingGameInfo(context.UdpConnection, player, context.ShutdownChannel)
+		go pingGameInfo(context.Log.Tracker, context.UdpConnection, context.GameInfoPingPeriod, *player, context.ShutdownChannel)
 		if newGame {
 			state.PlayerSetId(context, util.PlayerAddr{IpAddr: player.IpAddr.String(), IpPort: player.IpPort, ProxyPort: player.ProxyPort}, 0, false)
 		}
-		state.PrintServerState(context, false)
+		state.LogServerState(context, false)
 	}
 }
 
 func pingGameInfo(
-	connection *net.UDPConn,
+	logger *slog.Logger,
+	connection transport.PacketConn,
+	gameInfoPingPeriod time.Duration,
 	player state.Player,
 	shutdownChannel chan struct{},
 ) {
-	gameInfoPingSeconds := config.GetValueInt("game_info_ping_seconds")
-	ticker := time.NewTicker(time.Duration(gameInfoPingSeconds) * time.Second)
+	ticker := time.NewTicker(gameInfoPingPeriod)
 
 	for {
 		select {
 		case <-player.DisconnectChannel:
-			fmt.Println("Stopped pinging player", player.ProxyPort)
+			logger.Debug("stopped pinging player", logging.ProxyPort, player.ProxyPort)
 			ticker.Stop()
 			return
 		case <-shutdownChannel:
-			fmt.Println("Stopped pinging player", player.ProxyPort)
+			logger.Debug("stopped pinging player", logging.ProxyPort, player.ProxyPort)
 			ticker.Stop()
 			return
 		case <-ticker.C:
@@ -190,11 +230,11 @@ func pingGameInfo(
 func pingTimeout(
 	wg *sync.WaitGroup,
 	shutdownChannel chan struct{},
+	playerTimeoutDuration time.Duration,
 	playerPongChannel chan util.PlayerAddr,
 	playerPingTimeoutChannel chan util.PlayerAddr,
 ) {
 	defer wg.Done()
-	playerTimeoutDuration := time.Duration(config.GetValueInt("player_timeout_seconds")) * time.Second
 	mapPlayerTimestamp := make(map[util.PlayerAddr]time.Time)
 	ticker := time.NewTicker(playerTimeoutDuration / 4)
 
@@ -18,16 +18,18 @@
 package tracker
 
 import (
-	"fmt"
+	"log/slog"
 	"net"
 	"strings"
 	"sync"
 
+	"git.astrospark.com/bolorama/limit"
 	"git.astrospark.com/bolorama/proxy"
+	"git.astrospark.com/bolorama/transport"
 	"git.astrospark.com/bolorama/util"
 )
 
-func udpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, connection *net.UDPConn, port int, dataChannel chan proxy.UdpPacket) {
+func udpListener(wg *sync.WaitGroup, logger *slog.Logger, shutdownChannel chan struct{}, connection transport.PacketConn, port int, packetLimiter *limit.Limiter, dataChannel chan proxy.UdpPacket) {
 	defer wg.Done()
 
 	buffer := make([]byte, util.MaxUdpPacketSize)
@@ -42,18 +44,22 @@ func udpListener(wg *sync.WaitGroup, shutdownChannel chan struct{}, connection *
 		}
 	}()
 
-	fmt.Println("Listening on UDP port", port)
+	logger.Info("listening on udp", "port", port)
 
 	for {
 		n, addr, err := connection.ReadFromUDP(buffer)
 		if err != nil {
 			if !strings.HasSuffix(err.Error(), "use of closed network connection") {
-				fmt.Println(err)
+				logger.Warn("receive failed", "port", port, "error", err)
 			}
-			fmt.Println("Stopped listening on UDP port", port)
+			logger.Info("stopped listening on udp", "port", port)
 			break
 		}
 
+		if !packetLimiter.Allow(addr.IP.String()) {
+			continue
+		}
+
 		data := make([]byte, n)
 		copy(data, buffer)
 		dataChannel <- proxy.UdpPacket{
@@ -0,0 +1,99 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Socket is an open socket handed from one server to the next, such as from
+// a program to its upgrade. Packets that arrive while neither is reading
+// wait in it rather than being lost.
+type Socket struct {
+	Network string   `json:"network"` // "udp" or "tcp"
+	Port    int      `json:"port"`
+	File    *os.File `json:"-"`
+}
+
+// Dup duplicates the file descriptor of socket, a *net.UDPConn or
+// *net.TCPListener, so that it stays open after socket is closed
+func Dup(socket any) (*os.File, error) {
+	filer, ok := socket.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T is not a socket that can be handed over", socket)
+	}
+	return filer.File()
+}
+
+// Inherited listens on copies of the sockets it was handed when asked for
+// their ports, and on new sockets from Transport otherwise. The sockets it
+// was handed are left open for their owner to close.
+type Inherited struct {
+	Transport
+	mutex   sync.Mutex
+	sockets map[string]*os.File
+}
+
+func NewInherited(transport Transport, sockets []Socket) *Inherited {
+	inherited := &Inherited{Transport: transport, sockets: make(map[string]*os.File)}
+	for _, socket := range sockets {
+		inherited.sockets[fmt.Sprint(socket.Network, ":", socket.Port)] = socket.File
+	}
+	return inherited
+}
+
+// take removes the socket for network and port, nil if there is none
+func (inherited *Inherited) take(network string, port int) *os.File {
+	inherited.mutex.Lock()
+	defer inherited.mutex.Unlock()
+
+	key := fmt.Sprint(network, ":", port)
+	file := inherited.sockets[key]
+	delete(inherited.sockets, key)
+	return file
+}
+
+func (inherited *Inherited) ListenUDP(port int) (PacketConn, error) {
+	file := inherited.take("udp", port)
+	if file == nil {
+		return inherited.Transport.ListenUDP(port)
+	}
+
+	connection, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	udpConnection, ok := connection.(*net.UDPConn)
+	if !ok {
+		connection.Close()
+		return nil, fmt.Errorf("inherited socket for udp port %d is %T", port, connection)
+	}
+	return udpConnection, nil
+}
+
+func (inherited *Inherited) ListenTCP(port int) (net.Listener, error) {
+	file := inherited.take("tcp", port)
+	if file == nil {
+		return inherited.Transport.ListenTCP(port)
+	}
+
+	return net.FileListener(file)
+}
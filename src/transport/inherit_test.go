@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInheritedKeepsPackets(t *testing.T) {
+	old, err := Net{}.ListenUDP(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := old.LocalAddr().(*net.UDPAddr).Port
+	file, err := Dup(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	old.Close()
+
+	// sent while nobody is reading the socket
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	_, err = sender.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inherited := NewInherited(Net{}, []Socket{{Network: "udp", Port: port, File: file}})
+	connection, err := inherited.ListenUDP(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	connection.(*net.UDPConn).SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 16)
+	n, _, err := connection.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "hello" {
+		t.Errorf("received %q", buffer[:n])
+	}
+
+	// the socket is handed over once, after that the port is listened on afresh
+	_, err = inherited.ListenUDP(port)
+	if err == nil {
+		t.Error("listened on a port that is in use")
+	}
+}
+
+func TestDupRejectsMemorySockets(t *testing.T) {
+	network := NewNetwork(1)
+	connection := listen(t, network.Host(serverIp), 50000)
+	_, err := Dup(connection)
+	if err == nil {
+		t.Error("duplicated an in-memory socket")
+	}
+}
@@ -0,0 +1,362 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+)
+
+const memoryQueueSize = 256
+const firstEphemeralPort = 49152
+const firstNatPort = 20000
+
+type datagram struct {
+	srcAddr net.UDPAddr
+	buffer  []byte
+}
+
+// Network is an in-memory IPv4 network. Hosts on it get a Transport bound to
+// their address. Hosts can sit behind a nat, which maps each private port to
+// one public port and only lets in packets from addresses that port has sent
+// to (a port restricted cone nat, like most home routers).
+type Network struct {
+	mutex       sync.Mutex
+	conns       map[string]*memoryConn
+	listeners   map[string]*memoryListener
+	natByPublic map[string]*nat
+	natByHost   map[string]*nat
+	nextPort    map[string]int
+	random      *rand.Rand
+	lossRate    float64
+	dropped     int
+}
+
+type nat struct {
+	publicIp      net.IP
+	privateIp     net.IP
+	nextPort      int
+	byPrivatePort map[int]*natMapping
+	byPublicPort  map[int]*natMapping
+}
+
+type natMapping struct {
+	privatePort int
+	publicPort  int
+	permitted   map[string]bool
+}
+
+// Host is a Transport for one address on a Network
+type Host struct {
+	network *Network
+	ip      net.IP
+}
+
+// NewNetwork creates an empty network. Packet loss is decided by a random
+// source seeded with seed, so runs with the same seed drop the same packets.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		conns:       make(map[string]*memoryConn),
+		listeners:   make(map[string]*memoryListener),
+		natByPublic: make(map[string]*nat),
+		natByHost:   make(map[string]*nat),
+		nextPort:    make(map[string]int),
+		random:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Host returns the transport for a host with a public address
+func (network *Network) Host(ip net.IP) *Host {
+	return &Host{network: network, ip: ip.To4()}
+}
+
+// NatHost returns the transport for a host at privateIp behind its own nat at
+// publicIp
+func (network *Network) NatHost(privateIp net.IP, publicIp net.IP) *Host {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	natDevice := &nat{
+		publicIp:      publicIp.To4(),
+		privateIp:     privateIp.To4(),
+		nextPort:      firstNatPort,
+		byPrivatePort: make(map[int]*natMapping),
+		byPublicPort:  make(map[int]*natMapping),
+	}
+	network.natByPublic[publicIp.String()] = natDevice
+	network.natByHost[privateIp.String()] = natDevice
+
+	return &Host{network: network, ip: privateIp.To4()}
+}
+
+// SetLoss sets the fraction of packets dropped, from 0 to 1
+func (network *Network) SetLoss(rate float64) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	network.lossRate = rate
+}
+
+// Dropped is the number of packets lost, filtered by a nat or sent to a port
+// nobody is listening on
+func (network *Network) Dropped() int {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.dropped
+}
+
+// PublicAddr returns the address other hosts see packets from addr come from
+func (network *Network) PublicAddr(addr *net.UDPAddr) *net.UDPAddr {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	natDevice, ok := network.natByHost[addr.IP.String()]
+	if !ok {
+		return addr
+	}
+	mapping, ok := natDevice.byPrivatePort[addr.Port]
+	if !ok {
+		return addr
+	}
+	return &net.UDPAddr{IP: natDevice.publicIp, Port: mapping.publicPort}
+}
+
+func (network *Network) send(srcAddr net.UDPAddr, dstAddr net.UDPAddr, buffer []byte) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if network.lossRate > 0 && network.random.Float64() < network.lossRate {
+		network.dropped = network.dropped + 1
+		return
+	}
+
+	if natDevice, ok := network.natByHost[srcAddr.IP.String()]; ok {
+		mapping, ok := natDevice.byPrivatePort[srcAddr.Port]
+		if !ok {
+			mapping = &natMapping{
+				privatePort: srcAddr.Port,
+				publicPort:  natDevice.nextPort,
+				permitted:   make(map[string]bool),
+			}
+			natDevice.nextPort = natDevice.nextPort + 1
+			natDevice.byPrivatePort[srcAddr.Port] = mapping
+			natDevice.byPublicPort[mapping.publicPort] = mapping
+		}
+		mapping.permitted[dstAddr.String()] = true
+		srcAddr = net.UDPAddr{IP: natDevice.publicIp, Port: mapping.publicPort}
+	}
+
+	if natDevice, ok := network.natByPublic[dstAddr.IP.String()]; ok {
+		mapping, ok := natDevice.byPublicPort[dstAddr.Port]
+		if !ok || !mapping.permitted[srcAddr.String()] {
+			network.dropped = network.dropped + 1
+			return
+		}
+		dstAddr = net.UDPAddr{IP: natDevice.privateIp, Port: mapping.privatePort}
+	}
+
+	conn, ok := network.conns[dstAddr.String()]
+	if !ok {
+		network.dropped = network.dropped + 1
+		return
+	}
+
+	select {
+	case conn.queue <- datagram{srcAddr, buffer}:
+	default:
+		network.dropped = network.dropped + 1
+	}
+}
+
+// allocatePort must be called with the mutex held
+func (network *Network) allocatePort(ip net.IP, inUse func(string) bool) int {
+	port, ok := network.nextPort[ip.String()]
+	if !ok {
+		port = firstEphemeralPort
+	}
+	for inUse((&net.UDPAddr{IP: ip, Port: port}).String()) {
+		port = port + 1
+	}
+	network.nextPort[ip.String()] = port + 1
+	return port
+}
+
+func (host *Host) ListenUDP(port int) (PacketConn, error) {
+	network := host.network
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if port == 0 {
+		port = network.allocatePort(host.ip, func(key string) bool {
+			_, ok := network.conns[key]
+			return ok
+		})
+	}
+
+	conn := &memoryConn{
+		network: network,
+		addr:    net.UDPAddr{IP: host.ip, Port: port},
+		queue:   make(chan datagram, memoryQueueSize),
+		closed:  make(chan struct{}),
+	}
+
+	key := conn.addr.String()
+	if _, ok := network.conns[key]; ok {
+		return nil, fmt.Errorf("listen udp %s: address already in use", key)
+	}
+	network.conns[key] = conn
+
+	return conn, nil
+}
+
+func (host *Host) ListenTCP(port int) (net.Listener, error) {
+	network := host.network
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if port == 0 {
+		port = network.allocatePort(host.ip, func(key string) bool {
+			_, ok := network.listeners[key]
+			return ok
+		})
+	}
+
+	listener := &memoryListener{
+		network: network,
+		addr:    net.TCPAddr{IP: host.ip, Port: port},
+		accept:  make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+
+	key := listener.addr.String()
+	if _, ok := network.listeners[key]; ok {
+		return nil, fmt.Errorf("listen tcp %s: address already in use", key)
+	}
+	network.listeners[key] = listener
+
+	return listener, nil
+}
+
+func (host *Host) OutboundIp() net.IP {
+	return host.ip
+}
+
+// DialTCP connects to a listener on the network. Nats are not applied to tcp.
+func (host *Host) DialTCP(addr *net.TCPAddr) (net.Conn, error) {
+	network := host.network
+	network.mutex.Lock()
+	listener, ok := network.listeners[addr.String()]
+	network.mutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("dial tcp %s: connection refused", addr.String())
+	}
+
+	client, server := net.Pipe()
+	select {
+	case listener.accept <- server:
+		return client, nil
+	case <-listener.closed:
+		client.Close()
+		server.Close()
+		return nil, fmt.Errorf("dial tcp %s: connection refused", addr.String())
+	}
+}
+
+type memoryConn struct {
+	network   *Network
+	addr      net.UDPAddr
+	queue     chan datagram
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (conn *memoryConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case d := <-conn.queue:
+		n := copy(b, d.buffer)
+		return n, &d.srcAddr, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (conn *memoryConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	buffer := make([]byte, len(b))
+	copy(buffer, b)
+	conn.network.send(conn.addr, net.UDPAddr{IP: addr.IP.To4(), Port: addr.Port}, buffer)
+	return len(b), nil
+}
+
+func (conn *memoryConn) LocalAddr() net.Addr {
+	return &conn.addr
+}
+
+func (conn *memoryConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.network.mutex.Lock()
+		delete(conn.network.conns, conn.addr.String())
+		conn.network.mutex.Unlock()
+	})
+	return nil
+}
+
+type memoryListener struct {
+	network   *Network
+	addr      net.TCPAddr
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.accept:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *memoryListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+		listener.network.mutex.Lock()
+		delete(listener.network.listeners, listener.addr.String())
+		listener.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (listener *memoryListener) Addr() net.Addr {
+	return &listener.addr
+}
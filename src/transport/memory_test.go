@@ -0,0 +1,142 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+var serverIp = net.IPv4(198, 51, 100, 1).To4()
+
+func listen(t *testing.T, host *Host, port int) PacketConn {
+	conn, err := host.ListenUDP(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receiver reads conn until it is closed and returns the source addresses
+func receiver(conn PacketConn) chan *net.UDPAddr {
+	result := make(chan *net.UDPAddr, memoryQueueSize)
+	go func() {
+		buffer := make([]byte, 16)
+		for {
+			_, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			result <- addr
+		}
+	}()
+	return result
+}
+
+// readTimeout returns the next source address, or nil if no packet arrives
+// in time
+func readTimeout(received chan *net.UDPAddr) *net.UDPAddr {
+	select {
+	case addr := <-received:
+		return addr
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestNatFiltersUnsolicitedPackets(t *testing.T) {
+	network := NewNetwork(1)
+	server := network.Host(serverIp)
+	serverA := listen(t, server, 1000)
+	serverB := listen(t, server, 1001)
+	player := listen(t, network.NatHost(net.IPv4(192, 168, 1, 2), net.IPv4(203, 0, 113, 2)), 0)
+
+	serverAReceived := receiver(serverA)
+	playerReceived := receiver(player)
+
+	_, err := player.WriteToUDP([]byte("hello"), serverA.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicAddr := readTimeout(serverAReceived)
+	if publicAddr == nil {
+		t.Fatal("packet through the nat was not delivered")
+	}
+	if !publicAddr.IP.Equal(net.IPv4(203, 0, 113, 2)) {
+		t.Errorf("packet came from %s, expected the nat's public address", publicAddr.String())
+	}
+
+	serverB.WriteToUDP([]byte("unsolicited"), publicAddr)
+	if readTimeout(playerReceived) != nil {
+		t.Error("nat let in a packet from a port the player never sent to")
+	}
+
+	serverA.WriteToUDP([]byte("reply"), publicAddr)
+	if readTimeout(playerReceived) == nil {
+		t.Error("nat dropped a reply")
+	}
+	if network.Dropped() != 1 {
+		t.Errorf("%d packets dropped, expected 1", network.Dropped())
+	}
+}
+
+func TestLossIsDeterministic(t *testing.T) {
+	delivered := func() []bool {
+		network := NewNetwork(42)
+		network.SetLoss(0.5)
+		host := network.Host(serverIp)
+		src := listen(t, host, 1000)
+		dst := listen(t, host, 1001)
+		dstReceived := receiver(dst)
+
+		var result []bool
+		for i := 0; i < 20; i++ {
+			src.WriteToUDP([]byte{byte(i)}, dst.LocalAddr().(*net.UDPAddr))
+			result = append(result, readTimeout(dstReceived) != nil)
+		}
+		return result
+	}
+
+	first := delivered()
+	second := delivered()
+	lost := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("packet %d delivered differently with the same seed", i)
+		}
+		if !first[i] {
+			lost = lost + 1
+		}
+	}
+	if lost == 0 || lost == len(first) {
+		t.Errorf("%d of %d packets lost at 50%% loss", lost, len(first))
+	}
+}
+
+func TestClosedConn(t *testing.T) {
+	conn := listen(t, NewNetwork(1).Host(serverIp), 1000)
+	conn.Close()
+
+	_, _, err := conn.ReadFromUDP(make([]byte, 16))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close returned %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package transport creates the sockets the server listens on, so that the
+// server can run on real sockets or on an in-memory network in tests
+package transport
+
+import (
+	"fmt"
+	"net"
+
+	"git.astrospark.com/bolorama/util"
+)
+
+// PacketConn is the part of *net.UDPConn used by the tracker and the proxies
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+type Transport interface {
+	// ListenUDP listens on port on all addresses, port 0 picks a free port
+	ListenUDP(port int) (PacketConn, error)
+	ListenTCP(port int) (net.Listener, error)
+	// OutboundIp is the address players reach this host at
+	OutboundIp() net.IP
+}
+
+// Net is the Transport for real sockets
+type Net struct{}
+
+func (Net) ListenUDP(port int) (PacketConn, error) {
+	listenAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", port))
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ListenUDP("udp4", listenAddr)
+}
+
+func (Net) ListenTCP(port int) (net.Listener, error) {
+	listenAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", port))
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ListenTCP("tcp4", listenAddr)
+}
+
+func (Net) OutboundIp() net.IP {
+	return util.GetOutboundIp()
+}
+
+// LoopbackIp is the address Loopback tells players to reach the relay at
+var LoopbackIp = net.IPv4(127, 0, 0, 1).To4()
+
+// Loopback is real sockets, with players told to reach the relay on
+// LoopbackIp, for tests that relay between clients on the same host
+type Loopback struct {
+	Net
+}
+
+func (Loopback) OutboundIp() net.IP {
+	return LoopbackIp
+}
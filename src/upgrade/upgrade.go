@@ -0,0 +1,255 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package upgrade replaces the running program with a new build of it
+// without dropping players. The old process carries on relaying while it
+// starts a copy of the program with its server's sockets, stops only once
+// the copy is ready to take over, hands it the server's state, and exits
+// once the copy is relaying.
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+
+	"git.astrospark.com/bolorama/server"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/transport"
+)
+
+// envName is set for the copy, so that it takes over instead of starting
+// afresh
+const envName = "BOLORAMA_UPGRADE"
+
+// the copy's file descriptors after stdin, stdout and stderr: the handoff is
+// read from the state pipe, the copy writes to the ready pipe, and the
+// sockets follow in the order they are listed in the handoff
+const (
+	stateFd = 3 + iota
+	readyFd
+	firstSocketFd
+)
+
+// what the copy writes to the ready pipe: once it is about to read the state
+// pipe, and once it is relaying
+const (
+	prepared byte = 1 + iota
+	relaying
+)
+
+// message is the handoff as written to the state pipe
+type message struct {
+	Sockets          []transport.Socket `json:"sockets"`
+	Snapshot         state.Snapshot     `json:"snapshot"`
+	TrackerPort      int                `json:"tracker_port"`
+	TrackerDebugPort int                `json:"tracker_debug_port"`
+}
+
+// Start runs the program at path with args to take over from relay, and
+// returns its process id once it is relaying. relay carries on relaying
+// while the program starts, and is stopped only once the program calls
+// Inherit, to hand over its state. If the program exits or ctx is done
+// before that, relay carries on and no handoff is returned. If it happens
+// after, the program is killed, and the returned handoff starts a server in
+// this process again; the caller closes it.
+func Start(ctx context.Context, path string, args []string, relay *server.Server) (int, *server.Handoff, error) {
+	handoff, err := relay.BeginHandoff()
+	if err != nil {
+		return 0, nil, err
+	}
+	pid, handedOver, err := start(ctx, path, args, relay, handoff)
+	if err != nil && handedOver {
+		return 0, handoff, err
+	}
+	handoff.Close()
+	return pid, nil, err
+}
+
+// start runs the program for Start, and reports whether relay was stopped
+// and handoff handed over
+func start(ctx context.Context, path string, args []string, relay *server.Server, handoff *server.Handoff) (int, bool, error) {
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return 0, false, err
+	}
+	defer stateReader.Close()
+	defer stateWriter.Close()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, false, err
+	}
+	defer readyReader.Close()
+
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr, stateReader, readyWriter}
+	for _, socket := range handoff.Sockets {
+		files = append(files, socket.File)
+	}
+	fds, err := descriptors(files)
+	if err != nil {
+		readyWriter.Close()
+		return 0, false, err
+	}
+	// started without os/exec, which would switch the sockets to blocking
+	// mode and with them relay's, so that relay could no longer stop
+	pid, err := syscall.ForkExec(path, append([]string{path}, args...), &syscall.ProcAttr{
+		Env:   append(os.Environ(), envName+"=1"),
+		Files: fds,
+	})
+	readyWriter.Close()
+	if err != nil {
+		return 0, false, err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, false, err
+	}
+	exited := make(chan struct{})
+	var processState *os.ProcessState
+	go func() {
+		processState, _ = process.Wait()
+		close(exited)
+	}()
+	kill := func() {
+		process.Kill()
+		<-exited
+	}
+
+	// the copy writes to the ready pipe as it gets ready, and if it exits the
+	// pipe is closed
+	signals := make(chan byte, 2)
+	go func() {
+		defer close(signals)
+		buffer := make([]byte, 1)
+		for {
+			n, _ := readyReader.Read(buffer)
+			if n != 1 {
+				return
+			}
+			signals <- buffer[0]
+		}
+	}()
+	awaitSignal := func(expected byte) error {
+		select {
+		case signal, ok := <-signals:
+			if ok && signal == expected {
+				return nil
+			}
+			kill()
+			if !ok {
+				return fmt.Errorf("upgrade exited: %s", processState)
+			}
+			return fmt.Errorf("upgrade signalled %d, expected %d", signal, expected)
+		case <-ctx.Done():
+			kill()
+			return ctx.Err()
+		}
+	}
+
+	err = awaitSignal(prepared)
+	if err != nil {
+		return 0, false, fmt.Errorf("upgrade isn't ready to take over: %w", err)
+	}
+
+	// from here on packets wait in the sockets until the copy relays them
+	err = relay.FinishHandoff(ctx, handoff)
+	if err != nil {
+		kill()
+		return 0, true, err
+	}
+	go func() {
+		json.NewEncoder(stateWriter).Encode(message{
+			Sockets:          handoff.Sockets,
+			Snapshot:         handoff.Snapshot,
+			TrackerPort:      handoff.TrackerPort,
+			TrackerDebugPort: handoff.TrackerDebugPort,
+		})
+		stateWriter.Close()
+	}()
+
+	err = awaitSignal(relaying)
+	if err != nil {
+		return 0, true, fmt.Errorf("upgrade isn't relaying: %w", err)
+	}
+	return pid, true, nil
+}
+
+// descriptors returns the file descriptors of files, without switching them
+// to blocking mode like File.Fd does
+func descriptors(files []*os.File) ([]uintptr, error) {
+	var fds []uintptr
+	for _, file := range files {
+		raw, err := file.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		err = raw.Control(func(fd uintptr) {
+			fds = append(fds, fd)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fds, nil
+}
+
+// Inherit returns what the process that started this one handed over, nil
+// if this process wasn't started by Start. The old process relays until
+// Inherit is called, so call it once ready to start a server with the
+// handoff, and call ready once that server is relaying to let the old
+// process exit. The caller closes the handoff once the server has started.
+func Inherit() (handoff *server.Handoff, ready func(), err error) {
+	if os.Getenv(envName) == "" {
+		return nil, func() {}, nil
+	}
+	// the next upgrade sets it again
+	os.Unsetenv(envName)
+
+	stateFile := os.NewFile(stateFd, "upgrade state")
+	readyFile := os.NewFile(readyFd, "upgrade ready")
+	ready = func() {
+		readyFile.Write([]byte{relaying})
+		readyFile.Close()
+	}
+
+	_, err = readyFile.Write([]byte{prepared})
+	if err != nil {
+		stateFile.Close()
+		readyFile.Close()
+		return nil, nil, fmt.Errorf("can't take over: %w", err)
+	}
+	var decoded message
+	err = json.NewDecoder(stateFile).Decode(&decoded)
+	stateFile.Close()
+	if err != nil {
+		readyFile.Close()
+		return nil, nil, fmt.Errorf("can't read upgrade state: %w", err)
+	}
+
+	handoff = &server.Handoff{
+		Snapshot:         decoded.Snapshot,
+		TrackerPort:      decoded.TrackerPort,
+		TrackerDebugPort: decoded.TrackerDebugPort,
+	}
+	for i, socket := range decoded.Sockets {
+		socket.File = os.NewFile(uintptr(firstSocketFd+i), fmt.Sprint(socket.Network, ":", socket.Port))
+		handoff.Sockets = append(handoff.Sockets, socket)
+	}
+	return handoff, ready, nil
+}
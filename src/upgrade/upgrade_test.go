@@ -0,0 +1,355 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package upgrade
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/bolotest"
+	"git.astrospark.com/bolorama/server"
+	"git.astrospark.com/bolorama/transport"
+)
+
+const testTimeout = 5 * time.Second
+
+// slowStart is how long the upgrade run with "slow" takes before taking over
+const slowStart = 500 * time.Millisecond
+
+// the proxy ports are below the ports the system picks, so that a tracker
+// port picked for the old server is never one of them
+const (
+	proxyPortFirst = 30001
+	proxyPortLast  = 30100
+)
+
+// TestMain runs the test binary as the upgraded program when Start runs it
+func TestMain(m *testing.M) {
+	if os.Getenv(envName) != "" {
+		runUpgrade(os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runUpgrade takes over the tracker port in args[0] and relays until it is
+// killed. args[1] is "fail" to exit before taking over, "fail-taken-over" to
+// exit after, and "slow" to take slowStart before taking over.
+func runUpgrade(args []string) {
+	mode := ""
+	if len(args) > 1 {
+		mode = args[1]
+	}
+	switch mode {
+	case "fail":
+		os.Exit(1)
+	case "slow":
+		time.Sleep(slowStart)
+	}
+	handoff, ready, err := Inherit()
+	if err != nil || mode == "fail-taken-over" {
+		os.Exit(1)
+	}
+	trackerPort, _ := strconv.Atoi(args[0])
+	relay := newServer(trackerPort, handoff)
+	err = relay.Start(context.Background())
+	if err != nil {
+		os.Exit(1)
+	}
+	ready()
+	// in case the test is gone before it can kill this process
+	time.Sleep(30 * time.Second)
+}
+
+func newServer(trackerPort int, handoff *server.Handoff) *server.Server {
+	relay, err := server.New(server.Config{
+		Hostname:            "localhost",
+		TrackerPort:         trackerPort,
+		GameInfoPingSeconds: 1,
+		ProxyPortFirst:      proxyPortFirst,
+		ProxyPortLast:       proxyPortLast,
+		Transport:           transport.Loopback{},
+		Handoff:             handoff,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return relay
+}
+
+func startServer(t *testing.T, handoff *server.Handoff, trackerPort int) *server.Server {
+	relay := newServer(trackerPort, handoff)
+	err := relay.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		relay.Shutdown(ctx)
+	})
+	return relay
+}
+
+func waitForPlayer(t *testing.T, relay *server.Server, client *bolotest.Client) server.Player {
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, player := range relay.Players() {
+			if player.Addr.Port == client.Addr().Port {
+				return player
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no player for %s", client.Addr().String())
+	return server.Player{}
+}
+
+// startGame has a host and a joiner play on relay, and returns them with
+// their proxy addresses
+func startGame(t *testing.T, relay *server.Server) (*bolotest.Client, *net.UDPAddr, *bolotest.Client, *net.UDPAddr) {
+	trackerAddr := &net.UDPAddr{IP: transport.LoopbackIp, Port: relay.TrackerPort()}
+	var clients []*bolotest.Client
+	for i := 0; i < 2; i++ {
+		client, err := bolotest.NewClient(trackerAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(client.Close)
+		clients = append(clients, client)
+	}
+	host, joiner := clients[0], clients[1]
+
+	gameInfo := bolotest.NewGameInfo("Upgrade Island", host.Addr().IP)
+	err := host.Host(gameInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostProxyAddr := &net.UDPAddr{IP: transport.LoopbackIp, Port: waitForPlayer(t, relay, host).ProxyPort}
+	joiner.SetGameInfo(gameInfo)
+	err = joiner.Join(hostProxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinerProxyAddr := &net.UDPAddr{IP: transport.LoopbackIp, Port: waitForPlayer(t, relay, joiner).ProxyPort}
+	_, err = host.ReceiveType(bolo.PacketType5, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, hostProxyAddr, joiner, joinerProxyAddr
+}
+
+// expectRelayed sends game state from the host to the joiner through
+// whichever server now has their sockets
+func expectRelayed(t *testing.T, host *bolotest.Client, hostProxyAddr *net.UDPAddr, joiner *bolotest.Client, joinerProxyAddr *net.UDPAddr) {
+	err := host.Send(joinerProxyAddr, bolotest.GameStatePacket(0x10, bolotest.GameStateBlock(0x01, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := joiner.ReceiveType(bolo.PacketTypeGameState, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.SrcAddr.Port != hostProxyAddr.Port {
+		t.Errorf("game state came from port %d, expected host's proxy port %d", received.SrcAddr.Port, hostProxyAddr.Port)
+	}
+}
+
+// startUpgrade runs the test binary as the upgrade of relay, with args after
+// the tracker port as runUpgrade takes them
+func startUpgrade(t *testing.T, relay *server.Server, trackerPort int, args ...string) (int, *server.Handoff, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	args = append([]string{strconv.Itoa(trackerPort)}, args...)
+	pid, handoff, err := Start(ctx, executable, args, relay)
+	if err == nil {
+		t.Cleanup(func() { kill(pid) })
+	}
+	return pid, handoff, err
+}
+
+// expectServed expects the tracker text served on tcp port
+func expectServed(t *testing.T, port int) {
+	connection, err := net.DialTimeout("tcp", net.JoinHostPort(transport.LoopbackIp.String(), strconv.Itoa(port)), testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.SetReadDeadline(time.Now().Add(testTimeout))
+	// a socket that was handed over takes connections even when nobody
+	// listens on it, so only an answer shows that it is served
+	text, err := io.ReadAll(connection)
+	if err != nil {
+		t.Fatalf("port %d: %v", port, err)
+	}
+	if len(text) == 0 {
+		t.Errorf("nothing served on port %d", port)
+	}
+}
+
+// kill kills the upgrade and waits for it to be gone, and its sockets with it
+func kill(pid int) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	process.Kill()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) && process.Signal(syscall.Signal(0)) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStart(t *testing.T) {
+	old := startServer(t, nil, 0)
+	host, hostProxyAddr, joiner, joinerProxyAddr := startGame(t, old)
+
+	_, _, err := startUpgrade(t, old, old.TrackerPort())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old server is stopped, so only the upgrade can relay this
+	expectRelayed(t, host, hostProxyAddr, joiner, joinerProxyAddr)
+}
+
+// TestStartWithoutGap streams game state from the host to the joiner while
+// the upgrade starts, which the old server relays until the upgrade takes
+// over, so that the stream never stops for as long as the upgrade takes
+func TestStartWithoutGap(t *testing.T) {
+	old := startServer(t, nil, 0)
+	host, _, joiner, joinerProxyAddr := startGame(t, old)
+
+	const interval = 5 * time.Millisecond
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		count := 0
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				sent <- count
+				return
+			case <-ticker.C:
+				host.Send(joinerProxyAddr, bolotest.GameStatePacket(count, bolotest.GameStateBlock(count, 0)))
+				count++
+			}
+		}
+	}()
+
+	var arrivals []time.Time
+	received := make(chan []time.Time)
+	go func() {
+		var arrivals []time.Time
+		for {
+			_, err := joiner.ReceiveType(bolo.PacketTypeGameState, slowStart)
+			if err != nil {
+				received <- arrivals
+				return
+			}
+			arrivals = append(arrivals, time.Now())
+		}
+	}()
+
+	time.Sleep(20 * interval)
+	_, _, err := startUpgrade(t, old, old.TrackerPort(), "slow")
+	time.Sleep(20 * interval)
+	close(stop)
+	count := <-sent
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivals = <-received
+
+	var longest time.Duration
+	for i := 1; i < len(arrivals); i++ {
+		longest = max(longest, arrivals[i].Sub(arrivals[i-1]))
+	}
+	t.Logf("received %d of %d packets, longest gap %s", len(arrivals), count, longest)
+	if longest >= slowStart/2 {
+		t.Errorf("stream stopped for %s while upgrading", longest)
+	}
+	// packets the old server had read but not yet sent when it stopped are
+	// lost, like a busy network would lose them
+	if len(arrivals) < count*9/10 {
+		t.Errorf("received %d of %d packets", len(arrivals), count)
+	}
+}
+
+func TestStartFails(t *testing.T) {
+	old := startServer(t, nil, 0)
+	host, hostProxyAddr, joiner, joinerProxyAddr := startGame(t, old)
+
+	_, handoff, err := startUpgrade(t, old, old.TrackerPort(), "fail")
+	if err == nil {
+		t.Fatal("upgrade that exited started")
+	}
+	if handoff != nil {
+		t.Fatal("handed over to an upgrade that exited before taking over")
+	}
+
+	// the old server never stopped
+	expectRelayed(t, host, hostProxyAddr, joiner, joinerProxyAddr)
+}
+
+func TestStartFailsTakenOver(t *testing.T) {
+	old := startServer(t, nil, 0)
+	trackerPort := old.TrackerPort()
+	host, hostProxyAddr, joiner, joinerProxyAddr := startGame(t, old)
+
+	_, handoff, err := startUpgrade(t, old, trackerPort, "fail-taken-over")
+	if err == nil {
+		t.Fatal("upgrade that exited started")
+	}
+	if handoff == nil {
+		t.Fatal("no handoff to take back over from")
+	}
+	defer handoff.Close()
+
+	// the old process takes back over from the handoff
+	startServer(t, handoff, trackerPort)
+	expectRelayed(t, host, hostProxyAddr, joiner, joinerProxyAddr)
+}
+
+// TestStartPickedPorts upgrades a server whose tracker ports were picked for
+// it, which the upgrade carries on listening on
+func TestStartPickedPorts(t *testing.T) {
+	old := startServer(t, nil, 0)
+	trackerPort, trackerDebugPort := old.TrackerPort(), old.TrackerDebugPort()
+
+	_, _, err := startUpgrade(t, old, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectServed(t, trackerPort)
+	expectServed(t, trackerDebugPort)
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package watchdog reports goroutines that have been busy with one thing for
+// too long, such as a relay loop blocked on a channel nobody reads. A
+// goroutine waiting for its next piece of work is idle, not stuck.
+package watchdog
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.astrospark.com/bolorama/logging"
+)
+
+// Watchdog watches goroutines. A nil Watchdog watches nothing.
+type Watchdog struct {
+	threshold time.Duration
+	logger    *slog.Logger
+	mutex     sync.Mutex
+	watches   map[*Watch]struct{}
+	stuck     atomic.Uint64
+}
+
+// Watch is the state of one watched goroutine. Its methods do nothing on a
+// nil Watch.
+type Watch struct {
+	name     string
+	watchdog *Watchdog
+	// busySince is unix nanoseconds, 0 while idle
+	busySince atomic.Int64
+	reported  atomic.Bool
+}
+
+// New reports goroutines busy for longer than threshold. A threshold of 0
+// returns nil.
+func New(threshold time.Duration, logger *slog.Logger) *Watchdog {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Watchdog{
+		threshold: threshold,
+		logger:    logger,
+		watches:   make(map[*Watch]struct{}),
+	}
+}
+
+// Watch starts watching a goroutine named name. The goroutine calls Busy and
+// Idle around each piece of work, and Stop when it returns.
+func (watchdog *Watchdog) Watch(name string) *Watch {
+	if watchdog == nil {
+		return nil
+	}
+	watch := &Watch{name: name, watchdog: watchdog}
+	watchdog.mutex.Lock()
+	watchdog.watches[watch] = struct{}{}
+	watchdog.mutex.Unlock()
+	return watch
+}
+
+// Stuck is the number of times a goroutine was reported stuck
+func (watchdog *Watchdog) Stuck() uint64 {
+	if watchdog == nil {
+		return 0
+	}
+	return watchdog.stuck.Load()
+}
+
+// Run checks the watched goroutines until shutdownChannel is closed
+func (watchdog *Watchdog) Run(wg *sync.WaitGroup, shutdownChannel chan struct{}) {
+	defer wg.Done()
+	if watchdog == nil {
+		return
+	}
+
+	ticker := time.NewTicker(watchdog.threshold / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownChannel:
+			return
+		case now := <-ticker.C:
+			watchdog.Check(now)
+		}
+	}
+}
+
+// Check reports the goroutines busy for longer than the threshold at now that
+// haven't been reported yet, and returns their names
+func (watchdog *Watchdog) Check(now time.Time) []string {
+	if watchdog == nil {
+		return nil
+	}
+
+	var stuck []string
+	watchdog.mutex.Lock()
+	for watch := range watchdog.watches {
+		busySince := watch.busySince.Load()
+		if busySince == 0 || now.Sub(time.Unix(0, busySince)) < watchdog.threshold {
+			continue
+		}
+		if watch.reported.Swap(true) {
+			continue
+		}
+		watchdog.stuck.Add(1)
+		watchdog.logger.Warn("goroutine stuck", "goroutine", watch.name,
+			"busy_seconds", now.Sub(time.Unix(0, busySince)).Seconds())
+		stuck = append(stuck, watch.name)
+	}
+	watchdog.mutex.Unlock()
+
+	if len(stuck) > 0 && logging.DebugEnabled(watchdog.logger) {
+		buffer := make([]byte, 1<<20)
+		n := runtime.Stack(buffer, true)
+		watchdog.logger.Debug("goroutine stacks", "stacks", string(buffer[:n]))
+	}
+	return stuck
+}
+
+// Busy marks the start of a piece of work
+func (watch *Watch) Busy() {
+	if watch == nil {
+		return
+	}
+	watch.busySince.Store(time.Now().UnixNano())
+}
+
+// Idle marks the end of a piece of work
+func (watch *Watch) Idle() {
+	if watch == nil {
+		return
+	}
+	busySince := watch.busySince.Swap(0)
+	if watch.reported.Load() && watch.reported.Swap(false) {
+		watch.watchdog.logger.Info("goroutine no longer stuck", "goroutine", watch.name,
+			"busy_seconds", time.Since(time.Unix(0, busySince)).Seconds())
+	}
+}
+
+// Stop stops watching the goroutine
+func (watch *Watch) Stop() {
+	if watch == nil {
+		return
+	}
+	watch.watchdog.mutex.Lock()
+	delete(watch.watchdog.watches, watch)
+	watch.watchdog.mutex.Unlock()
+}
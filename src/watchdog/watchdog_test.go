@@ -0,0 +1,79 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package watchdog
+
+import (
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/logging"
+)
+
+func TestWatchdog(t *testing.T) {
+	watchdog := New(time.Second, logging.Discard().Server)
+	relay := watchdog.Watch("relay")
+	listener := watchdog.Watch("listener")
+
+	// an idle goroutine is waiting for work, not stuck
+	if stuck := watchdog.Check(time.Now().Add(time.Hour)); len(stuck) != 0 {
+		t.Errorf("idle goroutines reported stuck: %v", stuck)
+	}
+
+	relay.Busy()
+	listener.Busy()
+	listener.Idle()
+	if stuck := watchdog.Check(time.Now()); len(stuck) != 0 {
+		t.Errorf("goroutines reported stuck straight away: %v", stuck)
+	}
+	later := time.Now().Add(2 * time.Second)
+	if stuck := watchdog.Check(later); len(stuck) != 1 || stuck[0] != "relay" {
+		t.Errorf("reported %v stuck, expected relay", stuck)
+	}
+
+	// a stuck goroutine is reported once until it gets going again
+	if stuck := watchdog.Check(later); len(stuck) != 0 {
+		t.Errorf("reported %v stuck again", stuck)
+	}
+	relay.Idle()
+	relay.Busy()
+	if stuck := watchdog.Check(time.Now().Add(2 * time.Second)); len(stuck) != 1 {
+		t.Errorf("reported %v stuck, expected relay again", stuck)
+	}
+	if watchdog.Stuck() != 2 {
+		t.Errorf("counted %d stuck goroutines, expected 2", watchdog.Stuck())
+	}
+
+	relay.Stop()
+	if stuck := watchdog.Check(time.Now().Add(time.Hour)); len(stuck) != 0 {
+		t.Errorf("stopped goroutine reported stuck: %v", stuck)
+	}
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	watchdog := New(0, logging.Discard().Server)
+	if watchdog != nil {
+		t.Fatal("watchdog with no threshold was created")
+	}
+	watch := watchdog.Watch("relay")
+	watch.Busy()
+	watch.Idle()
+	watch.Stop()
+	if watchdog.Stuck() != 0 || watchdog.Check(time.Now()) != nil {
+		t.Error("nil watchdog reported something")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/state"
+)
+
+// announceJson is a chat message to send to every player, or to the players
+// of one game
+type announceJson struct {
+	GameId  string `json:"game_id"`
+	Message string `json:"message"`
+}
+
+type announcedJson struct {
+	Players int `json:"players"`
+}
+
+// serveAnnounce sends a chat message from the server on POST
+func serveAnnounce(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJson(w, http.StatusMethodNotAllowed, errorJson{"method not allowed"})
+		return
+	}
+
+	if !allowAdmin(context, w, r) {
+		return
+	}
+
+	var announce announceJson
+	err := json.NewDecoder(r.Body).Decode(&announce)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, errorJson{err.Error()})
+		return
+	}
+	if announce.Message == "" {
+		writeJson(w, http.StatusBadRequest, errorJson{"message is empty"})
+		return
+	}
+
+	var gameId *bolo.GameId
+	if announce.GameId != "" {
+		buffer, err := hex.DecodeString(announce.GameId)
+		if err != nil || len(buffer) != len(bolo.GameId{}) {
+			writeJson(w, http.StatusBadRequest, errorJson{"game_id is not 16 hex digits"})
+			return
+		}
+		gameId = &bolo.GameId{}
+		copy(gameId[:], buffer)
+	}
+
+	count, err := state.Announce(context, gameId, announce.Message, true)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, errorJson{err.Error()})
+		return
+	}
+	context.Log.Web.Info("announced message", "players", count, "message", announce.Message)
+	writeJson(w, http.StatusOK, announcedJson{Players: count})
+}
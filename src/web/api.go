@@ -0,0 +1,166 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+type gameJson struct {
+	Id                  string    `json:"id"`
+	Join                string    `json:"join"`
+	MapName             string    `json:"map_name"`
+	GameType            string    `json:"game_type"`
+	HiddenMines         bool      `json:"hidden_mines"`
+	Bots                bool      `json:"bots"`
+	Password            bool      `json:"password"`
+	PlayerCount         int       `json:"player_count"`
+	NeutralPillboxCount int       `json:"neutral_pillbox_count"`
+	NeutralBaseCount    int       `json:"neutral_base_count"`
+	TrackedSince        time.Time `json:"tracked_since"`
+	TrackedForMinutes   int       `json:"tracked_for_minutes"`
+	Players             []string  `json:"players"`
+}
+
+// playerJson leaves out the player's address, like the tracker does
+type playerJson struct {
+	Name   string `json:"name"`
+	GameId string `json:"game_id"`
+}
+
+type errorJson struct {
+	Error string `json:"error"`
+}
+
+func newGameJson(listing tracker.Listing) gameJson {
+	game := listing.Game
+	players := listing.Players
+	if players == nil {
+		players = []string{}
+	}
+
+	return gameJson{
+		Id:                  hex.EncodeToString(game.GameId[:]),
+		Join:                fmt.Sprintf("%s:%d", listing.Hostname, listing.Port),
+		MapName:             game.MapName,
+		GameType:            tracker.GameTypeName(game.GameType),
+		HiddenMines:         game.AllowHiddenMines,
+		Bots:                game.AllowComputer,
+		Password:            game.HasPassword,
+		PlayerCount:         int(game.PlayerCount),
+		NeutralPillboxCount: int(game.NeutralPillboxCount),
+		NeutralBaseCount:    int(game.NeutralBaseCount),
+		TrackedSince:        game.ServerStartTimestamp.UTC(),
+		TrackedForMinutes:   int(listing.TrackedFor().Minutes()),
+		Players:             players,
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// allowGet answers anything but GET and HEAD with an error
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	writeJson(w, http.StatusMethodNotAllowed, errorJson{"method not allowed"})
+	return false
+}
+
+// allowAdmin answers requests without the admin token with an error. The
+// http port may be public, and a reverse proxy on the server's own host makes
+// every request look local, so requests that change the server must carry
+// the token.
+func allowAdmin(context *state.ServerContext, w http.ResponseWriter, r *http.Request) bool {
+	if context.AdminToken == "" {
+		writeJson(w, http.StatusForbidden, errorJson{"admin_token is not set"})
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(context.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJson(w, http.StatusUnauthorized, errorJson{"admin token required"})
+		return false
+	}
+	return true
+}
+
+func serveGames(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	games := []gameJson{}
+	for _, listing := range tracker.GetListings(context, true) {
+		games = append(games, newGameJson(listing))
+	}
+	writeJson(w, http.StatusOK, games)
+}
+
+func serveGame(context *state.ServerContext, id string, w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	for _, listing := range tracker.GetListings(context, true) {
+		if hex.EncodeToString(listing.Game.GameId[:]) == id {
+			writeJson(w, http.StatusOK, newGameJson(listing))
+			return
+		}
+	}
+	writeJson(w, http.StatusNotFound, errorJson{"game not found"})
+}
+
+func servePlayers(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	context.Mutex.RLock()
+	players := []playerJson{}
+	for _, player := range context.Players.All() {
+		players = append(players, playerJson{
+			Name:   player.Name,
+			GameId: hex.EncodeToString(player.GameId[:]),
+		})
+	}
+	context.Mutex.RUnlock()
+
+	sort.Slice(players, func(i, j int) bool {
+		if players[i].GameId != players[j].GameId {
+			return players[i].GameId < players[j].GameId
+		}
+		return players[i].Name < players[j].Name
+	})
+	writeJson(w, http.StatusOK, players)
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/state"
+)
+
+type captureJson struct {
+	Enabled   bool       `json:"enabled"`
+	Running   bool       `json:"running"`
+	Filename  string     `json:"filename,omitempty"`
+	GameId    string     `json:"game_id,omitempty"`
+	ProxyPort int        `json:"proxy_port,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Packets   uint64     `json:"packets"`
+	Dropped   uint64     `json:"dropped"`
+}
+
+// startCaptureJson is the filter of a capture to start, empty fields match
+// any packet
+type startCaptureJson struct {
+	GameId    string `json:"game_id"`
+	ProxyPort int    `json:"proxy_port"`
+}
+
+func newCaptureJson(enabled bool, status capture.Status) captureJson {
+	result := captureJson{
+		Enabled:   enabled,
+		Running:   status.Running,
+		Filename:  status.Filename,
+		ProxyPort: status.Filter.ProxyPort,
+		Packets:   status.Packets,
+		Dropped:   status.Dropped,
+	}
+	if status.Filter.GameId != (bolo.GameId{}) {
+		result.GameId = hex.EncodeToString(status.Filter.GameId[:])
+	}
+	if !status.Started.IsZero() {
+		started := status.Started.UTC()
+		result.Started = &started
+	}
+	return result
+}
+
+// serveCapture reports the packet capture on GET, starts one on PUT and
+// stops it on DELETE
+func serveCapture(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJson(w, http.StatusOK, newCaptureJson(context.Capture.Enabled(), context.Capture.Status()))
+	case http.MethodPut:
+		if !allowAdmin(context, w, r) {
+			return
+		}
+		filter, err := parseCaptureFilter(r.Body)
+		if err != nil {
+			writeJson(w, http.StatusBadRequest, errorJson{err.Error()})
+			return
+		}
+		status, err := context.Capture.Start(filter)
+		if err != nil {
+			writeJson(w, http.StatusConflict, errorJson{err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, newCaptureJson(true, status))
+	case http.MethodDelete:
+		if !allowAdmin(context, w, r) {
+			return
+		}
+		status, err := context.Capture.Stop()
+		if err != nil {
+			writeJson(w, http.StatusConflict, errorJson{err.Error()})
+			return
+		}
+		writeJson(w, http.StatusOK, newCaptureJson(true, status))
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeJson(w, http.StatusMethodNotAllowed, errorJson{"method not allowed"})
+	}
+}
+
+func parseCaptureFilter(body io.Reader) (capture.Filter, error) {
+	var start startCaptureJson
+	err := json.NewDecoder(body).Decode(&start)
+	if err != nil && err != io.EOF {
+		return capture.Filter{}, err
+	}
+
+	filter := capture.Filter{ProxyPort: start.ProxyPort}
+	if start.GameId != "" {
+		gameId, err := hex.DecodeString(start.GameId)
+		if err != nil || len(gameId) != len(filter.GameId) {
+			return capture.Filter{}, errors.New("game_id is not 16 hex digits")
+		}
+		copy(filter.GameId[:], gameId)
+	}
+	return filter, nil
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+)
+
+const eventQueueSize = 64
+const eventKeepAlivePeriod = 30 * time.Second
+
+// eventJson identifies players by their proxy port rather than their address
+type eventJson struct {
+	Type    string           `json:"type"`
+	Time    time.Time        `json:"time"`
+	GameId  string           `json:"game_id"`
+	MapName string           `json:"map_name,omitempty"`
+	Player  *eventPlayerJson `json:"player,omitempty"`
+	OldName string           `json:"old_name,omitempty"`
+	Peer    *eventPlayerJson `json:"peer,omitempty"`
+	Message string           `json:"message,omitempty"`
+	// Recipients is set for chat messages, with an id of 0 for a player the
+	// relay doesn't know
+	Recipients []eventPlayerJson `json:"recipients,omitempty"`
+}
+
+type eventPlayerJson struct {
+	Id   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+func newEventJson(event events.Event) eventJson {
+	eventJson := eventJson{
+		Type:    string(event.Type),
+		Time:    event.Time.UTC(),
+		GameId:  hex.EncodeToString(event.GameId[:]),
+		MapName: event.MapName,
+		OldName: event.OldName,
+	}
+	if event.ProxyPort != 0 {
+		eventJson.Player = &eventPlayerJson{Id: event.ProxyPort, Name: event.Name}
+	}
+	if event.PeerProxyPort != 0 {
+		eventJson.Peer = &eventPlayerJson{Id: event.PeerProxyPort}
+	}
+	if event.Type == events.ChatMessage {
+		eventJson.Message = event.Message
+		eventJson.Recipients = make([]eventPlayerJson, len(event.Recipients))
+		for i, recipient := range event.Recipients {
+			eventJson.Recipients[i] = eventPlayerJson{Id: recipient.ProxyPort, Name: recipient.Name}
+		}
+	}
+	return eventJson
+}
+
+// serveEvents streams events as server-sent events until the client goes
+// away or the server shuts down
+func serveEvents(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJson(w, http.StatusMethodNotAllowed, errorJson{"method not allowed"})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, http.StatusInternalServerError, errorJson{"streaming is not supported"})
+		return
+	}
+
+	subscription := context.Events.Subscribe(eventQueueSize)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// comments keep proxies from closing an idle stream
+	ticker := time.NewTicker(eventKeepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-context.ShutdownChannel:
+			return
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-subscription.C:
+			data, err := json.Marshal(newEventJson(event))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
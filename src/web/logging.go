@@ -0,0 +1,78 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/state"
+)
+
+type loggingJson struct {
+	Subsystems []logging.Subsystem `json:"subsystems"`
+	Debug      []logging.Subsystem `json:"debug"`
+}
+
+type setDebugJson struct {
+	Debug bool `json:"debug"`
+}
+
+func newLoggingJson(loggers *logging.Loggers) loggingJson {
+	debug := loggers.Debug()
+	if debug == nil {
+		debug = []logging.Subsystem{}
+	}
+	return loggingJson{Subsystems: logging.Subsystems, Debug: debug}
+}
+
+func serveLogging(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	writeJson(w, http.StatusOK, newLoggingJson(context.Log))
+}
+
+// serveSetDebug turns debug messages of subsystem on or off
+func serveSetDebug(context *state.ServerContext, subsystem string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		writeJson(w, http.StatusMethodNotAllowed, errorJson{"method not allowed"})
+		return
+	}
+
+	if !allowAdmin(context, w, r) {
+		return
+	}
+
+	var setDebug setDebugJson
+	err := json.NewDecoder(r.Body).Decode(&setDebug)
+	if err != nil {
+		writeJson(w, http.StatusBadRequest, errorJson{err.Error()})
+		return
+	}
+
+	err = context.Log.SetDebug(logging.Subsystem(subsystem), setDebug.Debug)
+	if err != nil {
+		writeJson(w, http.StatusNotFound, errorJson{err.Error()})
+		return
+	}
+	context.Log.Web.Info("debug messages changed", "changed_subsystem", subsystem, "debug", setDebug.Debug)
+	writeJson(w, http.StatusOK, newLoggingJson(context.Log))
+}
@@ -0,0 +1,110 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/state"
+)
+
+// packetTypeLabel names the packet types metrics are labelled with. Types not
+// listed are labelled with their number, once they have been seen.
+var packetTypeLabel = map[int]string{
+	bolo.PacketType0:               "0x00",
+	bolo.PacketType1:               "0x01",
+	bolo.PacketTypeGameState:       "game_state",
+	bolo.PacketTypeGameStateAck:    "game_state_ack",
+	bolo.PacketType5:               "0x05",
+	bolo.PacketType6:               "0x06",
+	bolo.PacketType7:               "0x07",
+	bolo.PacketType8:               "0x08",
+	bolo.PacketType9:               "0x09",
+	bolo.PacketTypeGameInfoRequest: "game_info_request",
+	bolo.PacketTypeGameInfo:        "game_info",
+}
+
+// serveMetrics writes the server's gauges and counters in the prometheus
+// text format
+func serveMetrics(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	context.Mutex.RLock()
+	games := len(context.Games)
+	players := context.Players.Len()
+	assignedPorts := 0
+	if context.ProxyPorts != nil {
+		assignedPorts = context.ProxyPorts.Assigned()
+	}
+	context.Mutex.RUnlock()
+
+	counters := context.Counters
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "bolorama_games", "gauge", "Games being tracked.", uint64(games))
+	writeMetric(w, "bolorama_players", "gauge", "Players being relayed.", uint64(players))
+	writeMetric(w, "bolorama_proxy_ports_assigned", "gauge", "Proxy ports assigned to players.", uint64(assignedPorts))
+
+	var packetTypes []int
+	for packetType := range counters.RelayedPackets {
+		_, named := packetTypeLabel[packetType]
+		if named || atomic.LoadUint64(&counters.RelayedPackets[packetType]) > 0 {
+			packetTypes = append(packetTypes, packetType)
+		}
+	}
+	sort.Ints(packetTypes)
+	writeLabelledMetric(w, "bolorama_relayed_packets_total", "Packets relayed to players, by packet type.", packetTypes, &counters.RelayedPackets)
+	writeLabelledMetric(w, "bolorama_relayed_bytes_total", "Bytes relayed to players, by packet type.", packetTypes, &counters.RelayedBytes)
+
+	writeMetric(w, "bolorama_invalid_packets_total", "counter", "Datagrams dropped because they are not bolo packets.", atomic.LoadUint64(&counters.InvalidPackets))
+	writeMetric(w, "bolorama_malformed_packets_total", "counter", "Bolo packets dropped because they could not be parsed.", atomic.LoadUint64(&counters.MalformedPackets))
+	writeMetric(w, "bolorama_rejected_players_total", "counter", "New players turned away.", atomic.LoadUint64(&counters.RejectedPlayers))
+	writeMetric(w, "bolorama_nat_probes_total", "counter", "Nat probes sent to players.", atomic.LoadUint64(&counters.NatProbes))
+	writeMetric(w, "bolorama_nat_probe_replies_total", "counter", "Nat probe replies received from players.", atomic.LoadUint64(&counters.NatProbeReplies))
+	writeMetric(w, "bolorama_peer_packets_replayed_total", "counter", "Packets held for a nat probe and relayed once it was answered.", atomic.LoadUint64(&counters.PeerPacketsReplayed))
+	writeMetric(w, "bolorama_peer_packets_expired_total", "counter", "Packets held for a nat probe and dropped without being relayed.", atomic.LoadUint64(&counters.PeerPacketsExpired))
+	writeMetric(w, "bolorama_cached_route_packets_total", "counter", "Packets relayed over a cached route without taking the server lock.", atomic.LoadUint64(&counters.CachedRoutePackets))
+	writeMetric(w, "bolorama_tx_dropped_packets_total", "counter", "Game state packets dropped because a socket's transmit queue was full.", atomic.LoadUint64(&counters.TxDropped))
+	writeMetric(w, "bolorama_rx_dropped_packets_total", "counter", "Packets dropped because the relay loop's queue was full.", atomic.LoadUint64(&counters.RxDropped))
+	writeMetric(w, "bolorama_stats_dropped_records_total", "counter", "Statistics records dropped because the statistics logger fell behind.", atomic.LoadUint64(&counters.StatsDropped))
+	writeMetric(w, "bolorama_stuck_goroutines_total", "counter", "Times the watchdog found a goroutine stuck.", context.Watchdog.Stuck())
+	writeMetric(w, "bolorama_player_timeouts_total", "counter", "Players disconnected for not sending anything.", atomic.LoadUint64(&counters.PlayerTimeouts))
+	writeMetric(w, "bolorama_database_errors_total", "counter", "Failed statistics database statements.", atomic.LoadUint64(&counters.DatabaseErrors))
+}
+
+func writeMetric(w io.Writer, name string, metricType string, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
+
+func writeLabelledMetric(w io.Writer, name string, help string, packetTypes []int, values *[256]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, packetType := range packetTypes {
+		label, ok := packetTypeLabel[packetType]
+		if !ok {
+			label = fmt.Sprintf("0x%02x", packetType)
+		}
+		fmt.Fprintf(w, "%s{type=%q} %d\n", name, label, atomic.LoadUint64(&values[packetType]))
+	}
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"html/template"
+	"net/http"
+
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+const pageRefreshSeconds = 30
+
+// the page is plain html 3.2, like doc/index.html, so that it works in the
+// browsers of the Macs that run Bolo
+var pageTemplate = template.Must(template.New("page").Funcs(template.FuncMap{
+	"gameType": tracker.GameTypeName,
+	"mines":    tracker.MinesName,
+	"yesNo":    tracker.YesNo,
+	"minutes": func(listing tracker.Listing) int {
+		return int(listing.TrackedFor().Minutes())
+	},
+}).Parse(`<html>
+<head>
+<meta http-equiv="refresh" content="{{.RefreshSeconds}}">
+<title>Astrospark Bolorama</title>
+</head>
+<body>
+
+<center><h1>Astrospark Bolorama</h1></center>
+
+<hr>
+{{range .Games}}
+<h2>{{.Game.MapName}}</h2>
+
+<p>
+Host: <b>{{.Hostname}} {{"{"}}{{.Port}}{{"}"}}</b><br>
+Players: {{.Game.PlayerCount}} &nbsp; Bases: {{.Game.NeutralBaseCount}} &nbsp; Pills: {{.Game.NeutralPillboxCount}}<br>
+Game: {{gameType .Game.GameType}} &nbsp; Mines: {{mines .Game.AllowHiddenMines}} &nbsp; Bots: {{yesNo .Game.AllowComputer}} &nbsp; PW: {{yesNo .Game.HasPassword}}<br>
+Tracked for: {{minutes .}} minutes
+</p>
+
+<p>
+{{range .Players}}{{.}}<br>
+{{end}}</p>
+
+<hr>
+{{end}}
+<p>{{if eq (len .Games) 0}}There are no games in progress.{{else if eq (len .Games) 1}}There is 1 game in progress.{{else}}There are {{len .Games}} games in progress.{{end}}</p>
+
+<p>This page reloads every {{.RefreshSeconds}} seconds.</p>
+
+</body>
+</html>
+`))
+
+type pageData struct {
+	RefreshSeconds int
+	Games          []tracker.Listing
+}
+
+func servePage(context *state.ServerContext, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, pageData{
+		RefreshSeconds: pageRefreshSeconds,
+		Games:          tracker.GetListings(context, true),
+	})
+}
@@ -0,0 +1,90 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package web serves the tracker over http
+package web
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"git.astrospark.com/bolorama/state"
+)
+
+// NewHandler serves the status page and the json api for the server with
+// context
+func NewHandler(context *state.ServerContext) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		servePage(context, w, r)
+	})
+	mux.HandleFunc("/api/games", func(w http.ResponseWriter, r *http.Request) {
+		serveGames(context, w, r)
+	})
+	mux.HandleFunc("/api/games/", func(w http.ResponseWriter, r *http.Request) {
+		serveGame(context, strings.TrimPrefix(r.URL.Path, "/api/games/"), w, r)
+	})
+	mux.HandleFunc("/api/players", func(w http.ResponseWriter, r *http.Request) {
+		servePlayers(context, w, r)
+	})
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(context, w, r)
+	})
+	mux.HandleFunc("/api/logging", func(w http.ResponseWriter, r *http.Request) {
+		serveLogging(context, w, r)
+	})
+	mux.HandleFunc("/api/logging/", func(w http.ResponseWriter, r *http.Request) {
+		serveSetDebug(context, strings.TrimPrefix(r.URL.Path, "/api/logging/"), w, r)
+	})
+	mux.HandleFunc("/api/capture", func(w http.ResponseWriter, r *http.Request) {
+		serveCapture(context, w, r)
+	})
+	mux.HandleFunc("/api/announce", func(w http.ResponseWriter, r *http.Request) {
+		serveAnnounce(context, w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(context, w, r)
+	})
+	return mux
+}
+
+// Serve answers http requests on listener until the server shuts down
+func Serve(wg *sync.WaitGroup, context *state.ServerContext, listener net.Listener) {
+	defer wg.Done()
+
+	httpServer := &http.Server{
+		Handler:  NewHandler(context),
+		ErrorLog: slog.NewLogLogger(context.Log.Web.Handler(), slog.LevelWarn),
+	}
+
+	go func() {
+		<-context.ShutdownChannel
+		httpServer.Close()
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	context.Log.Web.Info("listening on http", "port", port)
+
+	err := httpServer.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		context.Log.Web.Error("http server failed", "port", port, "error", err)
+	}
+	context.Log.Web.Info("stopped listening on http", "port", port)
+}
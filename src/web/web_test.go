@@ -0,0 +1,456 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package web
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/capture"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/transport"
+)
+
+var testGameId = bolo.GameId{0xc0, 0xa8, 0x01, 0x0a, 0xdc, 0x89, 0x85, 0x00}
+
+const testAdminToken = "s3cret"
+
+// newContext returns a server context tracking one game with two players
+func newContext(t *testing.T) *state.ServerContext {
+	host := transport.NewNetwork(1).Host(net.IPv4(198, 51, 100, 1))
+	connection, err := host.ListenUDP(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+
+	context := state.InitContext(host, connection)
+	context.Hostname = "bolo.example.com"
+	context.Games[testGameId] = bolo.GameInfo{
+		MapName:              "Everard Island",
+		GameId:               testGameId,
+		GameType:             2,
+		AllowHiddenMines:     true,
+		HasPassword:          true,
+		PlayerCount:          2,
+		NeutralPillboxCount:  16,
+		NeutralBaseCount:     16,
+		ServerStartTimestamp: time.Now().Add(-90 * time.Minute),
+	}
+	context.Players.Add(&state.Player{IpAddr: net.IPv4(203, 0, 113, 10), IpPort: 50000, ProxyPort: 40002, RelayPort: 40002, GameId: testGameId, Name: "Zed"})
+	context.Players.Add(&state.Player{IpAddr: net.IPv4(203, 0, 113, 11), IpPort: 50000, ProxyPort: 40001, RelayPort: 40001, GameId: testGameId, Name: "Alice"})
+	return context
+}
+
+func get(t *testing.T, handler http.Handler, path string, value interface{}) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("%s has content type %q", path, contentType)
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), value)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	return recorder.Code
+}
+
+func TestApiGames(t *testing.T) {
+	handler := NewHandler(newContext(t))
+
+	var games []gameJson
+	status := get(t, handler, "/api/games", &games)
+	if status != http.StatusOK || len(games) != 1 {
+		t.Fatalf("status %d with %d games", status, len(games))
+	}
+
+	game := games[0]
+	if game.Id != "c0a8010adc898500" {
+		t.Errorf("id is %s", game.Id)
+	}
+	if game.Join != "bolo.example.com:40001" {
+		t.Errorf("join is %s, expected the lowest proxy port", game.Join)
+	}
+	if game.MapName != "Everard Island" || game.GameType != "Tournament" {
+		t.Errorf("map %q, type %q", game.MapName, game.GameType)
+	}
+	if !game.HiddenMines || game.Bots || !game.Password {
+		t.Errorf("hidden mines %t, bots %t, password %t", game.HiddenMines, game.Bots, game.Password)
+	}
+	if game.TrackedForMinutes != 90 {
+		t.Errorf("tracked for %d minutes, expected 90", game.TrackedForMinutes)
+	}
+	if len(game.Players) != 2 {
+		t.Errorf("players are %v", game.Players)
+	}
+
+	var single gameJson
+	status = get(t, handler, "/api/games/c0a8010adc898500", &single)
+	if status != http.StatusOK || single.Id != game.Id {
+		t.Errorf("status %d for game %s", status, single.Id)
+	}
+
+	var notFound errorJson
+	status = get(t, handler, "/api/games/0000000000000000", &notFound)
+	if status != http.StatusNotFound || notFound.Error == "" {
+		t.Errorf("status %d for a missing game", status)
+	}
+}
+
+func TestApiPlayers(t *testing.T) {
+	handler := NewHandler(newContext(t))
+
+	var players []map[string]interface{}
+	status := get(t, handler, "/api/players", &players)
+	if status != http.StatusOK || len(players) != 2 {
+		t.Fatalf("status %d with %d players", status, len(players))
+	}
+	if players[0]["name"] != "Alice" || players[0]["game_id"] != "c0a8010adc898500" {
+		t.Errorf("first player is %v", players[0])
+	}
+	if len(players[0]) != 2 {
+		t.Errorf("player has fields %v, expected only name and game id", players[0])
+	}
+}
+
+func TestApiMethodNotAllowed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewHandler(newContext(t)).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/games", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned %d", recorder.Code)
+	}
+}
+
+func TestPage(t *testing.T) {
+	context := newContext(t)
+	context.Players.ByPort(40002).Name = "<Zed>"
+	handler := NewHandler(context)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d", recorder.Code)
+	}
+
+	page := recorder.Body.String()
+	for _, expected := range []string{
+		`<meta http-equiv="refresh" content="30">`,
+		"<h2>Everard Island</h2>",
+		"bolo.example.com {40001}",
+		"Game: Tournament",
+		"Mines: Hidden",
+		"PW: Yes",
+		"Tracked for: 90 minutes",
+		"Alice<br>",
+		"&lt;Zed&gt;<br>",
+		"There is 1 game in progress.",
+	} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("page does not contain %q", expected)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown path returned %d", recorder.Code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	context := newContext(t)
+	server := httptest.NewServer(NewHandler(context))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/api/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("content type is %q", contentType)
+	}
+
+	// the handler has subscribed by the time the headers arrive
+	context.Events.Publish(events.Event{
+		Type:      events.PlayerRenamed,
+		GameId:    testGameId,
+		ProxyPort: 40001,
+		Name:      "Alice",
+		OldName:   "<unknown>",
+	})
+
+	reader := bufio.NewReader(response.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	if lines[0] != "event: player_renamed" {
+		t.Errorf("event line is %q", lines[0])
+	}
+	var event struct {
+		Type    string `json:"type"`
+		GameId  string `json:"game_id"`
+		OldName string `json:"old_name"`
+		Player  struct {
+			Id   int    `json:"id"`
+			Name string `json:"name"`
+		} `json:"player"`
+	}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "player_renamed" || event.GameId != "c0a8010adc898500" ||
+		event.Player.Id != 40001 || event.Player.Name != "Alice" || event.OldName != "<unknown>" {
+		t.Errorf("event is %+v", event)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	context := newContext(t)
+	context.Counters.InvalidPackets = 3
+	context.Counters.RelayedPackets[bolo.PacketTypeGameState] = 2
+	context.Counters.RelayedBytes[bolo.PacketTypeGameState] = 150
+	context.Counters.RelayedPackets[0x42] = 1
+	context.Counters.TxDropped = 4
+
+	recorder := httptest.NewRecorder()
+	NewHandler(context).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d", recorder.Code)
+	}
+
+	metrics := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE bolorama_games gauge\nbolorama_games 1\n",
+		"bolorama_players 2\n",
+		"bolorama_proxy_ports_assigned 0\n",
+		"# TYPE bolorama_relayed_packets_total counter\n",
+		`bolorama_relayed_packets_total{type="game_state"} 2` + "\n",
+		`bolorama_relayed_packets_total{type="0x05"} 0` + "\n",
+		`bolorama_relayed_packets_total{type="0x42"} 1` + "\n",
+		`bolorama_relayed_bytes_total{type="game_state"} 150` + "\n",
+		"bolorama_invalid_packets_total 3\n",
+		"bolorama_tx_dropped_packets_total 4\n",
+		"bolorama_stuck_goroutines_total 0\n",
+		"bolorama_player_timeouts_total 0\n",
+		"bolorama_database_errors_total 0\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("metrics do not contain %q", expected)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	context := newContext(t)
+	handler := NewHandler(context)
+
+	var list loggingJson
+	code := get(t, handler, "/api/logging", &list)
+	if code != http.StatusOK || len(list.Debug) != 0 || len(list.Subsystems) != len(logging.Subsystems) {
+		t.Fatalf("got %d %+v", code, list)
+	}
+
+	put := func(token string, path string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := put(testAdminToken, "/api/logging/nat", `{"debug": true}`)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("put without admin_token set got %d", recorder.Code)
+	}
+	context.AdminToken = testAdminToken
+	for _, token := range []string{"", "wrong"} {
+		recorder = put(token, "/api/logging/nat", `{"debug": true}`)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("put with token %q got %d", token, recorder.Code)
+		}
+	}
+	if logging.DebugEnabled(context.Log.Nat) {
+		t.Error("put without the token turned on debug")
+	}
+
+	recorder = put(testAdminToken, "/api/logging/nat", `{"debug": true}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("put got %d %s", recorder.Code, recorder.Body)
+	}
+	if !logging.DebugEnabled(context.Log.Nat) || logging.DebugEnabled(context.Log.Proxy) {
+		t.Error("put didn't turn on debug for only nat")
+	}
+	get(t, handler, "/api/logging", &list)
+	if len(list.Debug) != 1 || list.Debug[0] != logging.Nat {
+		t.Errorf("got debug %v", list.Debug)
+	}
+
+	recorder = put(testAdminToken, "/api/logging/nat", `{"debug": false}`)
+	if recorder.Code != http.StatusOK || logging.DebugEnabled(context.Log.Nat) {
+		t.Errorf("put got %d", recorder.Code)
+	}
+
+	recorder = put(testAdminToken, "/api/logging/nope", `{"debug": true}`)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown subsystem got %d", recorder.Code)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	context := newContext(t)
+	context.Capture = capture.New(t.TempDir(), context.Log.Capture)
+	context.AdminToken = testAdminToken
+	handler := NewHandler(context)
+
+	request := func(method string, token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, "/api/capture", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := request(http.MethodPut, "wrong", `{}`)
+	if recorder.Code != http.StatusUnauthorized || context.Capture.Running() {
+		t.Errorf("put with the wrong token got %d", recorder.Code)
+	}
+	recorder = request(http.MethodPut, testAdminToken, `{"game_id": "c0a801"}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("short game id got %d", recorder.Code)
+	}
+
+	recorder = request(http.MethodPut, testAdminToken, `{"game_id": "c0a8010adc898500", "proxy_port": 40001}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("put got %d %s", recorder.Code, recorder.Body)
+	}
+	status := context.Capture.Status()
+	if !status.Running || status.Filter.GameId != testGameId || status.Filter.ProxyPort != 40001 {
+		t.Errorf("got status %+v", status)
+	}
+	recorder = request(http.MethodPut, testAdminToken, `{}`)
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("second put got %d", recorder.Code)
+	}
+
+	var got captureJson
+	get(t, handler, "/api/capture", &got)
+	if !got.Enabled || !got.Running || got.GameId != "c0a8010adc898500" || got.ProxyPort != 40001 || got.Started == nil {
+		t.Errorf("got %+v", got)
+	}
+
+	recorder = request(http.MethodDelete, testAdminToken, "")
+	if recorder.Code != http.StatusOK || context.Capture.Running() {
+		t.Errorf("delete got %d", recorder.Code)
+	}
+	recorder = request(http.MethodDelete, testAdminToken, "")
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("second delete got %d", recorder.Code)
+	}
+}
+
+func TestChatEventJson(t *testing.T) {
+	event := newEventJson(events.Event{
+		Type:      events.ChatMessage,
+		GameId:    testGameId,
+		ProxyPort: 40001,
+		Name:      "Alice",
+		Message:   "gg",
+		Recipients: []events.Recipient{
+			{PlayerId: 1, ProxyPort: 40002, Name: "Bob"},
+			{PlayerId: 2},
+		},
+	})
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"player":{"id":40001,"name":"Alice"},"message":"gg","recipients":[{"id":40002,"name":"Bob"},{"id":0}]}`
+	if !strings.HasSuffix(string(data), want) {
+		t.Errorf("event is %s", data)
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	context := newContext(t)
+	context.AdminToken = testAdminToken
+	handler := NewHandler(context)
+
+	post := func(token string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/api/announce", strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	recorder := post("wrong", `{"message": "hello"}`)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("post with the wrong token got %d", recorder.Code)
+	}
+	for _, body := range []string{`{}`, `{"message": "hello", "game_id": "c0a801"}`, `{"message": "` + strings.Repeat("x", bolo.MaxMessageLength+1) + `"}`} {
+		recorder = post(testAdminToken, body)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d", body, recorder.Code)
+		}
+	}
+	if blocks := state.ServerChatBlocks(context, *context.Players.ByPort(40002)); len(blocks) != 0 {
+		t.Fatalf("rejected messages queued %d blocks", len(blocks))
+	}
+
+	recorder = post(testAdminToken, `{"message": "Server restarting in 5 minutes", "game_id": "c0a8010adc898500"}`)
+	var announced announcedJson
+	json.Unmarshal(recorder.Body.Bytes(), &announced)
+	if recorder.Code != http.StatusOK || announced.Players != 2 {
+		t.Fatalf("post got %d %s", recorder.Code, recorder.Body)
+	}
+	for _, player := range context.Players.All() {
+		blocks := state.ServerChatBlocks(context, *player)
+		if len(blocks) != 1 {
+			t.Errorf("player %d was sent %d blocks", player.ProxyPort, len(blocks))
+		}
+	}
+
+	recorder = post(testAdminToken, `{"message": "hello", "game_id": "0000000000000000"}`)
+	json.Unmarshal(recorder.Body.Bytes(), &announced)
+	if recorder.Code != http.StatusOK || announced.Players != 0 {
+		t.Errorf("post to no game got %d %s", recorder.Code, recorder.Body)
+	}
+}
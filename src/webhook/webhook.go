@@ -0,0 +1,287 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package webhook posts notifications about games to http endpoints, such as
+// a chat server announcing new games to a community
+package webhook
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/logging"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/tracker"
+)
+
+type Trigger string
+
+const (
+	GameCreated Trigger = "game_created"
+	// GamePlayers fires when a game reaches Config.PlayerCount players
+	GamePlayers Trigger = "game_players"
+	GameEnded   Trigger = "game_ended"
+)
+
+// DefaultTemplate posts the notification as a json object
+const DefaultTemplate = `{"event":{{json .Trigger}},"time":{{json .Time}},"game_id":{{json .GameId}},` +
+	`"map_name":{{json .MapName}},"game_type":{{json .GameType}},"join":{{json .Join}},` +
+	`"player_count":{{.PlayerCount}},"players":{{json .Players}}}`
+
+const defaultAttempts = 5
+const defaultRetryDelay = 5 * time.Second
+const requestTimeout = 10 * time.Second
+const queueSize = 64
+const eventQueueSize = 256
+
+type Config struct {
+	URL string
+	// Template is a text/template for the request body, executed with a
+	// Notification. It has a json function for quoting values. Empty uses
+	// DefaultTemplate.
+	Template string
+	// PlayerCount fires GamePlayers when a game reaches this many players, 0
+	// never does
+	PlayerCount int
+	// Attempts is how many times a notification is sent before it is given
+	// up on, 0 uses the default of 5
+	Attempts int
+	// RetryDelay is the wait after the first failed attempt, doubled after
+	// each one after that. 0 uses the default of 5 seconds.
+	RetryDelay time.Duration
+}
+
+// Notification is what a template is executed with
+type Notification struct {
+	Trigger     Trigger
+	Time        time.Time
+	GameId      string
+	MapName     string
+	GameType    string
+	Join        string // host:port players join the game at
+	PlayerCount int
+	Players     []string
+}
+
+type Hook struct {
+	config   Config
+	template *template.Template
+	client   *http.Client
+}
+
+// New checks config and fills in its defaults
+func New(config Config) (*Hook, error) {
+	parsedUrl, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("webhook url: %w", err)
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return nil, fmt.Errorf("webhook url %q is not http or https", config.URL)
+	}
+	if config.PlayerCount < 0 {
+		return nil, errors.New("webhook player count is negative")
+	}
+	if config.Attempts < 0 {
+		return nil, errors.New("webhook attempts is negative")
+	}
+	if config.RetryDelay < 0 {
+		return nil, errors.New("webhook retry delay is negative")
+	}
+
+	if config.Template == "" {
+		config.Template = DefaultTemplate
+	}
+	if config.Attempts == 0 {
+		config.Attempts = defaultAttempts
+	}
+	if config.RetryDelay == 0 {
+		config.RetryDelay = defaultRetryDelay
+	}
+
+	bodyTemplate, err := template.New("webhook").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			b, err := json.Marshal(value)
+			return string(b), err
+		},
+	}).Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("webhook template: %w", err)
+	}
+
+	return &Hook{
+		config:   config,
+		template: bodyTemplate,
+		client:   &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// Subscribe starts listening for the events the hook is fired by, so that
+// none are missed before Run
+func (hook *Hook) Subscribe(bus *events.Bus) *events.Subscription {
+	return bus.Subscribe(eventQueueSize)
+}
+
+// Run turns events from subscription into notifications until the server
+// shuts down. Notifications are posted one at a time, in order.
+func (hook *Hook) Run(context *state.ServerContext, subscription *events.Subscription) {
+	defer context.WaitGroup.Done()
+	defer subscription.Close()
+
+	notificationChannel := make(chan Notification, queueSize)
+	context.WaitGroup.Add(1)
+	go hook.post(context, notificationChannel)
+
+	games := make(map[bolo.GameId]Notification)
+	reachedPlayerCount := make(map[bolo.GameId]bool)
+
+	notify := func(trigger Trigger, notification Notification) {
+		notification.Trigger = trigger
+		notification.Time = time.Now().UTC()
+		select {
+		case notificationChannel <- notification:
+		default:
+			context.Log.Webhook.Warn("webhook is behind, dropping notification", "url", hook.config.URL, "trigger", trigger)
+		}
+	}
+
+	for {
+		select {
+		case <-context.ShutdownChannel:
+			return
+		case event := <-subscription.C:
+			switch event.Type {
+			case events.GameCreated:
+				notification, ok := getNotification(context, event.GameId)
+				if !ok {
+					continue
+				}
+				games[event.GameId] = notification
+				notify(GameCreated, notification)
+			case events.PlayerJoined, events.PlayerLeft, events.PlayerRenamed:
+				notification, ok := getNotification(context, event.GameId)
+				if !ok {
+					continue
+				}
+				games[event.GameId] = notification
+				if hook.config.PlayerCount == 0 {
+					continue
+				}
+				if notification.PlayerCount < hook.config.PlayerCount {
+					reachedPlayerCount[event.GameId] = false
+				} else if !reachedPlayerCount[event.GameId] {
+					reachedPlayerCount[event.GameId] = true
+					notify(GamePlayers, notification)
+				}
+			case events.GameEnded:
+				// the game is gone, so tell them how it was when last seen
+				notification, ok := games[event.GameId]
+				if !ok {
+					notification = Notification{
+						GameId:  hex.EncodeToString(event.GameId[:]),
+						MapName: event.MapName,
+					}
+				}
+				delete(games, event.GameId)
+				delete(reachedPlayerCount, event.GameId)
+				notify(GameEnded, notification)
+			}
+		}
+	}
+}
+
+func getNotification(context *state.ServerContext, gameId bolo.GameId) (Notification, bool) {
+	for _, listing := range tracker.GetListings(context, true) {
+		if listing.Game.GameId != gameId {
+			continue
+		}
+		players := listing.Players
+		if players == nil {
+			players = []string{}
+		}
+		return Notification{
+			GameId:      hex.EncodeToString(gameId[:]),
+			MapName:     listing.Game.MapName,
+			GameType:    tracker.GameTypeName(listing.Game.GameType),
+			Join:        fmt.Sprintf("%s:%d", listing.Hostname, listing.Port),
+			PlayerCount: int(listing.Game.PlayerCount),
+			Players:     players,
+		}, true
+	}
+	return Notification{}, false
+}
+
+func (hook *Hook) post(context *state.ServerContext, notificationChannel chan Notification) {
+	defer context.WaitGroup.Done()
+
+	for {
+		select {
+		case <-context.ShutdownChannel:
+			return
+		case notification := <-notificationChannel:
+			var body bytes.Buffer
+			err := hook.template.Execute(&body, notification)
+			if err != nil {
+				context.Log.Webhook.Error("webhook template failed", "url", hook.config.URL, "error", err)
+				continue
+			}
+
+			delay := hook.config.RetryDelay
+			for attempt := 1; ; attempt++ {
+				err = hook.send(body.Bytes())
+				if err == nil {
+					break
+				}
+				if attempt == hook.config.Attempts {
+					context.Log.Webhook.Warn("webhook failed, giving up", "url", hook.config.URL,
+						"trigger", notification.Trigger, logging.GameId, notification.GameId, "error", err)
+					break
+				}
+				context.Log.Webhook.Info("webhook failed, retrying", "url", hook.config.URL,
+					"trigger", notification.Trigger, logging.GameId, notification.GameId, "delay", delay, "error", err)
+
+				select {
+				case <-context.ShutdownChannel:
+					return
+				case <-time.After(delay):
+				}
+				delay = delay * 2
+			}
+		}
+	}
+}
+
+func (hook *Hook) send(body []byte) error {
+	response, err := hook.client.Post(hook.config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+	Copyright 2021 Astrospark Technologies
+
+	This file is part of bolorama. Bolorama is free software: you can
+	redistribute it and/or modify it under the terms of the GNU Affero General
+	Public License as published by the Free Software Foundation, either version
+	3 of the License, or (at your option) any later version.
+
+	Bolorama is distributed in the hope that it will be useful, but WITHOUT ANY
+	WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+	FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+	details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with Bolorama. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.astrospark.com/bolorama/bolo"
+	"git.astrospark.com/bolorama/events"
+	"git.astrospark.com/bolorama/state"
+	"git.astrospark.com/bolorama/transport"
+)
+
+const testTimeout = 5 * time.Second
+
+var testGameId = bolo.GameId{0xc0, 0xa8, 0x01, 0x0a, 0xdc, 0x89, 0x85, 0x00}
+
+// standIn is a webhook endpoint that fails the first failures requests
+type standIn struct {
+	server   *httptest.Server
+	requests int32
+	bodies   chan []byte
+}
+
+func newStandIn(t *testing.T, failures int32) *standIn {
+	standIn := &standIn{bodies: make(chan []byte, 16)}
+	standIn.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&standIn.requests, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		standIn.bodies <- body
+	}))
+	t.Cleanup(standIn.server.Close)
+	return standIn
+}
+
+func (standIn *standIn) receive(t *testing.T) map[string]interface{} {
+	select {
+	case body := <-standIn.bodies:
+		var value map[string]interface{}
+		err := json.Unmarshal(body, &value)
+		if err != nil {
+			t.Fatalf("%s: %s", body, err)
+		}
+		return value
+	case <-time.After(testTimeout):
+		t.Fatal("webhook was not posted")
+		return nil
+	}
+}
+
+// runHook runs hook against a server context tracking one game with one
+// player
+func runHook(t *testing.T, config Config) *state.ServerContext {
+	host := transport.NewNetwork(1).Host(net.IPv4(198, 51, 100, 1))
+	connection, err := host.ListenUDP(50000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := state.InitContext(host, connection)
+	context.Hostname = "bolo.example.com"
+	context.Games[testGameId] = bolo.GameInfo{
+		MapName:     "Everard Island",
+		GameId:      testGameId,
+		GameType:    2,
+		PlayerCount: 1,
+	}
+	context.Players.Add(&state.Player{IpAddr: net.IPv4(203, 0, 113, 10), IpPort: 50000, ProxyPort: 40001, RelayPort: 40001, GameId: testGameId, Name: "Alice"})
+
+	hook, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context.WaitGroup.Add(1)
+	go hook.Run(context, hook.Subscribe(context.Events))
+
+	t.Cleanup(func() {
+		close(context.ShutdownChannel)
+		context.WaitGroup.Wait()
+		connection.Close()
+	})
+	return context
+}
+
+func TestGameCreated(t *testing.T) {
+	standIn := newStandIn(t, 2)
+	context := runHook(t, Config{URL: standIn.server.URL, RetryDelay: time.Millisecond})
+
+	context.Events.Publish(events.Event{Type: events.GameCreated, GameId: testGameId, MapName: "Everard Island"})
+
+	notification := standIn.receive(t)
+	if notification["event"] != "game_created" || notification["game_id"] != "c0a8010adc898500" ||
+		notification["map_name"] != "Everard Island" || notification["game_type"] != "Tournament" ||
+		notification["join"] != "bolo.example.com:40001" || notification["player_count"] != 1.0 {
+		t.Errorf("notification is %v", notification)
+	}
+	if requests := atomic.LoadInt32(&standIn.requests); requests != 3 {
+		t.Errorf("posted %d times, expected 2 failures and a retry", requests)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	standIn := newStandIn(t, 2)
+	context := runHook(t, Config{URL: standIn.server.URL, Attempts: 2, RetryDelay: time.Millisecond})
+
+	context.Events.Publish(events.Event{Type: events.GameCreated, GameId: testGameId})
+	context.Events.Publish(events.Event{Type: events.GameEnded, GameId: testGameId})
+
+	// the first notification is given up on after two attempts
+	if notification := standIn.receive(t); notification["event"] != "game_ended" {
+		t.Errorf("notification is %v", notification)
+	}
+}
+
+func TestGamePlayers(t *testing.T) {
+	standIn := newStandIn(t, 0)
+	context := runHook(t, Config{
+		URL:         standIn.server.URL,
+		Template:    `{"content":{{json (printf "%s has %d players" .MapName .PlayerCount)}},"event":{{json .Trigger}}}`,
+		PlayerCount: 2,
+	})
+
+	context.Events.Publish(events.Event{Type: events.PlayerJoined, GameId: testGameId, ProxyPort: 40001})
+
+	context.Mutex.Lock()
+	context.Players.Add(&state.Player{
+		IpAddr: net.IPv4(203, 0, 113, 11), IpPort: 50000, ProxyPort: 40002, RelayPort: 40002, GameId: testGameId, Name: "Zed",
+	})
+	game := context.Games[testGameId]
+	game.PlayerCount = 2
+	context.Games[testGameId] = game
+	context.Mutex.Unlock()
+	context.Events.Publish(events.Event{Type: events.PlayerJoined, GameId: testGameId, ProxyPort: 40002})
+
+	notification := standIn.receive(t)
+	if notification["event"] != "game_players" || notification["content"] != "Everard Island has 2 players" {
+		t.Errorf("notification is %v", notification)
+	}
+
+	// a rename doesn't change the count, so the game isn't announced again
+	context.Events.Publish(events.Event{Type: events.PlayerRenamed, GameId: testGameId, ProxyPort: 40002})
+	context.Events.Publish(events.Event{Type: events.GameEnded, GameId: testGameId})
+	if notification := standIn.receive(t); notification["event"] != "game_ended" {
+		t.Errorf("notification is %v", notification)
+	}
+}
+
+func TestNewRejectsConfig(t *testing.T) {
+	for _, config := range []Config{
+		{URL: "ftp://example.com/hook"},
+		{URL: "http://example.com/hook", Template: "{{.Missing"},
+		{URL: "http://example.com/hook", Attempts: -1},
+		{URL: "http://example.com/hook", PlayerCount: -1},
+	} {
+		_, err := New(config)
+		if err == nil {
+			t.Errorf("accepted %+v", config)
+		}
+	}
+}
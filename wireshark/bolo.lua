@@ -49,6 +49,7 @@ checksum_field = ProtoField.uint16("bolo.checksum", "Checksum", base.HEX)
 host_address_field = ProtoField.ipv4("bolo.host_address", "Host Address")
 
 -- Opcode 0xfa
+message_recipients_field = ProtoField.uint16("bolo.message_recipients", "Recipients", base.HEX)
 message_field = ProtoField.string("bolo.message", "Message", base.ASCII)
 
 -- Opcode 0xff
@@ -108,7 +109,7 @@ bolo_protocol.fields = {
 	sender_flags_field, sender_field, block_flags_field,
 	opcode_field, subcode_field, checksum_field,
 	host_address_field,
-	message_length_field, message_field,
+	message_length_field, message_recipients_field, message_field,
 	map_pillbox_count_field, map_pillbox_data_field,
 	map_base_count_field, map_base_data_field,
 	map_start_count_field, map_start_data_field,
@@ -564,7 +565,8 @@ function dissect_opcode_send_message(buffer, pinfo, tree) -- 0xfa
 	t:append_text(" (Send Message)")
 
 	if buffer_length >= 3 then
-		t:add(unknown_field, buffer(pos, 2)); pos = pos + 2
+		-- bit n is set for each player id n the message is sent to
+		t:add(message_recipients_field, buffer(pos, 2)); pos = pos + 2
 	else
 		t:add_proto_expert_info(opcode_buffer_underrun_expert)
 		return